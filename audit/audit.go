@@ -0,0 +1,152 @@
+// Package audit records every broker operation, who asked for it and how
+// it turned out, as one JSON object per line.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of audited operations. Asynchronous operations are accepted
+// when they start and succeed or fail when they finish.
+const (
+	OutcomeAccepted  = "accepted"
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+	OutcomeError     = "error"
+)
+
+// Redacted replaces the values of parameters that look like secrets.
+const Redacted = "[REDACTED]"
+
+var secretParameter = regexp.MustCompile(`(?i)pass|secret|key|token|credential|cert`)
+
+// Entry is a single audit record.
+type Entry struct {
+	Time             time.Time   `json:"time"`
+	Operation        string      `json:"operation"`
+	InstanceID       string      `json:"instance_id"`
+	BindingID        string      `json:"binding_id,omitempty"`
+	Service          string      `json:"service,omitempty"`
+	Plan             string      `json:"plan,omitempty"`
+	Identity         *Identity   `json:"identity,omitempty"`
+	OrganizationGUID string      `json:"organization_guid,omitempty"`
+	SpaceGUID        string      `json:"space_guid,omitempty"`
+	Parameters       interface{} `json:"parameters,omitempty"`
+	StackID          string      `json:"stack_id,omitempty"`
+	Outcome          string      `json:"outcome"`
+	Error            string      `json:"error,omitempty"`
+}
+
+// Logger appends entries to a sink.
+type Logger struct {
+	mu   sync.Mutex
+	sink io.Writer
+}
+
+// NewLogger returns a logger writing to the sink.
+func NewLogger(sink io.Writer) *Logger {
+	return &Logger{sink: sink}
+}
+
+// Open returns a logger for the configured destination: "stdout", a syslog
+// server given as syslog+udp://host:port or syslog+tcp://host:port, or the
+// path of a file that is only ever appended to. An empty destination
+// discards every entry.
+func Open(destination string) (*Logger, error) {
+	switch {
+	case destination == "":
+		return NewLogger(ioutil.Discard), nil
+	case destination == "stdout":
+		return NewLogger(os.Stdout), nil
+	case strings.HasPrefix(destination, "syslog+"):
+		network := strings.TrimPrefix(destination, "syslog+")
+		parts := strings.SplitN(network, "://", 2)
+		if len(parts) != 2 || (parts[0] != "udp" && parts[0] != "tcp") || parts[1] == "" {
+			return nil, errors.New("audit log syslog destination must be syslog+udp://host:port or syslog+tcp://host:port")
+		}
+		writer, err := syslog.Dial(parts[0], parts[1], syslog.LOG_INFO|syslog.LOG_AUTH, "aws-service-broker")
+		if err != nil {
+			return nil, err
+		}
+		return NewLogger(writer), nil
+	default:
+		file, err := os.OpenFile(destination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return NewLogger(file), nil
+	}
+}
+
+// Log writes an entry as a single line of JSON, stamping it with the
+// current time if it has none. Entries that can't be written are lost
+// rather than failing the operation they record.
+func (l *Logger) Log(entry Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sink.Write(append(line, '\n'))
+}
+
+// RedactParameters decodes request parameters and replaces the values of
+// any that look like secrets, at any depth. Parameters that are not JSON
+// are redacted as a whole.
+func RedactParameters(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	var parameters interface{}
+	if err := json.Unmarshal(raw, &parameters); err != nil {
+		return Redacted
+	}
+	return redact(parameters)
+}
+
+func redact(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range value {
+			if secretParameter.MatchString(key) {
+				value[key] = Redacted
+			} else {
+				value[key] = redact(nested)
+			}
+		}
+		return value
+	case []interface{}:
+		for i, nested := range value {
+			value[i] = redact(nested)
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+// OrganizationAndSpace reads the Cloud Foundry organization and space from
+// a request's context object.
+func OrganizationAndSpace(raw json.RawMessage) (organizationGUID, spaceGUID string) {
+	var context struct {
+		OrganizationGUID string `json:"organization_guid"`
+		SpaceGUID        string `json:"space_guid"`
+	}
+	if len(raw) > 0 {
+		json.Unmarshal(raw, &context)
+	}
+	return context.OrganizationGUID, context.SpaceGUID
+}
@@ -0,0 +1,169 @@
+package audit_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/henrytk/aws-service-broker/audit"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Audit", func() {
+	Describe("ParseIdentity", func() {
+		It("decodes a Cloud Foundry user", func() {
+			// echo -n '{"user_id": "683ea748-3092-4ff4-b656-39cacc4d5360"}' | base64
+			identity, ok := ParseIdentity("cloudfoundry eyJ1c2VyX2lkIjogIjY4M2VhNzQ4LTMwOTItNGZmNC1iNjU2LTM5Y2FjYzRkNTM2MCJ9")
+			Expect(ok).To(BeTrue())
+			Expect(identity.Platform).To(Equal("cloudfoundry"))
+			Expect(identity.User).To(Equal("683ea748-3092-4ff4-b656-39cacc4d5360"))
+		})
+
+		It("decodes a Kubernetes user with all its details", func() {
+			// echo -n '{"username": "duke", "groups": ["admin"]}' | base64
+			identity, ok := ParseIdentity("kubernetes eyJ1c2VybmFtZSI6ICJkdWtlIiwgImdyb3VwcyI6IFsiYWRtaW4iXX0=")
+			Expect(ok).To(BeTrue())
+			Expect(identity.User).To(Equal("duke"))
+			Expect(identity.Value).To(HaveKeyWithValue("groups", []interface{}{"admin"}))
+		})
+
+		It("keeps the platform of a value it can't decode", func() {
+			identity, ok := ParseIdentity("cloudfoundry not-base64!")
+			Expect(ok).To(BeTrue())
+			Expect(identity).To(Equal(Identity{Platform: "cloudfoundry"}))
+		})
+
+		It("rejects a malformed header", func() {
+			_, ok := ParseIdentity("")
+			Expect(ok).To(BeFalse())
+			_, ok = ParseIdentity("cloudfoundry")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("IdentityHandler", func() {
+		It("passes the originating identity on in the request's context", func() {
+			var identity Identity
+			var found bool
+			handler := IdentityHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				identity, found = IdentityFromContext(r.Context())
+			}))
+			request := httptest.NewRequest("PUT", "/v2/service_instances/id", nil)
+			request.Header.Set(OriginatingIdentityHeader, "cloudfoundry eyJ1c2VyX2lkIjogIjY4M2VhNzQ4LTMwOTItNGZmNC1iNjU2LTM5Y2FjYzRkNTM2MCJ9")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(found).To(BeTrue())
+			Expect(identity.User).To(Equal("683ea748-3092-4ff4-b656-39cacc4d5360"))
+		})
+
+		It("leaves requests without an identity alone", func() {
+			found := true
+			handler := IdentityHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, found = IdentityFromContext(r.Context())
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/catalog", nil))
+			Expect(found).To(BeFalse())
+		})
+	})
+
+	Describe("Logger", func() {
+		It("writes each entry as a line of JSON", func() {
+			sink := &bytes.Buffer{}
+			logger := NewLogger(sink)
+			identity := Identity{Platform: "cloudfoundry", User: "user"}
+			logger.Log(Entry{
+				Time:       time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+				Operation:  "provision",
+				InstanceID: "instance-id",
+				Identity:   &identity,
+				StackID:    "stack-id",
+				Outcome:    OutcomeAccepted,
+			})
+			logger.Log(Entry{Operation: "unbind", InstanceID: "instance-id", Outcome: OutcomeError, Error: "boom"})
+
+			lines := bytes.Split(bytes.TrimSpace(sink.Bytes()), []byte("\n"))
+			Expect(lines).To(HaveLen(2))
+			Expect(string(lines[0])).To(MatchJSON(`{
+				"time": "2018-01-02T03:04:05Z",
+				"operation": "provision",
+				"instance_id": "instance-id",
+				"identity": {"platform": "cloudfoundry", "user": "user"},
+				"stack_id": "stack-id",
+				"outcome": "accepted"
+			}`))
+			var entry Entry
+			Expect(json.Unmarshal(lines[1], &entry)).To(Succeed())
+			Expect(entry.Time).NotTo(BeZero())
+			Expect(entry.Error).To(Equal("boom"))
+		})
+	})
+
+	Describe("Open", func() {
+		It("appends to the file", func() {
+			dir, err := ioutil.TempDir("", "audit")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "audit.log")
+			Expect(ioutil.WriteFile(path, []byte("existing\n"), 0600)).To(Succeed())
+
+			logger, err := Open(path)
+			Expect(err).NotTo(HaveOccurred())
+			logger.Log(Entry{Operation: "bind", Outcome: OutcomeSucceeded})
+
+			contents, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(HavePrefix("existing\n{"))
+			Expect(string(contents)).To(ContainSubstring(`"operation":"bind"`))
+		})
+
+		It("returns an error for a malformed syslog destination", func() {
+			_, err := Open("syslog+smtp://example.com")
+			Expect(err).To(MatchError("audit log syslog destination must be syslog+udp://host:port or syslog+tcp://host:port"))
+		})
+	})
+
+	Describe("RedactParameters", func() {
+		It("redacts the values of parameters that look like secrets, at any depth", func() {
+			parameters := RedactParameters(json.RawMessage(`{
+				"size": "large",
+				"admin_password": "hunter2",
+				"users": [{"name": "app", "apiKey": "abc"}],
+				"tls": {"certificate": "pem"}
+			}`))
+			Expect(parameters).To(Equal(map[string]interface{}{
+				"size":           "large",
+				"admin_password": Redacted,
+				"users":          []interface{}{map[string]interface{}{"name": "app", "apiKey": Redacted}},
+				"tls":            map[string]interface{}{"certificate": Redacted},
+			}))
+		})
+
+		It("redacts parameters that are not JSON as a whole", func() {
+			Expect(RedactParameters(json.RawMessage(`password=hunter2`))).To(Equal(Redacted))
+			Expect(RedactParameters(nil)).To(BeNil())
+		})
+	})
+
+	Describe("OrganizationAndSpace", func() {
+		It("reads them from a Cloud Foundry context", func() {
+			organization, space := OrganizationAndSpace(json.RawMessage(`{"platform": "cloudfoundry", "organization_guid": "org", "space_guid": "space"}`))
+			Expect(organization).To(Equal("org"))
+			Expect(space).To(Equal("space"))
+		})
+	})
+
+	It("carries identities in contexts", func() {
+		_, ok := IdentityFromContext(context.Background())
+		Expect(ok).To(BeFalse())
+		ctx := WithIdentity(context.Background(), Identity{Platform: "kubernetes"})
+		identity, ok := IdentityFromContext(ctx)
+		Expect(ok).To(BeTrue())
+		Expect(identity.Platform).To(Equal("kubernetes"))
+	})
+})
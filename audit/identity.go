@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// OriginatingIdentityHeader carries the platform user an Open Service
+// Broker API request was made on behalf of.
+const OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+// Identity is the decoded originating identity of a request.
+type Identity struct {
+	Platform string `json:"platform"`
+	// User is the user's ID on Cloud Foundry or username on Kubernetes.
+	User string `json:"user,omitempty"`
+	// Value is everything the platform sent about the user.
+	Value map[string]interface{} `json:"value,omitempty"`
+}
+
+type identityKey struct{}
+
+// ParseIdentity decodes an originating identity header, which is the name
+// of the platform followed by base64 encoded JSON describing the user.
+func ParseIdentity(header string) (Identity, bool) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return Identity{}, false
+	}
+	identity := Identity{Platform: fields[0]}
+
+	decoded, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		decoded, err = base64.RawStdEncoding.DecodeString(fields[1])
+	}
+	if err != nil || json.Unmarshal(decoded, &identity.Value) != nil {
+		return identity, true
+	}
+	for _, key := range []string{"user_id", "username"} {
+		if user, ok := identity.Value[key].(string); ok {
+			identity.User = user
+			break
+		}
+	}
+	return identity, true
+}
+
+// WithIdentity returns a copy of the context carrying the identity.
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity carried by the context, if any.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// IdentityHandler decodes the originating identity of each request into
+// its context, so that the operations it leads to can be attributed.
+func IdentityHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity, ok := ParseIdentity(r.Header.Get(OriginatingIdentityHeader)); ok {
+			r = r.WithContext(WithIdentity(r.Context(), identity))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
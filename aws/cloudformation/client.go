@@ -1,15 +1,326 @@
 package cloudformation
 
 import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/henrytk/aws-service-broker/aws/logging"
+	"github.com/henrytk/aws-service-broker/metrics"
+	"golang.org/x/time/rate"
 )
 
-func NewCloudFormationClient(region string) (*awscf.CloudFormation, error) {
-	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+// ErrCircuitOpen is returned without calling CloudFormation while the
+// client's circuit breaker is open.
+var ErrCircuitOpen = errors.New("CloudFormation is unavailable: too many consecutive calls failed, try again later")
+
+// ClientOptions configure how a Client retries, rate limits and stops
+// calling CloudFormation.
+type ClientOptions struct {
+	// MaxRetries is how many times a throttled or transiently failing
+	// call is retried.
+	MaxRetries int
+	// BaseDelay is the delay before the first retry. It doubles with
+	// every retry up to MaxDelay, and each delay is jittered.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// RequestsPerSecond and Burst limit the calls made by the client.
+	// CloudFormation's limits apply to the whole account, so the broker
+	// shares one client between all its instances.
+	RequestsPerSecond float64
+	Burst             int
+	// BreakerThreshold consecutive failed calls open the circuit breaker.
+	// Calls then fail straight away for BreakerCooldown, after which one
+	// call is let through to find out whether CloudFormation recovered.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+var DefaultClientOptions = ClientOptions{
+	MaxRetries:        5,
+	BaseDelay:         200 * time.Millisecond,
+	MaxDelay:          10 * time.Second,
+	RequestsPerSecond: 5,
+	Burst:             10,
+	BreakerThreshold:  10,
+	BreakerCooldown:   30 * time.Second,
+}
+
+func NewCloudFormationClient(region string, logger lager.Logger) (cloudformationiface.CloudFormationAPI, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	})
 	if err != nil {
 		return nil, err
 	}
-	return awscf.New(sess), nil
+	metrics.InstrumentAWSHandlers(&sess.Handlers)
+	logging.LogRequests(&sess.Handlers, logger)
+	return NewClient(awscf.New(sess), DefaultClientOptions), nil
+}
+
+// Client wraps the CloudFormation calls made by the broker with jittered
+// exponential retries of throttled and transient errors, a rate limiter
+// and a circuit breaker. Calls stop retrying when their context is done.
+//
+// Calls that change stacks are retried with the client request token of
+// their input, which CloudFormation uses to recognise repeats of a call it
+// has already received. Callers give each operation its own token.
+//
+// The SDK doesn't retry the calls the Client retries. Other calls reach the
+// wrapped API directly and are retried by the SDK as usual.
+type Client struct {
+	cloudformationiface.CloudFormationAPI
+	options ClientOptions
+	limiter *rate.Limiter
+	breaker *circuitBreaker
+}
+
+func NewClient(api cloudformationiface.CloudFormationAPI, options ClientOptions) *Client {
+	return &Client{
+		CloudFormationAPI: api,
+		options:           options,
+		limiter:           rate.NewLimiter(rate.Limit(options.RequestsPerSecond), options.Burst),
+		breaker: &circuitBreaker{
+			threshold: options.BreakerThreshold,
+			cooldown:  options.BreakerCooldown,
+		},
+	}
+}
+
+// CircuitOpen reports whether calls are failing straight away because too
+// many consecutive calls failed.
+func (c *Client) CircuitOpen() bool {
+	return c.breaker.open()
+}
+
+// IsTransient reports whether an error returned by a Client is likely to go
+// away by itself: CloudFormation throttling the account, failing with a
+// server error or the circuit breaker being open.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == ErrCircuitOpen || request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return true
+	}
+	if requestFailure, ok := err.(awserr.RequestFailure); ok {
+		return requestFailure.StatusCode() >= 500
+	}
+	return false
+}
+
+func (c *Client) call(ctx aws.Context, fn func() error) error {
+	if !c.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = c.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		err = fn()
+		if !IsTransient(err) || attempt == c.options.MaxRetries {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			// Give up, but return CloudFormation's error rather than the
+			// context's so that it can still be told apart.
+			c.breaker.record(err)
+			return err
+		case <-time.After(c.backoff(attempt)):
+		}
+	}
+	c.breaker.record(err)
+	return err
+}
+
+// backoff returns the delay before a retry: half of it grows exponentially,
+// the other half is random so that retries of calls throttled together
+// spread out.
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.options.BaseDelay << uint(attempt)
+	if delay > c.options.MaxDelay || delay <= 0 {
+		delay = c.options.MaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (c *Client) CreateStack(input *awscf.CreateStackInput) (*awscf.CreateStackOutput, error) {
+	return c.CreateStackWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *Client) CreateStackWithContext(ctx aws.Context, input *awscf.CreateStackInput, opts ...request.Option) (
+	output *awscf.CreateStackOutput, err error,
+) {
+	err = c.call(ctx, func() (err error) {
+		output, err = c.CloudFormationAPI.CreateStackWithContext(ctx, input, withoutSDKRetries(opts)...)
+		return err
+	})
+	return output, err
+}
+
+func (c *Client) UpdateStack(input *awscf.UpdateStackInput) (*awscf.UpdateStackOutput, error) {
+	return c.UpdateStackWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *Client) UpdateStackWithContext(ctx aws.Context, input *awscf.UpdateStackInput, opts ...request.Option) (
+	output *awscf.UpdateStackOutput, err error,
+) {
+	err = c.call(ctx, func() (err error) {
+		output, err = c.CloudFormationAPI.UpdateStackWithContext(ctx, input, withoutSDKRetries(opts)...)
+		return err
+	})
+	return output, err
+}
+
+func (c *Client) DeleteStack(input *awscf.DeleteStackInput) (*awscf.DeleteStackOutput, error) {
+	return c.DeleteStackWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *Client) DeleteStackWithContext(ctx aws.Context, input *awscf.DeleteStackInput, opts ...request.Option) (
+	output *awscf.DeleteStackOutput, err error,
+) {
+	err = c.call(ctx, func() (err error) {
+		output, err = c.CloudFormationAPI.DeleteStackWithContext(ctx, input, withoutSDKRetries(opts)...)
+		return err
+	})
+	return output, err
+}
+
+func (c *Client) DescribeStacks(input *awscf.DescribeStacksInput) (*awscf.DescribeStacksOutput, error) {
+	return c.DescribeStacksWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *Client) DescribeStacksWithContext(ctx aws.Context, input *awscf.DescribeStacksInput, opts ...request.Option) (
+	output *awscf.DescribeStacksOutput, err error,
+) {
+	err = c.call(ctx, func() (err error) {
+		output, err = c.CloudFormationAPI.DescribeStacksWithContext(ctx, input, withoutSDKRetries(opts)...)
+		return err
+	})
+	return output, err
+}
+
+func (c *Client) ListStackResources(input *awscf.ListStackResourcesInput) (*awscf.ListStackResourcesOutput, error) {
+	return c.ListStackResourcesWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *Client) ListStackResourcesWithContext(ctx aws.Context, input *awscf.ListStackResourcesInput, opts ...request.Option) (
+	output *awscf.ListStackResourcesOutput, err error,
+) {
+	err = c.call(ctx, func() (err error) {
+		output, err = c.CloudFormationAPI.ListStackResourcesWithContext(ctx, input, withoutSDKRetries(opts)...)
+		return err
+	})
+	return output, err
+}
+
+func (c *Client) ListStacks(input *awscf.ListStacksInput) (*awscf.ListStacksOutput, error) {
+	return c.ListStacksWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *Client) ListStacksWithContext(ctx aws.Context, input *awscf.ListStacksInput, opts ...request.Option) (
+	output *awscf.ListStacksOutput, err error,
+) {
+	err = c.call(ctx, func() (err error) {
+		output, err = c.CloudFormationAPI.ListStacksWithContext(ctx, input, withoutSDKRetries(opts)...)
+		return err
+	})
+	return output, err
+}
+
+func (c *Client) DescribeStackEvents(input *awscf.DescribeStackEventsInput) (*awscf.DescribeStackEventsOutput, error) {
+	return c.DescribeStackEventsWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *Client) DescribeStackEventsWithContext(ctx aws.Context, input *awscf.DescribeStackEventsInput, opts ...request.Option) (
+	output *awscf.DescribeStackEventsOutput, err error,
+) {
+	err = c.call(ctx, func() (err error) {
+		output, err = c.CloudFormationAPI.DescribeStackEventsWithContext(ctx, input, withoutSDKRetries(opts)...)
+		return err
+	})
+	return output, err
+}
+
+func (c *Client) ContinueUpdateRollback(input *awscf.ContinueUpdateRollbackInput) (*awscf.ContinueUpdateRollbackOutput, error) {
+	return c.ContinueUpdateRollbackWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *Client) ContinueUpdateRollbackWithContext(ctx aws.Context, input *awscf.ContinueUpdateRollbackInput, opts ...request.Option) (
+	output *awscf.ContinueUpdateRollbackOutput, err error,
+) {
+	err = c.call(ctx, func() (err error) {
+		output, err = c.CloudFormationAPI.ContinueUpdateRollbackWithContext(ctx, input, withoutSDKRetries(opts)...)
+		return err
+	})
+	return output, err
+}
+
+// withoutSDKRetries adds an option stopping the SDK from retrying a call
+// before the caller's options, which can override it.
+func withoutSDKRetries(opts []request.Option) []request.Option {
+	return append([]request.Option{func(r *request.Request) {
+		r.Retryer = client.DefaultRetryer{NumMaxRetries: 0}
+	}}, opts...)
+}
+
+// circuitBreaker counts consecutive transient failures. Other errors mean
+// CloudFormation answered, so they count as successes.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// Let this call through to try CloudFormation again, and keep the
+	// breaker open for the others until it returns.
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+func (b *circuitBreaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.threshold > 0 && b.failures >= b.threshold && time.Now().Before(b.openUntil)
+}
+
+func (b *circuitBreaker) record(err error) {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !IsTransient(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
 }
@@ -0,0 +1,222 @@
+package cloudformation_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	. "github.com/henrytk/aws-service-broker/aws/cloudformation"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		fakeCloudFormationAPI *fakes.FakeCloudFormationAPI
+		options               ClientOptions
+		client                *Client
+		throttled             error
+		input                 *awscf.DescribeStacksInput
+	)
+
+	BeforeEach(func() {
+		fakeCloudFormationAPI = &fakes.FakeCloudFormationAPI{}
+		options = ClientOptions{
+			MaxRetries:        3,
+			BaseDelay:         time.Millisecond,
+			MaxDelay:          5 * time.Millisecond,
+			RequestsPerSecond: 1000,
+			Burst:             1000,
+			BreakerThreshold:  2,
+			BreakerCooldown:   50 * time.Millisecond,
+		}
+		throttled = awserr.New("Throttling", "Rate exceeded", nil)
+		input = &awscf.DescribeStacksInput{StackName: aws.String("mongodb-id")}
+	})
+
+	JustBeforeEach(func() {
+		client = NewClient(fakeCloudFormationAPI, options)
+	})
+
+	It("retries throttled calls until they succeed", func() {
+		fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(0, nil, throttled)
+		fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(1, nil, throttled)
+		fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(2, &awscf.DescribeStacksOutput{}, nil)
+
+		output, err := client.DescribeStacks(input)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(output).To(Equal(&awscf.DescribeStacksOutput{}))
+		Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(3))
+		_, retriedInput, _ := fakeCloudFormationAPI.DescribeStacksWithContextArgsForCall(2)
+		Expect(retriedInput).To(Equal(input))
+	})
+
+	It("retries server errors", func() {
+		fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(0, nil, awserr.NewRequestFailure(
+			awserr.New("InternalFailure", "internal failure", nil), 500, "request-id",
+		))
+		fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(1, &awscf.DescribeStacksOutput{}, nil)
+
+		_, err := client.DescribeStacks(input)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(2))
+	})
+
+	It("does not retry other errors", func() {
+		validationError := awserr.NewRequestFailure(
+			awserr.New("ValidationError", "Stack with id mongodb-id does not exist", nil), 400, "request-id",
+		)
+		fakeCloudFormationAPI.DescribeStacksWithContextReturns(nil, validationError)
+
+		_, err := client.DescribeStacks(input)
+		Expect(err).To(Equal(validationError))
+		Expect(IsTransient(err)).To(BeFalse())
+		Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(1))
+	})
+
+	It("gives up after the maximum number of retries", func() {
+		fakeCloudFormationAPI.DescribeStacksWithContextReturns(nil, throttled)
+
+		_, err := client.DescribeStacks(input)
+		Expect(err).To(Equal(throttled))
+		Expect(IsTransient(err)).To(BeTrue())
+		Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(4))
+	})
+
+	It("stops retrying when the context is done", func() {
+		options.BaseDelay = time.Hour
+		options.MaxDelay = time.Hour
+		client = NewClient(fakeCloudFormationAPI, options)
+		fakeCloudFormationAPI.CreateStackWithContextReturns(nil, throttled)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		_, err := client.CreateStackWithContext(ctx, &awscf.CreateStackInput{})
+		Expect(err).To(Equal(throttled))
+		Expect(fakeCloudFormationAPI.CreateStackWithContextCallCount()).To(Equal(1))
+		callCtx, _, _ := fakeCloudFormationAPI.CreateStackWithContextArgsForCall(0)
+		Expect(callCtx).To(Equal(ctx))
+	})
+
+	It("passes request options through", func() {
+		var called bool
+		option := request.Option(func(*request.Request) { called = true })
+		fakeCloudFormationAPI.DeleteStackWithContextStub = func(_ aws.Context, _ *awscf.DeleteStackInput, opts ...request.Option) (*awscf.DeleteStackOutput, error) {
+			for _, opt := range opts {
+				opt(&request.Request{})
+			}
+			return &awscf.DeleteStackOutput{}, nil
+		}
+
+		_, err := client.DeleteStackWithContext(context.Background(), &awscf.DeleteStackInput{}, option)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(called).To(BeTrue())
+	})
+
+	Describe("calling CloudFormation", func() {
+		var (
+			server   *httptest.Server
+			requests []string
+		)
+
+		BeforeEach(func() {
+			requests = nil
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				requests = append(requests, r.Form.Get("Action"))
+				if len(requests) == 1 || r.Form.Get("Action") != "ValidateTemplate" {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					w.Write([]byte(`<ErrorResponse><Error><Code>ServiceUnavailable</Code><Message>Try again</Message></Error></ErrorResponse>`))
+					return
+				}
+				w.Write([]byte(`<ValidateTemplateResponse><ValidateTemplateResult></ValidateTemplateResult></ValidateTemplateResponse>`))
+			}))
+			options.MaxRetries = 2
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		JustBeforeEach(func() {
+			sess, err := session.NewSession(&aws.Config{
+				Region:      aws.String("eu-west-1"),
+				Endpoint:    aws.String(server.URL),
+				Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			client = NewClient(awscf.New(sess), options)
+		})
+
+		It("leaves the calls it doesn't retry itself to the SDK's retries", func() {
+			_, err := client.ValidateTemplate(&awscf.ValidateTemplateInput{TemplateBody: aws.String("{}")})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(requests).To(Equal([]string{"ValidateTemplate", "ValidateTemplate"}))
+		})
+
+		It("retries the calls it wraps itself, without the SDK's retries", func() {
+			_, err := client.DescribeStacks(input)
+			Expect(err).To(HaveOccurred())
+			Expect(requests).To(HaveLen(1 + options.MaxRetries))
+		})
+	})
+
+	Describe("circuit breaker", func() {
+		BeforeEach(func() {
+			options.MaxRetries = 0
+		})
+
+		It("fails fast once enough consecutive calls failed", func() {
+			fakeCloudFormationAPI.DescribeStacksWithContextReturns(nil, throttled)
+			client.DescribeStacks(input)
+			Expect(client.CircuitOpen()).To(BeFalse())
+			client.DescribeStacks(input)
+			Expect(client.CircuitOpen()).To(BeTrue())
+
+			_, err := client.DescribeStacks(input)
+			Expect(err).To(Equal(ErrCircuitOpen))
+			Expect(IsTransient(err)).To(BeTrue())
+			Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(2))
+		})
+
+		It("does not count errors CloudFormation answered with", func() {
+			fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(0, nil, throttled)
+			fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(1, nil, errors.New("ValidationError"))
+			fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(2, nil, throttled)
+			fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(3, &awscf.DescribeStacksOutput{}, nil)
+			for i := 0; i < 3; i++ {
+				client.DescribeStacks(input)
+			}
+
+			_, err := client.DescribeStacks(input)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("tries again after the cooldown and closes when that call succeeds", func() {
+			fakeCloudFormationAPI.DescribeStacksWithContextReturns(nil, throttled)
+			client.DescribeStacks(input)
+			client.DescribeStacks(input)
+			_, err := client.DescribeStacks(input)
+			Expect(err).To(Equal(ErrCircuitOpen))
+
+			fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{}, nil)
+			Eventually(func() error {
+				_, err := client.DescribeStacks(input)
+				return err
+			}).Should(Succeed())
+			_, err = client.DescribeStacks(input)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.CircuitOpen()).To(BeFalse())
+		})
+	})
+})
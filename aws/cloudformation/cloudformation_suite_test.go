@@ -0,0 +1,13 @@
+package cloudformation_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCloudformation(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cloudformation Suite")
+}
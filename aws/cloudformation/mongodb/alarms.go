@@ -0,0 +1,123 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	awscw "github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// describeAlarmsMaxNames is the most alarm names a single DescribeAlarms
+// call accepts.
+const describeAlarmsMaxNames = 100
+
+// Alarm is the current state of one of an instance's CloudWatch alarms.
+type Alarm struct {
+	// Name is the alarm's logical ID in the stack, naming the node and
+	// the metric it watches.
+	Name      string    `json:"name"`
+	AlarmName string    `json:"alarm_name"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Alarms reports whether the instance has CloudWatch alarms.
+func (p InputParameters) Alarms() bool {
+	return p.AlarmTopicArn != ""
+}
+
+// alarmParameters passes the alarm topic and the thresholds that are set.
+// Thresholds that are not set fall back to the template's defaults, on
+// updates as well, so an instance always follows its plan's thresholds.
+func alarmParameters(p InputParameters) []*awscf.Parameter {
+	var parameters []*awscf.Parameter
+	for _, parameter := range []struct {
+		key   StackParameterKey
+		value string
+	}{
+		{alarmTopicArnSPK, p.AlarmTopicArn},
+		{cpuUtilizationAlarmThresholdSPK, p.CPUUtilizationAlarmThreshold},
+		{burstBalanceAlarmThresholdSPK, p.BurstBalanceAlarmThreshold},
+		{diskSpaceUtilizationAlarmThresholdSPK, p.DiskSpaceUtilizationAlarmThreshold},
+		{replicationLagAlarmThresholdSPK, p.ReplicationLagAlarmThreshold},
+	} {
+		if parameter.value == "" {
+			continue
+		}
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(parameter.key)),
+			ParameterValue:   aws.String(parameter.value),
+			UsePreviousValue: aws.Bool(false),
+		})
+	}
+	return parameters
+}
+
+// DescribeAlarms looks up the alarms in an instance's stack and returns
+// their current state, in the order the stack lists them. Instances
+// without alarms have none.
+func (s *Service) DescribeAlarms(ctx context.Context, id string) ([]Alarm, error) {
+	var alarms []Alarm
+	alarmIndexes := map[string]int{}
+	input := &awscf.ListStackResourcesInput{
+		StackName: aws.String(s.GenerateStackName(id)),
+	}
+	for {
+		listStackResourcesOutput, err := s.Client.ListStackResourcesWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		if listStackResourcesOutput == nil {
+			break
+		}
+
+		for _, resource := range listStackResourcesOutput.StackResourceSummaries {
+			if resource.ResourceType == nil || *resource.ResourceType != "AWS::CloudWatch::Alarm" {
+				continue
+			}
+			if resource.LogicalResourceId == nil || resource.PhysicalResourceId == nil {
+				continue
+			}
+			alarmIndexes[*resource.PhysicalResourceId] = len(alarms)
+			alarms = append(alarms, Alarm{
+				Name:      *resource.LogicalResourceId,
+				AlarmName: *resource.PhysicalResourceId,
+			})
+		}
+
+		if listStackResourcesOutput.NextToken == nil {
+			break
+		}
+		input.NextToken = listStackResourcesOutput.NextToken
+	}
+
+	for start := 0; start < len(alarms); start += describeAlarmsMaxNames {
+		end := start + describeAlarmsMaxNames
+		if end > len(alarms) {
+			end = len(alarms)
+		}
+		describeAlarmsInput := &awscw.DescribeAlarmsInput{}
+		for _, alarm := range alarms[start:end] {
+			describeAlarmsInput.AlarmNames = append(describeAlarmsInput.AlarmNames, aws.String(alarm.AlarmName))
+		}
+		err := s.CloudWatch.DescribeAlarmsPagesWithContext(ctx, describeAlarmsInput, func(page *awscw.DescribeAlarmsOutput, lastPage bool) bool {
+			for _, metricAlarm := range page.MetricAlarms {
+				index, ok := alarmIndexes[aws.StringValue(metricAlarm.AlarmName)]
+				if !ok {
+					continue
+				}
+				alarms[index].State = aws.StringValue(metricAlarm.StateValue)
+				alarms[index].Reason = aws.StringValue(metricAlarm.StateReason)
+				alarms[index].UpdatedAt = aws.TimeValue(metricAlarm.StateUpdatedTimestamp)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return alarms, nil
+}
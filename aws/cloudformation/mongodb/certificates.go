@@ -0,0 +1,134 @@
+package mongodb
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsssm "github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const (
+	// certificateAuthorityValidity is how long an instance's certificate
+	// authority is valid for. Bindings hand out its certificate, so it
+	// outlives the node certificates it issues.
+	certificateAuthorityValidity = 10 * 365 * 24 * time.Hour
+	// nodeCertificateValidity is how long the node certificates are valid
+	// for from when they are issued or reissued.
+	nodeCertificateValidity = 365 * 24 * time.Hour
+	// CertificateRenewalWindow is how long before they expire node
+	// certificates are reissued by an update.
+	CertificateRenewalWindow = 30 * 24 * time.Hour
+)
+
+// CertificateAuthority is the PEM encoded certificate and private key of
+// the certificate authority an instance's nodes issue their server
+// certificates from.
+type CertificateAuthority struct {
+	Certificate string
+	PrivateKey  string
+}
+
+// GenerateCertificateAuthority creates a new certificate authority for an
+// instance. Every instance has its own, so a certificate issued for one
+// instance is never trusted by the clients of another.
+func (s *Service) GenerateCertificateAuthority(id string) (CertificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return CertificateAuthority{}, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return CertificateAuthority{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "MongoDB CA " + id},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certificateAuthorityValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return CertificateAuthority{}, err
+	}
+	privateKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return CertificateAuthority{}, err
+	}
+
+	return CertificateAuthority{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privateKey})),
+	}, nil
+}
+
+// caKeyParameterName is the name of the SSM parameter the private key of
+// a stack's certificate authority is kept in.
+func caKeyParameterName(stackName string) string {
+	return "/aws-service-broker/" + stackName + "/mongodb-ca-key"
+}
+
+// storeCAKey keeps the private key of a stack's certificate authority in
+// an SSM SecureString parameter, which the nodes read to issue their
+// certificates. Passing it to the stack instead would show it in the
+// metadata of the node instances.
+func (s *Service) storeCAKey(ctx context.Context, stackName, key string) error {
+	if key == "" {
+		return errors.New("Error storing MongoDB CA key: key is empty")
+	}
+	if s.SSM == nil {
+		return errors.New("Error storing MongoDB CA key: no SSM client")
+	}
+	_, err := s.SSM.PutParameterWithContext(ctx, &awsssm.PutParameterInput{
+		Name:        aws.String(caKeyParameterName(stackName)),
+		Description: aws.String("Private key of the MongoDB certificate authority of stack " + stackName),
+		Type:        aws.String(awsssm.ParameterTypeSecureString),
+		Value:       aws.String(key),
+		Overwrite:   aws.Bool(true),
+	})
+	return err
+}
+
+// deleteCAKey deletes the private key of a stack's certificate authority.
+// Stacks that don't require TLS have none.
+func (s *Service) deleteCAKey(ctx context.Context, stackName string) error {
+	if s.SSM == nil {
+		return nil
+	}
+	_, err := s.SSM.DeleteParameterWithContext(ctx, &awsssm.DeleteParameterInput{
+		Name: aws.String(caKeyParameterName(stackName)),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == awsssm.ErrCodeParameterNotFound {
+		return nil
+	}
+	return err
+}
+
+// GenerateCertificateExpiry returns the expiry for node certificates issued
+// now, in the format of the MongoDBCertificateExpiry stack parameter.
+func (s *Service) GenerateCertificateExpiry() string {
+	return time.Now().Add(nodeCertificateValidity).UTC().Format(time.RFC3339)
+}
+
+// ParseCertificateExpiry parses the MongoDBCertificateExpiry stack output.
+func ParseCertificateExpiry(expiry string) (time.Time, error) {
+	if expiry == "" {
+		return time.Time{}, errors.New("Error parsing certificate expiry: expiry is empty")
+	}
+	return time.Parse(time.RFC3339, expiry)
+}
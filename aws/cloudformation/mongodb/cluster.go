@@ -0,0 +1,125 @@
+package mongodb
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/templates"
+)
+
+const (
+	PrimaryRole      = "primary"
+	SecondaryRole    = "secondary"
+	ArbiterRole      = "arbiter"
+	MongosRole       = "mongos"
+	ConfigServerRole = "configsvr"
+	ShardRole        = "shard"
+)
+
+// ClusterMember is a single node of a MongoDB cluster as reported by the
+// stack outputs.
+type ClusterMember struct {
+	Name string `json:"name"`
+	Ip   string `json:"ip"`
+	Role string `json:"role"`
+}
+
+// Cluster describes the nodes of a provisioned instance. Members are listed
+// in the order they were declared in the template: the primary, then each
+// secondary, then the arbiter for a replica set; the mongos nodes, the config
+// servers and then the primary of each shard for a sharded cluster.
+//
+// Clusters using TLS also report the certificate of their certificate
+// authority and when the node certificates expire.
+type Cluster struct {
+	Sharded           bool            `json:"sharded"`
+	Members           []ClusterMember `json:"members"`
+	CACertificate     string          `json:"ca_certificate,omitempty"`
+	CertificateExpiry string          `json:"certificate_expiry,omitempty"`
+}
+
+// DataMembers returns the members a client should connect to: the data
+// bearing members of a replica set or the mongos nodes of a sharded cluster.
+func (c Cluster) DataMembers() []ClusterMember {
+	var members []ClusterMember
+	for _, member := range c.Members {
+		switch member.Role {
+		case PrimaryRole, SecondaryRole:
+			if !c.Sharded {
+				members = append(members, member)
+			}
+		case MongosRole:
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+func (s *Service) DescribeCluster(ctx context.Context, id string) (Cluster, error) {
+	outputs, err := s.GetStackOutputs(ctx, id)
+	if err != nil {
+		return Cluster{}, err
+	}
+	return ClusterFromOutputs(outputs), nil
+}
+
+// ClusterFromOutputs builds a cluster description from the outputs of a
+// replica set or sharded cluster stack.
+func ClusterFromOutputs(outputs map[string]string) Cluster {
+	cluster := clusterMembersFromOutputs(outputs)
+	cluster.CACertificate = outputs["MongoDBCACertificate"]
+	cluster.CertificateExpiry = outputs["MongoDBCertificateExpiry"]
+	return cluster
+}
+
+func clusterMembersFromOutputs(outputs map[string]string) Cluster {
+	if mongos, ok := outputs["MongosNodeIps"]; ok {
+		cluster := Cluster{Sharded: true}
+		cluster.addMembers("MongosNode", MongosRole, mongos)
+		cluster.addMembers("ConfigServerNode", ConfigServerRole, outputs["ConfigServerNodeIps"])
+		for shard := 0; ; shard++ {
+			name := "Shard" + strconv.Itoa(shard) + "PrimaryNode"
+			ip, ok := outputs[name+"Ip"]
+			if !ok {
+				break
+			}
+			cluster.addMembers(name, ShardRole, ip)
+		}
+		return cluster
+	}
+
+	cluster := Cluster{}
+	cluster.addMember("PrimaryReplicaNode", PrimaryRole, outputs["PrimaryReplicaNodeIp"])
+	for i := 0; i < templates.MaxReplicaSetMembers-1; i++ {
+		name := "SecondaryReplicaNode" + strconv.Itoa(i)
+		cluster.addMember(name, SecondaryRole, outputs[name+"Ip"])
+	}
+	cluster.addMember("ArbiterReplicaNode", ArbiterRole, outputs["ArbiterReplicaNodeIp"])
+	return cluster
+}
+
+func (c *Cluster) addMember(name, role, ip string) {
+	if ip == "" {
+		return
+	}
+	c.Members = append(c.Members, ClusterMember{Name: name, Ip: ip, Role: role})
+}
+
+// addMembers adds a member for each address in a comma separated list,
+// numbering their names when there is more than one.
+func (c *Cluster) addMembers(name, role, ips string) {
+	var list []string
+	for _, ip := range strings.Split(ips, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			list = append(list, ip)
+		}
+	}
+	for i, ip := range list {
+		memberName := name
+		if len(list) > 1 {
+			memberName += strconv.Itoa(i)
+		}
+		c.addMember(memberName, role, ip)
+	}
+}
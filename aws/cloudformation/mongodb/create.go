@@ -1,24 +1,58 @@
 package mongodb
 
 import (
+	"context"
 	"errors"
 
 	"github.com/aws/aws-sdk-go/aws"
 	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
-	"github.com/henrytk/aws-service-broker/aws/cloudformation/templates"
 )
 
 var (
 	timeoutInMinutes int64 = 15
 )
 
-func (s *Service) CreateStack(id string, inputParameters InputParameters) (*awscf.CreateStackOutput, error) {
+func (s *Service) CreateStack(ctx context.Context, id string, inputParameters InputParameters) (*awscf.CreateStackOutput, error) {
+	createStackInput, err := s.BuildCreateStack(id, inputParameters)
+	if err != nil {
+		return nil, err
+	}
+	if inputParameters.TLS {
+		if err := s.storeCAKey(ctx, *createStackInput.StackName, inputParameters.MongoDBCAKey); err != nil {
+			return nil, err
+		}
+	}
+	createStackOutput, err := s.Client.CreateStackWithContext(ctx, createStackInput)
+	if err != nil {
+		// Nothing would delete the CA key of a stack that was never
+		// created. Failing to delete it doesn't hide why creation failed.
+		if inputParameters.TLS {
+			s.deleteCAKey(ctx, *createStackInput.StackName)
+		}
+		return nil, err
+	}
+	s.StackStatuses.changing(*createStackInput.StackName, *createStackInput.ClientRequestToken, false)
+	return createStackOutput, nil
+}
+
+// BuildCreateStack builds the request CreateStack makes to create an
+// instance's stack.
+func (s *Service) BuildCreateStack(id string, inputParameters InputParameters) (*awscf.CreateStackInput, error) {
+	if inputParameters.TLS {
+		inputParameters.MongoDBCAKeyParameter = caKeyParameterName(s.GenerateStackName(id))
+	}
 	parameters, err := s.BuildCreateStackParameters(inputParameters)
 	if err != nil {
 		return nil, err
 	}
-	createStackInput := s.BuildCreateStackInput(id, parameters)
-	return s.Client.CreateStack(createStackInput)
+	templateBody, err := s.BuildTemplateBody(inputParameters)
+	if err != nil {
+		return nil, err
+	}
+	createStackInput := s.BuildCreateStackInput(id, templateBody, parameters)
+	createStackInput.Tags = stackTags(inputParameters.Tags)
+	createStackInput.NotificationARNs = s.notificationARNs()
+	return createStackInput, nil
 }
 
 func (s *Service) BuildCreateStackParameters(p InputParameters) ([]*awscf.Parameter, error) {
@@ -55,32 +89,12 @@ func (s *Service) BuildCreateStackParameters(p InputParameters) ([]*awscf.Parame
 		})
 	}
 
-	if p.PrimaryNodeSubnetId == "" {
-		return parameters, errors.New("Error building MongoDB parameters: primary node subnet ID is empty")
+	if len(p.NodeSubnetIds) == 0 {
+		return parameters, errors.New("Error building MongoDB parameters: node subnet IDs are empty")
 	} else {
 		parameters = append(parameters, &awscf.Parameter{
-			ParameterKey:     aws.String(string(primaryNodeSubnetIdSPK)),
-			ParameterValue:   aws.String(p.PrimaryNodeSubnetId),
-			UsePreviousValue: aws.Bool(usePreviousValue),
-		})
-	}
-
-	if p.Secondary0NodeSubnetId == "" {
-		return parameters, errors.New("Error building MongoDB parameters: secondary 0 node subnet ID is empty")
-	} else {
-		parameters = append(parameters, &awscf.Parameter{
-			ParameterKey:     aws.String(string(secondary0NodeSubnetIdSPK)),
-			ParameterValue:   aws.String(p.Secondary0NodeSubnetId),
-			UsePreviousValue: aws.Bool(usePreviousValue),
-		})
-	}
-
-	if p.Secondary1NodeSubnetId == "" {
-		return parameters, errors.New("Error building MongoDB parameters: secondary 1 node subnet ID is empty")
-	} else {
-		parameters = append(parameters, &awscf.Parameter{
-			ParameterKey:     aws.String(string(secondary1NodeSubnetIdSPK)),
-			ParameterValue:   aws.String(p.Secondary1NodeSubnetId),
+			ParameterKey:     aws.String(string(nodeSubnetsSPK)),
+			ParameterValue:   aws.String(nodeSubnetsValue(p.NodeSubnetIds)),
 			UsePreviousValue: aws.Bool(usePreviousValue),
 		})
 	}
@@ -119,6 +133,14 @@ func (s *Service) BuildCreateStackParameters(p InputParameters) ([]*awscf.Parame
 		})
 	}
 
+	if p.ArbiterCount != "" {
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(arbiterCountSPK)),
+			ParameterValue:   aws.String(p.ArbiterCount),
+			UsePreviousValue: aws.Bool(usePreviousValue),
+		})
+	}
+
 	if p.ReplicaShardIndex != "" {
 		parameters = append(parameters, &awscf.Parameter{
 			ParameterKey:     aws.String(string(replicaShardIndexSPK)),
@@ -159,18 +181,79 @@ func (s *Service) BuildCreateStackParameters(p InputParameters) ([]*awscf.Parame
 		})
 	}
 
+	if p.Sharded() {
+		if p.MongoDBClusterKey == "" {
+			return parameters, errors.New("Error building MongoDB parameters: MongoDB cluster key is empty")
+		}
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(mongoDBClusterKeySPK)),
+			ParameterValue:   aws.String(p.MongoDBClusterKey),
+			UsePreviousValue: aws.Bool(usePreviousValue),
+		})
+	}
+
+	if p.TLS {
+		if p.MongoDBCACertificate == "" || p.MongoDBCAKeyParameter == "" {
+			return parameters, errors.New("Error building MongoDB parameters: MongoDB certificate authority is empty")
+		}
+		if p.MongoDBCertificateExpiry == "" {
+			return parameters, errors.New("Error building MongoDB parameters: MongoDB certificate expiry is empty")
+		}
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(mongoDBCACertificateSPK)),
+			ParameterValue:   aws.String(p.MongoDBCACertificate),
+			UsePreviousValue: aws.Bool(usePreviousValue),
+		})
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(mongoDBCAKeyParameterSPK)),
+			ParameterValue:   aws.String(p.MongoDBCAKeyParameter),
+			UsePreviousValue: aws.Bool(usePreviousValue),
+		})
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(mongoDBCertificateExpirySPK)),
+			ParameterValue:   aws.String(p.MongoDBCertificateExpiry),
+			UsePreviousValue: aws.Bool(usePreviousValue),
+		})
+	}
+
+	if p.EncryptedVolumes() {
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(volumeEncryptedSPK)),
+			ParameterValue:   aws.String(p.VolumeEncrypted),
+			UsePreviousValue: aws.Bool(usePreviousValue),
+		})
+		if p.VolumeKmsKeyId != "" {
+			parameters = append(parameters, &awscf.Parameter{
+				ParameterKey:     aws.String(string(volumeKmsKeyIdSPK)),
+				ParameterValue:   aws.String(p.VolumeKmsKeyId),
+				UsePreviousValue: aws.Bool(usePreviousValue),
+			})
+		}
+	}
+
+	if p.Alarms() {
+		parameters = append(parameters, alarmParameters(p)...)
+	}
+
+	if p.Exporter() {
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(mongoDBExporterSecurityGroupIdSPK)),
+			ParameterValue:   aws.String(p.MongoDBExporterSecurityGroupId),
+			UsePreviousValue: aws.Bool(usePreviousValue),
+		})
+	}
+
 	return parameters, nil
 }
 
-func (s *Service) BuildCreateStackInput(id string, parameters []*awscf.Parameter) *awscf.CreateStackInput {
+func (s *Service) BuildCreateStackInput(id, templateBody string, parameters []*awscf.Parameter) *awscf.CreateStackInput {
 	stackName := s.GenerateStackName(id)
-	mongoDBStackTemplate := string(templates.MongoDBStack)
 	return &awscf.CreateStackInput{
 		Capabilities:       capabilities,
-		ClientRequestToken: aws.String("create-" + stackName),
+		ClientRequestToken: requestToken("create", stackName),
 		Parameters:         parameters,
 		StackName:          aws.String(stackName),
-		TemplateBody:       aws.String(mongoDBStackTemplate),
+		TemplateBody:       aws.String(templateBody),
 		TimeoutInMinutes:   aws.Int64(timeoutInMinutes),
 	}
 }
@@ -1,14 +1,22 @@
 package mongodb
 
 import (
+	"context"
+
 	"github.com/aws/aws-sdk-go/aws"
 	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
 )
 
-func (s *Service) DeleteStack(id string) error {
-	_, err := s.Client.DeleteStack(&awscf.DeleteStackInput{
-		ClientRequestToken: aws.String("delete-" + id),
-		StackName:          aws.String(s.GenerateStackName(id)),
+func (s *Service) DeleteStack(ctx context.Context, id string) error {
+	stackName := s.GenerateStackName(id)
+	token := requestToken("delete", stackName)
+	_, err := s.Client.DeleteStackWithContext(ctx, &awscf.DeleteStackInput{
+		ClientRequestToken: token,
+		StackName:          aws.String(stackName),
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	s.StackStatuses.changing(stackName, *token, true)
+	return s.deleteCAKey(ctx, stackName)
 }
@@ -0,0 +1,114 @@
+package mongodb
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+// Tags recording which instance a stack belongs to, so that it can be
+// found again when listing every stack in the account.
+const (
+	InstanceIDTag       = "aws-service-broker:instance-id"
+	PlanIDTag           = "aws-service-broker:plan-id"
+	OrganizationGUIDTag = "aws-service-broker:organization-guid"
+	SpaceGUIDTag        = "aws-service-broker:space-guid"
+)
+
+// ExporterInstance is an instance whose nodes serve their metrics with
+// mongodb_exporter.
+type ExporterInstance struct {
+	// ID is the instance ID from the stack's tags, or the stack name for
+	// stacks created before they were tagged.
+	ID           string
+	Tags         map[string]string
+	Cluster      Cluster
+	ExporterPort string
+}
+
+// DiscoverExporters lists the instances in the account running
+// mongodb_exporter, with the nodes listed in their stack outputs. Stacks
+// being deleted are left out.
+func (s *Service) DiscoverExporters(ctx context.Context) ([]ExporterInstance, error) {
+	var instances []ExporterInstance
+	input := &awscf.DescribeStacksInput{}
+	for {
+		describeStacksOutput, err := s.Client.DescribeStacksWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		if describeStacksOutput == nil {
+			return instances, nil
+		}
+
+		for _, stack := range describeStacksOutput.Stacks {
+			if stack.StackName == nil || stack.ParentId != nil {
+				continue
+			}
+			if !strings.HasPrefix(*stack.StackName, stackNamePrefix) {
+				continue
+			}
+			if stack.StackStatus != nil && strings.HasPrefix(*stack.StackStatus, "DELETE_") {
+				continue
+			}
+			outputs := map[string]string{}
+			for _, output := range stack.Outputs {
+				if output.OutputKey != nil && output.OutputValue != nil {
+					outputs[*output.OutputKey] = *output.OutputValue
+				}
+			}
+			port, ok := outputs["MongoDBExporterPort"]
+			if !ok {
+				continue
+			}
+			tags := tagsFromStack(stack)
+			id := tags[InstanceIDTag]
+			if id == "" {
+				id = *stack.StackName
+			}
+			instances = append(instances, ExporterInstance{
+				ID:           id,
+				Tags:         tags,
+				Cluster:      ClusterFromOutputs(outputs),
+				ExporterPort: port,
+			})
+		}
+
+		if describeStacksOutput.NextToken == nil {
+			return instances, nil
+		}
+		input.NextToken = describeStacksOutput.NextToken
+	}
+}
+
+// stackTags converts tags to stack tags, sorted by key so that requests
+// are stable.
+func stackTags(tags map[string]string) []*awscf.Tag {
+	var keys []string
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var stackTags []*awscf.Tag
+	for _, key := range keys {
+		stackTags = append(stackTags, &awscf.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(tags[key]),
+		})
+	}
+	return stackTags
+}
+
+func tagsFromStack(stack *awscf.Stack) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range stack.Tags {
+		if tag.Key != nil && tag.Value != nil {
+			tags[*tag.Key] = *tag.Value
+		}
+	}
+	return tags
+}
@@ -0,0 +1,152 @@
+package mongodb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/henrytk/aws-service-broker/health"
+)
+
+const stackResourceType = "AWS::CloudFormation::Stack"
+
+// StackEvent is a stack event as CloudFormation notifies it to the SNS
+// topics of a stack.
+type StackEvent struct {
+	StackId              string
+	StackName            string
+	LogicalResourceId    string
+	ResourceType         string
+	ResourceStatus       string
+	ResourceStatusReason string
+	ClientRequestToken   string
+	Timestamp            time.Time
+}
+
+// IsStackStatus reports whether the event is a change of the stack's own
+// status rather than of one of its resources.
+func (e StackEvent) IsStackStatus() bool {
+	return e.ResourceType == stackResourceType && e.LogicalResourceId == e.StackName
+}
+
+// ParseStackEvent parses a stack event received from an SQS queue
+// subscribed to a stack's SNS topic. Messages can be SNS notifications or,
+// with raw message delivery, the bare event, which CloudFormation writes as
+// lines of Key='value'.
+func ParseStackEvent(body string) (StackEvent, error) {
+	var notification struct {
+		Type    string
+		Message string
+	}
+	if err := json.Unmarshal([]byte(body), &notification); err == nil && notification.Type == "Notification" {
+		body = notification.Message
+	}
+
+	fields := map[string]string{}
+	for _, line := range strings.Split(body, "\n") {
+		separator := strings.Index(line, "=")
+		if separator < 0 {
+			continue
+		}
+		fields[line[:separator]] = strings.Trim(line[separator+1:], "'")
+	}
+
+	event := StackEvent{
+		StackId:              fields["StackId"],
+		StackName:            fields["StackName"],
+		LogicalResourceId:    fields["LogicalResourceId"],
+		ResourceType:         fields["ResourceType"],
+		ResourceStatus:       fields["ResourceStatus"],
+		ResourceStatusReason: fields["ResourceStatusReason"],
+		ClientRequestToken:   fields["ClientRequestToken"],
+	}
+	if event.StackName == "" || event.ResourceStatus == "" {
+		return StackEvent{}, errors.New("message is not a CloudFormation stack event")
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, fields["Timestamp"])
+	if err != nil {
+		return StackEvent{}, errors.New("stack event has an invalid timestamp: " + fields["Timestamp"])
+	}
+	event.Timestamp = timestamp
+	return event, nil
+}
+
+// ConsumeStackEvents receives stack events from an SQS queue until the
+// context is done, handling and then deleting each of them. Messages that
+// are not stack events are logged and deleted. Each receive is recorded in
+// the worker.
+func (s *Service) ConsumeStackEvents(ctx context.Context, queue sqsiface.SQSAPI, queueURL string, worker *health.Worker, logger lager.Logger) {
+	for ctx.Err() == nil {
+		receiveMessageOutput, err := queue.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error("receive-stack-events", err)
+			worker.Ran(err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		worker.Ran(nil)
+
+		for _, message := range receiveMessageOutput.Messages {
+			event, err := ParseStackEvent(aws.StringValue(message.Body))
+			if err != nil {
+				logger.Error("parse-stack-event", err, lager.Data{"message-id": aws.StringValue(message.MessageId)})
+			} else {
+				s.HandleStackEvent(event)
+			}
+			_, err = queue.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(queueURL),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			if err != nil && ctx.Err() == nil {
+				logger.Error("delete-stack-event", err, lager.Data{"message-id": aws.StringValue(message.MessageId)})
+			}
+		}
+	}
+}
+
+// HandleStackEvent records the status of an instance's stack, or of one of
+// its nested node stacks, in the service's stack status cache. Changes of
+// an instance stack's own status are then passed to the service's stack
+// event handlers. Events of stacks that are not instances are ignored.
+func (s *Service) HandleStackEvent(event StackEvent) {
+	if !strings.HasPrefix(event.StackName, stackNamePrefix) || strings.Contains(event.StackName, "-") {
+		return
+	}
+	if !event.IsStackStatus() {
+		if event.ResourceType == stackResourceType {
+			s.StackStatuses.recordNested(event.StackName, event.LogicalResourceId, event.ResourceStatus, event.ClientRequestToken, event.Timestamp)
+		}
+		return
+	}
+	reason := event.ResourceStatusReason
+	if reason == "" {
+		reason = "no reason returned via the API"
+	}
+	s.StackStatuses.record(event.StackName, event.ResourceStatus, reason, event.ClientRequestToken, event.Timestamp)
+	for _, handler := range s.StackEventHandlers {
+		handler(event)
+	}
+}
+
+func (s *Service) notificationARNs() []*string {
+	if len(s.NotificationARNs) == 0 {
+		return nil
+	}
+	return aws.StringSlice(s.NotificationARNs)
+}
@@ -1,15 +1,23 @@
 package mongodb
 
 import (
+	"context"
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
 )
 
-func (s *Service) GetStackState(stackName string) (string, string, error) {
-	describeStacksOutput, err := s.Client.DescribeStacks(&awscf.DescribeStacksInput{
+// GetStackState returns the status of a stack and the reason for it. The
+// status is cached if the service has a stack status cache.
+func (s *Service) GetStackState(ctx context.Context, stackName string) (string, string, error) {
+	if cached, ok := s.StackStatuses.get(stackName); ok {
+		return cached.status, cached.reason, nil
+	}
+	described := time.Now()
+	describeStacksOutput, err := s.Client.DescribeStacksWithContext(ctx, &awscf.DescribeStacksInput{
 		StackName: aws.String(stackName),
 	})
 	if err != nil {
@@ -25,12 +33,149 @@ func (s *Service) GetStackState(stackName string) (string, string, error) {
 	if stack.StackStatusReason != nil {
 		reason = *stack.StackStatusReason
 	}
+	s.StackStatuses.set(stackName, stackStatus{
+		status:  *stack.StackStatus,
+		reason:  reason,
+		started: operationStarted(aws.TimeValue(stack.CreationTime), stack.LastUpdatedTime, stack.DeletionTime),
+	}, described)
 	return *stack.StackStatus, reason, nil
 }
 
-func (s *Service) CreateStackCompleted(id string) (bool, error) {
+func (s *Service) GetStackOutputs(ctx context.Context, id string) (map[string]string, error) {
+	describeStacksOutput, err := s.Client.DescribeStacksWithContext(ctx, &awscf.DescribeStacksInput{
+		StackName: aws.String(s.GenerateStackName(id)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(describeStacksOutput.Stacks) != 1 {
+		return nil, errors.New("Error getting stack outputs: number of stacks was not 1")
+	}
+
+	outputs := map[string]string{}
+	for _, output := range describeStacksOutput.Stacks[0].Outputs {
+		if output.OutputKey != nil && output.OutputValue != nil {
+			outputs[*output.OutputKey] = *output.OutputValue
+		}
+	}
+	return outputs, nil
+}
+
+// GetStackTags returns the tags of an instance's stack.
+func (s *Service) GetStackTags(ctx context.Context, id string) (map[string]string, error) {
+	stack, err := s.describeStack(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return tagsFromStack(stack), nil
+}
+
+func (s *Service) describeStack(ctx context.Context, id string) (*awscf.Stack, error) {
+	describeStacksOutput, err := s.Client.DescribeStacksWithContext(ctx, &awscf.DescribeStacksInput{
+		StackName: aws.String(s.GenerateStackName(id)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if describeStacksOutput == nil || len(describeStacksOutput.Stacks) != 1 {
+		return nil, errors.New("Error describing stack: number of stacks was not 1")
+	}
+
+	return describeStacksOutput.Stacks[0], nil
+}
+
+// stackParameter returns the value of one of a stack's parameters, or an
+// empty string if the stack doesn't have it.
+func stackParameter(stack *awscf.Stack, key StackParameterKey) string {
+	for _, parameter := range stack.Parameters {
+		if aws.StringValue(parameter.ParameterKey) == string(key) {
+			return aws.StringValue(parameter.ParameterValue)
+		}
+	}
+	return ""
+}
+
+// NestedStackProgress counts the nested node stacks of an instance and how
+// many of them have finished their current operation, so that callers can
+// report progress while the parent stack is still in progress.
+func (s *Service) NestedStackProgress(ctx context.Context, id string) (completed int, total int, err error) {
+	if cached, ok := s.StackStatuses.get(s.GenerateStackName(id)); ok && cached.total > 0 {
+		return cached.completed, cached.total, nil
+	}
+	input := &awscf.ListStackResourcesInput{
+		StackName: aws.String(s.GenerateStackName(id)),
+	}
+	for {
+		listStackResourcesOutput, err := s.Client.ListStackResourcesWithContext(ctx, input)
+		if err != nil {
+			return 0, 0, err
+		}
+		if listStackResourcesOutput == nil {
+			return completed, total, nil
+		}
+
+		for _, resource := range listStackResourcesOutput.StackResourceSummaries {
+			if resource.ResourceType == nil || *resource.ResourceType != "AWS::CloudFormation::Stack" {
+				continue
+			}
+			total++
+			if resource.ResourceStatus != nil && nestedStackCompleted(*resource.ResourceStatus) {
+				completed++
+			}
+		}
+
+		if listStackResourcesOutput.NextToken == nil {
+			return completed, total, nil
+		}
+		input.NextToken = listStackResourcesOutput.NextToken
+	}
+}
+
+// CountStacksByStatus counts the MongoDB instance stacks in the account by
+// their status. Nested node stacks and deleted stacks are not counted.
+func (s *Service) CountStacksByStatus(ctx context.Context) (map[string]int, error) {
+	counts := map[string]int{}
+	input := &awscf.ListStacksInput{StackStatusFilter: liveStackStatuses}
+	for {
+		listStacksOutput, err := s.Client.ListStacksWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		if listStacksOutput == nil {
+			return counts, nil
+		}
+
+		for _, stack := range listStacksOutput.StackSummaries {
+			if stack.StackName == nil || stack.StackStatus == nil || stack.ParentId != nil {
+				continue
+			}
+			if !strings.HasPrefix(*stack.StackName, stackNamePrefix) {
+				continue
+			}
+			counts[*stack.StackStatus]++
+		}
+
+		if listStacksOutput.NextToken == nil {
+			return counts, nil
+		}
+		input.NextToken = listStacksOutput.NextToken
+	}
+}
+
+func nestedStackCompleted(status string) bool {
+	switch status {
+	case awscf.ResourceStatusCreateComplete, awscf.ResourceStatusUpdateComplete:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Service) CreateStackCompleted(ctx context.Context, id string) (bool, error) {
 	stackName := s.GenerateStackName(id)
-	state, reason, err := s.GetStackState(stackName)
+	state, reason, err := s.GetStackState(ctx, stackName)
 	if err != nil {
 		return false, err
 	}
@@ -43,9 +188,9 @@ func (s *Service) CreateStackCompleted(id string) (bool, error) {
 	return false, nil
 }
 
-func (s *Service) DeleteStackCompleted(id string) (bool, error) {
+func (s *Service) DeleteStackCompleted(ctx context.Context, id string) (bool, error) {
 	stackName := s.GenerateStackName(id)
-	state, reason, err := s.GetStackState(stackName)
+	state, reason, err := s.GetStackState(ctx, stackName)
 	if err != nil {
 		if strings.Contains(err.Error(), "Stack with id "+stackName+" does not exist") {
 			return true, nil
@@ -61,9 +206,9 @@ func (s *Service) DeleteStackCompleted(id string) (bool, error) {
 	return false, nil
 }
 
-func (s *Service) UpdateStackCompleted(id string) (bool, error) {
+func (s *Service) UpdateStackCompleted(ctx context.Context, id string) (bool, error) {
 	stackName := s.GenerateStackName(id)
-	state, reason, err := s.GetStackState(stackName)
+	state, reason, err := s.GetStackState(ctx, stackName)
 	if err != nil {
 		return false, err
 	}
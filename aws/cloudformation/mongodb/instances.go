@@ -0,0 +1,215 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+var (
+	// ErrStackNotFound is returned for instances that have no stack.
+	ErrStackNotFound = errors.New("stack does not exist")
+	// ErrNothingToRetry is returned when retrying the operation of a stack
+	// whose status is not one a retry can get it out of.
+	ErrNothingToRetry = errors.New("stack has no failed operation that can be retried")
+)
+
+// InstanceStack is the stack of an instance.
+type InstanceStack struct {
+	// ID is the instance ID from the stack's tags, or the stack name for
+	// stacks created before they were tagged.
+	ID              string
+	StackName       string
+	StackId         string
+	Status          string
+	StatusReason    string
+	Tags            map[string]string
+	CreationTime    time.Time
+	LastUpdatedTime *time.Time
+}
+
+// InstanceStackDetails is an instance's stack with its parameters, its
+// outputs and its most recent events. CloudFormation masks the values of
+// secret parameters.
+type InstanceStackDetails struct {
+	InstanceStack
+	Parameters map[string]string
+	Outputs    map[string]string
+	Events     []StackEvent
+}
+
+// ListInstanceStacks lists the stacks of the instances in the account.
+// Nested node stacks and deleted stacks are left out.
+func (s *Service) ListInstanceStacks(ctx context.Context) ([]InstanceStack, error) {
+	var instances []InstanceStack
+	input := &awscf.DescribeStacksInput{}
+	for {
+		describeStacksOutput, err := s.Client.DescribeStacksWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		if describeStacksOutput == nil {
+			return instances, nil
+		}
+
+		for _, stack := range describeStacksOutput.Stacks {
+			if stack.StackName == nil || stack.ParentId != nil {
+				continue
+			}
+			if !strings.HasPrefix(*stack.StackName, stackNamePrefix) {
+				continue
+			}
+			instances = append(instances, instanceStack(stack))
+		}
+
+		if describeStacksOutput.NextToken == nil {
+			return instances, nil
+		}
+		input.NextToken = describeStacksOutput.NextToken
+	}
+}
+
+// DescribeInstanceStack returns the stack of an instance with up to
+// eventCount of its most recent events.
+func (s *Service) DescribeInstanceStack(ctx context.Context, id string, eventCount int) (InstanceStackDetails, error) {
+	stackName := s.GenerateStackName(id)
+	describeStacksOutput, err := s.Client.DescribeStacksWithContext(ctx, &awscf.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		return InstanceStackDetails{}, stackNotFound(stackName, err)
+	}
+	if describeStacksOutput == nil || len(describeStacksOutput.Stacks) != 1 {
+		return InstanceStackDetails{}, errors.New("Error describing stack: number of stacks was not 1")
+	}
+	stack := describeStacksOutput.Stacks[0]
+
+	details := InstanceStackDetails{
+		InstanceStack: instanceStack(stack),
+		Parameters:    map[string]string{},
+		Outputs:       map[string]string{},
+	}
+	for _, parameter := range stack.Parameters {
+		if parameter.ParameterKey != nil && parameter.ParameterValue != nil {
+			details.Parameters[*parameter.ParameterKey] = *parameter.ParameterValue
+		}
+	}
+	for _, output := range stack.Outputs {
+		if output.OutputKey != nil && output.OutputValue != nil {
+			details.Outputs[*output.OutputKey] = *output.OutputValue
+		}
+	}
+
+	// Events are returned newest first.
+	input := &awscf.DescribeStackEventsInput{StackName: stack.StackId}
+	for len(details.Events) < eventCount {
+		describeStackEventsOutput, err := s.Client.DescribeStackEventsWithContext(ctx, input)
+		if err != nil {
+			return InstanceStackDetails{}, err
+		}
+		if describeStackEventsOutput == nil {
+			break
+		}
+		for _, event := range describeStackEventsOutput.StackEvents {
+			if len(details.Events) == eventCount {
+				break
+			}
+			details.Events = append(details.Events, StackEvent{
+				StackId:              aws.StringValue(event.StackId),
+				StackName:            aws.StringValue(event.StackName),
+				LogicalResourceId:    aws.StringValue(event.LogicalResourceId),
+				ResourceType:         aws.StringValue(event.ResourceType),
+				ResourceStatus:       aws.StringValue(event.ResourceStatus),
+				ResourceStatusReason: aws.StringValue(event.ResourceStatusReason),
+				Timestamp:            aws.TimeValue(event.Timestamp),
+			})
+		}
+		if describeStackEventsOutput.NextToken == nil {
+			break
+		}
+		input.NextToken = describeStackEventsOutput.NextToken
+	}
+	return details, nil
+}
+
+// RetryStackOperation retries the failed operation of an instance's stack,
+// returning the operation it started. Stacks that failed to delete are
+// deleted again, and stacks that failed to roll back an update continue
+// rolling back. Stacks that failed to be created or updated are left to the
+// platform, which knows what they were asked to be.
+func (s *Service) RetryStackOperation(ctx context.Context, id string) (string, error) {
+	stackName := s.GenerateStackName(id)
+	// The status is asked of CloudFormation because the decision can't be
+	// made on a status that might be out of date.
+	s.StackStatuses.invalidate(stackName)
+	status, _, err := s.GetStackState(ctx, stackName)
+	if err != nil {
+		return "", stackNotFound(stackName, err)
+	}
+
+	token := requestToken("retry", stackName)
+	var operation string
+	switch status {
+	case awscf.StackStatusDeleteFailed:
+		operation = "delete"
+		_, err = s.Client.DeleteStackWithContext(ctx, &awscf.DeleteStackInput{
+			ClientRequestToken: token,
+			StackName:          aws.String(stackName),
+		})
+	case awscf.StackStatusUpdateRollbackFailed:
+		operation = "continue-update-rollback"
+		_, err = s.Client.ContinueUpdateRollbackWithContext(ctx, &awscf.ContinueUpdateRollbackInput{
+			ClientRequestToken: token,
+			StackName:          aws.String(stackName),
+		})
+	default:
+		return "", ErrNothingToRetry
+	}
+	if err != nil {
+		return "", err
+	}
+	s.StackStatuses.changing(stackName, *token, operation == "delete")
+	return operation, nil
+}
+
+// RefreshStackState asks CloudFormation for the status of an instance's
+// stack, replacing any cached status.
+func (s *Service) RefreshStackState(ctx context.Context, id string) (string, string, error) {
+	stackName := s.GenerateStackName(id)
+	s.StackStatuses.invalidate(stackName)
+	status, reason, err := s.GetStackState(ctx, stackName)
+	if err != nil {
+		return "", "", stackNotFound(stackName, err)
+	}
+	return status, reason, nil
+}
+
+func instanceStack(stack *awscf.Stack) InstanceStack {
+	instance := InstanceStack{
+		StackName:       aws.StringValue(stack.StackName),
+		StackId:         aws.StringValue(stack.StackId),
+		Status:          aws.StringValue(stack.StackStatus),
+		StatusReason:    aws.StringValue(stack.StackStatusReason),
+		Tags:            tagsFromStack(stack),
+		CreationTime:    aws.TimeValue(stack.CreationTime),
+		LastUpdatedTime: stack.LastUpdatedTime,
+	}
+	instance.ID = instance.Tags[InstanceIDTag]
+	if instance.ID == "" {
+		instance.ID = instance.StackName
+	}
+	return instance
+}
+
+// stackNotFound returns ErrStackNotFound in place of CloudFormation's error
+// for a stack that does not exist.
+func stackNotFound(stackName string, err error) error {
+	if strings.Contains(err.Error(), "Stack with id "+stackName+" does not exist") {
+		return ErrStackNotFound
+	}
+	return err
+}
@@ -1,26 +1,63 @@
 package mongodb
 
 import (
+	"strconv"
 	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
 
 	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/henrytk/aws-service-broker/aws/cloudformation"
+	"github.com/henrytk/aws-service-broker/aws/cloudwatch"
+	"github.com/henrytk/aws-service-broker/aws/ssm"
 	"github.com/henrytk/aws-service-broker/utils"
 )
 
-const adminPasswordMaxLength = 64
+const (
+	adminPasswordMaxLength = 64
+	clusterKeyMaxLength    = 64
+
+	stackNamePrefix = "mongodb"
+)
 
 type Service struct {
-	Client cloudformationiface.CloudFormationAPI
+	Client     cloudformationiface.CloudFormationAPI
+	CloudWatch cloudwatchiface.CloudWatchAPI
+	// SSM keeps the private keys of the certificate authorities of TLS
+	// instances. It is only needed to create and delete them.
+	SSM ssmiface.SSMAPI
+	// StackStatuses is optional. Without it, every stack status is asked
+	// of CloudFormation.
+	StackStatuses *StackStatuses
+	// NotificationARNs are the SNS topics stack events are sent to. They
+	// are set on stacks when the broker creates or updates them.
+	NotificationARNs []string
+	// StackEventHandlers are called with every change of an instance
+	// stack's status received by ConsumeStackEvents.
+	StackEventHandlers []func(StackEvent)
 }
 
-func NewService(region string) (*Service, error) {
-	client, err := cloudformation.NewCloudFormationClient(region)
+func NewService(region string, logger lager.Logger) (*Service, error) {
+	client, err := cloudformation.NewCloudFormationClient(region, logger)
+	if err != nil {
+		return &Service{}, err
+	}
+	cloudWatchClient, err := cloudwatch.NewCloudWatchClient(region, logger)
+	if err != nil {
+		return &Service{}, err
+	}
+	ssmClient, err := ssm.NewSSMClient(region, logger)
 	if err != nil {
 		return &Service{}, err
 	}
 	return &Service{
-		Client: client,
+		Client:     client,
+		CloudWatch: cloudWatchClient,
+		SSM:        ssmClient,
 	}, nil
 }
 
@@ -28,6 +65,18 @@ func (s *Service) GenerateAdminPassword(input string) string {
 	return utils.GetMD5Hex(input, adminPasswordMaxLength)
 }
 
+func (s *Service) GenerateClusterKey(input string) string {
+	return utils.GetMD5Hex(input, clusterKeyMaxLength)
+}
+
 func (s *Service) GenerateStackName(input string) string {
-	return "mongodb" + strings.Replace(input, "-", "", -1)
+	return stackNamePrefix + strings.Replace(input, "-", "", -1)
+}
+
+// requestToken returns the client request token of one operation on a
+// stack. The Client retries a call with the same input, and so the same
+// token, which CloudFormation recognises as a repeat. Every operation has
+// its own token, so that it isn't taken for a repeat of an earlier one.
+func requestToken(operation, stackName string) *string {
+	return aws.String(operation + "-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + stackName)
 }
@@ -1,12 +1,24 @@
 package mongodb_test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"time"
 
+	"code.cloudfoundry.org/lager/lagertest"
 	"github.com/aws/aws-sdk-go/aws"
 	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	awscw "github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/henrytk/aws-service-broker/aws/cloudformation/fakes"
 	. "github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/templates"
+	cloudwatchfakes "github.com/henrytk/aws-service-broker/aws/cloudwatch/fakes"
+	sqsfakes "github.com/henrytk/aws-service-broker/aws/sqs/fakes"
+	ssmfakes "github.com/henrytk/aws-service-broker/aws/ssm/fakes"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -15,24 +27,25 @@ import (
 var _ = Describe("Mongodb", func() {
 	var (
 		fakeCloudFormationAPI *fakes.FakeCloudFormationAPI
+		fakeCloudWatchAPI     *cloudwatchfakes.FakeCloudWatchAPI
 		mongoDBService        *Service
 		inputParameters       InputParameters
 	)
 
 	BeforeEach(func() {
 		fakeCloudFormationAPI = &fakes.FakeCloudFormationAPI{}
-		mongoDBService = &Service{Client: fakeCloudFormationAPI}
+		fakeCloudWatchAPI = &cloudwatchfakes.FakeCloudWatchAPI{}
+		mongoDBService = &Service{Client: fakeCloudFormationAPI, CloudWatch: fakeCloudWatchAPI}
 		inputParameters = InputParameters{
 			BastionSecurityGroupId: "bastion",
 			KeyPairName:            "keypairname",
 			VpcId:                  "vpc-id",
-			PrimaryNodeSubnetId:    "primary",
-			Secondary0NodeSubnetId: "secondary0",
-			Secondary1NodeSubnetId: "secondary1",
+			NodeSubnetIds:          []string{"subnet-a", "subnet-b", "subnet-c"},
 			MongoDBAdminPassword:   "password",
 			MongoDBAdminUsername:   "admin",
 			MongoDBVersion:         "3.4",
 			ClusterReplicaSetCount: "1",
+			ArbiterCount:           "0",
 			ReplicaShardIndex:      "0",
 			VolumeSize:             "400",
 			VolumeType:             "io1",
@@ -44,7 +57,7 @@ var _ = Describe("Mongodb", func() {
 	Describe("BuildUpdateStackParameters", func() {
 		It("creates a parameter for each input field", func() {
 			parameters := mongoDBService.BuildUpdateStackParameters(inputParameters)
-			Expect(len(parameters)).To(Equal(15))
+			Expect(len(parameters)).To(Equal(14))
 
 			By("overriding their previous value")
 			for _, v := range parameters {
@@ -56,11 +69,64 @@ var _ = Describe("Mongodb", func() {
 		It("uses the previous value when a parameter isn't provided", func() {
 			inputParameters.BastionSecurityGroupId = ""
 			parameters := mongoDBService.BuildUpdateStackParameters(inputParameters)
-			Expect(len(parameters)).To(Equal(15))
+			Expect(len(parameters)).To(Equal(14))
 			Expect(*parameters[0].ParameterKey).To(Equal("BastionSecurityGroupID"))
 			Expect(parameters[0].ParameterValue).To(BeNil())
 			Expect(*parameters[0].UsePreviousValue).To(BeTrue())
 		})
+
+		It("adds the cluster key parameter for sharded clusters", func() {
+			inputParameters.ShardCount = "2"
+			parameters := mongoDBService.BuildUpdateStackParameters(inputParameters)
+			Expect(len(parameters)).To(Equal(15))
+			Expect(*parameters[14].ParameterKey).To(Equal("MongoDBClusterKey"))
+			Expect(parameters[14].ParameterValue).To(BeNil())
+			Expect(*parameters[14].UsePreviousValue).To(BeTrue())
+		})
+
+		It("adds the certificate parameters for TLS, using their previous values when not provided", func() {
+			inputParameters.TLS = true
+			inputParameters.MongoDBCertificateExpiry = "2030-01-01T00:00:00Z"
+			parameters := mongoDBService.BuildUpdateStackParameters(inputParameters)
+			Expect(len(parameters)).To(Equal(17))
+			Expect(*parameters[14].ParameterKey).To(Equal("MongoDBCACertificate"))
+			Expect(*parameters[14].UsePreviousValue).To(BeTrue())
+			Expect(*parameters[15].ParameterKey).To(Equal("MongoDBCAKeyParameter"))
+			Expect(*parameters[15].UsePreviousValue).To(BeTrue())
+			Expect(*parameters[16].ParameterKey).To(Equal("MongoDBCertificateExpiry"))
+			Expect(*parameters[16].ParameterValue).To(Equal("2030-01-01T00:00:00Z"))
+			Expect(*parameters[16].UsePreviousValue).To(BeFalse())
+		})
+
+		It("adds the volume encryption parameters, keeping their previous values", func() {
+			inputParameters.VolumeEncrypted = "true"
+			parameters := mongoDBService.BuildUpdateStackParameters(inputParameters)
+			Expect(len(parameters)).To(Equal(16))
+			Expect(*parameters[14].ParameterKey).To(Equal("VolumeEncrypted"))
+			Expect(*parameters[14].UsePreviousValue).To(BeTrue())
+			Expect(*parameters[15].ParameterKey).To(Equal("VolumeKmsKeyId"))
+			Expect(*parameters[15].UsePreviousValue).To(BeTrue())
+		})
+
+		It("passes the alarm topic and thresholds, leaving unset thresholds to the template", func() {
+			inputParameters.AlarmTopicArn = "arn:aws:sns:eu-west-1:123456789012:alarms"
+			inputParameters.ReplicationLagAlarmThreshold = "30"
+			parameters := mongoDBService.BuildUpdateStackParameters(inputParameters)
+			Expect(len(parameters)).To(Equal(16))
+			Expect(*parameters[14].ParameterKey).To(Equal("AlarmTopicArn"))
+			Expect(*parameters[14].ParameterValue).To(Equal("arn:aws:sns:eu-west-1:123456789012:alarms"))
+			Expect(*parameters[14].UsePreviousValue).To(BeFalse())
+			Expect(*parameters[15].ParameterKey).To(Equal("ReplicationLagAlarmThreshold"))
+			Expect(*parameters[15].ParameterValue).To(Equal("30"))
+		})
+
+		It("uses the previous subnets when none are provided", func() {
+			inputParameters.NodeSubnetIds = nil
+			parameters := mongoDBService.BuildUpdateStackParameters(inputParameters)
+			Expect(*parameters[3].ParameterKey).To(Equal("NodeSubnets"))
+			Expect(parameters[3].ParameterValue).To(BeNil())
+			Expect(*parameters[3].UsePreviousValue).To(BeTrue())
+		})
 	})
 
 	Describe("BuildCreateStackParameters", func() {
@@ -83,63 +149,404 @@ var _ = Describe("Mongodb", func() {
 				Expect(err).To(MatchError("Error building MongoDB parameters: VPC ID is empty"))
 			})
 
-			It("returns an error if primary node subnet ID is empty", func() {
-				inputParameters.PrimaryNodeSubnetId = ""
+			It("returns an error if there are no node subnet IDs", func() {
+				inputParameters.NodeSubnetIds = nil
 				_, err := mongoDBService.BuildCreateStackParameters(inputParameters)
-				Expect(err).To(MatchError("Error building MongoDB parameters: primary node subnet ID is empty"))
+				Expect(err).To(MatchError("Error building MongoDB parameters: node subnet IDs are empty"))
 			})
 
-			It("returns an error if secondary 0 node subnet ID is empty", func() {
-				inputParameters.Secondary0NodeSubnetId = ""
+			It("returns an error if MongoDB admin password is empty", func() {
+				inputParameters.MongoDBAdminPassword = ""
 				_, err := mongoDBService.BuildCreateStackParameters(inputParameters)
-				Expect(err).To(MatchError("Error building MongoDB parameters: secondary 0 node subnet ID is empty"))
+				Expect(err).To(MatchError("Error building MongoDB parameters: MongoDB admin password is empty"))
 			})
+		})
 
-			It("returns an error if secondary 1 node subnet ID is empty", func() {
-				inputParameters.Secondary1NodeSubnetId = ""
+		Describe("Parameters with default values", func() {
+			It("Adds all six optional parameters if non-empty", func() {
+				parameters, err := mongoDBService.BuildCreateStackParameters(inputParameters)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(parameters)).To(Equal(14))
+			})
+		})
+
+		Describe("Node subnets", func() {
+			It("spreads the subnets over every member in turn", func() {
+				parameters, err := mongoDBService.BuildCreateStackParameters(inputParameters)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*parameters[3].ParameterKey).To(Equal("NodeSubnets"))
+				Expect(*parameters[3].ParameterValue).To(Equal(
+					"subnet-a,subnet-b,subnet-c,subnet-a,subnet-b,subnet-c,subnet-a,subnet-b",
+				))
+			})
+		})
+
+		Describe("Sharded clusters", func() {
+			BeforeEach(func() {
+				inputParameters.ShardCount = "2"
+			})
+
+			It("returns an error if the cluster key is empty", func() {
 				_, err := mongoDBService.BuildCreateStackParameters(inputParameters)
-				Expect(err).To(MatchError("Error building MongoDB parameters: secondary 1 node subnet ID is empty"))
+				Expect(err).To(MatchError("Error building MongoDB parameters: MongoDB cluster key is empty"))
 			})
 
-			It("returns an error if MongoDB admin password is empty", func() {
-				inputParameters.MongoDBAdminPassword = ""
+			It("adds the cluster key parameter", func() {
+				inputParameters.MongoDBClusterKey = "cluster-key"
+				parameters, err := mongoDBService.BuildCreateStackParameters(inputParameters)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(parameters)).To(Equal(15))
+				Expect(*parameters[14].ParameterKey).To(Equal("MongoDBClusterKey"))
+				Expect(*parameters[14].ParameterValue).To(Equal("cluster-key"))
+			})
+		})
+
+		Describe("TLS", func() {
+			BeforeEach(func() {
+				inputParameters.TLS = true
+				inputParameters.MongoDBCACertificate = "ca-certificate"
+				inputParameters.MongoDBCAKeyParameter = "/aws-service-broker/mongodbid/mongodb-ca-key"
+				inputParameters.MongoDBCertificateExpiry = "2030-01-01T00:00:00Z"
+			})
+
+			It("returns an error if the certificate authority is empty", func() {
+				inputParameters.MongoDBCAKeyParameter = ""
 				_, err := mongoDBService.BuildCreateStackParameters(inputParameters)
-				Expect(err).To(MatchError("Error building MongoDB parameters: MongoDB admin password is empty"))
+				Expect(err).To(MatchError("Error building MongoDB parameters: MongoDB certificate authority is empty"))
+			})
+
+			It("returns an error if the certificate expiry is empty", func() {
+				inputParameters.MongoDBCertificateExpiry = ""
+				_, err := mongoDBService.BuildCreateStackParameters(inputParameters)
+				Expect(err).To(MatchError("Error building MongoDB parameters: MongoDB certificate expiry is empty"))
+			})
+
+			It("adds the certificate authority and expiry parameters", func() {
+				parameters, err := mongoDBService.BuildCreateStackParameters(inputParameters)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(parameters)).To(Equal(17))
+				Expect(*parameters[14].ParameterKey).To(Equal("MongoDBCACertificate"))
+				Expect(*parameters[14].ParameterValue).To(Equal("ca-certificate"))
+				Expect(*parameters[15].ParameterKey).To(Equal("MongoDBCAKeyParameter"))
+				Expect(*parameters[15].ParameterValue).To(Equal("/aws-service-broker/mongodbid/mongodb-ca-key"))
+				Expect(*parameters[16].ParameterKey).To(Equal("MongoDBCertificateExpiry"))
+				Expect(*parameters[16].ParameterValue).To(Equal("2030-01-01T00:00:00Z"))
 			})
 		})
 
-		Describe("Parameters with default values", func() {
-			It("Adds all six optional parameters if non-empty", func() {
+		Describe("Volume encryption", func() {
+			BeforeEach(func() {
+				inputParameters.VolumeEncrypted = "true"
+			})
+
+			It("adds the volume encryption parameter", func() {
 				parameters, err := mongoDBService.BuildCreateStackParameters(inputParameters)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(len(parameters)).To(Equal(15))
+				Expect(*parameters[14].ParameterKey).To(Equal("VolumeEncrypted"))
+				Expect(*parameters[14].ParameterValue).To(Equal("true"))
+			})
+
+			It("adds the KMS key parameter when a key is given", func() {
+				inputParameters.VolumeKmsKeyId = "arn:aws:kms:eu-west-1:123456789012:key/abc"
+				parameters, err := mongoDBService.BuildCreateStackParameters(inputParameters)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(parameters)).To(Equal(16))
+				Expect(*parameters[15].ParameterKey).To(Equal("VolumeKmsKeyId"))
+				Expect(*parameters[15].ParameterValue).To(Equal("arn:aws:kms:eu-west-1:123456789012:key/abc"))
+			})
+		})
+
+		Describe("Alarms", func() {
+			It("adds the alarm topic and every threshold", func() {
+				inputParameters.AlarmTopicArn = "arn:aws:sns:eu-west-1:123456789012:alarms"
+				inputParameters.CPUUtilizationAlarmThreshold = "90"
+				inputParameters.BurstBalanceAlarmThreshold = "10"
+				inputParameters.DiskSpaceUtilizationAlarmThreshold = "75"
+				inputParameters.ReplicationLagAlarmThreshold = "120"
+				parameters, err := mongoDBService.BuildCreateStackParameters(inputParameters)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(parameters)).To(Equal(19))
+				values := map[string]string{}
+				for _, parameter := range parameters[14:] {
+					values[*parameter.ParameterKey] = *parameter.ParameterValue
+				}
+				Expect(values).To(Equal(map[string]string{
+					"AlarmTopicArn":                      "arn:aws:sns:eu-west-1:123456789012:alarms",
+					"CPUUtilizationAlarmThreshold":       "90",
+					"BurstBalanceAlarmThreshold":         "10",
+					"DiskSpaceUtilizationAlarmThreshold": "75",
+					"ReplicationLagAlarmThreshold":       "120",
+				}))
+			})
+
+			It("adds no alarm parameters without an alarm topic", func() {
+				inputParameters.CPUUtilizationAlarmThreshold = "90"
+				parameters, err := mongoDBService.BuildCreateStackParameters(inputParameters)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(parameters)).To(Equal(14))
 			})
 		})
 	})
 
+	Describe("Certificates", func() {
+		It("generates a certificate authority for each instance", func() {
+			certificateAuthority, err := mongoDBService.GenerateCertificateAuthority("some-unique-id")
+			Expect(err).NotTo(HaveOccurred())
+
+			block, _ := pem.Decode([]byte(certificateAuthority.Certificate))
+			Expect(block).NotTo(BeNil())
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(certificate.IsCA).To(BeTrue())
+			Expect(certificate.Subject.CommonName).To(Equal("MongoDB CA some-unique-id"))
+
+			block, _ = pem.Decode([]byte(certificateAuthority.PrivateKey))
+			Expect(block).NotTo(BeNil())
+			key, err := x509.ParseECPrivateKey(block.Bytes)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(key.PublicKey).To(Equal(*certificate.PublicKey.(*ecdsa.PublicKey)))
+
+			other, err := mongoDBService.GenerateCertificateAuthority("some-unique-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(other.PrivateKey).NotTo(Equal(certificateAuthority.PrivateKey))
+		})
+
+		It("generates a node certificate expiry that can be parsed back", func() {
+			expiry, err := ParseCertificateExpiry(mongoDBService.GenerateCertificateExpiry())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(expiry).To(BeTemporally("~", time.Now().Add(365*24*time.Hour), time.Minute))
+		})
+
+		It("returns an error for a missing expiry", func() {
+			_, err := ParseCertificateExpiry("")
+			Expect(err).To(MatchError("Error parsing certificate expiry: expiry is empty"))
+		})
+
+		Describe("CA key", func() {
+			var fakeSSMAPI *ssmfakes.FakeSSMAPI
+
+			BeforeEach(func() {
+				fakeSSMAPI = &ssmfakes.FakeSSMAPI{}
+				mongoDBService.SSM = fakeSSMAPI
+				inputParameters.TLS = true
+				inputParameters.MongoDBCACertificate = "ca-certificate"
+				inputParameters.MongoDBCAKey = "ca-key"
+				inputParameters.MongoDBCertificateExpiry = "2030-01-01T00:00:00Z"
+				fakeCloudFormationAPI.CreateStackWithContextReturns(&awscf.CreateStackOutput{StackId: aws.String("stack-id")}, nil)
+			})
+
+			It("keeps the CA key in SSM and only passes its name to the stack", func() {
+				_, err := mongoDBService.CreateStack(context.Background(), "id", inputParameters)
+				Expect(err).NotTo(HaveOccurred())
+
+				parameter := fakeSSMAPI.Parameter("/aws-service-broker/mongodbid/mongodb-ca-key")
+				Expect(parameter).NotTo(BeNil())
+				Expect(*parameter.Type).To(Equal("SecureString"))
+				Expect(*parameter.Value).To(Equal("ca-key"))
+
+				_, createStackInput, _ := fakeCloudFormationAPI.CreateStackWithContextArgsForCall(0)
+				for _, p := range createStackInput.Parameters {
+					Expect(*p.ParameterValue).NotTo(Equal("ca-key"))
+				}
+				Expect(createStackInput.Parameters).To(ContainElement(&awscf.Parameter{
+					ParameterKey:     aws.String("MongoDBCAKeyParameter"),
+					ParameterValue:   aws.String("/aws-service-broker/mongodbid/mongodb-ca-key"),
+					UsePreviousValue: aws.Bool(false),
+				}))
+			})
+
+			It("doesn't create the stack if the CA key can't be stored", func() {
+				fakeSSMAPI.PutParameterReturnsError(errors.New("access denied"))
+				_, err := mongoDBService.CreateStack(context.Background(), "id", inputParameters)
+				Expect(err).To(MatchError("access denied"))
+				Expect(fakeCloudFormationAPI.CreateStackWithContextCallCount()).To(Equal(0))
+			})
+
+			It("deletes the CA key if the stack can't be created", func() {
+				fakeCloudFormationAPI.CreateStackWithContextReturns(nil, errors.New("AlreadyExistsException"))
+				_, err := mongoDBService.CreateStack(context.Background(), "id", inputParameters)
+				Expect(err).To(MatchError("AlreadyExistsException"))
+				Expect(fakeSSMAPI.Parameter("/aws-service-broker/mongodbid/mongodb-ca-key")).To(BeNil())
+			})
+
+			It("refuses to create a TLS stack without somewhere to keep the CA key", func() {
+				mongoDBService.SSM = nil
+				_, err := mongoDBService.CreateStack(context.Background(), "id", inputParameters)
+				Expect(err).To(MatchError("Error storing MongoDB CA key: no SSM client"))
+				Expect(fakeCloudFormationAPI.CreateStackWithContextCallCount()).To(Equal(0))
+			})
+
+			It("passes the name of the CA key parameter on update", func() {
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{Stacks: []*awscf.Stack{{}}}, nil)
+				fakeCloudFormationAPI.UpdateStackWithContextReturns(&awscf.UpdateStackOutput{}, nil)
+				_, err := mongoDBService.UpdateStack(context.Background(), "id", InputParameters{TLS: true})
+				Expect(err).NotTo(HaveOccurred())
+				_, updateStackInput, _ := fakeCloudFormationAPI.UpdateStackWithContextArgsForCall(0)
+				Expect(updateStackInput.Parameters).To(ContainElement(&awscf.Parameter{
+					ParameterKey:     aws.String("MongoDBCAKeyParameter"),
+					ParameterValue:   aws.String("/aws-service-broker/mongodbid/mongodb-ca-key"),
+					UsePreviousValue: aws.Bool(false),
+				}))
+			})
+
+			It("deletes the CA key with the stack", func() {
+				_, err := mongoDBService.CreateStack(context.Background(), "id", inputParameters)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mongoDBService.DeleteStack(context.Background(), "id")).To(Succeed())
+				Expect(fakeSSMAPI.Parameter("/aws-service-broker/mongodbid/mongodb-ca-key")).To(BeNil())
+			})
+
+			It("deletes stacks that have no CA key", func() {
+				Expect(mongoDBService.DeleteStack(context.Background(), "id")).To(Succeed())
+				Expect(fakeCloudFormationAPI.DeleteStackWithContextCallCount()).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("BuildTemplateBody", func() {
+		It("uses the replica set template by default", func() {
+			templateBody, err := mongoDBService.BuildTemplateBody(inputParameters)
+			Expect(err).NotTo(HaveOccurred())
+			expectedTemplate, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(templateBody).To(Equal(string(expectedTemplate)))
+		})
+
+		It("builds a sharded cluster template when a shard count is given", func() {
+			inputParameters.ShardCount = "2"
+			inputParameters.MongosCount = "3"
+			templateBody, err := mongoDBService.BuildTemplateBody(inputParameters)
+			Expect(err).NotTo(HaveOccurred())
+			expectedTemplate, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{
+				ShardCount:  2,
+				MongosCount: 3,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(templateBody).To(Equal(string(expectedTemplate)))
+		})
+
+		It("builds a template requiring TLS for TLS instances", func() {
+			inputParameters.TLS = true
+			templateBody, err := mongoDBService.BuildTemplateBody(inputParameters)
+			Expect(err).NotTo(HaveOccurred())
+			expectedTemplate, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{TLS: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(templateBody).To(Equal(string(expectedTemplate)))
+		})
+
+		It("builds a template with encrypted volumes for encrypted instances", func() {
+			inputParameters.VolumeEncrypted = "true"
+			templateBody, err := mongoDBService.BuildTemplateBody(inputParameters)
+			Expect(err).NotTo(HaveOccurred())
+			expectedTemplate, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{EncryptedVolumes: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(templateBody).To(Equal(string(expectedTemplate)))
+		})
+
+		It("builds a template with alarms for instances with an alarm topic", func() {
+			inputParameters.AlarmTopicArn = "arn:aws:sns:eu-west-1:123456789012:alarms"
+			templateBody, err := mongoDBService.BuildTemplateBody(inputParameters)
+			Expect(err).NotTo(HaveOccurred())
+			expectedTemplate, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{Alarms: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(templateBody).To(Equal(string(expectedTemplate)))
+		})
+
+		It("returns an error if the shard count is not a number", func() {
+			inputParameters.ShardCount = "two"
+			_, err := mongoDBService.BuildTemplateBody(inputParameters)
+			Expect(err).To(MatchError("Error building MongoDB template: shard count is not a number"))
+		})
+
+		It("returns an error if the shard count is zero", func() {
+			inputParameters.ShardCount = "0"
+			_, err := mongoDBService.BuildTemplateBody(inputParameters)
+			Expect(err).To(MatchError("Error building sharded MongoDB template: shard count must be at least 1"))
+		})
+
+		It("returns an error if the mongos count is not a number", func() {
+			inputParameters.ShardCount = "2"
+			inputParameters.MongosCount = "three"
+			_, err := mongoDBService.BuildTemplateBody(inputParameters)
+			Expect(err).To(MatchError("Error building MongoDB template: mongos count is not a number"))
+		})
+	})
+
 	Describe("BuildCreateStackInput", func() {
 		It("should build valid input", func() {
 			var parameters []*awscf.Parameter
-			createStackInput := mongoDBService.BuildCreateStackInput("some-unique-id", parameters)
+			createStackInput := mongoDBService.BuildCreateStackInput("some-unique-id", "{}", parameters)
 			err := createStackInput.Validate()
 			Expect(err).NotTo(HaveOccurred())
 		})
 	})
 
+	Describe("UpdateStack", func() {
+		BeforeEach(func() {
+			fakeCloudFormationAPI.UpdateStackWithContextReturns(&awscf.UpdateStackOutput{}, nil)
+		})
+
+		It("keeps the volume encryption of an encrypted stack", func() {
+			fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+				Stacks: []*awscf.Stack{{
+					Parameters: []*awscf.Parameter{
+						{ParameterKey: aws.String("VolumeEncrypted"), ParameterValue: aws.String("true")},
+						{ParameterKey: aws.String("VolumeKmsKeyId"), ParameterValue: aws.String("")},
+					},
+				}},
+			}, nil)
+			_, err := mongoDBService.UpdateStack(context.Background(), "id", InputParameters{})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, updateStackInput, _ := fakeCloudFormationAPI.UpdateStackWithContextArgsForCall(0)
+			Expect(updateStackInput.Parameters).To(ContainElement(&awscf.Parameter{
+				ParameterKey:     aws.String("VolumeEncrypted"),
+				UsePreviousValue: aws.Bool(true),
+			}))
+			expectedTemplate, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{EncryptedVolumes: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*updateStackInput.TemplateBody).To(Equal(string(expectedTemplate)))
+		})
+
+		It("doesn't encrypt the volumes of a stack created without encryption", func() {
+			fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{Stacks: []*awscf.Stack{{}}}, nil)
+			_, err := mongoDBService.UpdateStack(context.Background(), "id", InputParameters{VolumeEncrypted: "true"})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, updateStackInput, _ := fakeCloudFormationAPI.UpdateStackWithContextArgsForCall(0)
+			for _, parameter := range updateStackInput.Parameters {
+				Expect(*parameter.ParameterKey).NotTo(Equal("VolumeEncrypted"))
+				Expect(*parameter.ParameterKey).NotTo(Equal("VolumeKmsKeyId"))
+			}
+			expectedTemplate, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*updateStackInput.TemplateBody).To(Equal(string(expectedTemplate)))
+		})
+	})
+
 	Describe("BuildUpdateStackInput", func() {
 		It("should build valid input", func() {
 			var parameters []*awscf.Parameter
-			updateStackInput := mongoDBService.BuildUpdateStackInput("some-unique-id", parameters)
+			updateStackInput := mongoDBService.BuildUpdateStackInput("some-unique-id", "{}", parameters)
 			err := updateStackInput.Validate()
 			Expect(err).NotTo(HaveOccurred())
 		})
+
+		It("gives each update its own client request token", func() {
+			var parameters []*awscf.Parameter
+			first := mongoDBService.BuildUpdateStackInput("some-unique-id", "{}", parameters)
+			second := mongoDBService.BuildUpdateStackInput("some-unique-id", "{}", parameters)
+			Expect(*first.ClientRequestToken).To(HavePrefix("update-"))
+			Expect(*second.ClientRequestToken).NotTo(Equal(*first.ClientRequestToken))
+		})
 	})
 
 	Describe("Getting stack information", func() {
 		Describe("GetStackState", func() {
 			Context("when stack has been created successfully", func() {
 				It("returns the state with no error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{
 								&awscf.Stack{
@@ -148,7 +555,7 @@ var _ = Describe("Mongodb", func() {
 							},
 						}, nil,
 					)
-					state, reason, err := mongoDBService.GetStackState("irrelevant")
+					state, reason, err := mongoDBService.GetStackState(context.Background(), "irrelevant")
 					Expect(err).NotTo(HaveOccurred())
 					Expect(state).To(Equal(awscf.StackStatusCreateComplete))
 					Expect(reason).To(Equal("no reason returned via the API"))
@@ -157,12 +564,12 @@ var _ = Describe("Mongodb", func() {
 
 			Context("when there is an error getting the stack information", func() {
 				It("returns no state information and an error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{},
 						}, errors.New("Error calling DescribeStacks"),
 					)
-					state, reason, err := mongoDBService.GetStackState("irrelevant")
+					state, reason, err := mongoDBService.GetStackState(context.Background(), "irrelevant")
 					Expect(err).To(MatchError("Error calling DescribeStacks"))
 					Expect(state).To(BeEmpty())
 					Expect(reason).To(BeEmpty())
@@ -171,7 +578,7 @@ var _ = Describe("Mongodb", func() {
 
 			Context("when multiple stacks are returned", func() {
 				It("returns no state information and an error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{
 								&awscf.Stack{
@@ -183,7 +590,7 @@ var _ = Describe("Mongodb", func() {
 							},
 						}, nil,
 					)
-					state, reason, err := mongoDBService.GetStackState("irrelevant")
+					state, reason, err := mongoDBService.GetStackState(context.Background(), "irrelevant")
 					Expect(err).To(MatchError("Error checking stack state: number of stacks was not 1"))
 					Expect(state).To(BeEmpty())
 					Expect(reason).To(BeEmpty())
@@ -192,7 +599,7 @@ var _ = Describe("Mongodb", func() {
 
 			Context("when stack has failed to create", func() {
 				It("returns the state with a reason and no error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{
 								&awscf.Stack{
@@ -202,7 +609,7 @@ var _ = Describe("Mongodb", func() {
 							},
 						}, nil,
 					)
-					state, reason, err := mongoDBService.GetStackState("irrelevant")
+					state, reason, err := mongoDBService.GetStackState(context.Background(), "irrelevant")
 					Expect(err).NotTo(HaveOccurred())
 					Expect(state).To(Equal(awscf.StackStatusCreateFailed))
 					Expect(reason).To(Equal("some reason for failure"))
@@ -210,15 +617,632 @@ var _ = Describe("Mongodb", func() {
 			})
 		})
 
+		Describe("GetStackOutputs", func() {
+			It("returns the outputs of the stack", func() {
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(
+					&awscf.DescribeStacksOutput{
+						Stacks: []*awscf.Stack{
+							&awscf.Stack{
+								Outputs: []*awscf.Output{
+									{OutputKey: aws.String("MongosNodeIps"), OutputValue: aws.String("10.0.0.1,10.0.0.2")},
+								},
+							},
+						},
+					}, nil,
+				)
+				outputs, err := mongoDBService.GetStackOutputs(context.Background(), "some-unique-id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(outputs).To(Equal(map[string]string{"MongosNodeIps": "10.0.0.1,10.0.0.2"}))
+				_, describeStacksInput, _ := fakeCloudFormationAPI.DescribeStacksWithContextArgsForCall(0)
+				Expect(*describeStacksInput.StackName).To(Equal("mongodbsomeuniqueid"))
+			})
+
+			It("returns an error if the stack cannot be described", func() {
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(nil, errors.New("Error calling DescribeStacks"))
+				_, err := mongoDBService.GetStackOutputs(context.Background(), "some-unique-id")
+				Expect(err).To(MatchError("Error calling DescribeStacks"))
+			})
+		})
+
+		Describe("DescribeCluster", func() {
+			It("lists the members of a replica set in order", func() {
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(
+					&awscf.DescribeStacksOutput{
+						Stacks: []*awscf.Stack{
+							&awscf.Stack{
+								Outputs: []*awscf.Output{
+									{OutputKey: aws.String("ArbiterReplicaNodeIp"), OutputValue: aws.String("10.0.0.3")},
+									{OutputKey: aws.String("SecondaryReplicaNode0Ip"), OutputValue: aws.String("10.0.0.2")},
+									{OutputKey: aws.String("PrimaryReplicaNodeIp"), OutputValue: aws.String("10.0.0.1")},
+									{OutputKey: aws.String("MongoDBServerAccessSecurityGroup"), OutputValue: aws.String("sg-1")},
+								},
+							},
+						},
+					}, nil,
+				)
+				cluster, err := mongoDBService.DescribeCluster(context.Background(), "some-unique-id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cluster.Sharded).To(BeFalse())
+				Expect(cluster.Members).To(Equal([]ClusterMember{
+					{Name: "PrimaryReplicaNode", Ip: "10.0.0.1", Role: PrimaryRole},
+					{Name: "SecondaryReplicaNode0", Ip: "10.0.0.2", Role: SecondaryRole},
+					{Name: "ArbiterReplicaNode", Ip: "10.0.0.3", Role: ArbiterRole},
+				}))
+				By("leaving the arbiter out of the members clients connect to")
+				Expect(cluster.DataMembers()).To(HaveLen(2))
+			})
+
+			It("lists the mongos nodes, config servers and shards of a sharded cluster", func() {
+				cluster := ClusterFromOutputs(map[string]string{
+					"MongosNodeIps":        "10.0.0.1,10.0.0.2",
+					"ConfigServerNodeIps":  "10.0.1.1,10.0.1.2,10.0.1.3",
+					"Shard0PrimaryNodeIp":  "10.0.2.1",
+					"Shard1PrimaryNodeIp":  "10.0.3.1",
+					"PrimaryReplicaNodeIp": "ignored",
+				})
+				Expect(cluster.Sharded).To(BeTrue())
+				Expect(cluster.Members).To(HaveLen(7))
+				Expect(cluster.Members[6]).To(Equal(ClusterMember{Name: "Shard1PrimaryNode", Ip: "10.0.3.1", Role: ShardRole}))
+				Expect(cluster.DataMembers()).To(Equal([]ClusterMember{
+					{Name: "MongosNode0", Ip: "10.0.0.1", Role: MongosRole},
+					{Name: "MongosNode1", Ip: "10.0.0.2", Role: MongosRole},
+				}))
+			})
+
+			It("reports the CA certificate and certificate expiry of a TLS cluster", func() {
+				cluster := ClusterFromOutputs(map[string]string{
+					"PrimaryReplicaNodeIp":     "10.0.0.1",
+					"MongoDBCACertificate":     "ca-certificate",
+					"MongoDBCertificateExpiry": "2030-01-01T00:00:00Z",
+				})
+				Expect(cluster.CACertificate).To(Equal("ca-certificate"))
+				Expect(cluster.CertificateExpiry).To(Equal("2030-01-01T00:00:00Z"))
+			})
+		})
+
+		Describe("NestedStackProgress", func() {
+			It("counts the completed nested stacks across pages", func() {
+				fakeCloudFormationAPI.ListStackResourcesWithContextReturnsOnCall(0,
+					&awscf.ListStackResourcesOutput{
+						StackResourceSummaries: []*awscf.StackResourceSummary{
+							{ResourceType: aws.String("AWS::CloudFormation::Stack"), ResourceStatus: aws.String(awscf.ResourceStatusCreateComplete)},
+							{ResourceType: aws.String("AWS::CloudFormation::WaitCondition"), ResourceStatus: aws.String(awscf.ResourceStatusCreateComplete)},
+						},
+						NextToken: aws.String("next"),
+					}, nil,
+				)
+				fakeCloudFormationAPI.ListStackResourcesWithContextReturnsOnCall(1,
+					&awscf.ListStackResourcesOutput{
+						StackResourceSummaries: []*awscf.StackResourceSummary{
+							{ResourceType: aws.String("AWS::CloudFormation::Stack"), ResourceStatus: aws.String(awscf.ResourceStatusCreateInProgress)},
+						},
+					}, nil,
+				)
+				completed, total, err := mongoDBService.NestedStackProgress(context.Background(), "irrelevant")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(Equal(1))
+				Expect(total).To(Equal(2))
+				_, listStackResourcesInput, _ := fakeCloudFormationAPI.ListStackResourcesWithContextArgsForCall(1)
+				Expect(*listStackResourcesInput.NextToken).To(Equal("next"))
+			})
+		})
+
+		Describe("CountStacksByStatus", func() {
+			It("counts the instance stacks by status across pages", func() {
+				fakeCloudFormationAPI.ListStacksWithContextReturnsOnCall(0,
+					&awscf.ListStacksOutput{
+						StackSummaries: []*awscf.StackSummary{
+							{StackName: aws.String("mongodbinstance1"), StackStatus: aws.String(awscf.StackStatusCreateComplete)},
+							{StackName: aws.String("mongodbinstance1-PrimaryReplicaNode0-ABC"), StackStatus: aws.String(awscf.StackStatusCreateComplete), ParentId: aws.String("parent-stack-id")},
+							{StackName: aws.String("someotherstack"), StackStatus: aws.String(awscf.StackStatusCreateComplete)},
+						},
+						NextToken: aws.String("next"),
+					}, nil,
+				)
+				fakeCloudFormationAPI.ListStacksWithContextReturnsOnCall(1,
+					&awscf.ListStacksOutput{
+						StackSummaries: []*awscf.StackSummary{
+							{StackName: aws.String("mongodbinstance2"), StackStatus: aws.String(awscf.StackStatusCreateComplete)},
+							{StackName: aws.String("mongodbinstance3"), StackStatus: aws.String(awscf.StackStatusUpdateInProgress)},
+						},
+					}, nil,
+				)
+				counts, err := mongoDBService.CountStacksByStatus(context.Background())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(counts).To(Equal(map[string]int{
+					awscf.StackStatusCreateComplete:   2,
+					awscf.StackStatusUpdateInProgress: 1,
+				}))
+				_, firstInput, _ := fakeCloudFormationAPI.ListStacksWithContextArgsForCall(0)
+				Expect(aws.StringValueSlice(firstInput.StackStatusFilter)).NotTo(ContainElement(awscf.StackStatusDeleteComplete))
+				Expect(aws.StringValueSlice(firstInput.StackStatusFilter)).To(ContainElement(awscf.StackStatusCreateComplete))
+				_, secondInput, _ := fakeCloudFormationAPI.ListStacksWithContextArgsForCall(1)
+				Expect(*secondInput.NextToken).To(Equal("next"))
+				Expect(secondInput.StackStatusFilter).To(Equal(firstInput.StackStatusFilter))
+			})
+		})
+
+		Describe("DiscoverExporters", func() {
+			It("lists the instances running mongodb_exporter across pages", func() {
+				exporterOutputs := []*awscf.Output{
+					{OutputKey: aws.String("PrimaryReplicaNodeIp"), OutputValue: aws.String("10.0.0.1")},
+					{OutputKey: aws.String("MongoDBExporterPort"), OutputValue: aws.String("9216")},
+				}
+				fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(0,
+					&awscf.DescribeStacksOutput{
+						Stacks: []*awscf.Stack{
+							{
+								StackName:   aws.String("mongodbinstance1"),
+								StackStatus: aws.String(awscf.StackStatusCreateComplete),
+								Outputs:     exporterOutputs,
+								Tags: []*awscf.Tag{
+									{Key: aws.String(InstanceIDTag), Value: aws.String("instance-1")},
+								},
+							},
+							{
+								StackName:   aws.String("mongodbinstance1-PrimaryReplicaNode0-ABC"),
+								StackStatus: aws.String(awscf.StackStatusCreateComplete),
+								Outputs:     exporterOutputs,
+								ParentId:    aws.String("parent-stack-id"),
+							},
+							{
+								StackName:   aws.String("mongodbinstance2"),
+								StackStatus: aws.String(awscf.StackStatusCreateComplete),
+								Outputs:     exporterOutputs[:1],
+							},
+						},
+						NextToken: aws.String("next"),
+					}, nil,
+				)
+				fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(1,
+					&awscf.DescribeStacksOutput{
+						Stacks: []*awscf.Stack{
+							{
+								StackName:   aws.String("mongodbinstance3"),
+								StackStatus: aws.String(awscf.StackStatusUpdateComplete),
+								Outputs:     exporterOutputs,
+							},
+							{
+								StackName:   aws.String("mongodbinstance4"),
+								StackStatus: aws.String(awscf.StackStatusDeleteInProgress),
+								Outputs:     exporterOutputs,
+							},
+						},
+					}, nil,
+				)
+				instances, err := mongoDBService.DiscoverExporters(context.Background())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(instances).To(HaveLen(2))
+				Expect(instances[0].ID).To(Equal("instance-1"))
+				Expect(instances[0].ExporterPort).To(Equal("9216"))
+				Expect(instances[0].Cluster.Members).To(Equal([]ClusterMember{
+					{Name: "PrimaryReplicaNode", Ip: "10.0.0.1", Role: PrimaryRole},
+				}))
+				Expect(instances[1].ID).To(Equal("mongodbinstance3"))
+				ctx, input, _ := fakeCloudFormationAPI.DescribeStacksWithContextArgsForCall(1)
+				Expect(ctx).To(Equal(context.Background()))
+				Expect(*input.NextToken).To(Equal("next"))
+			})
+		})
+
+		Describe("StackStatuses", func() {
+			var (
+				inProgress *awscf.DescribeStacksOutput
+				listed     *awscf.ListStacksOutput
+			)
+
+			BeforeEach(func() {
+				mongoDBService.StackStatuses = NewStackStatuses(time.Minute)
+				inProgress = &awscf.DescribeStacksOutput{
+					Stacks: []*awscf.Stack{{StackStatus: aws.String(awscf.StackStatusCreateInProgress)}},
+				}
+				listed = &awscf.ListStacksOutput{
+					StackSummaries: []*awscf.StackSummary{
+						{
+							StackName:    aws.String("mongodbid"),
+							StackId:      aws.String("stack-id"),
+							StackStatus:  aws.String(awscf.StackStatusCreateInProgress),
+							CreationTime: aws.Time(time.Now().Add(-time.Hour)),
+						},
+						{StackName: aws.String("mongodbid-PrimaryReplicaNode0-ABC"), StackStatus: aws.String(awscf.StackStatusCreateComplete), ParentId: aws.String("stack-id")},
+						{StackName: aws.String("mongodbid-SecondaryReplicaNode0-DEF"), StackStatus: aws.String(awscf.StackStatusCreateInProgress), ParentId: aws.String("stack-id")},
+					},
+				}
+			})
+
+			It("answers polls from the last refresh", func() {
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(inProgress, nil)
+				completed, err := mongoDBService.CreateStackCompleted(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(BeFalse())
+				Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(1))
+
+				fakeCloudFormationAPI.ListStacksWithContextReturns(listed, nil)
+				Expect(mongoDBService.RefreshStackStatuses(context.Background())).To(Succeed())
+
+				completed, err = mongoDBService.CreateStackCompleted(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(BeFalse())
+				completedNodes, totalNodes, err := mongoDBService.NestedStackProgress(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completedNodes).To(Equal(1))
+				Expect(totalNodes).To(Equal(2))
+				Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(1))
+				Expect(fakeCloudFormationAPI.ListStackResourcesWithContextCallCount()).To(Equal(0))
+				_, listStacksInput, _ := fakeCloudFormationAPI.ListStacksWithContextArgsForCall(0)
+				Expect(aws.StringValueSlice(listStacksInput.StackStatusFilter)).NotTo(ContainElement(awscf.StackStatusDeleteComplete))
+				Expect(aws.StringValueSlice(listStacksInput.StackStatusFilter)).To(ContainElement(awscf.StackStatusDeleteInProgress))
+
+				listed.StackSummaries[0].StackStatus = aws.String(awscf.StackStatusRollbackComplete)
+				listed.StackSummaries[0].StackStatusReason = aws.String("The following resource(s) failed to create")
+				Expect(mongoDBService.RefreshStackStatuses(context.Background())).To(Succeed())
+
+				completed, err = mongoDBService.CreateStackCompleted(context.Background(), "id")
+				Expect(completed).To(BeTrue())
+				Expect(err).To(MatchError("Final state of stack was not CREATE_COMPLETE. Got: ROLLBACK_COMPLETE. Reason: The following resource(s) failed to create"))
+				Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(1))
+			})
+
+			It("forgets the status of a stack the broker changes", func() {
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(inProgress, nil)
+				mongoDBService.CreateStackCompleted(context.Background(), "id")
+				listed.StackSummaries[0].StackStatus = aws.String(awscf.StackStatusCreateComplete)
+				fakeCloudFormationAPI.ListStacksWithContextReturns(listed, nil)
+				Expect(mongoDBService.RefreshStackStatuses(context.Background())).To(Succeed())
+
+				Expect(mongoDBService.DeleteStack(context.Background(), "id")).To(Succeed())
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+					Stacks: []*awscf.Stack{{StackStatus: aws.String(awscf.StackStatusDeleteInProgress)}},
+				}, nil)
+				completed, err := mongoDBService.DeleteStackCompleted(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(BeFalse())
+				Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(2))
+			})
+
+			It("takes a stack being deleted that is no longer listed as deleted", func() {
+				Expect(mongoDBService.DeleteStack(context.Background(), "id")).To(Succeed())
+				fakeCloudFormationAPI.ListStacksWithContextReturns(&awscf.ListStacksOutput{}, nil)
+				Expect(mongoDBService.RefreshStackStatuses(context.Background())).To(Succeed())
+
+				completed, err := mongoDBService.DeleteStackCompleted(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(BeTrue())
+				Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(0))
+			})
+
+			It("keeps watching a stack the broker just created until it is listed", func() {
+				fakeCloudFormationAPI.CreateStackWithContextReturns(&awscf.CreateStackOutput{StackId: aws.String("stack-id")}, nil)
+				_, err := mongoDBService.CreateStack(context.Background(), "id", inputParameters)
+				Expect(err).NotTo(HaveOccurred())
+				fakeCloudFormationAPI.ListStacksWithContextReturns(&awscf.ListStacksOutput{}, nil)
+				Expect(mongoDBService.RefreshStackStatuses(context.Background())).To(Succeed())
+
+				fakeCloudFormationAPI.ListStacksWithContextReturns(listed, nil)
+				Expect(mongoDBService.RefreshStackStatuses(context.Background())).To(Succeed())
+				completed, err := mongoDBService.CreateStackCompleted(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(BeFalse())
+				Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(0))
+			})
+
+			It("asks CloudFormation about other stacks that aren't listed", func() {
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(inProgress, nil)
+				mongoDBService.CreateStackCompleted(context.Background(), "id")
+				fakeCloudFormationAPI.ListStacksWithContextReturns(&awscf.ListStacksOutput{}, nil)
+				Expect(mongoDBService.RefreshStackStatuses(context.Background())).To(Succeed())
+
+				mongoDBService.CreateStackCompleted(context.Background(), "id")
+				Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(2))
+			})
+
+			It("asks CloudFormation once statuses are too old", func() {
+				mongoDBService.StackStatuses = NewStackStatuses(time.Millisecond)
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(inProgress, nil)
+				mongoDBService.CreateStackCompleted(context.Background(), "id")
+				fakeCloudFormationAPI.ListStacksWithContextReturns(listed, nil)
+				Expect(mongoDBService.RefreshStackStatuses(context.Background())).To(Succeed())
+				time.Sleep(5 * time.Millisecond)
+
+				mongoDBService.CreateStackCompleted(context.Background(), "id")
+				Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(2))
+			})
+
+			It("only lists stacks while some are watched", func() {
+				fakeCloudFormationAPI.ListStacksWithContextReturns(listed, nil)
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go mongoDBService.WatchStackStatuses(ctx, time.Millisecond, nil, lagertest.NewTestLogger("stack-statuses"))
+				Consistently(fakeCloudFormationAPI.ListStacksWithContextCallCount, 20*time.Millisecond).Should(Equal(0))
+
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(inProgress, nil)
+				mongoDBService.CreateStackCompleted(context.Background(), "id")
+				Eventually(fakeCloudFormationAPI.ListStacksWithContextCallCount).ShouldNot(Equal(0))
+			})
+		})
+
+		Describe("Stack events", func() {
+			stackEvent := func(logicalResourceId, resourceType, status string, at time.Time) string {
+				return "StackId='arn:aws:cloudformation:eu-west-1:123456789012:stack/mongodbid/stack-id'\n" +
+					"Timestamp='" + at.UTC().Format(time.RFC3339Nano) + "'\n" +
+					"EventId='event-id'\n" +
+					"LogicalResourceId='" + logicalResourceId + "'\n" +
+					"Namespace='123456789012'\n" +
+					"ResourceProperties='{\"TimeoutInMinutes\":\"15\"}'\n" +
+					"ResourceStatus='" + status + "'\n" +
+					"ResourceStatusReason=''\n" +
+					"ResourceType='" + resourceType + "'\n" +
+					"StackName='mongodbid'\n" +
+					"ClientRequestToken='create-1-mongodbid'\n"
+			}
+			notification := func(message string) string {
+				body, err := json.Marshal(map[string]string{"Type": "Notification", "Message": message})
+				Expect(err).NotTo(HaveOccurred())
+				return string(body)
+			}
+
+			BeforeEach(func() {
+				mongoDBService.StackStatuses = NewStackStatuses(time.Minute)
+			})
+
+			It("parses stack events from SNS notifications and raw messages", func() {
+				at := time.Date(2018, 1, 2, 3, 4, 5, 6000000, time.UTC)
+				expected := StackEvent{
+					StackId:            "arn:aws:cloudformation:eu-west-1:123456789012:stack/mongodbid/stack-id",
+					StackName:          "mongodbid",
+					LogicalResourceId:  "mongodbid",
+					ResourceType:       "AWS::CloudFormation::Stack",
+					ResourceStatus:     "CREATE_COMPLETE",
+					ClientRequestToken: "create-1-mongodbid",
+					Timestamp:          at,
+				}
+				event, err := ParseStackEvent(notification(stackEvent("mongodbid", "AWS::CloudFormation::Stack", "CREATE_COMPLETE", at)))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(event).To(Equal(expected))
+				Expect(event.IsStackStatus()).To(BeTrue())
+
+				event, err = ParseStackEvent(stackEvent("mongodbid", "AWS::CloudFormation::Stack", "CREATE_COMPLETE", at))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(event).To(Equal(expected))
+
+				_, err = ParseStackEvent(notification("hello"))
+				Expect(err).To(MatchError("message is not a CloudFormation stack event"))
+			})
+
+			It("answers polls from stack events", func() {
+				Expect(mongoDBService.DeleteStack(context.Background(), "id")).To(Succeed())
+				_, deleteStackInput, _ := fakeCloudFormationAPI.DeleteStackWithContextArgsForCall(0)
+				mongoDBService.HandleStackEvent(StackEvent{
+					StackName:          "mongodbid",
+					LogicalResourceId:  "mongodbid",
+					ResourceType:       "AWS::CloudFormation::Stack",
+					ResourceStatus:     awscf.StackStatusDeleteComplete,
+					ClientRequestToken: *deleteStackInput.ClientRequestToken,
+					Timestamp:          time.Now().Add(time.Second),
+				})
+
+				completed, err := mongoDBService.DeleteStackCompleted(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(BeTrue())
+				Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(0))
+			})
+
+			It("tells events of the broker's last change from earlier ones by CloudFormation's times", func() {
+				// CloudFormation's clock is an hour behind the broker's.
+				started := time.Now().Add(-time.Hour)
+				Expect(mongoDBService.DeleteStack(context.Background(), "id")).To(Succeed())
+				_, deleteStackInput, _ := fakeCloudFormationAPI.DeleteStackWithContextArgsForCall(0)
+				mongoDBService.HandleStackEvent(StackEvent{StackName: "mongodbid", LogicalResourceId: "mongodbid", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.StackStatusUpdateComplete, ClientRequestToken: "update-1-mongodbid", Timestamp: started.Add(-time.Minute)})
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+					Stacks: []*awscf.Stack{{StackStatus: aws.String(awscf.StackStatusDeleteInProgress)}},
+				}, nil)
+				completed, err := mongoDBService.DeleteStackCompleted(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(BeFalse())
+				Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(1))
+
+				mongoDBService.HandleStackEvent(StackEvent{StackName: "mongodbid", LogicalResourceId: "mongodbid", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.StackStatusDeleteInProgress, ClientRequestToken: *deleteStackInput.ClientRequestToken, Timestamp: started})
+				mongoDBService.HandleStackEvent(StackEvent{StackName: "mongodbid", LogicalResourceId: "mongodbid", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.StackStatusDeleteComplete, Timestamp: started.Add(time.Minute)})
+				completed, err = mongoDBService.DeleteStackCompleted(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(BeTrue())
+				Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(1))
+			})
+
+			It("learns when CloudFormation started the broker's last change from the stack", func() {
+				started := time.Now().Add(-time.Hour)
+				Expect(mongoDBService.DeleteStack(context.Background(), "id")).To(Succeed())
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+					Stacks: []*awscf.Stack{{
+						StackStatus:     aws.String(awscf.StackStatusDeleteInProgress),
+						CreationTime:    aws.Time(started.Add(-48 * time.Hour)),
+						LastUpdatedTime: aws.Time(started.Add(-24 * time.Hour)),
+						DeletionTime:    aws.Time(started),
+					}},
+				}, nil)
+				mongoDBService.DeleteStackCompleted(context.Background(), "id")
+
+				mongoDBService.HandleStackEvent(StackEvent{StackName: "mongodbid", LogicalResourceId: "mongodbid", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.StackStatusUpdateComplete, Timestamp: started.Add(-time.Minute)})
+				completed, err := mongoDBService.DeleteStackCompleted(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(BeFalse())
+
+				mongoDBService.HandleStackEvent(StackEvent{StackName: "mongodbid", LogicalResourceId: "mongodbid", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.StackStatusDeleteComplete, Timestamp: started.Add(time.Minute)})
+				completed, err = mongoDBService.DeleteStackCompleted(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(BeTrue())
+				Expect(fakeCloudFormationAPI.DescribeStacksWithContextCallCount()).To(Equal(1))
+			})
+
+			It("counts ready nested node stacks from their events", func() {
+				at := time.Now().Add(time.Second)
+				for _, event := range []StackEvent{
+					{LogicalResourceId: "mongodbid", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.StackStatusCreateInProgress},
+					{LogicalResourceId: "PrimaryReplicaNode0", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.ResourceStatusCreateInProgress},
+					{LogicalResourceId: "PrimaryReplicaNode0", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.ResourceStatusCreateComplete},
+					{LogicalResourceId: "SecondaryReplicaNode0", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.ResourceStatusCreateInProgress},
+					{LogicalResourceId: "MongoDBServerSecurityGroup", ResourceType: "AWS::EC2::SecurityGroup", ResourceStatus: awscf.ResourceStatusCreateComplete},
+				} {
+					event.StackName = "mongodbid"
+					event.Timestamp = at
+					mongoDBService.HandleStackEvent(event)
+				}
+
+				completed, total, err := mongoDBService.NestedStackProgress(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(Equal(1))
+				Expect(total).To(Equal(2))
+				Expect(fakeCloudFormationAPI.ListStackResourcesWithContextCallCount()).To(Equal(0))
+			})
+
+			It("ignores events older than the last one recorded", func() {
+				at := time.Now().Add(time.Second)
+				mongoDBService.HandleStackEvent(StackEvent{StackName: "mongodbid", LogicalResourceId: "mongodbid", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.StackStatusCreateComplete, Timestamp: at})
+				mongoDBService.HandleStackEvent(StackEvent{StackName: "mongodbid", LogicalResourceId: "mongodbid", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.StackStatusCreateInProgress, Timestamp: at.Add(-time.Millisecond)})
+
+				completed, err := mongoDBService.CreateStackCompleted(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(BeTrue())
+			})
+
+			It("passes changes of instance stack statuses to the handlers", func() {
+				var handled []string
+				mongoDBService.StackEventHandlers = []func(StackEvent){func(event StackEvent) {
+					handled = append(handled, event.StackName+" "+event.ResourceStatus)
+				}}
+				at := time.Now().Add(time.Second)
+				mongoDBService.HandleStackEvent(StackEvent{StackName: "mongodbid", LogicalResourceId: "PrimaryReplicaNode0", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.ResourceStatusCreateComplete, Timestamp: at})
+				mongoDBService.HandleStackEvent(StackEvent{StackName: "mongodbid-PrimaryReplicaNode0-ABC", LogicalResourceId: "mongodbid-PrimaryReplicaNode0-ABC", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.StackStatusCreateComplete, Timestamp: at})
+				mongoDBService.HandleStackEvent(StackEvent{StackName: "someotherstack", LogicalResourceId: "someotherstack", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.StackStatusCreateComplete, Timestamp: at})
+				mongoDBService.HandleStackEvent(StackEvent{StackName: "mongodbid", LogicalResourceId: "mongodbid", ResourceType: "AWS::CloudFormation::Stack", ResourceStatus: awscf.StackStatusCreateComplete, Timestamp: at})
+
+				Expect(handled).To(Equal([]string{"mongodbid CREATE_COMPLETE"}))
+			})
+
+			It("consumes stack events from the queue, deleting every message", func() {
+				fakeSQSAPI := &sqsfakes.FakeSQSAPI{}
+				created := stackEvent("mongodbid", "AWS::CloudFormation::Stack", awscf.StackStatusCreateComplete, time.Now().Add(time.Second))
+				fakeSQSAPI.Send(notification(created), "not an event")
+				logger := lagertest.NewTestLogger("stack-events")
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go mongoDBService.ConsumeStackEvents(ctx, fakeSQSAPI, "https://sqs.eu-west-1.amazonaws.com/123456789012/stack-events", nil, logger)
+
+				Eventually(fakeSQSAPI.Deleted).Should(HaveLen(2))
+				Expect(*fakeSQSAPI.ReceiveMessageArgsForCall(0).QueueUrl).To(Equal("https://sqs.eu-west-1.amazonaws.com/123456789012/stack-events"))
+				completed, err := mongoDBService.CreateStackCompleted(context.Background(), "id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(BeTrue())
+				Expect(logger.LogMessages()).To(ContainElement("stack-events.parse-stack-event"))
+			})
+
+			It("has stacks notify the configured topics", func() {
+				mongoDBService.NotificationARNs = []string{"arn:aws:sns:eu-west-1:123456789012:stack-events"}
+				fakeCloudFormationAPI.CreateStackWithContextReturns(&awscf.CreateStackOutput{StackId: aws.String("stack-id")}, nil)
+				_, err := mongoDBService.CreateStack(context.Background(), "id", inputParameters)
+				Expect(err).NotTo(HaveOccurred())
+				_, createStackInput, _ := fakeCloudFormationAPI.CreateStackWithContextArgsForCall(0)
+				Expect(createStackInput.NotificationARNs).To(Equal(aws.StringSlice([]string{"arn:aws:sns:eu-west-1:123456789012:stack-events"})))
+			})
+		})
+
+		Describe("DescribeAlarms", func() {
+			It("reports the state of the alarms in the stack", func() {
+				updatedAt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+				fakeCloudFormationAPI.ListStackResourcesWithContextReturns(
+					&awscf.ListStackResourcesOutput{
+						StackResourceSummaries: []*awscf.StackResourceSummary{
+							{
+								ResourceType:       aws.String("AWS::CloudFormation::Stack"),
+								LogicalResourceId:  aws.String("PrimaryReplicaNode0"),
+								PhysicalResourceId: aws.String("node-stack-id"),
+							},
+							{
+								ResourceType:       aws.String("AWS::CloudWatch::Alarm"),
+								LogicalResourceId:  aws.String("PrimaryReplicaNode0CPUUtilizationAlarm"),
+								PhysicalResourceId: aws.String("cpu-alarm"),
+							},
+							{
+								ResourceType:       aws.String("AWS::CloudWatch::Alarm"),
+								LogicalResourceId:  aws.String("PrimaryReplicaNode0ReplicationLagAlarm"),
+								PhysicalResourceId: aws.String("lag-alarm"),
+							},
+						},
+					}, nil,
+				)
+				fakeCloudWatchAPI.DescribeAlarmsPagesWithContextReturns(nil, &awscw.DescribeAlarmsOutput{
+					MetricAlarms: []*awscw.MetricAlarm{
+						{
+							AlarmName:             aws.String("lag-alarm"),
+							StateValue:            aws.String(awscw.StateValueOk),
+							StateReason:           aws.String("Threshold Crossed"),
+							StateUpdatedTimestamp: aws.Time(updatedAt),
+						},
+						{
+							AlarmName:             aws.String("cpu-alarm"),
+							StateValue:            aws.String(awscw.StateValueAlarm),
+							StateReason:           aws.String("Threshold Crossed"),
+							StateUpdatedTimestamp: aws.Time(updatedAt),
+						},
+					},
+				})
+
+				alarms, err := mongoDBService.DescribeAlarms(context.Background(), "instance-id")
+				Expect(err).NotTo(HaveOccurred())
+				_, listStackResourcesInput, _ := fakeCloudFormationAPI.ListStackResourcesWithContextArgsForCall(0)
+				Expect(*listStackResourcesInput.StackName).To(Equal("mongodbinstanceid"))
+				Expect(fakeCloudWatchAPI.DescribeAlarmsPagesWithContextArgsForCall(0).AlarmNames).To(Equal([]*string{aws.String("cpu-alarm"), aws.String("lag-alarm")}))
+				Expect(alarms).To(Equal([]Alarm{
+					{
+						Name:      "PrimaryReplicaNode0CPUUtilizationAlarm",
+						AlarmName: "cpu-alarm",
+						State:     awscw.StateValueAlarm,
+						Reason:    "Threshold Crossed",
+						UpdatedAt: updatedAt,
+					},
+					{
+						Name:      "PrimaryReplicaNode0ReplicationLagAlarm",
+						AlarmName: "lag-alarm",
+						State:     awscw.StateValueOk,
+						Reason:    "Threshold Crossed",
+						UpdatedAt: updatedAt,
+					},
+				}))
+			})
+
+			It("doesn't call CloudWatch when the stack has no alarms", func() {
+				fakeCloudFormationAPI.ListStackResourcesWithContextReturns(&awscf.ListStackResourcesOutput{}, nil)
+				alarms, err := mongoDBService.DescribeAlarms(context.Background(), "instance-id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(alarms).To(BeEmpty())
+				Expect(fakeCloudWatchAPI.DescribeAlarmsPagesWithContextCallCount()).To(Equal(0))
+			})
+
+			It("returns an error if the alarms can't be described", func() {
+				fakeCloudFormationAPI.ListStackResourcesWithContextReturns(
+					&awscf.ListStackResourcesOutput{
+						StackResourceSummaries: []*awscf.StackResourceSummary{{
+							ResourceType:       aws.String("AWS::CloudWatch::Alarm"),
+							LogicalResourceId:  aws.String("PrimaryReplicaNode0CPUUtilizationAlarm"),
+							PhysicalResourceId: aws.String("cpu-alarm"),
+						}},
+					}, nil,
+				)
+				fakeCloudWatchAPI.DescribeAlarmsPagesWithContextReturns(errors.New("throttled"))
+				_, err := mongoDBService.DescribeAlarms(context.Background(), "instance-id")
+				Expect(err).To(MatchError("throttled"))
+			})
+		})
+
 		Describe("CreateStackCompleted", func() {
 			Context("when failing to get stack information", func() {
 				It("returns false with an error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{},
 						}, errors.New("Error calling DescribeStacks"),
 					)
-					completed, err := mongoDBService.CreateStackCompleted("irrelevant")
+					completed, err := mongoDBService.CreateStackCompleted(context.Background(), "irrelevant")
 					Expect(err).To(MatchError("Error calling DescribeStacks"))
 					Expect(completed).To(BeFalse())
 				})
@@ -226,7 +1250,7 @@ var _ = Describe("Mongodb", func() {
 
 			Context("when stack has been created successfully", func() {
 				It("returns true with no error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{
 								&awscf.Stack{
@@ -235,7 +1259,7 @@ var _ = Describe("Mongodb", func() {
 							},
 						}, nil,
 					)
-					completed, err := mongoDBService.CreateStackCompleted("irrelevant")
+					completed, err := mongoDBService.CreateStackCompleted(context.Background(), "irrelevant")
 					Expect(err).NotTo(HaveOccurred())
 					Expect(completed).To(BeTrue())
 				})
@@ -243,7 +1267,7 @@ var _ = Describe("Mongodb", func() {
 
 			Context("when stack creation fails", func() {
 				It("returns false and an error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{
 								&awscf.Stack{
@@ -253,7 +1277,7 @@ var _ = Describe("Mongodb", func() {
 							},
 						}, nil,
 					)
-					completed, err := mongoDBService.CreateStackCompleted("irrelevant")
+					completed, err := mongoDBService.CreateStackCompleted(context.Background(), "irrelevant")
 					Expect(err).To(MatchError("Final state of stack was not CREATE_COMPLETE. Got: CREATE_FAILED. Reason: something went wrong"))
 					Expect(completed).To(BeTrue())
 				})
@@ -261,7 +1285,7 @@ var _ = Describe("Mongodb", func() {
 
 			Context("when stack creation is still in progress", func() {
 				It("returns false and no error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{
 								&awscf.Stack{
@@ -270,7 +1294,7 @@ var _ = Describe("Mongodb", func() {
 							},
 						}, nil,
 					)
-					completed, err := mongoDBService.CreateStackCompleted("irrelevant")
+					completed, err := mongoDBService.CreateStackCompleted(context.Background(), "irrelevant")
 					Expect(err).NotTo(HaveOccurred())
 					Expect(completed).To(BeFalse())
 				})
@@ -281,12 +1305,12 @@ var _ = Describe("Mongodb", func() {
 			Context("when failing to get stack information", func() {
 				Context("if it is due to the stack not existing", func() {
 					It("assumes the deletion is complete", func() {
-						fakeCloudFormationAPI.DescribeStacksReturns(
+						fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 							&awscf.DescribeStacksOutput{
 								Stacks: []*awscf.Stack{},
 							}, errors.New("ValidationError: Stack with id "+mongoDBService.GenerateStackName("irrelevant")+" does not exist"),
 						)
-						completed, err := mongoDBService.DeleteStackCompleted("irrelevant")
+						completed, err := mongoDBService.DeleteStackCompleted(context.Background(), "irrelevant")
 						Expect(err).NotTo(HaveOccurred())
 						Expect(completed).To(BeTrue())
 					})
@@ -294,12 +1318,12 @@ var _ = Describe("Mongodb", func() {
 
 				Context("if it is due to some other error", func() {
 					It("doesn't consider it complete and returns the error", func() {
-						fakeCloudFormationAPI.DescribeStacksReturns(
+						fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 							&awscf.DescribeStacksOutput{
 								Stacks: []*awscf.Stack{},
 							}, errors.New("Error calling DescribeStacks"),
 						)
-						completed, err := mongoDBService.DeleteStackCompleted("irrelevant")
+						completed, err := mongoDBService.DeleteStackCompleted(context.Background(), "irrelevant")
 						Expect(err).To(MatchError("Error calling DescribeStacks"))
 						Expect(completed).To(BeFalse())
 					})
@@ -308,7 +1332,7 @@ var _ = Describe("Mongodb", func() {
 
 			Context("when stack has been deleted successfully", func() {
 				It("returns true with no error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{
 								&awscf.Stack{
@@ -317,7 +1341,7 @@ var _ = Describe("Mongodb", func() {
 							},
 						}, nil,
 					)
-					completed, err := mongoDBService.DeleteStackCompleted("irrelevant")
+					completed, err := mongoDBService.DeleteStackCompleted(context.Background(), "irrelevant")
 					Expect(err).NotTo(HaveOccurred())
 					Expect(completed).To(BeTrue())
 				})
@@ -325,7 +1349,7 @@ var _ = Describe("Mongodb", func() {
 
 			Context("when stack deletion fails", func() {
 				It("returns false and an error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{
 								&awscf.Stack{
@@ -335,7 +1359,7 @@ var _ = Describe("Mongodb", func() {
 							},
 						}, nil,
 					)
-					completed, err := mongoDBService.DeleteStackCompleted("irrelevant")
+					completed, err := mongoDBService.DeleteStackCompleted(context.Background(), "irrelevant")
 					Expect(err).To(MatchError("Final state of stack was not DELETE_COMPLETE. Got: DELETE_FAILED. Reason: something went wrong"))
 					Expect(completed).To(BeTrue())
 				})
@@ -343,7 +1367,7 @@ var _ = Describe("Mongodb", func() {
 
 			Context("when stack deletion is still in progress", func() {
 				It("returns false and no error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{
 								&awscf.Stack{
@@ -352,7 +1376,7 @@ var _ = Describe("Mongodb", func() {
 							},
 						}, nil,
 					)
-					completed, err := mongoDBService.DeleteStackCompleted("irrelevant")
+					completed, err := mongoDBService.DeleteStackCompleted(context.Background(), "irrelevant")
 					Expect(err).NotTo(HaveOccurred())
 					Expect(completed).To(BeFalse())
 				})
@@ -362,12 +1386,12 @@ var _ = Describe("Mongodb", func() {
 		Describe("UpdateStackCompleted", func() {
 			Context("when failing to get stack information", func() {
 				It("returns false with an error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{},
 						}, errors.New("Error calling DescribeStacks"),
 					)
-					completed, err := mongoDBService.UpdateStackCompleted("irrelevant")
+					completed, err := mongoDBService.UpdateStackCompleted(context.Background(), "irrelevant")
 					Expect(err).To(MatchError("Error calling DescribeStacks"))
 					Expect(completed).To(BeFalse())
 				})
@@ -375,7 +1399,7 @@ var _ = Describe("Mongodb", func() {
 
 			Context("when stack has been updated successfully", func() {
 				It("returns true with no error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{
 								&awscf.Stack{
@@ -384,7 +1408,7 @@ var _ = Describe("Mongodb", func() {
 							},
 						}, nil,
 					)
-					completed, err := mongoDBService.UpdateStackCompleted("irrelevant")
+					completed, err := mongoDBService.UpdateStackCompleted(context.Background(), "irrelevant")
 					Expect(err).NotTo(HaveOccurred())
 					Expect(completed).To(BeTrue())
 				})
@@ -392,7 +1416,7 @@ var _ = Describe("Mongodb", func() {
 
 			Context("when update stack fails", func() {
 				It("returns false and an error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{
 								&awscf.Stack{
@@ -402,7 +1426,7 @@ var _ = Describe("Mongodb", func() {
 							},
 						}, nil,
 					)
-					completed, err := mongoDBService.UpdateStackCompleted("irrelevant")
+					completed, err := mongoDBService.UpdateStackCompleted(context.Background(), "irrelevant")
 					Expect(err).To(MatchError("Final state of stack was not UPDATE_COMPLETE. Got: UPDATE_ROLLBACK_COMPLETE. Reason: something went wrong"))
 					Expect(completed).To(BeTrue())
 				})
@@ -410,7 +1434,7 @@ var _ = Describe("Mongodb", func() {
 
 			Context("when update stack is still in progress", func() {
 				It("returns false and no error", func() {
-					fakeCloudFormationAPI.DescribeStacksReturns(
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(
 						&awscf.DescribeStacksOutput{
 							Stacks: []*awscf.Stack{
 								&awscf.Stack{
@@ -419,11 +1443,221 @@ var _ = Describe("Mongodb", func() {
 							},
 						}, nil,
 					)
-					completed, err := mongoDBService.UpdateStackCompleted("irrelevant")
+					completed, err := mongoDBService.UpdateStackCompleted(context.Background(), "irrelevant")
 					Expect(err).NotTo(HaveOccurred())
 					Expect(completed).To(BeFalse())
 				})
 			})
 		})
+
+		Describe("Instances", func() {
+			It("lists the stacks of instances, leaving out nested stacks", func() {
+				created := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+				fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(0, &awscf.DescribeStacksOutput{
+					Stacks: []*awscf.Stack{
+						{
+							StackName:    aws.String("mongodbabc"),
+							StackId:      aws.String("stack-abc"),
+							StackStatus:  aws.String(awscf.StackStatusCreateComplete),
+							CreationTime: aws.Time(created),
+							Tags:         []*awscf.Tag{{Key: aws.String(InstanceIDTag), Value: aws.String("a-b-c")}},
+						},
+						{
+							StackName: aws.String("mongodbabc-Node0"),
+							ParentId:  aws.String("stack-abc"),
+						},
+						{
+							StackName: aws.String("other"),
+						},
+					},
+					NextToken: aws.String("next"),
+				}, nil)
+				fakeCloudFormationAPI.DescribeStacksWithContextReturnsOnCall(1, &awscf.DescribeStacksOutput{
+					Stacks: []*awscf.Stack{
+						{
+							StackName:         aws.String("mongodbdef"),
+							StackStatus:       aws.String(awscf.StackStatusDeleteFailed),
+							StackStatusReason: aws.String("security group in use"),
+						},
+					},
+				}, nil)
+
+				instances, err := mongoDBService.ListInstanceStacks(context.Background())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(instances).To(HaveLen(2))
+				Expect(instances[0].ID).To(Equal("a-b-c"))
+				Expect(instances[0].StackId).To(Equal("stack-abc"))
+				Expect(instances[0].Status).To(Equal(awscf.StackStatusCreateComplete))
+				Expect(instances[0].CreationTime).To(Equal(created))
+				Expect(instances[1].ID).To(Equal("mongodbdef"))
+				Expect(instances[1].StatusReason).To(Equal("security group in use"))
+
+				_, input, _ := fakeCloudFormationAPI.DescribeStacksWithContextArgsForCall(1)
+				Expect(input.NextToken).To(Equal(aws.String("next")))
+			})
+
+			It("describes an instance's stack with its most recent events", func() {
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+					Stacks: []*awscf.Stack{{
+						StackName:   aws.String("mongodbabc"),
+						StackId:     aws.String("stack-abc"),
+						StackStatus: aws.String(awscf.StackStatusCreateComplete),
+						Parameters: []*awscf.Parameter{
+							{ParameterKey: aws.String("NodeInstanceType"), ParameterValue: aws.String("m4.large")},
+							{ParameterKey: aws.String("MongoDBAdminPassword"), ParameterValue: aws.String("****")},
+						},
+						Outputs: []*awscf.Output{
+							{OutputKey: aws.String("PrimaryReplicaNodeIp"), OutputValue: aws.String("10.0.0.1")},
+						},
+					}},
+				}, nil)
+				fakeCloudFormationAPI.DescribeStackEventsWithContextReturns(&awscf.DescribeStackEventsOutput{
+					StackEvents: []*awscf.StackEvent{
+						{LogicalResourceId: aws.String("mongodbabc"), ResourceStatus: aws.String(awscf.ResourceStatusCreateComplete)},
+						{LogicalResourceId: aws.String("Node0"), ResourceStatus: aws.String(awscf.ResourceStatusCreateComplete)},
+						{LogicalResourceId: aws.String("Node0"), ResourceStatus: aws.String(awscf.ResourceStatusCreateInProgress)},
+					},
+					NextToken: aws.String("next"),
+				}, nil)
+
+				details, err := mongoDBService.DescribeInstanceStack(context.Background(), "a-b-c", 2)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(details.StackName).To(Equal("mongodbabc"))
+				Expect(details.Parameters).To(Equal(map[string]string{
+					"NodeInstanceType":     "m4.large",
+					"MongoDBAdminPassword": "****",
+				}))
+				Expect(details.Outputs).To(Equal(map[string]string{"PrimaryReplicaNodeIp": "10.0.0.1"}))
+				Expect(details.Events).To(HaveLen(2))
+				Expect(details.Events[0].LogicalResourceId).To(Equal("mongodbabc"))
+
+				_, input, _ := fakeCloudFormationAPI.DescribeStacksWithContextArgsForCall(0)
+				Expect(input.StackName).To(Equal(aws.String("mongodbabc")))
+				Expect(fakeCloudFormationAPI.DescribeStackEventsWithContextCallCount()).To(Equal(1))
+				_, eventsInput, _ := fakeCloudFormationAPI.DescribeStackEventsWithContextArgsForCall(0)
+				Expect(eventsInput.StackName).To(Equal(aws.String("stack-abc")))
+			})
+
+			It("returns ErrStackNotFound for instances without a stack", func() {
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(nil, errors.New("ValidationError: Stack with id mongodbabc does not exist"))
+				_, err := mongoDBService.DescribeInstanceStack(context.Background(), "a-b-c", 25)
+				Expect(err).To(Equal(ErrStackNotFound))
+			})
+
+			Describe("RetryStackOperation", func() {
+				stackWithStatus := func(status string) {
+					fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+						Stacks: []*awscf.Stack{{StackStatus: aws.String(status)}},
+					}, nil)
+				}
+
+				It("deletes stacks that failed to delete again, with a new client request token", func() {
+					stackWithStatus(awscf.StackStatusDeleteFailed)
+					operation, err := mongoDBService.RetryStackOperation(context.Background(), "a-b-c")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(operation).To(Equal("delete"))
+					Expect(fakeCloudFormationAPI.DeleteStackWithContextCallCount()).To(Equal(1))
+					_, input, _ := fakeCloudFormationAPI.DeleteStackWithContextArgsForCall(0)
+					Expect(*input.StackName).To(Equal("mongodbabc"))
+					Expect(*input.ClientRequestToken).To(HavePrefix("retry-"))
+				})
+
+				It("continues rolling back stacks that failed to roll back an update", func() {
+					stackWithStatus(awscf.StackStatusUpdateRollbackFailed)
+					operation, err := mongoDBService.RetryStackOperation(context.Background(), "a-b-c")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(operation).To(Equal("continue-update-rollback"))
+					Expect(fakeCloudFormationAPI.ContinueUpdateRollbackWithContextCallCount()).To(Equal(1))
+				})
+
+				It("asks CloudFormation for the status rather than using the cache", func() {
+					mongoDBService.StackStatuses = NewStackStatuses(time.Minute)
+					stackWithStatus(awscf.StackStatusUpdateRollbackFailed)
+					_, _, err := mongoDBService.GetStackState(context.Background(), "mongodbabc")
+					Expect(err).NotTo(HaveOccurred())
+
+					stackWithStatus(awscf.StackStatusDeleteFailed)
+					operation, err := mongoDBService.RetryStackOperation(context.Background(), "a-b-c")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(operation).To(Equal("delete"))
+				})
+
+				It("returns ErrNothingToRetry for stacks in other statuses", func() {
+					stackWithStatus(awscf.StackStatusRollbackComplete)
+					_, err := mongoDBService.RetryStackOperation(context.Background(), "a-b-c")
+					Expect(err).To(Equal(ErrNothingToRetry))
+					Expect(fakeCloudFormationAPI.DeleteStackWithContextCallCount()).To(BeZero())
+				})
+			})
+
+			It("refreshes a cached stack status", func() {
+				mongoDBService.StackStatuses = NewStackStatuses(time.Minute)
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+					Stacks: []*awscf.Stack{{StackStatus: aws.String(awscf.StackStatusUpdateInProgress)}},
+				}, nil)
+				_, _, err := mongoDBService.GetStackState(context.Background(), "mongodbabc")
+				Expect(err).NotTo(HaveOccurred())
+
+				fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+					Stacks: []*awscf.Stack{{StackStatus: aws.String(awscf.StackStatusUpdateComplete)}},
+				}, nil)
+				status, _, err := mongoDBService.RefreshStackState(context.Background(), "a-b-c")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(status).To(Equal(awscf.StackStatusUpdateComplete))
+				status, _, err = mongoDBService.GetStackState(context.Background(), "mongodbabc")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(status).To(Equal(awscf.StackStatusUpdateComplete))
+			})
+		})
+	})
+
+	Describe("ValidateParameters", func() {
+		It("accepts parameters the template allows", func() {
+			Expect(ValidateParameters(inputParameters)).To(BeEmpty())
+		})
+
+		It("returns every parameter the template doesn't allow", func() {
+			inputParameters.NodeInstanceType = "m4.lrage"
+			inputParameters.VolumeType = "gp3"
+			inputParameters.MongoDBVersion = "4.0"
+			errs := ValidateParameters(inputParameters)
+			Expect(errs).To(HaveLen(3))
+			Expect(errs[0]).To(MatchError("parameter MongoDBVersion value 4.0 must be one of 3.4, 3.2"))
+			Expect(errs[1]).To(MatchError("parameter VolumeType value gp3 must be one of gp2, io1"))
+			Expect(errs[2]).To(MatchError(HavePrefix("parameter NodeInstanceType value m4.lrage must be one of m3.medium, ")))
+		})
+
+		It("doesn't check generated parameters or those locating the instance", func() {
+			inputParameters.MongoDBAdminPassword = ""
+			inputParameters.VpcId = "vpc-0123456789abcdef0"
+			Expect(ValidateParameters(inputParameters)).To(BeEmpty())
+		})
+	})
+
+	Describe("WithDefaults", func() {
+		It("sets the parameters left empty to the template's defaults", func() {
+			parameters, err := WithDefaults(InputParameters{ClusterReplicaSetCount: "3"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parameters.ClusterReplicaSetCount).To(Equal("3"))
+			Expect(parameters.MongoDBVersion).To(Equal("3.4"))
+			Expect(parameters.VolumeSize).To(Equal("400"))
+			Expect(parameters.VolumeType).To(Equal("gp2"))
+			Expect(parameters.NodeInstanceType).To(Equal("m4.large"))
+			Expect(parameters.ArbiterCount).To(Equal("0"))
+			Expect(parameters.MongosCount).To(BeEmpty())
+			Expect(parameters.CPUUtilizationAlarmThreshold).To(BeEmpty())
+		})
+
+		It("sets the defaults of sharded clusters and alarms", func() {
+			parameters, err := WithDefaults(InputParameters{
+				ShardCount:    "2",
+				AlarmTopicArn: "arn:aws:sns:eu-west-1:123456789012:mongodb-alarms",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parameters.MongosCount).To(Equal("2"))
+			Expect(parameters.NodeInstanceType).To(Equal("m4.large"))
+			Expect(parameters.CPUUtilizationAlarmThreshold).To(Equal("80"))
+			Expect(parameters.ReplicationLagAlarmThreshold).To(Equal("60"))
+		})
 	})
 })
@@ -1,6 +1,12 @@
 package mongodb
 
-import "github.com/aws/aws-sdk-go/aws"
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/templates"
+)
 
 var (
 	capabilities = []*string{aws.String("CAPABILITY_IAM")}
@@ -9,37 +15,117 @@ var (
 type StackParameterKey string
 
 var (
-	bastionSecurityGroupIdSPK StackParameterKey = "BastionSecurityGroupID"
-	keyPairNameSPK            StackParameterKey = "KeyPairName"
-	vpcIdSPK                  StackParameterKey = "VPC"
-	primaryNodeSubnetIdSPK    StackParameterKey = "PrimaryNodeSubnet"
-	secondary0NodeSubnetIdSPK StackParameterKey = "Secondary0NodeSubnet"
-	secondary1NodeSubnetIdSPK StackParameterKey = "Secondary1NodeSubnet"
-	mongoDBAdminPasswordSPK   StackParameterKey = "MongoDBAdminPassword"
-	mongoDBAdminUsernameSPK   StackParameterKey = "MongoDBAdminUsername"
-	mongoDBVersionSPK         StackParameterKey = "MongoDBVersion"
-	clusterReplicaSetCountSPK StackParameterKey = "ClusterReplicaSetCount"
-	replicaShardIndexSPK      StackParameterKey = "ReplicaShardIndex"
-	volumeSizeSPK             StackParameterKey = "VolumeSize"
-	volumeTypeSPK             StackParameterKey = "VolumeType"
-	iopsSPK                   StackParameterKey = "Iops"
-	nodeInstanceTypeSPK       StackParameterKey = "NodeInstanceType"
+	bastionSecurityGroupIdSPK   StackParameterKey = "BastionSecurityGroupID"
+	keyPairNameSPK              StackParameterKey = "KeyPairName"
+	vpcIdSPK                    StackParameterKey = "VPC"
+	nodeSubnetsSPK              StackParameterKey = "NodeSubnets"
+	mongoDBAdminPasswordSPK     StackParameterKey = "MongoDBAdminPassword"
+	mongoDBAdminUsernameSPK     StackParameterKey = "MongoDBAdminUsername"
+	mongoDBVersionSPK           StackParameterKey = "MongoDBVersion"
+	clusterReplicaSetCountSPK   StackParameterKey = "ClusterReplicaSetCount"
+	arbiterCountSPK             StackParameterKey = "ArbiterCount"
+	replicaShardIndexSPK        StackParameterKey = "ReplicaShardIndex"
+	volumeSizeSPK               StackParameterKey = "VolumeSize"
+	volumeTypeSPK               StackParameterKey = "VolumeType"
+	iopsSPK                     StackParameterKey = "Iops"
+	nodeInstanceTypeSPK         StackParameterKey = "NodeInstanceType"
+	mongoDBClusterKeySPK        StackParameterKey = "MongoDBClusterKey"
+	mongoDBCACertificateSPK     StackParameterKey = "MongoDBCACertificate"
+	mongoDBCAKeyParameterSPK    StackParameterKey = "MongoDBCAKeyParameter"
+	mongoDBCertificateExpirySPK StackParameterKey = "MongoDBCertificateExpiry"
+	volumeEncryptedSPK          StackParameterKey = "VolumeEncrypted"
+	volumeKmsKeyIdSPK           StackParameterKey = "VolumeKmsKeyId"
+
+	alarmTopicArnSPK                      StackParameterKey = "AlarmTopicArn"
+	cpuUtilizationAlarmThresholdSPK       StackParameterKey = "CPUUtilizationAlarmThreshold"
+	burstBalanceAlarmThresholdSPK         StackParameterKey = "BurstBalanceAlarmThreshold"
+	diskSpaceUtilizationAlarmThresholdSPK StackParameterKey = "DiskSpaceUtilizationAlarmThreshold"
+	replicationLagAlarmThresholdSPK       StackParameterKey = "ReplicationLagAlarmThreshold"
+
+	mongoDBExporterSecurityGroupIdSPK StackParameterKey = "MongoDBExporterSecurityGroupID"
 )
 
+// secretParameters are the stack parameters holding secrets. CloudFormation
+// never shows their values.
+var secretParameters = []StackParameterKey{mongoDBAdminPasswordSPK, mongoDBClusterKeySPK}
+
+// MaskSecretParameters replaces the values of secret parameters the way
+// CloudFormation does when it describes a stack.
+func MaskSecretParameters(parameters []*awscf.Parameter) []*awscf.Parameter {
+	var masked []*awscf.Parameter
+	for _, parameter := range parameters {
+		for _, key := range secretParameters {
+			if aws.StringValue(parameter.ParameterKey) == string(key) && parameter.ParameterValue != nil {
+				copied := *parameter
+				copied.ParameterValue = aws.String("****")
+				parameter = &copied
+			}
+		}
+		masked = append(masked, parameter)
+	}
+	return masked
+}
+
 type InputParameters struct {
-	BastionSecurityGroupId string
-	KeyPairName            string
-	VpcId                  string
-	PrimaryNodeSubnetId    string
-	Secondary0NodeSubnetId string
-	Secondary1NodeSubnetId string
-	MongoDBAdminPassword   string
-	MongoDBAdminUsername   string
-	MongoDBVersion         string
-	ClusterReplicaSetCount string
-	ReplicaShardIndex      string
-	VolumeSize             string
-	VolumeType             string
-	Iops                   string
-	NodeInstanceType       string
+	BastionSecurityGroupId   string
+	KeyPairName              string
+	VpcId                    string
+	NodeSubnetIds            []string
+	MongoDBAdminPassword     string
+	MongoDBAdminUsername     string
+	MongoDBVersion           string
+	ClusterReplicaSetCount   string
+	ArbiterCount             string
+	ReplicaShardIndex        string
+	VolumeSize               string
+	VolumeType               string
+	Iops                     string
+	NodeInstanceType         string
+	MongoDBClusterKey        string
+	ShardCount               string
+	MongosCount              string
+	TLS                      bool
+	MongoDBCACertificate     string
+	MongoDBCAKey             string
+	MongoDBCAKeyParameter    string
+	MongoDBCertificateExpiry string
+	VolumeEncrypted          string
+	VolumeKmsKeyId           string
+
+	AlarmTopicArn                      string
+	CPUUtilizationAlarmThreshold       string
+	BurstBalanceAlarmThreshold         string
+	DiskSpaceUtilizationAlarmThreshold string
+	ReplicationLagAlarmThreshold       string
+
+	MongoDBExporterSecurityGroupId string
+
+	// Tags are set on the stack, and through it on every resource. Updates
+	// only change the tags given, keeping the others.
+	Tags map[string]string
+}
+
+// EncryptedVolumes reports whether the nodes' EBS volumes are encrypted.
+func (p InputParameters) EncryptedVolumes() bool {
+	return p.VolumeEncrypted == "true"
+}
+
+// Exporter reports whether the nodes run mongodb_exporter.
+func (p InputParameters) Exporter() bool {
+	return p.MongoDBExporterSecurityGroupId != ""
+}
+
+// nodeSubnetsValue spreads the given subnets over every member of a replica
+// set in turn, so that listing subnets from different availability zones
+// places consecutive members in different zones. It returns an empty string
+// when there are no subnets.
+func nodeSubnetsValue(subnetIds []string) string {
+	if len(subnetIds) == 0 {
+		return ""
+	}
+	subnets := make([]string, templates.NodeSubnetCount)
+	for i := range subnets {
+		subnets[i] = subnetIds[i%len(subnetIds)]
+	}
+	return strings.Join(subnets, ",")
 }
@@ -0,0 +1,56 @@
+package mongodb
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/templates"
+)
+
+const defaultMongosCount = 2
+
+// Sharded reports whether the parameters describe a sharded cluster rather
+// than a single replica set.
+func (p InputParameters) Sharded() bool {
+	return p.ShardCount != ""
+}
+
+func (s *Service) BuildTemplateBody(p InputParameters) (string, error) {
+	template, err := buildTemplate(p)
+	if err != nil {
+		return "", err
+	}
+	return string(template), nil
+}
+
+func buildTemplate(p InputParameters) ([]byte, error) {
+	options := templates.MongoDBStackOptions{
+		TLS:              p.TLS,
+		EncryptedVolumes: p.EncryptedVolumes(),
+		Alarms:           p.Alarms(),
+		Exporter:         p.Exporter(),
+	}
+	if !p.Sharded() {
+		return templates.BuildMongoDBStack(options)
+	}
+
+	shardCount, err := strconv.Atoi(p.ShardCount)
+	if err != nil {
+		return nil, errors.New("Error building MongoDB template: shard count is not a number")
+	}
+	mongosCount := defaultMongosCount
+	if p.MongosCount != "" {
+		mongosCount, err = strconv.Atoi(p.MongosCount)
+		if err != nil {
+			return nil, errors.New("Error building MongoDB template: mongos count is not a number")
+		}
+	}
+
+	// A shard count of zero must not fall back to a replica set template.
+	if shardCount < 1 {
+		return nil, errors.New("Error building sharded MongoDB template: shard count must be at least 1")
+	}
+	options.ShardCount = shardCount
+	options.MongosCount = mongosCount
+	return templates.BuildMongoDBStack(options)
+}
@@ -0,0 +1,393 @@
+package mongodb
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/henrytk/aws-service-broker/health"
+)
+
+// StackStatuses caches the status of the stacks whose operations the
+// broker is being polled about, so that polls are answered without calling
+// CloudFormation. A watcher refreshes every watched stack at once with
+// ListStacks. Stacks are watched from the first time their status is asked
+// for or the broker changes them, until their status is final. Stack events
+// update statuses as soon as they are received.
+//
+// Statuses are used while they are younger than the cache's maximum age,
+// which bounds how late a poll can learn of a change. Older or missing
+// statuses are asked of CloudFormation directly.
+type StackStatuses struct {
+	mu       sync.Mutex
+	maxAge   time.Duration
+	statuses map[string]stackStatus
+	watched  map[string]bool
+	// changes are the operations the broker has started on stacks and not
+	// yet seen finish.
+	changes map[string]stackChange
+	// evented is CloudFormation's time of the latest stack event recorded
+	// for a stack, received when the broker received it, and nested the
+	// status of its nested stacks according to events.
+	evented  map[string]time.Time
+	received map[string]time.Time
+	nested   map[string]map[string]string
+}
+
+// stackChange is an operation the broker has started on a stack. Stack
+// events carry CloudFormation's times, which can't be compared with the
+// broker's clock, so the operation's start is learnt from CloudFormation:
+// from the first event with the operation's client request token, or from
+// the stack's times as described or listed once the operation is under
+// way. Until then, only events of the operation are recorded.
+type stackChange struct {
+	token    string
+	deleting bool
+	made     time.Time
+	started  time.Time
+}
+
+type stackStatus struct {
+	status, reason string
+	// completed and total count the stack's nested node stacks and how
+	// many of them have finished their current operation.
+	completed, total int
+	// started is CloudFormation's time of the stack's latest operation.
+	started   time.Time
+	refreshed time.Time
+}
+
+func NewStackStatuses(maxAge time.Duration) *StackStatuses {
+	return &StackStatuses{
+		maxAge:   maxAge,
+		statuses: map[string]stackStatus{},
+		watched:  map[string]bool{},
+		changes:  map[string]stackChange{},
+		evented:  map[string]time.Time{},
+		received: map[string]time.Time{},
+		nested:   map[string]map[string]string{},
+	}
+}
+
+// get returns the cached status of a stack, if it is recent enough, and
+// watches the stack. A nil cache has no statuses.
+func (c *StackStatuses) get(stackName string) (stackStatus, bool) {
+	if c == nil {
+		return stackStatus{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status, ok := c.statuses[stackName]
+	if !ok || time.Since(status.refreshed) > c.maxAge {
+		c.watched[stackName] = true
+		return stackStatus{}, false
+	}
+	if !stackStateIsFinal(status.status) {
+		c.watched[stackName] = true
+	}
+	return status, true
+}
+
+// set caches a status described by CloudFormation from the given time.
+// A description made after the broker changed the stack tells when
+// CloudFormation started the change.
+func (c *StackStatuses) set(stackName string, status stackStatus, described time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status.refreshed = time.Now()
+	c.statuses[stackName] = status
+	if change, ok := c.changes[stackName]; ok && change.started.IsZero() && !described.Before(change.made) {
+		change.started = status.started
+		c.changes[stackName] = change
+	}
+}
+
+// invalidate forgets the status of a stack so that it is next asked of
+// CloudFormation.
+func (c *StackStatuses) invalidate(stackName string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.statuses, stackName)
+}
+
+// changing forgets the status of a stack the broker has just changed, or
+// started deleting, with the client request token, and watches it until the
+// change is finished.
+func (c *StackStatuses) changing(stackName, token string, deleting bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.statuses, stackName)
+	delete(c.nested, stackName)
+	c.watched[stackName] = true
+	c.changes[stackName] = stackChange{token: token, deleting: deleting, made: time.Now()}
+}
+
+// current reports whether a stack event belongs to the broker's last change
+// of the stack or came after it. Events of the change tell when it started.
+func (c *StackStatuses) current(stackName, token string, at time.Time) bool {
+	change, ok := c.changes[stackName]
+	if !ok {
+		return true
+	}
+	if token != "" && token == change.token {
+		if change.started.IsZero() || at.Before(change.started) {
+			change.started = at
+			c.changes[stackName] = change
+		}
+		return true
+	}
+	return !change.started.IsZero() && !at.Before(change.started)
+}
+
+// record caches a stack's status from a stack event. Events from before
+// the last change the broker made, or older than the last event recorded,
+// are out of date.
+func (c *StackStatuses) record(stackName, status, reason, token string, at time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.current(stackName, token, at) || at.Before(c.evented[stackName]) {
+		return
+	}
+	c.evented[stackName] = at
+	c.received[stackName] = time.Now()
+	cached := c.statuses[stackName]
+	cached.status, cached.reason, cached.refreshed = status, reason, time.Now()
+	c.statuses[stackName] = c.withNestedProgress(stackName, cached)
+	if stackStateIsFinal(status) {
+		delete(c.watched, stackName)
+		delete(c.changes, stackName)
+	} else {
+		c.watched[stackName] = true
+	}
+}
+
+// recordNested records the status of one of a stack's nested stacks from a
+// stack event, to count how many of them are ready.
+func (c *StackStatuses) recordNested(stackName, logicalResourceId, status, token string, at time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.current(stackName, token, at) {
+		return
+	}
+	if c.nested[stackName] == nil {
+		c.nested[stackName] = map[string]string{}
+	}
+	c.nested[stackName][logicalResourceId] = status
+	if cached, ok := c.statuses[stackName]; ok {
+		c.statuses[stackName] = c.withNestedProgress(stackName, cached)
+	}
+}
+
+func (c *StackStatuses) withNestedProgress(stackName string, status stackStatus) stackStatus {
+	nested, ok := c.nested[stackName]
+	if !ok {
+		return status
+	}
+	status.completed, status.total = 0, 0
+	for _, nestedStatus := range nested {
+		if nestedStatus == awscf.ResourceStatusDeleteComplete {
+			continue
+		}
+		status.total++
+		if nestedStackCompleted(nestedStatus) {
+			status.completed++
+		}
+	}
+	return status
+}
+
+func (c *StackStatuses) watching() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.watched) > 0
+}
+
+// update caches the statuses of the watched stacks as listed from the given
+// time, and stops watching the stacks whose status is final. Listings
+// begun before the broker changed a stack or received an event of it are
+// out of date.
+//
+// Deleted stacks are not listed, so a stack being deleted that is missing
+// from the listing has been deleted. Other missing stacks are still being
+// created if the broker just created them. Otherwise they stop being
+// watched and their status is asked of CloudFormation directly.
+func (c *StackStatuses) update(listed time.Time, statuses map[string]stackStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for stackName := range c.watched {
+		status, ok := statuses[stackName]
+		change, changing := c.changes[stackName]
+		if (changing && listed.Before(change.made)) || listed.Before(c.received[stackName]) {
+			continue
+		}
+		if !ok {
+			switch {
+			case changing && change.deleting, c.statuses[stackName].status == awscf.StackStatusDeleteInProgress:
+				c.statuses[stackName] = stackStatus{
+					status:    awscf.StackStatusDeleteComplete,
+					reason:    "no reason returned via the API",
+					refreshed: listed,
+				}
+			case changing && listed.Sub(change.made) <= c.maxAge:
+				continue
+			default:
+				delete(c.statuses, stackName)
+			}
+			delete(c.watched, stackName)
+			delete(c.changes, stackName)
+			continue
+		}
+		if changing && change.started.IsZero() {
+			change.started = status.started
+			c.changes[stackName] = change
+		}
+		status.refreshed = listed
+		c.statuses[stackName] = status
+		if stackStateIsFinal(status.status) {
+			delete(c.watched, stackName)
+			delete(c.changes, stackName)
+		}
+	}
+}
+
+// operationStarted returns CloudFormation's time of the latest operation on
+// a stack: its deletion, last update or creation.
+func operationStarted(created time.Time, updated, deleted *time.Time) time.Time {
+	started := created
+	for _, t := range []*time.Time{updated, deleted} {
+		if t != nil && t.After(started) {
+			started = *t
+		}
+	}
+	return started
+}
+
+// WatchStackStatuses refreshes the service's stack statuses every interval
+// until the context is done, recording each refresh in the worker. Nothing
+// is listed while no stacks are watched.
+func (s *Service) WatchStackStatuses(ctx context.Context, interval time.Duration, worker *health.Worker, logger lager.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.StackStatuses.watching() {
+				worker.Ran(nil)
+				continue
+			}
+			err := s.RefreshStackStatuses(ctx)
+			if err != nil {
+				logger.Error("refresh-stack-statuses", err)
+			}
+			worker.Ran(err)
+		}
+	}
+}
+
+// liveStackStatuses are every stack status but DELETE_COMPLETE. Deleted
+// stacks are listed for 90 days, so listings leave them out.
+var liveStackStatuses = aws.StringSlice([]string{
+	awscf.StackStatusCreateInProgress,
+	awscf.StackStatusCreateFailed,
+	awscf.StackStatusCreateComplete,
+	awscf.StackStatusRollbackInProgress,
+	awscf.StackStatusRollbackFailed,
+	awscf.StackStatusRollbackComplete,
+	awscf.StackStatusDeleteInProgress,
+	awscf.StackStatusDeleteFailed,
+	awscf.StackStatusUpdateInProgress,
+	awscf.StackStatusUpdateCompleteCleanupInProgress,
+	awscf.StackStatusUpdateComplete,
+	awscf.StackStatusUpdateRollbackInProgress,
+	awscf.StackStatusUpdateRollbackFailed,
+	awscf.StackStatusUpdateRollbackCompleteCleanupInProgress,
+	awscf.StackStatusUpdateRollbackComplete,
+	awscf.StackStatusReviewInProgress,
+})
+
+// RefreshStackStatuses lists the account's stacks that aren't deleted and
+// caches the statuses of the watched ones, along with the progress of their
+// nested stacks.
+func (s *Service) RefreshStackStatuses(ctx context.Context) error {
+	listed := time.Now()
+	statuses := map[string]stackStatus{}
+	stackNames := map[string]string{}
+	var nested []*awscf.StackSummary
+	input := &awscf.ListStacksInput{StackStatusFilter: liveStackStatuses}
+	for {
+		listStacksOutput, err := s.Client.ListStacksWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		if listStacksOutput == nil {
+			break
+		}
+
+		for _, stack := range listStacksOutput.StackSummaries {
+			if stack.StackName == nil || stack.StackStatus == nil {
+				continue
+			}
+			if stack.ParentId != nil {
+				nested = append(nested, stack)
+				continue
+			}
+			if !strings.HasPrefix(*stack.StackName, stackNamePrefix) {
+				continue
+			}
+			status := stackStatus{
+				status:  *stack.StackStatus,
+				reason:  "no reason returned via the API",
+				started: operationStarted(aws.TimeValue(stack.CreationTime), stack.LastUpdatedTime, stack.DeletionTime),
+			}
+			if stack.StackStatusReason != nil {
+				status.reason = *stack.StackStatusReason
+			}
+			statuses[*stack.StackName] = status
+			if stack.StackId != nil {
+				stackNames[*stack.StackId] = *stack.StackName
+			}
+		}
+
+		if listStacksOutput.NextToken == nil {
+			break
+		}
+		input.NextToken = listStacksOutput.NextToken
+	}
+
+	for _, stack := range nested {
+		stackName, ok := stackNames[*stack.ParentId]
+		if !ok || *stack.StackStatus == awscf.StackStatusDeleteComplete {
+			continue
+		}
+		status := statuses[stackName]
+		status.total++
+		if nestedStackCompleted(*stack.StackStatus) {
+			status.completed++
+		}
+		statuses[stackName] = status
+	}
+
+	s.StackStatuses.update(listed, statuses)
+	return nil
+}
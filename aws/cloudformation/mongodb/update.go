@@ -5,13 +5,41 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
-	"github.com/henrytk/aws-service-broker/aws/cloudformation/templates"
 )
 
+// UpdateStack updates an instance's stack. Whether its volumes are
+// encrypted is kept from the stack, whatever the input parameters say:
+// changing it would replace the volumes, and the config it was worked out
+// from can have changed since the stack was created.
 func (s *Service) UpdateStack(ctx context.Context, id string, inputParameters InputParameters) (*awscf.UpdateStackOutput, error) {
+	stack, err := s.describeStack(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	inputParameters.VolumeEncrypted = stackParameter(stack, volumeEncryptedSPK)
+	if inputParameters.TLS {
+		inputParameters.MongoDBCAKeyParameter = caKeyParameterName(s.GenerateStackName(id))
+	}
 	parameters := s.BuildUpdateStackParameters(inputParameters)
-	updateStackInput := s.BuildUpdateStackInput(id, parameters)
-	return s.Client.UpdateStackWithContext(ctx, updateStackInput)
+	templateBody, err := s.BuildTemplateBody(inputParameters)
+	if err != nil {
+		return nil, err
+	}
+	updateStackInput := s.BuildUpdateStackInput(id, templateBody, parameters)
+	if len(inputParameters.Tags) > 0 {
+		tags := tagsFromStack(stack)
+		for key, value := range inputParameters.Tags {
+			tags[key] = value
+		}
+		updateStackInput.Tags = stackTags(tags)
+	}
+	updateStackInput.NotificationARNs = s.notificationARNs()
+	updateStackOutput, err := s.Client.UpdateStackWithContext(ctx, updateStackInput)
+	if err != nil {
+		return nil, err
+	}
+	s.StackStatuses.changing(*updateStackInput.StackName, *updateStackInput.ClientRequestToken, false)
+	return updateStackOutput, nil
 }
 
 func (s *Service) BuildUpdateStackParameters(p InputParameters) []*awscf.Parameter {
@@ -38,23 +66,9 @@ func (s *Service) BuildUpdateStackParameters(p InputParameters) []*awscf.Paramet
 		UsePreviousValue: usePreviousValue,
 	})
 
-	value, usePreviousValue = updateParameterValue(p.PrimaryNodeSubnetId)
-	parameters = append(parameters, &awscf.Parameter{
-		ParameterKey:     aws.String(string(primaryNodeSubnetIdSPK)),
-		ParameterValue:   value,
-		UsePreviousValue: usePreviousValue,
-	})
-
-	value, usePreviousValue = updateParameterValue(p.Secondary0NodeSubnetId)
-	parameters = append(parameters, &awscf.Parameter{
-		ParameterKey:     aws.String(string(secondary0NodeSubnetIdSPK)),
-		ParameterValue:   value,
-		UsePreviousValue: usePreviousValue,
-	})
-
-	value, usePreviousValue = updateParameterValue(p.Secondary1NodeSubnetId)
+	value, usePreviousValue = updateParameterValue(nodeSubnetsValue(p.NodeSubnetIds))
 	parameters = append(parameters, &awscf.Parameter{
-		ParameterKey:     aws.String(string(secondary1NodeSubnetIdSPK)),
+		ParameterKey:     aws.String(string(nodeSubnetsSPK)),
 		ParameterValue:   value,
 		UsePreviousValue: usePreviousValue,
 	})
@@ -87,6 +101,13 @@ func (s *Service) BuildUpdateStackParameters(p InputParameters) []*awscf.Paramet
 		UsePreviousValue: usePreviousValue,
 	})
 
+	value, usePreviousValue = updateParameterValue(p.ArbiterCount)
+	parameters = append(parameters, &awscf.Parameter{
+		ParameterKey:     aws.String(string(arbiterCountSPK)),
+		ParameterValue:   value,
+		UsePreviousValue: usePreviousValue,
+	})
+
 	value, usePreviousValue = updateParameterValue(p.ReplicaShardIndex)
 	parameters = append(parameters, &awscf.Parameter{
 		ParameterKey:     aws.String(string(replicaShardIndexSPK)),
@@ -121,6 +142,65 @@ func (s *Service) BuildUpdateStackParameters(p InputParameters) []*awscf.Paramet
 		ParameterValue:   value,
 		UsePreviousValue: usePreviousValue,
 	})
+
+	if p.Sharded() {
+		value, usePreviousValue = updateParameterValue(p.MongoDBClusterKey)
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(mongoDBClusterKeySPK)),
+			ParameterValue:   value,
+			UsePreviousValue: usePreviousValue,
+		})
+	}
+
+	// The certificate authority never changes. A new certificate expiry
+	// makes the nodes reissue their certificates.
+	if p.TLS {
+		value, usePreviousValue = updateParameterValue(p.MongoDBCACertificate)
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(mongoDBCACertificateSPK)),
+			ParameterValue:   value,
+			UsePreviousValue: usePreviousValue,
+		})
+
+		value, usePreviousValue = updateParameterValue(p.MongoDBCAKeyParameter)
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(mongoDBCAKeyParameterSPK)),
+			ParameterValue:   value,
+			UsePreviousValue: usePreviousValue,
+		})
+
+		value, usePreviousValue = updateParameterValue(p.MongoDBCertificateExpiry)
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(mongoDBCertificateExpirySPK)),
+			ParameterValue:   value,
+			UsePreviousValue: usePreviousValue,
+		})
+	}
+
+	// Changing the encryption of a volume replaces it, so the previous
+	// values are always kept.
+	if p.EncryptedVolumes() {
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(volumeEncryptedSPK)),
+			UsePreviousValue: aws.Bool(true),
+		})
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(volumeKmsKeyIdSPK)),
+			UsePreviousValue: aws.Bool(true),
+		})
+	}
+
+	if p.Alarms() {
+		parameters = append(parameters, alarmParameters(p)...)
+	}
+
+	if p.Exporter() {
+		parameters = append(parameters, &awscf.Parameter{
+			ParameterKey:     aws.String(string(mongoDBExporterSecurityGroupIdSPK)),
+			ParameterValue:   aws.String(p.MongoDBExporterSecurityGroupId),
+			UsePreviousValue: aws.Bool(false),
+		})
+	}
 	return parameters
 }
 
@@ -131,14 +211,13 @@ func updateParameterValue(input string) (*string, *bool) {
 	return aws.String(input), aws.Bool(false)
 }
 
-func (s *Service) BuildUpdateStackInput(id string, parameters []*awscf.Parameter) *awscf.UpdateStackInput {
+func (s *Service) BuildUpdateStackInput(id, templateBody string, parameters []*awscf.Parameter) *awscf.UpdateStackInput {
 	stackName := s.GenerateStackName(id)
-	mongoDBStackTemplate := string(templates.MongoDBStack)
 	return &awscf.UpdateStackInput{
 		Capabilities:       capabilities,
-		ClientRequestToken: aws.String("update-" + stackName),
+		ClientRequestToken: requestToken("update", stackName),
 		Parameters:         parameters,
 		StackName:          aws.String(stackName),
-		TemplateBody:       aws.String(mongoDBStackTemplate),
+		TemplateBody:       aws.String(templateBody),
 	}
 }
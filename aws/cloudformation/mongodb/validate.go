@@ -0,0 +1,105 @@
+package mongodb
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/templates"
+)
+
+// unplannedParameters are the stack parameters that don't come from a plan:
+// the broker generates some for every instance, and the others locate the
+// instance in the account.
+var unplannedParameters = map[StackParameterKey]bool{
+	bastionSecurityGroupIdSPK:         true,
+	keyPairNameSPK:                    true,
+	vpcIdSPK:                          true,
+	nodeSubnetsSPK:                    true,
+	mongoDBExporterSecurityGroupIdSPK: true,
+	mongoDBAdminPasswordSPK:           true,
+	mongoDBClusterKeySPK:              true,
+	mongoDBCACertificateSPK:           true,
+	mongoDBCAKeyParameterSPK:          true,
+	mongoDBCertificateExpirySPK:       true,
+}
+
+// ValidateParameters checks the stack parameters a plan sets against the
+// constraints of the template its stacks are created from, which
+// CloudFormation would otherwise only check when an instance is
+// provisioned. It returns every parameter that breaks its constraints.
+func ValidateParameters(p InputParameters) []error {
+	template, err := buildTemplate(p)
+	if err != nil {
+		return []error{err}
+	}
+	constraints, err := templates.ParseParameterConstraints(template)
+	if err != nil {
+		return []error{err}
+	}
+
+	// Generated parameters are required, so stand-ins are used to build
+	// the others.
+	p.MongoDBAdminPassword = "generated"
+	p.MongoDBClusterKey = "generated"
+	p.MongoDBCACertificate, p.MongoDBCAKeyParameter, p.MongoDBCertificateExpiry = "generated", "generated", "generated"
+	parameters, err := (&Service{}).BuildCreateStackParameters(p)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, parameter := range parameters {
+		key := aws.StringValue(parameter.ParameterKey)
+		if unplannedParameters[StackParameterKey(key)] {
+			continue
+		}
+		constraint, ok := constraints[key]
+		if !ok {
+			errs = append(errs, errors.New("parameter "+key+" is not in the template"))
+			continue
+		}
+		value := aws.StringValue(parameter.ParameterValue)
+		if err := constraint.Check(value); err != nil {
+			errs = append(errs, errors.New("parameter "+key+" value "+value+" "+err.Error()))
+		}
+	}
+	return errs
+}
+
+// WithDefaults returns the parameters with the plan parameters they leave
+// empty set to the defaults of the template their stack is created from,
+// which is what CloudFormation would set them to.
+func WithDefaults(p InputParameters) (InputParameters, error) {
+	template, err := buildTemplate(p)
+	if err != nil {
+		return p, err
+	}
+	constraints, err := templates.ParseParameterConstraints(template)
+	if err != nil {
+		return p, err
+	}
+	for key, value := range map[StackParameterKey]*string{
+		mongoDBVersionSPK:                     &p.MongoDBVersion,
+		mongoDBAdminUsernameSPK:               &p.MongoDBAdminUsername,
+		clusterReplicaSetCountSPK:             &p.ClusterReplicaSetCount,
+		arbiterCountSPK:                       &p.ArbiterCount,
+		replicaShardIndexSPK:                  &p.ReplicaShardIndex,
+		volumeSizeSPK:                         &p.VolumeSize,
+		volumeTypeSPK:                         &p.VolumeType,
+		iopsSPK:                               &p.Iops,
+		nodeInstanceTypeSPK:                   &p.NodeInstanceType,
+		cpuUtilizationAlarmThresholdSPK:       &p.CPUUtilizationAlarmThreshold,
+		burstBalanceAlarmThresholdSPK:         &p.BurstBalanceAlarmThreshold,
+		diskSpaceUtilizationAlarmThresholdSPK: &p.DiskSpaceUtilizationAlarmThreshold,
+		replicationLagAlarmThresholdSPK:       &p.ReplicationLagAlarmThreshold,
+	} {
+		if *value == "" {
+			*value = constraints[string(key)].Default
+		}
+	}
+	if p.Sharded() && p.MongosCount == "" {
+		p.MongosCount = strconv.Itoa(defaultMongosCount)
+	}
+	return p, nil
+}
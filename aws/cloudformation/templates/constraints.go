@@ -0,0 +1,82 @@
+package templates
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ParameterConstraints are the constraints CloudFormation checks parameter
+// values against before it creates or updates a stack.
+type ParameterConstraints struct {
+	Type           string
+	Default        string
+	AllowedValues  []string
+	AllowedPattern string
+	MinLength      string
+	MaxLength      string
+	MinValue       string
+	MaxValue       string
+}
+
+// ParseParameterConstraints reads the constraints of every parameter from
+// the Parameters section of a rendered template.
+func ParseParameterConstraints(template []byte) (map[string]ParameterConstraints, error) {
+	var sections struct {
+		Parameters map[string]ParameterConstraints
+	}
+	if err := json.Unmarshal(template, &sections); err != nil {
+		return nil, err
+	}
+	return sections.Parameters, nil
+}
+
+// Check returns an error describing how a value breaks the constraints, or
+// nil if CloudFormation would accept it.
+func (c ParameterConstraints) Check(value string) error {
+	if len(c.AllowedValues) > 0 {
+		allowed := false
+		for _, allowedValue := range c.AllowedValues {
+			if value == allowedValue {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.New("must be one of " + strings.Join(c.AllowedValues, ", "))
+		}
+	}
+	// CloudFormation requires the whole value to match the pattern.
+	if c.AllowedPattern != "" {
+		pattern, err := regexp.Compile("^(?:" + c.AllowedPattern + ")$")
+		if err != nil {
+			return errors.New("has an invalid allowed pattern " + c.AllowedPattern)
+		}
+		if !pattern.MatchString(value) {
+			return errors.New("must match the pattern " + c.AllowedPattern)
+		}
+	}
+	length := utf8.RuneCountInString(value)
+	if min, err := strconv.Atoi(c.MinLength); err == nil && length < min {
+		return errors.New("must be at least " + c.MinLength + " characters long")
+	}
+	if max, err := strconv.Atoi(c.MaxLength); err == nil && length > max {
+		return errors.New("must be at most " + c.MaxLength + " characters long")
+	}
+	if c.Type == "Number" || c.MinValue != "" || c.MaxValue != "" {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		if min, err := strconv.ParseFloat(c.MinValue, 64); err == nil && number < min {
+			return errors.New("must be at least " + c.MinValue)
+		}
+		if max, err := strconv.ParseFloat(c.MaxValue, 64); err == nil && number > max {
+			return errors.New("must be at most " + c.MaxValue)
+		}
+	}
+	return nil
+}
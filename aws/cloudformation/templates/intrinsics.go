@@ -0,0 +1,44 @@
+package templates
+
+// Intrinsic is a CloudFormation intrinsic function or condition.
+type Intrinsic map[string]interface{}
+
+func Ref(name string) Intrinsic {
+	return Intrinsic{"Ref": name}
+}
+
+func GetAtt(resource, attribute string) Intrinsic {
+	return Intrinsic{"Fn::GetAtt": []string{resource, attribute}}
+}
+
+func Join(delimiter string, values ...interface{}) Intrinsic {
+	return Intrinsic{"Fn::Join": []interface{}{delimiter, values}}
+}
+
+func Select(index interface{}, list interface{}) Intrinsic {
+	return Intrinsic{"Fn::Select": []interface{}{index, list}}
+}
+
+func Sub(text string, variables map[string]interface{}) Intrinsic {
+	return Intrinsic{"Fn::Sub": []interface{}{text, variables}}
+}
+
+func FindInMap(mapName string, topLevelKey, secondLevelKey interface{}) Intrinsic {
+	return Intrinsic{"Fn::FindInMap": []interface{}{mapName, topLevelKey, secondLevelKey}}
+}
+
+func If(condition string, valueIfTrue, valueIfFalse interface{}) Intrinsic {
+	return Intrinsic{"Fn::If": []interface{}{condition, valueIfTrue, valueIfFalse}}
+}
+
+func Equals(a, b interface{}) Intrinsic {
+	return Intrinsic{"Fn::Equals": []interface{}{a, b}}
+}
+
+func Not(condition Intrinsic) Intrinsic {
+	return Intrinsic{"Fn::Not": []interface{}{condition}}
+}
+
+func Or(conditions ...Intrinsic) Intrinsic {
+	return Intrinsic{"Fn::Or": conditions}
+}
@@ -0,0 +1,204 @@
+package templates
+
+const (
+	monitoringConfigurationGroup = "Monitoring Configuration"
+
+	// mongoDBMetricNamespace is the CloudWatch namespace the nodes publish
+	// their disk, burst balance and replication metrics to.
+	mongoDBMetricNamespace = "MongoDB"
+)
+
+// nodeAlarm describes one of the alarms every matching node gets.
+type nodeAlarm struct {
+	name               string
+	description        string
+	namespace          string
+	metricName         string
+	statistic          string
+	period             string
+	evaluationPeriods  string
+	threshold          interface{}
+	comparisonOperator string
+	treatMissingData   string
+	dataBearing        bool
+}
+
+var nodeAlarms = []nodeAlarm{
+	{
+		name:               "StatusCheckFailedAlarm",
+		description:        "Failed status checks of ",
+		namespace:          "AWS/EC2",
+		metricName:         "StatusCheckFailed",
+		statistic:          "Maximum",
+		period:             "60",
+		evaluationPeriods:  "2",
+		threshold:          "1",
+		comparisonOperator: "GreaterThanOrEqualToThreshold",
+	},
+	{
+		name:               "CPUUtilizationAlarm",
+		description:        "CPU utilization of ",
+		namespace:          "AWS/EC2",
+		metricName:         "CPUUtilization",
+		statistic:          "Average",
+		period:             "300",
+		evaluationPeriods:  "3",
+		threshold:          Ref("CPUUtilizationAlarmThreshold"),
+		comparisonOperator: "GreaterThanThreshold",
+	},
+	{
+		name:               "BurstBalanceAlarm",
+		description:        "Burst balance of the data volume of ",
+		namespace:          mongoDBMetricNamespace,
+		metricName:         "BurstBalance",
+		statistic:          "Minimum",
+		period:             "300",
+		evaluationPeriods:  "1",
+		threshold:          Ref("BurstBalanceAlarmThreshold"),
+		comparisonOperator: "LessThanThreshold",
+		treatMissingData:   "notBreaching",
+		dataBearing:        true,
+	},
+	{
+		name:               "DiskSpaceUtilizationAlarm",
+		description:        "Disk space utilization of the data volume of ",
+		namespace:          mongoDBMetricNamespace,
+		metricName:         "DiskSpaceUtilization",
+		statistic:          "Maximum",
+		period:             "300",
+		evaluationPeriods:  "1",
+		threshold:          Ref("DiskSpaceUtilizationAlarmThreshold"),
+		comparisonOperator: "GreaterThanThreshold",
+		dataBearing:        true,
+	},
+	{
+		name:               "ReplicationLagAlarm",
+		description:        "Replication lag of ",
+		namespace:          mongoDBMetricNamespace,
+		metricName:         "ReplicationLag",
+		statistic:          "Maximum",
+		period:             "60",
+		evaluationPeriods:  "5",
+		threshold:          Ref("ReplicationLagAlarmThreshold"),
+		comparisonOperator: "GreaterThanThreshold",
+		treatMissingData:   "notBreaching",
+		dataBearing:        true,
+	},
+}
+
+// addAlarms adds the alarm topic and threshold parameters, lets the nodes
+// publish their MongoDB metrics and adds an alarm for each metric of each
+// node. Arbiters and mongos hold no data, so they only get the instance
+// alarms. Alarms share their node's condition and keep CloudFormation
+// generated names, so they follow the nodes through updates.
+func addAlarms(template *Template) {
+	template.Parameters.Add("AlarmTopicArn", Parameter{
+		Description: "ARN of the SNS topic the alarms notify",
+		Type:        "String",
+	})
+	template.Parameters.Add("CPUUtilizationAlarmThreshold", Parameter{
+		Description: "Average CPU utilization of a node, in percent, above which it alarms",
+		Type:        "Number",
+		Default:     "80",
+	})
+	template.Parameters.Add("BurstBalanceAlarmThreshold", Parameter{
+		Description: "Burst balance of a node's data volume, in percent, below which it alarms",
+		Type:        "Number",
+		Default:     "20",
+	})
+	template.Parameters.Add("DiskSpaceUtilizationAlarmThreshold", Parameter{
+		Description: "Disk space utilization of a node's data volume, in percent, above which it alarms",
+		Type:        "Number",
+		Default:     "80",
+	})
+	template.Parameters.Add("ReplicationLagAlarmThreshold", Parameter{
+		Description: "Seconds a secondary can lag behind the primary before it alarms",
+		Type:        "Number",
+		Default:     "60",
+	})
+	addMonitoringGroup(template)
+	template.Metadata.AddToGroup(monitoringConfigurationGroup, "AlarmTopicArn", "Alarm Topic ARN")
+	template.Metadata.AddToGroup(monitoringConfigurationGroup, "CPUUtilizationAlarmThreshold", "CPU Utilization Alarm Threshold")
+	template.Metadata.AddToGroup(monitoringConfigurationGroup, "BurstBalanceAlarmThreshold", "Burst Balance Alarm Threshold")
+	template.Metadata.AddToGroup(monitoringConfigurationGroup, "DiskSpaceUtilizationAlarmThreshold", "Disk Space Utilization Alarm Threshold")
+	template.Metadata.AddToGroup(monitoringConfigurationGroup, "ReplicationLagAlarmThreshold", "Replication Lag Alarm Threshold")
+
+	addMonitoringPolicy(template)
+	updateNodes(template, func(parameters *NodeStackParameters) {
+		parameters.MonitoringEnabled = "true"
+	})
+
+	for _, name := range template.Resources.Names() {
+		resource, _ := template.Resources.Get(name)
+		node, ok := resource.(NodeStack)
+		if !ok {
+			continue
+		}
+		role := node.Properties.Parameters.NodeRole
+		dataBearing := role != "arbiter" && role != "mongos"
+		for _, alarm := range nodeAlarms {
+			if alarm.dataBearing && !dataBearing {
+				continue
+			}
+			template.Resources.Add(name+alarm.name, newNodeAlarm(name, node.Condition, alarm))
+		}
+	}
+}
+
+// addMonitoringGroup adds the metadata group of the monitoring parameters,
+// unless another monitoring feature already added it.
+func addMonitoringGroup(template *Template) {
+	for _, group := range template.Metadata.Interface.ParameterGroups {
+		if group.Label.Default == monitoringConfigurationGroup {
+			return
+		}
+	}
+	template.Metadata.Interface.ParameterGroups = append(template.Metadata.Interface.ParameterGroups, ParameterGroup{
+		Label: Label{Default: monitoringConfigurationGroup},
+	})
+}
+
+func newNodeAlarm(node, condition string, alarm nodeAlarm) Alarm {
+	return Alarm{
+		Type:      "AWS::CloudWatch::Alarm",
+		Condition: condition,
+		Properties: AlarmProperties{
+			AlarmDescription: alarm.description + node,
+			Namespace:        alarm.namespace,
+			MetricName:       alarm.metricName,
+			Dimensions: []MetricDimension{{
+				Name:  "InstanceId",
+				Value: GetAtt(node, "Outputs.NodeInstanceID"),
+			}},
+			Statistic:          alarm.statistic,
+			Period:             alarm.period,
+			EvaluationPeriods:  alarm.evaluationPeriods,
+			Threshold:          alarm.threshold,
+			ComparisonOperator: alarm.comparisonOperator,
+			TreatMissingData:   alarm.treatMissingData,
+			AlarmActions:       []interface{}{Ref("AlarmTopicArn")},
+			OKActions:          []interface{}{Ref("AlarmTopicArn")},
+		},
+	}
+}
+
+// addMonitoringPolicy lets the nodes publish their metrics and read the
+// burst balance of their data volumes.
+func addMonitoringPolicy(template *Template) {
+	resource, _ := template.Resources.Get("MongoDBNodeIAMRole")
+	role := resource.(IAMRole)
+	role.Properties.Policies = append(role.Properties.Policies, Policy{
+		PolicyName: "Monitoring",
+		PolicyDocument: PolicyDocument{
+			Statement: []Statement{{
+				Effect: "Allow",
+				Action: []string{
+					"cloudwatch:PutMetricData",
+					"cloudwatch:GetMetricStatistics",
+				},
+				Resource: "*",
+			}},
+		},
+	})
+	template.Resources.Add("MongoDBNodeIAMRole", role)
+}
@@ -0,0 +1,40 @@
+package templates
+
+// MongoDBExporterPort is the port mongodb_exporter serves each node's
+// metrics on.
+const MongoDBExporterPort = "9216"
+
+// addExporter installs mongodb_exporter on every node and lets the
+// security group given as a parameter scrape it. The port is an output so
+// that service discovery can tell which instances serve metrics.
+func addExporter(template *Template) {
+	template.Parameters.Add("MongoDBExporterSecurityGroupID", Parameter{
+		Description: "Security group of the Prometheus servers scraping the nodes' mongodb_exporter",
+		Type:        "AWS::EC2::SecurityGroup::Id",
+	})
+	template.Parameters.Add("MongoDBExporterVersion", Parameter{
+		Description: "Version of mongodb_exporter to install on the nodes",
+		Type:        "String",
+		Default:     "0.7.1",
+	})
+	addMonitoringGroup(template)
+	template.Metadata.AddToGroup(monitoringConfigurationGroup, "MongoDBExporterSecurityGroupID", "MongoDB Exporter Security Group ID")
+	template.Metadata.AddToGroup(monitoringConfigurationGroup, "MongoDBExporterVersion", "MongoDB Exporter Version")
+
+	resource, _ := template.Resources.Get("MongoDBServerSecurityGroup")
+	securityGroup := resource.(SecurityGroup)
+	securityGroup.Properties.SecurityGroupIngress = append(securityGroup.Properties.SecurityGroupIngress,
+		TCPIngress(MongoDBExporterPort, MongoDBExporterPort, Ref("MongoDBExporterSecurityGroupID")),
+	)
+	template.Resources.Add("MongoDBServerSecurityGroup", securityGroup)
+
+	updateNodes(template, func(parameters *NodeStackParameters) {
+		parameters.ExporterEnabled = "true"
+		parameters.MongoDBExporterVersion = Ref("MongoDBExporterVersion")
+	})
+
+	template.Outputs.Add("MongoDBExporterPort", Output{
+		Value:       MongoDBExporterPort,
+		Description: "Port mongodb_exporter Serves the Nodes' Metrics On",
+	})
+}
@@ -1,820 +1,719 @@
 package templates
 
-var MongoDBStack = []byte(`
-{
-    "AWSTemplateFormatVersion": "2010-09-09",
-    "Description": "(000F) Deploy MongoDB Replica Set on AWS (Existing VPC)",
-    "Metadata": {
-        "AWS::CloudFormation::Interface": {
-            "ParameterGroups": [
-                {
-                    "Label": {
-                        "default": "Network Configuration"
-                    },
-                    "Parameters": [
-                        "VPC",
-                        "PrimaryNodeSubnet",
-                        "Secondary0NodeSubnet",
-                        "Secondary1NodeSubnet",
-                        "BastionSecurityGroupID"
-                    ]
-                },
-                {
-                    "Label": {
-                        "default": "Security Configuration"
-                    },
-                    "Parameters": [
-                        "KeyPairName"
-                    ]
-                },
-                {
-                    "Label": {
-                        "default": "MongoDB Database Configuration"
-                    },
-                    "Parameters": [
-                        "ClusterReplicaSetCount",
-                        "Iops",
-                        "MongoDBVersion",
-                        "MongoDBAdminUsername",
-                        "MongoDBAdminPassword",
-                        "NodeInstanceType",
-                        "ReplicaShardIndex",
-                        "VolumeSize",
-                        "VolumeType"
-                    ]
-                },
-                {
-                    "Label": {
-                        "default": "AWS Quick Start Configuration"
-                    },
-                    "Parameters": [
-                        "QSS3BucketName",
-                        "QSS3KeyPrefix"
-                    ]
-                }
-            ],
-            "ParameterLabels": {
-                "BastionSecurityGroupID": {
-                    "default": "Bastion Security Group ID"
-                },
-                "ClusterReplicaSetCount": {
-                    "default": "Cluster Replica Set Count"
-                },
-                "Iops": {
-                    "default": "Iops"
-                },
-                "KeyPairName": {
-                    "default": "Key Pair Name"
-                },
-                "MongoDBAdminPassword": {
-                    "default": "MongoDB Admin Password"
-                },
-                "MongoDBAdminUsername": {
-                    "default": "MongoDB Admin Username"
-                },
-                "MongoDBVersion": {
-                    "default": "MongoDB Version"
-                },
-                "NodeInstanceType": {
-                    "default": "Node Instance Type"
-                },
-                "PrimaryNodeSubnet": {
-                    "default": "Primary Node Subnet"
-                },
-                "QSS3BucketName": {
-                    "default": "Quick Start S3 Bucket Name"
-                },
-                "QSS3KeyPrefix": {
-                    "default": "Quick Start S3 Key Prefix"
-                },
-                "ReplicaShardIndex": {
-                    "default": "Replica Shard Index"
-                },
-                "Secondary0NodeSubnet": {
-                    "default": "Secondary0 Node Subnet"
-                },
-                "Secondary1NodeSubnet": {
-                    "default": "Secondary1 Node Subnet"
-                },
-                "VPC": {
-                    "default": "VPC"
-                },
-                "VolumeSize": {
-                    "default": "Volume Size"
-                },
-                "VolumeType": {
-                    "default": "Volume Type"
-                }
-            }
-        }
-    },
-    "Parameters": {
-        "BastionSecurityGroupID": {
-            "Description": "ID of the Bastion Security Group (e.g., sg-7f16e910)",
-            "Type": "AWS::EC2::SecurityGroup::Id"
-        },
-        "ClusterReplicaSetCount": {
-            "Description": "Number of Replica Set Members. Choose 1 or 3",
-            "Type": "String",
-            "Default": "1",
-            "AllowedValues": [
-                "1",
-                "3"
-            ]
-        },
-        "MongoDBVersion": {
-            "Description": "MongoDB version",
-            "Type": "String",
-            "Default": "3.4",
-            "AllowedValues": [
-                "3.4",
-                "3.2"
-            ]
-        },
-        "MongoDBAdminUsername": {
-            "Default": "admin",
-            "NoEcho": "true",
-            "Description": "MongoDB admin account username",
-            "Type": "String",
-            "MinLength": "1",
-            "MaxLength": "16",
-            "AllowedPattern": "[a-zA-Z][a-zA-Z0-9]*",
-            "ConstraintDescription": "must begin with a letter and contain only alphanumeric characters."
-        },
-        "MongoDBAdminPassword": {
-            "AllowedPattern": "([A-Za-z0-9_@-]{8,32})",
-            "ConstraintDescription": "Input your MongoDB database password, Min 8, Maximum of 32 characters. . Allowed characters are: [A-Za-z0-9_@-]",
-            "Description": "Enter your MongoDB Database Password, Min 8, maximum of 32 characters.",
-            "NoEcho": "true",
-            "Type": "String"
-        },
-        "ReplicaShardIndex": {
-            "Description": "Shard Index of this replica set",
-            "Type": "String",
-            "Default": "0"
-        },
-        "QSS3BucketName": {
-            "AllowedPattern": "^[0-9a-zA-Z]+([0-9a-zA-Z-]*[0-9a-zA-Z])*$",
-            "Default": "quickstart-reference",
-            "Type": "String",
-            "ConstraintDescription": "Quick Start bucket name can include numbers, lowercase letters, uppercase letters, and hyphens (-). It cannot start or end with a hyphen (-).",
-            "Description": "S3 bucket name for the Quick Start assets. Quick Start bucket name can include numbers, lowercase letters, uppercase letters, and hyphens (-). It cannot start or end with a hyphen (-)."
-        },
-        "QSS3KeyPrefix": {
-            "AllowedPattern": "^[0-9a-zA-Z-/]*$",
-            "Default": "mongodb/latest/",
-            "Type": "String",
-            "ConstraintDescription": "Quick Start key prefix can include numbers, lowercase letters, uppercase letters, hyphens (-), and forward slash (/).",
-            "Description": "S3 key prefix for the Quick Start assets. Quick Start key prefix can include numbers, lowercase letters, uppercase letters, hyphens (-), and forward slash (/). It cannot start or end with a hyphen (-)."
-        },
-        "KeyPairName": {
-            "Type": "AWS::EC2::KeyPair::KeyName",
-            "Description": "Name of an existing EC2 KeyPair. MongoDB instances will launch with this KeyPair."
-        },
-        "VolumeSize": {
-            "Type": "String",
-            "Description": "EBS Volume Size (data) to be attached to node in GBs",
-            "Default": "400"
-        },
-        "VolumeType": {
-            "Type": "String",
-            "Description": "EBS Volume Type (data) to be attached to node in GBs [io1,gp2]",
-            "Default": "gp2",
-            "AllowedValues": [
-                "gp2",
-                "io1"
-            ]
-        },
-        "Iops": {
-            "Type": "String",
-            "Description": "Iops of EBS volume when io1 type is chosen. Otherwise ignored",
-            "Default": "100"
-        },
-        "NodeInstanceType": {
-            "Description": "Amazon EC2 instance type for the MongoDB nodes.",
-            "Type": "String",
-            "Default": "m4.large",
-            "AllowedValues": [
-                "m3.medium",
-                "m3.large",
-                "m3.xlarge",
-                "m3.2xlarge",
-                "m4.large",
-                "m4.xlarge",
-                "m4.2xlarge",
-                "m4.4xlarge",
-                "m4.10xlarge",
-                "c3.large",
-                "c3.xlarge",
-                "c3.2xlarge",
-                "c3.4xlarge",
-                "c3.8xlarge",
-                "r3.large",
-                "r3.xlarge",
-                "r3.2xlarge",
-                "r3.4xlarge",
-                "r3.8xlarge",
-                "i2.xlarge",
-                "i2.2xlarge",
-                "i2.4xlarge",
-                "i2.8xlarge"
-            ]
-        },
-        "VPC": {
-            "Type": "AWS::EC2::VPC::Id",
-            "Description": "VPC-ID of your existing Virtual Private Cloud (VPC) where you want to depoy MongoDB cluster.",
-            "AllowedPattern": "vpc-[0-9a-z]{8}"
-        },
-        "PrimaryNodeSubnet": {
-            "Type": "AWS::EC2::Subnet::Id",
-            "Description": "Subnet-ID the existing subnet in your VPC where you want to deploy Primary node(s).",
-            "AllowedPattern": "subnet-[0-9a-z]{8}"
-        },
-        "Secondary0NodeSubnet": {
-            "Type": "AWS::EC2::Subnet::Id",
-            "Description": "Subnet-ID the existing subnet in your VPC where you want to deploy Primary node(s).",
-            "AllowedPattern": "subnet-[0-9a-z]{8}"
-        },
-        "Secondary1NodeSubnet": {
-            "Type": "AWS::EC2::Subnet::Id",
-            "Description": "Subnet-ID the existing subnet in your VPC where you want to deploy Primary node(s).",
-            "AllowedPattern": "subnet-[0-9a-z]{8}"
-        }
-    },
-    "Conditions": {
-        "CreateThreeReplicaSet": {
-            "Fn::Equals": [
-                {
-                    "Ref": "ClusterReplicaSetCount"
-                },
-                "3"
-            ]
-        },
-        "GovCloudCondition": {
-            "Fn::Equals": [
-                {
-                    "Ref": "AWS::Region"
-                },
-                "us-gov-west-1"
-            ]
-        }
-    },
-    "Mappings": {
-        "AWSAMIRegionMap": {
-            "AMI": {
-                "AMZNLINUX": "amzn-ami-hvm-2017.09.1.20171120-x86_64-gp2"
-            },
-            "ap-northeast-1": {
-                "AMZNLINUX": "ami-da9e2cbc"
-            },
-            "ap-northeast-2": {
-                "AMZNLINUX": "ami-1196317f"
-            },
-            "ap-south-1": {
-                "AMZNLINUX": "ami-d5c18eba"
-            },
-            "ap-southeast-1": {
-                "AMZNLINUX": "ami-c63d6aa5"
-            },
-            "ap-southeast-2": {
-                "AMZNLINUX": "ami-ff4ea59d"
-            },
-            "ca-central-1": {
-                "AMZNLINUX": "ami-d29e25b6"
-            },
-            "eu-central-1": {
-                "AMZNLINUX": "ami-bf2ba8d0"
-            },
-            "eu-west-1": {
-                "AMZNLINUX": "ami-1a962263"
-            },
-            "eu-west-2": {
-                "AMZNLINUX": "ami-e7d6c983"
-            },
-            "sa-east-1": {
-                "AMZNLINUX": "ami-286f2a44"
-            },
-            "us-east-1": {
-                "AMZNLINUX": "ami-55ef662f"
-            },
-            "us-east-2": {
-                "AMZNLINUX": "ami-15e9c770"
-            },
-            "us-west-1": {
-                "AMZNLINUX": "ami-a51f27c5"
-            },
-            "us-west-2": {
-                "AMZNLINUX": "ami-bf4193c7"
-            }
-        }
-    },
-    "Resources": {
-        "MongoDBServerAccessSecurityGroup": {
-            "Type": "AWS::EC2::SecurityGroup",
-            "Properties": {
-                "VpcId": {
-                    "Ref": "VPC"
-                },
-                "GroupDescription": "Instances with access to MongoDB servers"
-            }
-        },
-        "MongoDBServerSecurityGroup": {
-            "Type": "AWS::EC2::SecurityGroup",
-            "Properties": {
-                "VpcId": {
-                    "Ref": "VPC"
-                },
-                "GroupDescription": "MongoDB server management and access ports",
-                "SecurityGroupIngress": [
-                    {
-                        "IpProtocol": "tcp",
-                        "FromPort": "22",
-                        "ToPort": "22",
-                        "SourceSecurityGroupId": {
-                            "Ref": "BastionSecurityGroupID"
-                        }
-                    },
-                    {
-                        "IpProtocol": "tcp",
-                        "FromPort": "27017",
-                        "ToPort": "27030",
-                        "SourceSecurityGroupId": {
-                            "Ref": "MongoDBServerAccessSecurityGroup"
-                        }
-                    },
-                    {
-                        "IpProtocol": "tcp",
-                        "FromPort": "28017",
-                        "ToPort": "28017",
-                        "SourceSecurityGroupId": {
-                            "Ref": "MongoDBServerAccessSecurityGroup"
-                        }
-                    }
-                ]
-            }
-        },
-        "MongoDBServersSecurityGroup": {
-            "Type": "AWS::EC2::SecurityGroup",
-            "Properties": {
-                "VpcId": {
-                    "Ref": "VPC"
-                },
-                "GroupDescription": "MongoDB inter-server communication and management ports",
-                "SecurityGroupIngress": [
-                    {
-                        "IpProtocol": "tcp",
-                        "FromPort": "22",
-                        "ToPort": "22",
-                        "SourceSecurityGroupId": {
-                            "Ref": "MongoDBServerSecurityGroup"
-                        }
-                    },
-                    {
-                        "IpProtocol": "tcp",
-                        "FromPort": "27017",
-                        "ToPort": "27030",
-                        "SourceSecurityGroupId": {
-                            "Ref": "MongoDBServerSecurityGroup"
-                        }
-                    },
-                    {
-                        "IpProtocol": "tcp",
-                        "FromPort": "28017",
-                        "ToPort": "28017",
-                        "SourceSecurityGroupId": {
-                            "Ref": "MongoDBServerSecurityGroup"
-                        }
-                    }
-                ]
-            }
-        },
-        "MongoDBNodeIAMRole": {
-            "Type": "AWS::IAM::Role",
-            "Properties": {
-                "AssumeRolePolicyDocument": {
-                    "Statement": [
-                        {
-                            "Effect": "Allow",
-                            "Principal": {
-                                "Service": [
-                                    "ec2.amazonaws.com"
-                                ]
-                            },
-                            "Action": [
-                                "sts:AssumeRole"
-                            ]
-                        }
-                    ]
-                },
-                "Path": "/",
-                "Policies": [
-                    {
-                        "PolicyName": "Backup",
-                        "PolicyDocument": {
-                            "Statement": [
-                                {
-                                    "Effect": "Allow",
-                                    "Action": [
-                                        "s3:*",
-                                        "ec2:Describe*",
-                                        "ec2:AttachNetworkInterface",
-                                        "ec2:AttachVolume",
-                                        "ec2:CreateTags",
-                                        "ec2:CreateVolume",
-                                        "ec2:RunInstances",
-                                        "ec2:StartInstances",
-                                        "ec2:DeleteVolume",
-                                        "ec2:CreateSecurityGroup",
-                                        "ec2:CreateSnapshot"
-                                    ],
-                                    "Resource": "*"
-                                },
-                                {
-                                    "Effect": "Allow",
-                                    "Action": [
-                                        "dynamodb:*",
-                                        "dynamodb:Scan",
-                                        "dynamodb:Query",
-                                        "dynamodb:GetItem",
-                                        "dynamodb:BatchGetItem",
-                                        "dynamodb:UpdateTable"
-                                    ],
-                                    "Resource": [
-                                        "*"
-                                    ]
-                                }
-                            ]
-                        }
-                    }
-                ]
-            }
-        },
-        "MongoDBNodeIAMProfile": {
-            "Type": "AWS::IAM::InstanceProfile",
-            "Properties": {
-                "Path": "/",
-                "Roles": [
-                    {
-                        "Ref": "MongoDBNodeIAMRole"
-                    }
-                ]
-            }
-        },
-        "PrimaryReplicaNode0WaitForNodeInstallWaitHandle": {
-            "Type": "AWS::CloudFormation::WaitConditionHandle",
-            "Properties": {}
-        },
-        "PrimaryReplicaNode0": {
-            "DependsOn": "PrimaryReplicaNode0WaitForNodeInstallWaitHandle",
-            "Type": "AWS::CloudFormation::Stack",
-            "Properties": {
-                "TemplateURL": {
-                    "Fn::Sub": [
-                        "https://${QSS3BucketName}.${QSS3Region}.amazonaws.com/${QSS3KeyPrefix}templates/mongodb-node.template",
-                        {
-                            "QSS3Region": {
-                                "Fn::If": [
-                                    "GovCloudCondition",
-                                    "s3-us-gov-west-1",
-                                    "s3"
-                                ]
-                            }
-                        }
-                    ]
-                },
-                "Parameters": {
-                    "QSS3BucketName": {
-                        "Ref": "QSS3BucketName"
-                    },
-                    "QSS3KeyPrefix": {
-                        "Ref": "QSS3KeyPrefix"
-                    },
-                    "ClusterReplicaSetCount": {
-                        "Ref": "ClusterReplicaSetCount"
-                    },
-                    "Iops": {
-                        "Ref": "Iops"
-                    },
-                    "KeyName": {
-                        "Ref": "KeyPairName"
-                    },
-                    "MongoDBVersion": {
-                        "Ref": "MongoDBVersion"
-                    },
-                    "MongoDBAdminUsername": {
-                        "Ref": "MongoDBAdminUsername"
-                    },
-                    "MongoDBAdminPassword": {
-                        "Ref": "MongoDBAdminPassword"
-                    },
-                    "NodeInstanceType": {
-                        "Ref": "NodeInstanceType"
-                    },
-                    "NodeSubnet": {
-                        "Ref": "PrimaryNodeSubnet"
-                    },
-                    "MongoDBServerSecurityGroupID": {
-                        "Ref": "MongoDBServerSecurityGroup"
-                    },
-                    "MongoDBServersSecurityGroupID": {
-                        "Ref": "MongoDBServersSecurityGroup"
-                    },
-                    "MongoDBNodeIAMProfileID": {
-                        "Ref": "MongoDBNodeIAMProfile"
-                    },
-                    "VPC": {
-                        "Ref": "VPC"
-                    },
-                    "VolumeSize": {
-                        "Ref": "VolumeSize"
-                    },
-                    "VolumeType": {
-                        "Ref": "VolumeType"
-                    },
-                    "StackName": {
-                        "Ref": "AWS::StackName"
-                    },
-                    "ImageId": {
-                        "Fn::FindInMap": [
-                            "AWSAMIRegionMap",
-                            {
-                                "Ref": "AWS::Region"
-                            },
-                            "AMZNLINUX"
-                        ]
-                    },
-                    "ReplicaNodeNameTag": "PrimaryReplicaNode0",
-                    "NodeReplicaSetIndex": "0",
-                    "ReplicaShardIndex": {
-                        "Ref": "ReplicaShardIndex"
-                    },
-                    "ReplicaNodeWaitForNodeInstallWaitHandle": {
-                        "Ref": "PrimaryReplicaNode0WaitForNodeInstallWaitHandle"
-                    }
-                }
-            }
-        },
-        "PrimaryReplicaNode0WaitForNodeInstall": {
-            "Type": "AWS::CloudFormation::WaitCondition",
-            "DependsOn": "PrimaryReplicaNode0",
-            "Properties": {
-                "Handle": {
-                    "Ref": "PrimaryReplicaNode0WaitForNodeInstallWaitHandle"
-                },
-                "Timeout": "3600"
-            }
-        },
-        "SecondaryReplicaNode0WaitForNodeInstallWaitHandle": {
-            "Type": "AWS::CloudFormation::WaitConditionHandle",
-            "Properties": {},
-            "Condition": "CreateThreeReplicaSet"
-        },
-        "SecondaryReplicaNode0": {
-            "DependsOn": "SecondaryReplicaNode0WaitForNodeInstallWaitHandle",
-            "Condition": "CreateThreeReplicaSet",
-            "Type": "AWS::CloudFormation::Stack",
-            "Properties": {
-                "TemplateURL": {
-                    "Fn::Sub": [
-                        "https://${QSS3BucketName}.${QSS3Region}.amazonaws.com/${QSS3KeyPrefix}templates/mongodb-node.template",
-                        {
-                            "QSS3Region": {
-                                "Fn::If": [
-                                    "GovCloudCondition",
-                                    "s3-us-gov-west-1",
-                                    "s3"
-                                ]
-                            }
-                        }
-                    ]
-                },
-                "Parameters": {
-                    "QSS3BucketName": {
-                        "Ref": "QSS3BucketName"
-                    },
-                    "QSS3KeyPrefix": {
-                        "Ref": "QSS3KeyPrefix"
-                    },
-                    "ClusterReplicaSetCount": {
-                        "Ref": "ClusterReplicaSetCount"
-                    },
-                    "Iops": {
-                        "Ref": "Iops"
-                    },
-                    "KeyName": {
-                        "Ref": "KeyPairName"
-                    },
-                    "MongoDBVersion": {
-                        "Ref": "MongoDBVersion"
-                    },
-                    "MongoDBAdminUsername": {
-                        "Ref": "MongoDBAdminUsername"
-                    },
-                    "MongoDBAdminPassword": {
-                        "Ref": "MongoDBAdminPassword"
-                    },
-                    "NodeInstanceType": {
-                        "Ref": "NodeInstanceType"
-                    },
-                    "NodeSubnet": {
-                        "Ref": "Secondary0NodeSubnet"
-                    },
-                    "MongoDBServerSecurityGroupID": {
-                        "Ref": "MongoDBServerSecurityGroup"
-                    },
-                    "MongoDBServersSecurityGroupID": {
-                        "Ref": "MongoDBServersSecurityGroup"
-                    },
-                    "MongoDBNodeIAMProfileID": {
-                        "Ref": "MongoDBNodeIAMProfile"
-                    },
-                    "VPC": {
-                        "Ref": "VPC"
-                    },
-                    "VolumeSize": {
-                        "Ref": "VolumeSize"
-                    },
-                    "VolumeType": {
-                        "Ref": "VolumeType"
-                    },
-                    "StackName": {
-                        "Ref": "AWS::StackName"
-                    },
-                    "ImageId": {
-                        "Fn::FindInMap": [
-                            "AWSAMIRegionMap",
-                            {
-                                "Ref": "AWS::Region"
-                            },
-                            "AMZNLINUX"
-                        ]
-                    },
-                    "ReplicaNodeNameTag": "SecondaryReplicaNode0",
-                    "NodeReplicaSetIndex": "1",
-                    "ReplicaShardIndex": {
-                        "Ref": "ReplicaShardIndex"
-                    },
-                    "ReplicaNodeWaitForNodeInstallWaitHandle": {
-                        "Ref": "SecondaryReplicaNode0WaitForNodeInstallWaitHandle"
-                    }
-                }
-            }
-        },
-        "SecondaryReplicaNode0WaitForNodeInstall": {
-            "Type": "AWS::CloudFormation::WaitCondition",
-            "Condition": "CreateThreeReplicaSet",
-            "DependsOn": "SecondaryReplicaNode0",
-            "Properties": {
-                "Handle": {
-                    "Ref": "SecondaryReplicaNode0WaitForNodeInstallWaitHandle"
-                },
-                "Timeout": "3600"
-            }
-        },
-        "SecondaryReplicaNode1WaitForNodeInstallWaitHandle": {
-            "Type": "AWS::CloudFormation::WaitConditionHandle",
-            "Properties": {},
-            "Condition": "CreateThreeReplicaSet"
-        },
-        "SecondaryReplicaNode1": {
-            "DependsOn": "SecondaryReplicaNode1WaitForNodeInstallWaitHandle",
-            "Condition": "CreateThreeReplicaSet",
-            "Type": "AWS::CloudFormation::Stack",
-            "Properties": {
-                "TemplateURL": {
-                    "Fn::Sub": [
-                        "https://${QSS3BucketName}.${QSS3Region}.amazonaws.com/${QSS3KeyPrefix}templates/mongodb-node.template",
-                        {
-                            "QSS3Region": {
-                                "Fn::If": [
-                                    "GovCloudCondition",
-                                    "s3-us-gov-west-1",
-                                    "s3"
-                                ]
-                            }
-                        }
-                    ]
-                },
-                "Parameters": {
-                    "QSS3BucketName": {
-                        "Ref": "QSS3BucketName"
-                    },
-                    "QSS3KeyPrefix": {
-                        "Ref": "QSS3KeyPrefix"
-                    },
-                    "ClusterReplicaSetCount": {
-                        "Ref": "ClusterReplicaSetCount"
-                    },
-                    "Iops": {
-                        "Ref": "Iops"
-                    },
-                    "KeyName": {
-                        "Ref": "KeyPairName"
-                    },
-                    "MongoDBVersion": {
-                        "Ref": "MongoDBVersion"
-                    },
-                    "MongoDBAdminUsername": {
-                        "Ref": "MongoDBAdminUsername"
-                    },
-                    "MongoDBAdminPassword": {
-                        "Ref": "MongoDBAdminPassword"
-                    },
-                    "NodeInstanceType": {
-                        "Ref": "NodeInstanceType"
-                    },
-                    "NodeSubnet": {
-                        "Ref": "Secondary1NodeSubnet"
-                    },
-                    "MongoDBServerSecurityGroupID": {
-                        "Ref": "MongoDBServerSecurityGroup"
-                    },
-                    "MongoDBServersSecurityGroupID": {
-                        "Ref": "MongoDBServersSecurityGroup"
-                    },
-                    "MongoDBNodeIAMProfileID": {
-                        "Ref": "MongoDBNodeIAMProfile"
-                    },
-                    "VPC": {
-                        "Ref": "VPC"
-                    },
-                    "VolumeSize": {
-                        "Ref": "VolumeSize"
-                    },
-                    "VolumeType": {
-                        "Ref": "VolumeType"
-                    },
-                    "StackName": {
-                        "Ref": "AWS::StackName"
-                    },
-                    "ImageId": {
-                        "Fn::FindInMap": [
-                            "AWSAMIRegionMap",
-                            {
-                                "Ref": "AWS::Region"
-                            },
-                            "AMZNLINUX"
-                        ]
-                    },
-                    "ReplicaNodeNameTag": "SecondaryReplicaNode1",
-                    "NodeReplicaSetIndex": "2",
-                    "ReplicaShardIndex": {
-                        "Ref": "ReplicaShardIndex"
-                    },
-                    "ReplicaNodeWaitForNodeInstallWaitHandle": {
-                        "Ref": "SecondaryReplicaNode1WaitForNodeInstallWaitHandle"
-                    }
-                }
-            }
-        },
-        "SecondaryReplicaNode1WaitForNodeInstall": {
-            "Type": "AWS::CloudFormation::WaitCondition",
-            "Condition": "CreateThreeReplicaSet",
-            "DependsOn": "SecondaryReplicaNode1",
-            "Properties": {
-                "Handle": {
-                    "Ref": "SecondaryReplicaNode1WaitForNodeInstallWaitHandle"
-                },
-                "Timeout": "3600"
-            }
-        }
-    },
-    "Outputs": {
-        "PrimaryReplicaNodeIp": {
-            "Value": {
-                "Fn::GetAtt": [
-                    "PrimaryReplicaNode0",
-                    "Outputs.NodePrivateIp"
-                ]
-            },
-            "Description": "Private IP Address of Primary Replica Node"
-        },
-        "SecondaryReplicaNode0Ip": {
-            "Value": {
-                "Fn::GetAtt": [
-                    "SecondaryReplicaNode0",
-                    "Outputs.NodePrivateIp"
-                ]
-            },
-            "Description": "Private IP Address of Secondary Replica 0 Node",
-            "Condition": "CreateThreeReplicaSet"
-        },
-        "SecondaryReplicaNode1Ip": {
-            "Value": {
-                "Fn::GetAtt": [
-                    "SecondaryReplicaNode1",
-                    "Outputs.NodePrivateIp"
-                ]
-            },
-            "Description": "Private IP Address of Secondary Replica 1 Node",
-            "Condition": "CreateThreeReplicaSet"
-        },
-        "MongoDBServerAccessSecurityGroup": {
-            "Value": {
-                "Ref": "MongoDBServerAccessSecurityGroup"
-            },
-            "Description": "MongoDB Access Security Group"
-        }
-    }
+import (
+	"errors"
+	"strconv"
+)
+
+const (
+	// MaxReplicaSetMembers is the largest number of data bearing members
+	// a replica set in the MongoDB templates can have.
+	MaxReplicaSetMembers = 7
+	// NodeSubnetCount is the number of entries the NodeSubnets parameter
+	// must have: one for each data bearing member and one for the arbiter.
+	NodeSubnetCount = MaxReplicaSetMembers + 1
+
+	configServerCount = 3
+	shardNodePort     = "27017"
+	configServerPort  = "27019"
+	nodeWaitTimeout   = "3600"
+
+	databaseConfigurationGroup = "MongoDB Database Configuration"
+)
+
+// MongoDBStackOptions selects the shape of the generated stack. The zero
+// value builds a single replica set.
+type MongoDBStackOptions struct {
+	// ShardCount is the number of shards of a sharded cluster.
+	ShardCount int
+	// MongosCount is the number of mongos query routers of a sharded
+	// cluster.
+	MongosCount int
+	// TLS requires TLS for every connection to the nodes. The nodes issue
+	// their server certificates from the instance's certificate authority,
+	// passed in as parameters.
+	TLS bool
+	// EncryptedVolumes encrypts the EBS volumes of every node, with the KMS
+	// key given as a parameter or the account's default EBS key.
+	EncryptedVolumes bool
+	// Alarms adds CloudWatch alarms for every node, notifying the SNS
+	// topic given as a parameter.
+	Alarms bool
+	// Exporter installs mongodb_exporter on every node, reachable from the
+	// security group given as a parameter.
+	Exporter bool
+}
+
+func (o MongoDBStackOptions) Sharded() bool {
+	return o.ShardCount != 0 || o.MongosCount != 0
+}
+
+// BuildMongoDBStack renders the MongoDB stack template for the options.
+func BuildMongoDBStack(options MongoDBStackOptions) ([]byte, error) {
+	template, err := NewMongoDBStack(options)
+	if err != nil {
+		return nil, err
+	}
+	return template.Marshal()
+}
+
+// NewMongoDBStack builds the MongoDB stack template for the options. A
+// replica set is sized by the ClusterReplicaSetCount and ArbiterCount
+// parameters. A sharded cluster has ShardCount replica sets sized the same
+// way, a three member config server replica set and MongosCount query
+// routers. Every node is launched from the nested node template.
+func NewMongoDBStack(options MongoDBStackOptions) (*Template, error) {
+	if options.Sharded() {
+		if options.ShardCount < 1 {
+			return nil, errors.New("Error building sharded MongoDB template: shard count must be at least 1")
+		}
+		if options.MongosCount < 1 {
+			return nil, errors.New("Error building sharded MongoDB template: mongos count must be at least 1")
+		}
+	}
+
+	template := &Template{
+		AWSTemplateFormatVersion: "2010-09-09",
+		Description:              "(000F) Deploy MongoDB Replica Set on AWS (Existing VPC)",
+		Metadata:                 mongoDBMetadata(),
+		Parameters:               mongoDBParameters(),
+		Conditions:               mongoDBConditions(),
+		Mappings:                 amiRegionMappings(),
+	}
+	addSecurityResources(template)
+
+	if options.Sharded() {
+		template.Description = "(000F) Deploy sharded MongoDB cluster on AWS (Existing VPC)"
+		template.Parameters.Add("MongoDBClusterKey", Parameter{
+			Description: "Shared key file contents used for authentication between cluster members",
+			NoEcho:      "true",
+			Type:        "String",
+			MinLength:   "6",
+			MaxLength:   "1024",
+			keyOrder:    []string{"Description", "NoEcho", "Type", "MinLength", "MaxLength"},
+		})
+		template.Metadata.AddToGroup(databaseConfigurationGroup, "MongoDBClusterKey", "MongoDB Cluster Key")
+		addShardedCluster(template, options)
+	} else {
+		addReplicaSet(template)
+	}
+
+	if options.TLS {
+		addTLS(template)
+	}
+	if options.EncryptedVolumes {
+		addVolumeEncryption(template)
+	}
+	if options.Alarms {
+		addAlarms(template)
+	}
+	if options.Exporter {
+		addExporter(template)
+	}
+
+	template.Outputs.Add("MongoDBServerAccessSecurityGroup", Output{
+		Value:       Ref("MongoDBServerAccessSecurityGroup"),
+		Description: "MongoDB Access Security Group",
+	})
+	return template, nil
+}
+
+var typeFirstKeyOrder = []string{"Type", "Description", "Default", "AllowedValues", "AllowedPattern"}
+
+func mongoDBParameters() Parameters {
+	var parameters Parameters
+	parameters.Add("BastionSecurityGroupID", Parameter{
+		Description: "ID of the Bastion Security Group (e.g., sg-7f16e910)",
+		Type:        "AWS::EC2::SecurityGroup::Id",
+	})
+	parameters.Add("ClusterReplicaSetCount", Parameter{
+		Description:   "Number of data bearing Replica Set Members. Choose 1 to " + strconv.Itoa(MaxReplicaSetMembers),
+		Type:          "String",
+		Default:       "1",
+		AllowedValues: countValues(1, MaxReplicaSetMembers),
+	})
+	parameters.Add("ArbiterCount", Parameter{
+		Description:   "Number of Arbiters added to the Replica Set. Choose 0 or 1",
+		Type:          "String",
+		Default:       "0",
+		AllowedValues: []string{"0", "1"},
+	})
+	parameters.Add("MongoDBVersion", Parameter{
+		Description:   "MongoDB version",
+		Type:          "String",
+		Default:       "3.4",
+		AllowedValues: []string{"3.4", "3.2"},
+	})
+	parameters.Add("MongoDBAdminUsername", Parameter{
+		Default:               "admin",
+		NoEcho:                "true",
+		Description:           "MongoDB admin account username",
+		Type:                  "String",
+		MinLength:             "1",
+		MaxLength:             "16",
+		AllowedPattern:        "[a-zA-Z][a-zA-Z0-9]*",
+		ConstraintDescription: "must begin with a letter and contain only alphanumeric characters.",
+		keyOrder:              []string{"Default", "NoEcho", "Description", "Type", "MinLength", "MaxLength"},
+	})
+	parameters.Add("MongoDBAdminPassword", Parameter{
+		AllowedPattern:        "([A-Za-z0-9_@-]{8,32})",
+		ConstraintDescription: "Input your MongoDB database password, Min 8, Maximum of 32 characters. . Allowed characters are: [A-Za-z0-9_@-]",
+		Description:           "Enter your MongoDB Database Password, Min 8, maximum of 32 characters.",
+		NoEcho:                "true",
+		Type:                  "String",
+		keyOrder:              []string{"AllowedPattern", "ConstraintDescription", "Description", "NoEcho", "Type"},
+	})
+	parameters.Add("ReplicaShardIndex", Parameter{
+		Description: "Shard Index of this replica set",
+		Type:        "String",
+		Default:     "0",
+	})
+	parameters.Add("QSS3BucketName", Parameter{
+		AllowedPattern:        "^[0-9a-zA-Z]+([0-9a-zA-Z-]*[0-9a-zA-Z])*$",
+		Default:               "quickstart-reference",
+		Type:                  "String",
+		ConstraintDescription: "Quick Start bucket name can include numbers, lowercase letters, uppercase letters, and hyphens (-). It cannot start or end with a hyphen (-).",
+		Description:           "S3 bucket name for the Quick Start assets. Quick Start bucket name can include numbers, lowercase letters, uppercase letters, and hyphens (-). It cannot start or end with a hyphen (-).",
+		keyOrder:              []string{"AllowedPattern", "Default", "Type", "ConstraintDescription"},
+	})
+	parameters.Add("QSS3KeyPrefix", Parameter{
+		AllowedPattern:        "^[0-9a-zA-Z-/]*$",
+		Default:               "mongodb/latest/",
+		Type:                  "String",
+		ConstraintDescription: "Quick Start key prefix can include numbers, lowercase letters, uppercase letters, hyphens (-), and forward slash (/).",
+		Description:           "S3 key prefix for the Quick Start assets. Quick Start key prefix can include numbers, lowercase letters, uppercase letters, hyphens (-), and forward slash (/). It cannot start or end with a hyphen (-).",
+		keyOrder:              []string{"AllowedPattern", "Default", "Type", "ConstraintDescription"},
+	})
+	parameters.Add("KeyPairName", Parameter{
+		Type:        "AWS::EC2::KeyPair::KeyName",
+		Description: "Name of an existing EC2 KeyPair. MongoDB instances will launch with this KeyPair.",
+		keyOrder:    typeFirstKeyOrder,
+	})
+	parameters.Add("VolumeSize", Parameter{
+		Type:        "String",
+		Description: "EBS Volume Size (data) to be attached to node in GBs",
+		Default:     "400",
+		keyOrder:    typeFirstKeyOrder,
+	})
+	parameters.Add("VolumeType", Parameter{
+		Type:          "String",
+		Description:   "EBS Volume Type (data) to be attached to node in GBs [io1,gp2]",
+		Default:       "gp2",
+		AllowedValues: []string{"gp2", "io1"},
+		keyOrder:      typeFirstKeyOrder,
+	})
+	parameters.Add("Iops", Parameter{
+		Type:        "String",
+		Description: "Iops of EBS volume when io1 type is chosen. Otherwise ignored",
+		Default:     "100",
+		keyOrder:    typeFirstKeyOrder,
+	})
+	parameters.Add("NodeInstanceType", Parameter{
+		Description: "Amazon EC2 instance type for the MongoDB nodes.",
+		Type:        "String",
+		Default:     "m4.large",
+		AllowedValues: []string{
+			"m3.medium", "m3.large", "m3.xlarge", "m3.2xlarge",
+			"m4.large", "m4.xlarge", "m4.2xlarge", "m4.4xlarge", "m4.10xlarge",
+			"c3.large", "c3.xlarge", "c3.2xlarge", "c3.4xlarge", "c3.8xlarge",
+			"r3.large", "r3.xlarge", "r3.2xlarge", "r3.4xlarge", "r3.8xlarge",
+			"i2.xlarge", "i2.2xlarge", "i2.4xlarge", "i2.8xlarge",
+		},
+	})
+	parameters.Add("VPC", Parameter{
+		Type:           "AWS::EC2::VPC::Id",
+		Description:    "VPC-ID of your existing Virtual Private Cloud (VPC) where you want to depoy MongoDB cluster.",
+		AllowedPattern: "vpc-[0-9a-z]{8}",
+		keyOrder:       typeFirstKeyOrder,
+	})
+	parameters.Add("NodeSubnets", Parameter{
+		Type:        "List<AWS::EC2::Subnet::Id>",
+		Description: "Subnet-IDs of the existing subnets in your VPC, one for each Replica Set Member in order followed by one for the Arbiter. Members are spread across AZs by listing subnets in different AZs in turn.",
+		keyOrder:    typeFirstKeyOrder,
+	})
+	return parameters
+}
+
+func mongoDBMetadata() Metadata {
+	return Metadata{
+		Interface: ParameterInterface{
+			ParameterGroups: []ParameterGroup{
+				{
+					Label:      Label{Default: "Network Configuration"},
+					Parameters: []string{"VPC", "NodeSubnets", "BastionSecurityGroupID"},
+				},
+				{
+					Label:      Label{Default: "Security Configuration"},
+					Parameters: []string{"KeyPairName"},
+				},
+				{
+					Label: Label{Default: databaseConfigurationGroup},
+					Parameters: []string{
+						"ArbiterCount",
+						"ClusterReplicaSetCount",
+						"Iops",
+						"MongoDBVersion",
+						"MongoDBAdminUsername",
+						"MongoDBAdminPassword",
+						"NodeInstanceType",
+						"ReplicaShardIndex",
+						"VolumeSize",
+						"VolumeType",
+					},
+				},
+				{
+					Label:      Label{Default: "AWS Quick Start Configuration"},
+					Parameters: []string{"QSS3BucketName", "QSS3KeyPrefix"},
+				},
+			},
+			ParameterLabels: map[string]Label{
+				"ArbiterCount":           {Default: "Arbiter Count"},
+				"BastionSecurityGroupID": {Default: "Bastion Security Group ID"},
+				"ClusterReplicaSetCount": {Default: "Cluster Replica Set Count"},
+				"Iops":                   {Default: "Iops"},
+				"KeyPairName":            {Default: "Key Pair Name"},
+				"MongoDBAdminPassword":   {Default: "MongoDB Admin Password"},
+				"MongoDBAdminUsername":   {Default: "MongoDB Admin Username"},
+				"MongoDBVersion":         {Default: "MongoDB Version"},
+				"NodeInstanceType":       {Default: "Node Instance Type"},
+				"NodeSubnets":            {Default: "Node Subnets"},
+				"QSS3BucketName":         {Default: "Quick Start S3 Bucket Name"},
+				"QSS3KeyPrefix":          {Default: "Quick Start S3 Key Prefix"},
+				"ReplicaShardIndex":      {Default: "Replica Shard Index"},
+				"VPC":                    {Default: "VPC"},
+				"VolumeSize":             {Default: "Volume Size"},
+				"VolumeType":             {Default: "Volume Type"},
+			},
+		},
+	}
+}
+
+// mongoDBConditions declares a condition for each secondary, true when
+// ClusterReplicaSetCount is large enough to include it, and one for the
+// arbiter.
+func mongoDBConditions() Conditions {
+	var conditions Conditions
+	for secondary := 0; secondary < MaxReplicaSetMembers-1; secondary++ {
+		var smallerCounts []Intrinsic
+		for count := 1; count <= secondary+1; count++ {
+			smallerCounts = append(smallerCounts, Equals(Ref("ClusterReplicaSetCount"), strconv.Itoa(count)))
+		}
+		if len(smallerCounts) == 1 {
+			conditions.Add(secondaryCondition(secondary), Not(smallerCounts[0]))
+		} else {
+			conditions.Add(secondaryCondition(secondary), Not(Or(smallerCounts...)))
+		}
+	}
+	conditions.Add("CreateArbiter", Equals(Ref("ArbiterCount"), "1"))
+	conditions.Add("GovCloudCondition", Equals(Ref("AWS::Region"), "us-gov-west-1"))
+	return conditions
+}
+
+func secondaryCondition(secondary int) string {
+	return "CreateSecondaryReplicaNode" + strconv.Itoa(secondary)
+}
+
+func amiRegionMappings() Mappings {
+	regions := map[string]string{
+		"AMI":            "amzn-ami-hvm-2017.09.1.20171120-x86_64-gp2",
+		"ap-northeast-1": "ami-da9e2cbc",
+		"ap-northeast-2": "ami-1196317f",
+		"ap-south-1":     "ami-d5c18eba",
+		"ap-southeast-1": "ami-c63d6aa5",
+		"ap-southeast-2": "ami-ff4ea59d",
+		"ca-central-1":   "ami-d29e25b6",
+		"eu-central-1":   "ami-bf2ba8d0",
+		"eu-west-1":      "ami-1a962263",
+		"eu-west-2":      "ami-e7d6c983",
+		"sa-east-1":      "ami-286f2a44",
+		"us-east-1":      "ami-55ef662f",
+		"us-east-2":      "ami-15e9c770",
+		"us-west-1":      "ami-a51f27c5",
+		"us-west-2":      "ami-bf4193c7",
+	}
+	mapping := map[string]map[string]string{}
+	for region, ami := range regions {
+		mapping[region] = map[string]string{"AMZNLINUX": ami}
+	}
+	return Mappings{"AWSAMIRegionMap": mapping}
+}
+
+func addSecurityResources(template *Template) {
+	template.Resources.Add("MongoDBServerAccessSecurityGroup", NewSecurityGroup(
+		Ref("VPC"),
+		"Instances with access to MongoDB servers",
+	))
+	template.Resources.Add("MongoDBServerSecurityGroup", NewSecurityGroup(
+		Ref("VPC"),
+		"MongoDB server management and access ports",
+		TCPIngress("22", "22", Ref("BastionSecurityGroupID")),
+		TCPIngress("27017", "27030", Ref("MongoDBServerAccessSecurityGroup")),
+		TCPIngress("28017", "28017", Ref("MongoDBServerAccessSecurityGroup")),
+	))
+	template.Resources.Add("MongoDBServersSecurityGroup", NewSecurityGroup(
+		Ref("VPC"),
+		"MongoDB inter-server communication and management ports",
+		TCPIngress("22", "22", Ref("MongoDBServerSecurityGroup")),
+		TCPIngress("27017", "27030", Ref("MongoDBServerSecurityGroup")),
+		TCPIngress("28017", "28017", Ref("MongoDBServerSecurityGroup")),
+	))
+	template.Resources.Add("MongoDBNodeIAMRole", IAMRole{
+		Type: "AWS::IAM::Role",
+		Properties: IAMRoleProperties{
+			AssumeRolePolicyDocument: PolicyDocument{
+				Statement: []Statement{{
+					Effect:    "Allow",
+					Principal: &Principal{Service: []string{"ec2.amazonaws.com"}},
+					Action:    []string{"sts:AssumeRole"},
+				}},
+			},
+			Path: "/",
+			Policies: []Policy{{
+				PolicyName: "Backup",
+				PolicyDocument: PolicyDocument{
+					Statement: []Statement{
+						{
+							Effect: "Allow",
+							Action: []string{
+								"s3:*",
+								"ec2:Describe*",
+								"ec2:AttachNetworkInterface",
+								"ec2:AttachVolume",
+								"ec2:CreateTags",
+								"ec2:CreateVolume",
+								"ec2:RunInstances",
+								"ec2:StartInstances",
+								"ec2:DeleteVolume",
+								"ec2:CreateSecurityGroup",
+								"ec2:CreateSnapshot",
+							},
+							Resource: "*",
+						},
+						{
+							Effect: "Allow",
+							Action: []string{
+								"dynamodb:*",
+								"dynamodb:Scan",
+								"dynamodb:Query",
+								"dynamodb:GetItem",
+								"dynamodb:BatchGetItem",
+								"dynamodb:UpdateTable",
+							},
+							Resource: []string{"*"},
+						},
+					},
+				},
+			}},
+		},
+	})
+	template.Resources.Add("MongoDBNodeIAMProfile", IAMInstanceProfile{
+		Type: "AWS::IAM::InstanceProfile",
+		Properties: IAMInstanceProfileProperties{
+			Path:  "/",
+			Roles: []interface{}{Ref("MongoDBNodeIAMRole")},
+		},
+	})
+}
+
+func addReplicaSet(template *Template) {
+	primary := newNodeStack("PrimaryReplicaNode0", nodeSubnet("0"))
+	primary.Properties.Parameters.NodeReplicaSetIndex = "0"
+	addNode(template, "PrimaryReplicaNode0", primary, "")
+	template.Outputs.Add("PrimaryReplicaNodeIp", Output{
+		Value:       nodeIp("PrimaryReplicaNode0"),
+		Description: "Private IP Address of Primary Replica Node",
+	})
+
+	for secondary := 0; secondary < MaxReplicaSetMembers-1; secondary++ {
+		name := "SecondaryReplicaNode" + strconv.Itoa(secondary)
+		node := newNodeStack(name, nodeSubnet(strconv.Itoa(secondary+1)))
+		node.Properties.Parameters.NodeReplicaSetIndex = strconv.Itoa(secondary + 1)
+		addNode(template, name, node, secondaryCondition(secondary))
+		template.Outputs.Add(name+"Ip", Output{
+			Value:       nodeIp(name),
+			Description: "Private IP Address of Secondary Replica " + strconv.Itoa(secondary) + " Node",
+			Condition:   secondaryCondition(secondary),
+		})
+	}
+
+	arbiter := newNodeStack("ArbiterReplicaNode0", nodeSubnet(Ref("ClusterReplicaSetCount")))
+	arbiter.Properties.Parameters.NodeReplicaSetIndex = Ref("ClusterReplicaSetCount")
+	arbiter.Properties.Parameters.NodeRole = "arbiter"
+	addNode(template, "ArbiterReplicaNode0", arbiter, "CreateArbiter")
+	template.Outputs.Add("ArbiterReplicaNodeIp", Output{
+		Value:       nodeIp("ArbiterReplicaNode0"),
+		Description: "Private IP Address of Arbiter Replica Node",
+		Condition:   "CreateArbiter",
+	})
+}
+
+func addShardedCluster(template *Template, options MongoDBStackOptions) {
+	var configServerNames, configServerWaits []string
+	var configServerHosts []interface{}
+	for i := 0; i < configServerCount; i++ {
+		name := nodeName("ConfigServerNode", i)
+		node := newShardedNodeStack(name, nodeSubnet(strconv.Itoa(i)))
+		node.Properties.Parameters.NodeRole = "configsvr"
+		node.Properties.Parameters.ClusterReplicaSetCount = strconv.Itoa(configServerCount)
+		node.Properties.Parameters.ArbiterCount = "0"
+		node.Properties.Parameters.NodeReplicaSetIndex = strconv.Itoa(i)
+		node.Properties.Parameters.ReplicaShardIndex = "0"
+		addNode(template, name, node, "")
+		if i > 0 {
+			configServerHosts = append(configServerHosts, ",")
+		}
+		configServerHosts = append(configServerHosts, nodeIp(name), ":"+configServerPort)
+		configServerNames = append(configServerNames, name)
+		configServerWaits = append(configServerWaits, name+"WaitForNodeInstall")
+	}
+
+	var shardHosts []interface{}
+	var shardWaits []string
+	for shard := 0; shard < options.ShardCount; shard++ {
+		prefix := "Shard" + strconv.Itoa(shard) + "Node"
+		for member := 0; member < MaxReplicaSetMembers; member++ {
+			name := nodeName(prefix, member)
+			node := newShardedNodeStack(name, nodeSubnet(strconv.Itoa(member)))
+			node.Properties.Parameters.NodeRole = "shardsvr"
+			node.Properties.Parameters.NodeReplicaSetIndex = strconv.Itoa(member)
+			node.Properties.Parameters.ReplicaShardIndex = strconv.Itoa(shard)
+			condition := ""
+			if member > 0 {
+				condition = secondaryCondition(member - 1)
+			}
+			addNode(template, name, node, condition)
+		}
+		arbiter := "Arbiter" + prefix + "0"
+		node := newShardedNodeStack(arbiter, nodeSubnet(Ref("ClusterReplicaSetCount")))
+		node.Properties.Parameters.NodeRole = "arbiter"
+		node.Properties.Parameters.NodeReplicaSetIndex = Ref("ClusterReplicaSetCount")
+		node.Properties.Parameters.ReplicaShardIndex = strconv.Itoa(shard)
+		addNode(template, arbiter, node, "CreateArbiter")
+
+		primary := nodeName(prefix, 0)
+		if shard > 0 {
+			shardHosts = append(shardHosts, ";")
+		}
+		shardHosts = append(shardHosts, "s"+strconv.Itoa(shard)+"/", nodeIp(primary), ":"+shardNodePort)
+		shardWaits = append(shardWaits, primary+"WaitForNodeInstall")
+	}
+
+	var mongosNames []string
+	for i := 0; i < options.MongosCount; i++ {
+		name := "MongosNode" + strconv.Itoa(i)
+		node := newShardedNodeStack(name, nodeSubnet(strconv.Itoa(i%NodeSubnetCount)))
+		node.DependsOn = append([]string{name + "WaitForNodeInstallWaitHandle"}, append(configServerWaits, shardWaits...)...)
+		node.Properties.Parameters.NodeRole = "mongos"
+		node.Properties.Parameters.ClusterReplicaSetCount = "1"
+		node.Properties.Parameters.ArbiterCount = "0"
+		node.Properties.Parameters.NodeReplicaSetIndex = strconv.Itoa(i)
+		node.Properties.Parameters.ReplicaShardIndex = "0"
+		node.Properties.Parameters.ConfigServerHosts = Join("", append([]interface{}{"cfg/"}, configServerHosts...)...)
+		node.Properties.Parameters.ShardHosts = Join("", shardHosts...)
+		addNode(template, name, node, "")
+		mongosNames = append(mongosNames, name)
+	}
+
+	template.Outputs.Add("MongosNodeIps", nodeIpsOutput("Private IP Addresses of Mongos Nodes", mongosNames))
+	template.Outputs.Add("ConfigServerNodeIps", nodeIpsOutput("Private IP Addresses of Config Server Nodes", configServerNames))
+	for shard := 0; shard < options.ShardCount; shard++ {
+		template.Outputs.Add("Shard"+strconv.Itoa(shard)+"PrimaryNodeIp", Output{
+			Value:       nodeIp(nodeName("Shard"+strconv.Itoa(shard)+"Node", 0)),
+			Description: "Private IP Address of Primary Node of Shard " + strconv.Itoa(shard),
+		})
+	}
+}
+
+// addTLS adds the certificate authority parameters and passes them on to
+// every node. The CA certificate is an output so that bindings can hand it
+// to clients, and the expiry is one so that it can be tracked.
+//
+// The CA private key is never passed through the template, where
+// DescribeStackResource would show it in the nodes' metadata. The nodes
+// fetch it from the SSM SecureString parameter named by
+// MongoDBCAKeyParameter, which their role may read.
+func addTLS(template *Template) {
+	template.Parameters.Add("MongoDBCACertificate", Parameter{
+		Description: "PEM encoded certificate of the certificate authority issuing the node certificates",
+		Type:        "String",
+	})
+	template.Parameters.Add("MongoDBCAKeyParameter", Parameter{
+		Description: "Name of the SSM SecureString parameter holding the PEM encoded private key of the certificate authority",
+		Type:        "String",
+	})
+	template.Parameters.Add("MongoDBCertificateExpiry", Parameter{
+		Description: "Time the node certificates expire, in RFC 3339 format. Changing it reissues them",
+		Type:        "String",
+	})
+	template.Metadata.AddToGroup("Security Configuration", "MongoDBCACertificate", "MongoDB CA Certificate")
+	template.Metadata.AddToGroup("Security Configuration", "MongoDBCAKeyParameter", "MongoDB CA Key SSM Parameter")
+	template.Metadata.AddToGroup("Security Configuration", "MongoDBCertificateExpiry", "MongoDB Certificate Expiry")
+
+	updateNodes(template, func(parameters *NodeStackParameters) {
+		parameters.MongoDBCACertificate = Ref("MongoDBCACertificate")
+		parameters.MongoDBCAKeyParameter = Ref("MongoDBCAKeyParameter")
+		parameters.MongoDBCertificateExpiry = Ref("MongoDBCertificateExpiry")
+	})
+
+	resource, _ := template.Resources.Get("MongoDBNodeIAMRole")
+	role := resource.(IAMRole)
+	role.Properties.Policies = append(role.Properties.Policies, Policy{
+		PolicyName: "CertificateAuthority",
+		PolicyDocument: PolicyDocument{
+			Statement: []Statement{{
+				Effect: "Allow",
+				Action: []string{"ssm:GetParameter"},
+				Resource: Sub(
+					"arn:${AWS::Partition}:ssm:${AWS::Region}:${AWS::AccountId}:parameter${MongoDBCAKeyParameter}",
+					map[string]interface{}{},
+				),
+			}},
+		},
+	})
+	template.Resources.Add("MongoDBNodeIAMRole", role)
+
+	template.Outputs.Add("MongoDBCACertificate", Output{
+		Value:       Ref("MongoDBCACertificate"),
+		Description: "MongoDB CA Certificate",
+	})
+	template.Outputs.Add("MongoDBCertificateExpiry", Output{
+		Value:       Ref("MongoDBCertificateExpiry"),
+		Description: "Expiry of the MongoDB Node Certificates",
+	})
+}
+
+func addVolumeEncryption(template *Template) {
+	template.Parameters.Add("VolumeEncrypted", Parameter{
+		Description:   "Encrypt the EBS Volumes attached to the nodes",
+		Type:          "String",
+		Default:       "true",
+		AllowedValues: []string{"true", "false"},
+	})
+	template.Parameters.Add("VolumeKmsKeyId", Parameter{
+		Description:  "ID or ARN of the KMS key encrypting the EBS Volumes. Leave empty to use the default EBS key",
+		Type:         "String",
+		emptyDefault: true,
+	})
+	template.Metadata.AddToGroup(databaseConfigurationGroup, "VolumeEncrypted", "Volume Encrypted")
+	template.Metadata.AddToGroup(databaseConfigurationGroup, "VolumeKmsKeyId", "Volume KMS Key ID")
+
+	updateNodes(template, func(parameters *NodeStackParameters) {
+		parameters.VolumeEncrypted = Ref("VolumeEncrypted")
+		parameters.VolumeKmsKeyId = Ref("VolumeKmsKeyId")
+	})
+}
+
+// updateNodes applies an update to the parameters of every node stack.
+func updateNodes(template *Template, update func(*NodeStackParameters)) {
+	for _, name := range template.Resources.Names() {
+		resource, _ := template.Resources.Get(name)
+		node, ok := resource.(NodeStack)
+		if !ok {
+			continue
+		}
+		update(&node.Properties.Parameters)
+		template.Resources.Add(name, node)
+	}
+}
+
+func nodeName(prefix string, index int) string {
+	if index == 0 {
+		return "Primary" + prefix + "0"
+	}
+	return "Secondary" + prefix + strconv.Itoa(index)
+}
+
+// newNodeStack returns a node stack taking its settings from the parent
+// stack's parameters. Callers set the node's index and role.
+func newNodeStack(name string, subnet interface{}) NodeStack {
+	return NodeStack{
+		DependsOn: name + "WaitForNodeInstallWaitHandle",
+		Type:      "AWS::CloudFormation::Stack",
+		Properties: NodeStackProperties{
+			TemplateURL: Sub(
+				"https://${QSS3BucketName}.${QSS3Region}.amazonaws.com/${QSS3KeyPrefix}templates/mongodb-node.template",
+				map[string]interface{}{
+					"QSS3Region": If("GovCloudCondition", "s3-us-gov-west-1", "s3"),
+				},
+			),
+			Parameters: NodeStackParameters{
+				QSS3BucketName:                          Ref("QSS3BucketName"),
+				QSS3KeyPrefix:                           Ref("QSS3KeyPrefix"),
+				ClusterReplicaSetCount:                  Ref("ClusterReplicaSetCount"),
+				ArbiterCount:                            Ref("ArbiterCount"),
+				Iops:                                    Ref("Iops"),
+				KeyName:                                 Ref("KeyPairName"),
+				MongoDBVersion:                          Ref("MongoDBVersion"),
+				MongoDBAdminUsername:                    Ref("MongoDBAdminUsername"),
+				MongoDBAdminPassword:                    Ref("MongoDBAdminPassword"),
+				NodeInstanceType:                        Ref("NodeInstanceType"),
+				NodeSubnet:                              subnet,
+				MongoDBServerSecurityGroupID:            Ref("MongoDBServerSecurityGroup"),
+				MongoDBServersSecurityGroupID:           Ref("MongoDBServersSecurityGroup"),
+				MongoDBNodeIAMProfileID:                 Ref("MongoDBNodeIAMProfile"),
+				VPC:                                     Ref("VPC"),
+				VolumeSize:                              Ref("VolumeSize"),
+				VolumeType:                              Ref("VolumeType"),
+				StackName:                               Ref("AWS::StackName"),
+				ImageId:                                 FindInMap("AWSAMIRegionMap", Ref("AWS::Region"), "AMZNLINUX"),
+				ReplicaNodeNameTag:                      name,
+				ReplicaShardIndex:                       Ref("ReplicaShardIndex"),
+				ReplicaNodeWaitForNodeInstallWaitHandle: Ref(name + "WaitForNodeInstallWaitHandle"),
+			},
+		},
+	}
+}
+
+func newShardedNodeStack(name string, subnet interface{}) NodeStack {
+	node := newNodeStack(name, subnet)
+	node.Properties.Parameters.MongoDBClusterKey = Ref("MongoDBClusterKey")
+	return node
+}
+
+// addNode adds a node stack along with the wait condition its install
+// script signals, all under the same condition.
+func addNode(template *Template, name string, node NodeStack, condition string) {
+	node.Condition = condition
+	template.Resources.Add(name+"WaitForNodeInstallWaitHandle", WaitConditionHandle{
+		Type:      "AWS::CloudFormation::WaitConditionHandle",
+		Condition: condition,
+	})
+	template.Resources.Add(name, node)
+	template.Resources.Add(name+"WaitForNodeInstall", WaitCondition{
+		Type:      "AWS::CloudFormation::WaitCondition",
+		Condition: condition,
+		DependsOn: name,
+		Properties: WaitConditionProperties{
+			Handle:  Ref(name + "WaitForNodeInstallWaitHandle"),
+			Timeout: nodeWaitTimeout,
+		},
+	})
+}
+
+// nodeSubnet selects an entry of the NodeSubnets list parameter.
+func nodeSubnet(index interface{}) Intrinsic {
+	return Select(index, Ref("NodeSubnets"))
+}
+
+func nodeIp(name string) Intrinsic {
+	return GetAtt(name, "Outputs.NodePrivateIp")
+}
+
+func nodeIpsOutput(description string, names []string) Output {
+	var ips []interface{}
+	for _, name := range names {
+		ips = append(ips, nodeIp(name))
+	}
+	return Output{
+		Value:       Join(",", ips...),
+		Description: description,
+	}
+}
+
+func countValues(from, to int) []string {
+	var values []string
+	for i := from; i <= to; i++ {
+		values = append(values, strconv.Itoa(i))
+	}
+	return values
 }
-`)
@@ -0,0 +1,179 @@
+package templates
+
+type SecurityGroup struct {
+	Type       string
+	Properties SecurityGroupProperties
+}
+
+type SecurityGroupProperties struct {
+	VpcId                interface{}
+	GroupDescription     string
+	SecurityGroupIngress []SecurityGroupIngress `json:",omitempty"`
+}
+
+type SecurityGroupIngress struct {
+	IpProtocol            string
+	FromPort              string
+	ToPort                string
+	SourceSecurityGroupId interface{}
+}
+
+func NewSecurityGroup(vpcId interface{}, description string, ingress ...SecurityGroupIngress) SecurityGroup {
+	return SecurityGroup{
+		Type: "AWS::EC2::SecurityGroup",
+		Properties: SecurityGroupProperties{
+			VpcId:                vpcId,
+			GroupDescription:     description,
+			SecurityGroupIngress: ingress,
+		},
+	}
+}
+
+// TCPIngress allows a port range from members of another security group.
+func TCPIngress(fromPort, toPort string, source interface{}) SecurityGroupIngress {
+	return SecurityGroupIngress{
+		IpProtocol:            "tcp",
+		FromPort:              fromPort,
+		ToPort:                toPort,
+		SourceSecurityGroupId: source,
+	}
+}
+
+type IAMRole struct {
+	Type       string
+	Properties IAMRoleProperties
+}
+
+type IAMRoleProperties struct {
+	AssumeRolePolicyDocument PolicyDocument
+	Path                     string
+	Policies                 []Policy
+}
+
+type Policy struct {
+	PolicyName     string
+	PolicyDocument PolicyDocument
+}
+
+type PolicyDocument struct {
+	Statement []Statement
+}
+
+type Statement struct {
+	Effect    string
+	Principal *Principal `json:",omitempty"`
+	Action    []string
+	Resource  interface{} `json:",omitempty"`
+}
+
+type Principal struct {
+	Service []string
+}
+
+type IAMInstanceProfile struct {
+	Type       string
+	Properties IAMInstanceProfileProperties
+}
+
+type IAMInstanceProfileProperties struct {
+	Path  string
+	Roles []interface{}
+}
+
+type WaitConditionHandle struct {
+	Type       string
+	Properties struct{}
+	Condition  string `json:",omitempty"`
+}
+
+type WaitCondition struct {
+	Type       string
+	Condition  string `json:",omitempty"`
+	DependsOn  string
+	Properties WaitConditionProperties
+}
+
+type WaitConditionProperties struct {
+	Handle  interface{}
+	Timeout string
+}
+
+// NodeStack is a nested stack launching a single MongoDB node from the
+// mongodb-node.template.
+type NodeStack struct {
+	DependsOn  interface{}
+	Condition  string `json:",omitempty"`
+	Type       string
+	Properties NodeStackProperties
+}
+
+type NodeStackProperties struct {
+	TemplateURL interface{}
+	Parameters  NodeStackParameters
+}
+
+// NodeStackParameters are the parameters of mongodb-node.template. Values
+// are literals or intrinsic functions.
+type NodeStackParameters struct {
+	QSS3BucketName                          interface{}
+	QSS3KeyPrefix                           interface{}
+	ClusterReplicaSetCount                  interface{}
+	ArbiterCount                            interface{}
+	Iops                                    interface{}
+	KeyName                                 interface{}
+	MongoDBVersion                          interface{}
+	MongoDBAdminUsername                    interface{}
+	MongoDBAdminPassword                    interface{}
+	NodeInstanceType                        interface{}
+	NodeSubnet                              interface{}
+	MongoDBServerSecurityGroupID            interface{}
+	MongoDBServersSecurityGroupID           interface{}
+	MongoDBNodeIAMProfileID                 interface{}
+	VPC                                     interface{}
+	VolumeSize                              interface{}
+	VolumeType                              interface{}
+	StackName                               interface{}
+	ImageId                                 interface{}
+	ReplicaNodeNameTag                      interface{}
+	NodeReplicaSetIndex                     interface{}
+	ReplicaShardIndex                       interface{}
+	ReplicaNodeWaitForNodeInstallWaitHandle interface{}
+	NodeRole                                interface{} `json:",omitempty"`
+	MongoDBClusterKey                       interface{} `json:",omitempty"`
+	ConfigServerHosts                       interface{} `json:",omitempty"`
+	ShardHosts                              interface{} `json:",omitempty"`
+	MongoDBCACertificate                    interface{} `json:",omitempty"`
+	MongoDBCAKeyParameter                   interface{} `json:",omitempty"`
+	MongoDBCertificateExpiry                interface{} `json:",omitempty"`
+	VolumeEncrypted                         interface{} `json:",omitempty"`
+	VolumeKmsKeyId                          interface{} `json:",omitempty"`
+	MonitoringEnabled                       interface{} `json:",omitempty"`
+	ExporterEnabled                         interface{} `json:",omitempty"`
+	MongoDBExporterVersion                  interface{} `json:",omitempty"`
+}
+
+type Alarm struct {
+	Type       string
+	Condition  string `json:",omitempty"`
+	Properties AlarmProperties
+}
+
+type AlarmProperties struct {
+	AlarmDescription   string
+	Namespace          string
+	MetricName         string
+	Dimensions         []MetricDimension
+	Statistic          string
+	Period             string
+	EvaluationPeriods  string
+	Threshold          interface{}
+	ComparisonOperator string
+	TreatMissingData   string `json:",omitempty"`
+	AlarmActions       []interface{}
+	OKActions          []interface{}
+}
+
+type MetricDimension struct {
+	Name  string
+	Value interface{}
+}
@@ -0,0 +1,257 @@
+package templates
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Template is a CloudFormation template. Its sections are kept in the order
+// they are added so that generated templates are stable and easy to diff.
+type Template struct {
+	AWSTemplateFormatVersion string
+	Description              string
+	Metadata                 Metadata
+	Parameters               Parameters
+	Conditions               Conditions
+	Mappings                 Mappings
+	Resources                Resources
+	Outputs                  Outputs
+}
+
+// Marshal renders the template as indented JSON.
+func (t *Template) Marshal() ([]byte, error) {
+	return marshal(t, "    ")
+}
+
+type Metadata struct {
+	Interface ParameterInterface `json:"AWS::CloudFormation::Interface"`
+}
+
+type ParameterInterface struct {
+	ParameterGroups []ParameterGroup
+	ParameterLabels map[string]Label
+}
+
+type ParameterGroup struct {
+	Label      Label
+	Parameters []string
+}
+
+type Label struct {
+	Default string `json:"default"`
+}
+
+// AddToGroup appends a parameter to the group with the given label and
+// gives it a label of its own.
+func (m *Metadata) AddToGroup(group, parameter, label string) {
+	for i := range m.Interface.ParameterGroups {
+		if m.Interface.ParameterGroups[i].Label.Default == group {
+			m.Interface.ParameterGroups[i].Parameters = append(m.Interface.ParameterGroups[i].Parameters, parameter)
+		}
+	}
+	if m.Interface.ParameterLabels == nil {
+		m.Interface.ParameterLabels = map[string]Label{}
+	}
+	m.Interface.ParameterLabels[parameter] = Label{Default: label}
+}
+
+type Parameter struct {
+	Type                  string
+	Description           string
+	Default               string
+	AllowedValues         []string
+	AllowedPattern        string
+	MinLength             string
+	MaxLength             string
+	MinValue              string
+	MaxValue              string
+	NoEcho                string
+	ConstraintDescription string
+
+	// keyOrder is the order the keys are written in. Keys that are set but
+	// missing from it follow in the default order.
+	keyOrder []string
+	// emptyDefault writes an empty Default, making the parameter optional.
+	emptyDefault bool
+}
+
+var defaultParameterKeyOrder = []string{
+	"Description",
+	"Type",
+	"Default",
+	"AllowedValues",
+	"AllowedPattern",
+	"MinLength",
+	"MaxLength",
+	"MinValue",
+	"MaxValue",
+	"NoEcho",
+	"ConstraintDescription",
+}
+
+func (p Parameter) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{}
+	for key, value := range map[string]string{
+		"Type":                  p.Type,
+		"Description":           p.Description,
+		"Default":               p.Default,
+		"AllowedPattern":        p.AllowedPattern,
+		"MinLength":             p.MinLength,
+		"MaxLength":             p.MaxLength,
+		"MinValue":              p.MinValue,
+		"MaxValue":              p.MaxValue,
+		"NoEcho":                p.NoEcho,
+		"ConstraintDescription": p.ConstraintDescription,
+	} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	if p.emptyDefault {
+		fields["Default"] = p.Default
+	}
+	if len(p.AllowedValues) > 0 {
+		fields["AllowedValues"] = p.AllowedValues
+	}
+
+	var object orderedObject
+	order := append(append([]string(nil), p.keyOrder...), defaultParameterKeyOrder...)
+	for _, key := range order {
+		if value, ok := fields[key]; ok {
+			object.set(key, value)
+			delete(fields, key)
+		}
+	}
+	return object.MarshalJSON()
+}
+
+type Parameters struct {
+	orderedObject
+}
+
+func (p *Parameters) Add(name string, parameter Parameter) {
+	p.set(name, parameter)
+}
+
+func (p Parameters) Get(name string) (Parameter, bool) {
+	value, ok := p.get(name)
+	if !ok {
+		return Parameter{}, false
+	}
+	return value.(Parameter), true
+}
+
+func (p Parameters) Names() []string {
+	return append([]string(nil), p.keys...)
+}
+
+type Conditions struct {
+	orderedObject
+}
+
+func (c *Conditions) Add(name string, condition Intrinsic) {
+	c.set(name, condition)
+}
+
+type Mappings map[string]map[string]map[string]string
+
+// Resources holds the typed resources defined in resources.go.
+type Resources struct {
+	orderedObject
+}
+
+func (r *Resources) Add(name string, resource interface{}) {
+	r.set(name, resource)
+}
+
+func (r Resources) Get(name string) (interface{}, bool) {
+	return r.get(name)
+}
+
+func (r Resources) Names() []string {
+	return append([]string(nil), r.keys...)
+}
+
+type Output struct {
+	Value       interface{}
+	Description string
+	Condition   string `json:",omitempty"`
+}
+
+type Outputs struct {
+	orderedObject
+}
+
+func (o *Outputs) Add(name string, output Output) {
+	o.set(name, output)
+}
+
+func (o Outputs) Get(name string) (Output, bool) {
+	value, ok := o.get(name)
+	if !ok {
+		return Output{}, false
+	}
+	return value.(Output), true
+}
+
+// orderedObject is a JSON object that keeps its keys in insertion order.
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (o *orderedObject) set(key string, value interface{}) {
+	if o.values == nil {
+		o.values = map[string]interface{}{}
+	}
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o orderedObject) get(key string) (interface{}, bool) {
+	value, ok := o.values[key]
+	return value, ok
+}
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	for i, key := range o.keys {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		k, err := marshal(key, "")
+		if err != nil {
+			return nil, err
+		}
+		v, err := marshal(o.values[key], "")
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(k)
+		buffer.WriteString(":")
+		buffer.Write(v)
+	}
+	buffer.WriteString("}")
+	return buffer.Bytes(), nil
+}
+
+// marshal encodes without escaping HTML characters, which appear in
+// parameter types such as List<AWS::EC2::Subnet::Id>.
+func marshal(v interface{}, indent string) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if indent != "" {
+		encoder.SetIndent("", indent)
+	}
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	if indent == "" {
+		return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+	}
+	return buffer.Bytes(), nil
+}
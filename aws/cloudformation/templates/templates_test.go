@@ -2,17 +2,324 @@ package templates_test
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
 
 	"github.com/henrytk/aws-service-broker/aws/cloudformation/templates"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 )
 
+var updateGolden = flag.Bool("update", false, "rewrite the golden template files")
+
 var _ = Describe("Templates", func() {
-	It("Must contain a MongoDB stack template using valid JSON", func() {
-		var data interface{}
-		err := json.Unmarshal(templates.MongoDBStack, &data)
-		Expect(err).NotTo(HaveOccurred())
+	DescribeTable("renders the MongoDB stack for each option combination",
+		func(options templates.MongoDBStackOptions, golden string) {
+			templateBody, err := templates.BuildMongoDBStack(options)
+			Expect(err).NotTo(HaveOccurred())
+			var data interface{}
+			Expect(json.Unmarshal(templateBody, &data)).To(Succeed())
+
+			path := filepath.Join("testdata", golden)
+			if *updateGolden {
+				Expect(ioutil.WriteFile(path, templateBody, 0644)).To(Succeed())
+			}
+			expected, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(templateBody)).To(Equal(string(expected)))
+		},
+		Entry("replica set", templates.MongoDBStackOptions{}, "mongodb-stack.golden.json"),
+		Entry("one shard and one mongos", templates.MongoDBStackOptions{ShardCount: 1, MongosCount: 1}, "mongodb-sharded-stack-1-1.golden.json"),
+		Entry("two shards and three mongos", templates.MongoDBStackOptions{ShardCount: 2, MongosCount: 3}, "mongodb-sharded-stack-2-3.golden.json"),
+		Entry("replica set with TLS", templates.MongoDBStackOptions{TLS: true}, "mongodb-stack-tls.golden.json"),
+		Entry("replica set with encrypted volumes", templates.MongoDBStackOptions{EncryptedVolumes: true}, "mongodb-stack-encrypted.golden.json"),
+		Entry("sharded cluster with TLS and encrypted volumes", templates.MongoDBStackOptions{ShardCount: 2, MongosCount: 2, TLS: true, EncryptedVolumes: true}, "mongodb-sharded-stack-2-2-tls-encrypted.golden.json"),
+		Entry("sharded cluster with TLS", templates.MongoDBStackOptions{ShardCount: 1, MongosCount: 1, TLS: true}, "mongodb-sharded-stack-1-1-tls.golden.json"),
+		Entry("replica set with alarms", templates.MongoDBStackOptions{Alarms: true}, "mongodb-stack-alarms.golden.json"),
+		Entry("sharded cluster with alarms", templates.MongoDBStackOptions{ShardCount: 1, MongosCount: 2, Alarms: true}, "mongodb-sharded-stack-1-2-alarms.golden.json"),
+		Entry("replica set with mongodb_exporter", templates.MongoDBStackOptions{Exporter: true}, "mongodb-stack-exporter.golden.json"),
+		Entry("sharded cluster with alarms and mongodb_exporter", templates.MongoDBStackOptions{ShardCount: 1, MongosCount: 1, Alarms: true, Exporter: true}, "mongodb-sharded-stack-1-1-alarms-exporter.golden.json"),
+	)
+
+	Describe("replica set MongoDB stack", func() {
+		var template map[string]interface{}
+
+		BeforeEach(func() {
+			templateBody, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			err = json.Unmarshal(templateBody, &template)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("creates a conditional secondary for every member after the primary and an optional arbiter", func() {
+			resources := template["Resources"].(map[string]interface{})
+			outputs := template["Outputs"].(map[string]interface{})
+			Expect(resources["PrimaryReplicaNode0"]).NotTo(HaveKey("Condition"))
+			for i := 0; i < templates.MaxReplicaSetMembers-1; i++ {
+				name := fmt.Sprintf("SecondaryReplicaNode%d", i)
+				condition := fmt.Sprintf("CreateSecondaryReplicaNode%d", i)
+				Expect(template["Conditions"]).To(HaveKey(condition))
+				Expect(resources[name]).To(HaveKeyWithValue("Condition", condition))
+				Expect(outputs[name+"Ip"]).To(HaveKeyWithValue("Condition", condition))
+			}
+			Expect(resources).NotTo(HaveKey(fmt.Sprintf("SecondaryReplicaNode%d", templates.MaxReplicaSetMembers-1)))
+			Expect(resources["ArbiterReplicaNode0"]).To(HaveKeyWithValue("Condition", "CreateArbiter"))
+			Expect(outputs["ArbiterReplicaNodeIp"]).To(HaveKeyWithValue("Condition", "CreateArbiter"))
+		})
+
+		It("places each member in its own entry of the subnet list", func() {
+			resources := template["Resources"].(map[string]interface{})
+			parameters := resources["SecondaryReplicaNode2"].(map[string]interface{})["Properties"].(map[string]interface{})["Parameters"].(map[string]interface{})
+			Expect(parameters["NodeSubnet"]).To(Equal(map[string]interface{}{
+				"Fn::Select": []interface{}{"3", map[string]interface{}{"Ref": "NodeSubnets"}},
+			}))
+			parameters = resources["ArbiterReplicaNode0"].(map[string]interface{})["Properties"].(map[string]interface{})["Parameters"].(map[string]interface{})
+			Expect(parameters).To(HaveKeyWithValue("NodeRole", "arbiter"))
+			Expect(parameters["NodeSubnet"]).To(Equal(map[string]interface{}{
+				"Fn::Select": []interface{}{
+					map[string]interface{}{"Ref": "ClusterReplicaSetCount"},
+					map[string]interface{}{"Ref": "NodeSubnets"},
+				},
+			}))
+		})
+
+		It("allows one to seven data bearing members", func() {
+			count := template["Parameters"].(map[string]interface{})["ClusterReplicaSetCount"].(map[string]interface{})
+			Expect(count["AllowedValues"]).To(Equal([]interface{}{"1", "2", "3", "4", "5", "6", "7"}))
+		})
+	})
+
+	Describe("sharded MongoDB stack", func() {
+		var template map[string]interface{}
+
+		BeforeEach(func() {
+			templateBody, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{ShardCount: 2, MongosCount: 3})
+			Expect(err).NotTo(HaveOccurred())
+			err = json.Unmarshal(templateBody, &template)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("creates three config servers, three members per shard and the mongos nodes", func() {
+			resources := template["Resources"].(map[string]interface{})
+			for _, name := range []string{
+				"PrimaryConfigServerNode0",
+				"SecondaryConfigServerNode1",
+				"SecondaryConfigServerNode2",
+				"PrimaryShard0Node0",
+				"SecondaryShard0Node1",
+				"SecondaryShard0Node2",
+				"PrimaryShard1Node0",
+				"SecondaryShard1Node1",
+				"SecondaryShard1Node2",
+				"MongosNode0",
+				"MongosNode1",
+				"MongosNode2",
+			} {
+				Expect(resources).To(HaveKey(name))
+				Expect(resources).To(HaveKey(name + "WaitForNodeInstall"))
+				Expect(resources).To(HaveKey(name + "WaitForNodeInstallWaitHandle"))
+			}
+			Expect(resources).NotTo(HaveKey("MongosNode3"))
+			Expect(resources).NotTo(HaveKey("PrimaryShard2Node0"))
+		})
+
+		It("sizes the shards with the same conditions as a replica set", func() {
+			resources := template["Resources"].(map[string]interface{})
+			Expect(resources["PrimaryShard0Node0"]).NotTo(HaveKey("Condition"))
+			Expect(resources["SecondaryShard0Node1"]).To(HaveKeyWithValue("Condition", "CreateSecondaryReplicaNode0"))
+			Expect(resources["SecondaryShard1Node6"]).To(HaveKeyWithValue("Condition", "CreateSecondaryReplicaNode5"))
+			Expect(resources["ArbiterShard1Node0"]).To(HaveKeyWithValue("Condition", "CreateArbiter"))
+			Expect(resources["SecondaryConfigServerNode1"]).NotTo(HaveKey("Condition"))
+		})
+
+		It("starts the mongos nodes once the config servers and shards are ready", func() {
+			mongos := template["Resources"].(map[string]interface{})["MongosNode0"].(map[string]interface{})
+			Expect(mongos["DependsOn"]).To(ConsistOf(
+				"MongosNode0WaitForNodeInstallWaitHandle",
+				"PrimaryConfigServerNode0WaitForNodeInstall",
+				"SecondaryConfigServerNode1WaitForNodeInstall",
+				"SecondaryConfigServerNode2WaitForNodeInstall",
+				"PrimaryShard0Node0WaitForNodeInstall",
+				"PrimaryShard1Node0WaitForNodeInstall",
+			))
+			parameters := mongos["Properties"].(map[string]interface{})["Parameters"].(map[string]interface{})
+			Expect(parameters).To(HaveKeyWithValue("NodeRole", "mongos"))
+			Expect(parameters).To(HaveKey("ConfigServerHosts"))
+			Expect(parameters).To(HaveKey("ShardHosts"))
+		})
+
+		It("requires a cluster key and exposes the mongos addresses", func() {
+			Expect(template["Parameters"]).To(HaveKey("MongoDBClusterKey"))
+			Expect(template["Outputs"]).To(HaveKey("MongosNodeIps"))
+			Expect(template["Outputs"]).To(HaveKey("ConfigServerNodeIps"))
+			Expect(template["Outputs"]).To(HaveKey("Shard1PrimaryNodeIp"))
+		})
+
+		It("returns an error when there are no shards or mongos nodes", func() {
+			_, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{ShardCount: 0, MongosCount: 1})
+			Expect(err).To(MatchError("Error building sharded MongoDB template: shard count must be at least 1"))
+			_, err = templates.BuildMongoDBStack(templates.MongoDBStackOptions{ShardCount: 1, MongosCount: 0})
+			Expect(err).To(MatchError("Error building sharded MongoDB template: mongos count must be at least 1"))
+		})
+	})
+
+	Describe("MongoDB stack with TLS", func() {
+		var template map[string]interface{}
+
+		BeforeEach(func() {
+			templateBody, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{ShardCount: 1, MongosCount: 1, TLS: true})
+			Expect(err).NotTo(HaveOccurred())
+			err = json.Unmarshal(templateBody, &template)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("passes the certificate authority to every node", func() {
+			resources := template["Resources"].(map[string]interface{})
+			nodes := 0
+			for _, resource := range resources {
+				resource := resource.(map[string]interface{})
+				if resource["Type"] != "AWS::CloudFormation::Stack" {
+					continue
+				}
+				nodes++
+				parameters := resource["Properties"].(map[string]interface{})["Parameters"].(map[string]interface{})
+				Expect(parameters).To(HaveKeyWithValue("MongoDBCACertificate", map[string]interface{}{"Ref": "MongoDBCACertificate"}))
+				Expect(parameters).To(HaveKeyWithValue("MongoDBCAKeyParameter", map[string]interface{}{"Ref": "MongoDBCAKeyParameter"}))
+				Expect(parameters).To(HaveKeyWithValue("MongoDBCertificateExpiry", map[string]interface{}{"Ref": "MongoDBCertificateExpiry"}))
+			}
+			Expect(nodes).To(Equal(3 + templates.MaxReplicaSetMembers + 1 + 1))
+		})
+
+		It("keeps the CA key out of the template and exposes the CA certificate and expiry", func() {
+			parameters := template["Parameters"].(map[string]interface{})
+			Expect(parameters).NotTo(HaveKey("MongoDBCAKey"))
+			Expect(parameters).To(HaveKey("MongoDBCAKeyParameter"))
+			Expect(template["Outputs"]).To(HaveKey("MongoDBCACertificate"))
+			Expect(template["Outputs"]).To(HaveKey("MongoDBCertificateExpiry"))
+		})
+
+		It("lets the nodes read the CA key parameter", func() {
+			resources := template["Resources"].(map[string]interface{})
+			role := resources["MongoDBNodeIAMRole"].(map[string]interface{})
+			policies := role["Properties"].(map[string]interface{})["Policies"].([]interface{})
+			Expect(policies).To(HaveLen(2))
+			Expect(policies[1]).To(HaveKeyWithValue("PolicyName", "CertificateAuthority"))
+			statement := policies[1].(map[string]interface{})["PolicyDocument"].(map[string]interface{})["Statement"].([]interface{})[0]
+			Expect(statement).To(HaveKeyWithValue("Action", []interface{}{"ssm:GetParameter"}))
+			Expect(statement).To(HaveKeyWithValue("Resource", map[string]interface{}{"Fn::Sub": []interface{}{
+				"arn:${AWS::Partition}:ssm:${AWS::Region}:${AWS::AccountId}:parameter${MongoDBCAKeyParameter}",
+				map[string]interface{}{},
+			}}))
+		})
+	})
+
+	Describe("MongoDB stack with encrypted volumes", func() {
+		It("passes the encryption settings to every node", func() {
+			templateBody, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{EncryptedVolumes: true})
+			Expect(err).NotTo(HaveOccurred())
+			var template map[string]interface{}
+			Expect(json.Unmarshal(templateBody, &template)).To(Succeed())
+
+			parameters := template["Parameters"].(map[string]interface{})
+			Expect(parameters["VolumeKmsKeyId"]).To(HaveKeyWithValue("Default", ""))
+			Expect(parameters["VolumeEncrypted"]).To(HaveKeyWithValue("Default", "true"))
+			for name, resource := range template["Resources"].(map[string]interface{}) {
+				resource := resource.(map[string]interface{})
+				if resource["Type"] != "AWS::CloudFormation::Stack" {
+					continue
+				}
+				nodeParameters := resource["Properties"].(map[string]interface{})["Parameters"].(map[string]interface{})
+				Expect(nodeParameters).To(HaveKeyWithValue("VolumeEncrypted", map[string]interface{}{"Ref": "VolumeEncrypted"}), name)
+				Expect(nodeParameters).To(HaveKeyWithValue("VolumeKmsKeyId", map[string]interface{}{"Ref": "VolumeKmsKeyId"}), name)
+			}
+		})
+	})
+
+	Describe("MongoDB stack with alarms", func() {
+		var resources map[string]interface{}
+
+		BeforeEach(func() {
+			templateBody, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{ShardCount: 1, MongosCount: 1, Alarms: true})
+			Expect(err).NotTo(HaveOccurred())
+			var template map[string]interface{}
+			Expect(json.Unmarshal(templateBody, &template)).To(Succeed())
+			resources = template["Resources"].(map[string]interface{})
+		})
+
+		It("alarms on every metric of the data bearing nodes, under their conditions", func() {
+			for _, alarm := range []string{"StatusCheckFailed", "CPUUtilization", "BurstBalance", "DiskSpaceUtilization", "ReplicationLag"} {
+				Expect(resources).To(HaveKey("PrimaryShard0Node0" + alarm + "Alarm"))
+				Expect(resources).To(HaveKey("PrimaryConfigServerNode0" + alarm + "Alarm"))
+				secondary := resources["SecondaryShard0Node1"+alarm+"Alarm"].(map[string]interface{})
+				Expect(secondary).To(HaveKeyWithValue("Condition", "CreateSecondaryReplicaNode0"))
+			}
+		})
+
+		It("only alarms on the instance metrics of arbiters and mongos", func() {
+			for _, node := range []string{"ArbiterShard0Node0", "MongosNode0"} {
+				Expect(resources).To(HaveKey(node + "StatusCheckFailedAlarm"))
+				Expect(resources).To(HaveKey(node + "CPUUtilizationAlarm"))
+				Expect(resources).NotTo(HaveKey(node + "DiskSpaceUtilizationAlarm"))
+				Expect(resources).NotTo(HaveKey(node + "ReplicationLagAlarm"))
+			}
+		})
+
+		It("notifies the alarm topic about the node's instance", func() {
+			alarm := resources["MongosNode0CPUUtilizationAlarm"].(map[string]interface{})
+			properties := alarm["Properties"].(map[string]interface{})
+			Expect(properties["AlarmActions"]).To(Equal([]interface{}{map[string]interface{}{"Ref": "AlarmTopicArn"}}))
+			Expect(properties["Threshold"]).To(Equal(map[string]interface{}{"Ref": "CPUUtilizationAlarmThreshold"}))
+			Expect(properties["Dimensions"]).To(Equal([]interface{}{map[string]interface{}{
+				"Name":  "InstanceId",
+				"Value": map[string]interface{}{"Fn::GetAtt": []interface{}{"MongosNode0", "Outputs.NodeInstanceID"}},
+			}}))
+		})
+
+		It("lets the nodes publish their metrics", func() {
+			node := resources["MongosNode0"].(map[string]interface{})
+			nodeParameters := node["Properties"].(map[string]interface{})["Parameters"].(map[string]interface{})
+			Expect(nodeParameters).To(HaveKeyWithValue("MonitoringEnabled", "true"))
+			role := resources["MongoDBNodeIAMRole"].(map[string]interface{})
+			policies := role["Properties"].(map[string]interface{})["Policies"].([]interface{})
+			Expect(policies).To(HaveLen(2))
+			Expect(policies[1]).To(HaveKeyWithValue("PolicyName", "Monitoring"))
+		})
+	})
+
+	Describe("Parameter constraints", func() {
+		It("parses the constraints of every parameter of a rendered template", func() {
+			template, err := templates.BuildMongoDBStack(templates.MongoDBStackOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			constraints, err := templates.ParseParameterConstraints(template)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(constraints["VolumeType"].AllowedValues).To(Equal([]string{"gp2", "io1"}))
+			Expect(constraints["MongoDBAdminUsername"].AllowedPattern).To(Equal("[a-zA-Z][a-zA-Z0-9]*"))
+			Expect(constraints["MongoDBAdminUsername"].MaxLength).To(Equal("16"))
+		})
+
+		DescribeTable("checks values against the constraints",
+			func(constraints templates.ParameterConstraints, value, violation string) {
+				err := constraints.Check(value)
+				if violation == "" {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(MatchError(violation))
+				}
+			},
+			Entry("allowed value", templates.ParameterConstraints{AllowedValues: []string{"gp2", "io1"}}, "io1", ""),
+			Entry("value not allowed", templates.ParameterConstraints{AllowedValues: []string{"gp2", "io1"}}, "gp3", "must be one of gp2, io1"),
+			Entry("matching the whole pattern", templates.ParameterConstraints{AllowedPattern: "[a-z]+"}, "admin", ""),
+			Entry("matching part of the pattern", templates.ParameterConstraints{AllowedPattern: "[a-z]+"}, "admin1", "must match the pattern [a-z]+"),
+			Entry("too short", templates.ParameterConstraints{MinLength: "2"}, "a", "must be at least 2 characters long"),
+			Entry("too long", templates.ParameterConstraints{MaxLength: "2"}, "abc", "must be at most 2 characters long"),
+			Entry("not a number", templates.ParameterConstraints{Type: "Number"}, "ten", "must be a number"),
+			Entry("below the minimum", templates.ParameterConstraints{Type: "Number", MinValue: "1"}, "0", "must be at least 1"),
+			Entry("above the maximum", templates.ParameterConstraints{Type: "Number", MaxValue: "100"}, "101", "must be at most 100"),
+			Entry("within range", templates.ParameterConstraints{Type: "Number", MinValue: "1", MaxValue: "100"}, "50", ""),
+		)
 	})
 })
@@ -0,0 +1,20 @@
+package cloudwatch
+
+import (
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awscw "github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/henrytk/aws-service-broker/aws/logging"
+	"github.com/henrytk/aws-service-broker/metrics"
+)
+
+func NewCloudWatchClient(region string, logger lager.Logger) (*awscw.CloudWatch, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+	metrics.InstrumentAWSHandlers(&sess.Handlers)
+	logging.LogRequests(&sess.Handlers, logger)
+	return awscw.New(sess), nil
+}
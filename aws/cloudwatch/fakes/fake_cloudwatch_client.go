@@ -0,0 +1,60 @@
+package fakes
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// FakeCloudWatchAPI fakes the CloudWatch calls the broker makes. Any
+// other call panics on the nil embedded interface.
+type FakeCloudWatchAPI struct {
+	cloudwatchiface.CloudWatchAPI
+
+	describeAlarmsPagesMutex       sync.RWMutex
+	describeAlarmsPagesArgsForCall []*cloudwatch.DescribeAlarmsInput
+	describeAlarmsPagesPages       []*cloudwatch.DescribeAlarmsOutput
+	describeAlarmsPagesErr         error
+}
+
+func (fake *FakeCloudWatchAPI) DescribeAlarmsPagesWithContext(ctx aws.Context, input *cloudwatch.DescribeAlarmsInput, fn func(*cloudwatch.DescribeAlarmsOutput, bool) bool, opts ...request.Option) error {
+	fake.describeAlarmsPagesMutex.Lock()
+	fake.describeAlarmsPagesArgsForCall = append(fake.describeAlarmsPagesArgsForCall, input)
+	pages, err := fake.describeAlarmsPagesPages, fake.describeAlarmsPagesErr
+	fake.describeAlarmsPagesMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (fake *FakeCloudWatchAPI) DescribeAlarmsPagesWithContextCallCount() int {
+	fake.describeAlarmsPagesMutex.RLock()
+	defer fake.describeAlarmsPagesMutex.RUnlock()
+	return len(fake.describeAlarmsPagesArgsForCall)
+}
+
+func (fake *FakeCloudWatchAPI) DescribeAlarmsPagesWithContextArgsForCall(i int) *cloudwatch.DescribeAlarmsInput {
+	fake.describeAlarmsPagesMutex.RLock()
+	defer fake.describeAlarmsPagesMutex.RUnlock()
+	return fake.describeAlarmsPagesArgsForCall[i]
+}
+
+// DescribeAlarmsPagesWithContextReturns sets the pages every call walks
+// through, or the error every call fails with.
+func (fake *FakeCloudWatchAPI) DescribeAlarmsPagesWithContextReturns(err error, pages ...*cloudwatch.DescribeAlarmsOutput) {
+	fake.describeAlarmsPagesMutex.Lock()
+	defer fake.describeAlarmsPagesMutex.Unlock()
+	fake.describeAlarmsPagesPages = pages
+	fake.describeAlarmsPagesErr = err
+}
+
+var _ cloudwatchiface.CloudWatchAPI = new(FakeCloudWatchAPI)
@@ -0,0 +1,20 @@
+package ec2
+
+import (
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/henrytk/aws-service-broker/aws/logging"
+	"github.com/henrytk/aws-service-broker/metrics"
+)
+
+func NewEC2Client(region string, logger lager.Logger) (*awsec2.EC2, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+	metrics.InstrumentAWSHandlers(&sess.Handlers)
+	logging.LogRequests(&sess.Handlers, logger)
+	return awsec2.New(sess), nil
+}
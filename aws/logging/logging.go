@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"reflect"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// LogRequests logs every request made through the handlers once it
+// completes, with its operation, the stack it acted on, how long it took
+// and the request ID AWS gave it. The request ID is what ties a call to
+// its CloudTrail event.
+func LogRequests(handlers *request.Handlers, logger lager.Logger) {
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "logging.LogRequests",
+		Fn: func(r *request.Request) {
+			logRequest(logger, r)
+		},
+	})
+}
+
+func logRequest(logger lager.Logger, r *request.Request) {
+	data := lager.Data{
+		"service":    r.ClientInfo.ServiceName,
+		"request-id": r.RequestID,
+		"duration":   time.Since(r.Time).String(),
+	}
+	if r.Operation != nil {
+		data["operation"] = r.Operation.Name
+	}
+	if stackName := stackName(r.Params); stackName != "" {
+		data["stack-name"] = stackName
+	}
+	if r.RetryCount > 0 {
+		data["retries"] = r.RetryCount
+	}
+	if r.Error != nil {
+		logger.Error("aws-request", r.Error, data)
+		return
+	}
+	logger.Info("aws-request", data)
+}
+
+// stackName returns the StackName of a CloudFormation request's input, or
+// an empty string for inputs without one.
+func stackName(params interface{}) string {
+	v := reflect.ValueOf(params)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return ""
+	}
+	field := v.Elem().FieldByName("StackName")
+	if !field.IsValid() || field.Kind() != reflect.Ptr || field.IsNil() || field.Elem().Kind() != reflect.String {
+		return ""
+	}
+	return field.Elem().String()
+}
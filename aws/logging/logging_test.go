@@ -0,0 +1,76 @@
+package logging_test
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	awscw "github.com/aws/aws-sdk-go/service/cloudwatch"
+	. "github.com/henrytk/aws-service-broker/aws/logging"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LogRequests", func() {
+	var (
+		logger   *lagertest.TestLogger
+		handlers request.Handlers
+		req      *request.Request
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("aws")
+		handlers = request.Handlers{}
+		LogRequests(&handlers, logger)
+		req = &request.Request{
+			ClientInfo: metadata.ClientInfo{ServiceName: "cloudformation"},
+			Operation:  &request.Operation{Name: "CreateStack"},
+			Params:     &awscf.CreateStackInput{StackName: aws.String("mongodb-instance-id")},
+			RequestID:  "4a1b2c3d-0000-1111-2222-333344445555",
+			Time:       time.Now().Add(-2 * time.Second),
+		}
+	})
+
+	It("logs completed calls with their operation, stack name, duration and request ID", func() {
+		handlers.Complete.Run(req)
+
+		logs := logger.Logs()
+		Expect(logs).To(HaveLen(1))
+		Expect(logs[0].Message).To(Equal("aws.aws-request"))
+		Expect(logs[0].LogLevel).To(Equal(lager.INFO))
+		Expect(logs[0].Data).To(HaveKeyWithValue("service", "cloudformation"))
+		Expect(logs[0].Data).To(HaveKeyWithValue("operation", "CreateStack"))
+		Expect(logs[0].Data).To(HaveKeyWithValue("stack-name", "mongodb-instance-id"))
+		Expect(logs[0].Data).To(HaveKeyWithValue("request-id", "4a1b2c3d-0000-1111-2222-333344445555"))
+		Expect(logs[0].Data).To(HaveKey("duration"))
+		Expect(logs[0].Data).NotTo(HaveKey("retries"))
+	})
+
+	It("logs failed calls as errors with their retries", func() {
+		req.Error = awserr.New("AlreadyExistsException", "Stack [mongodb-instance-id] already exists", nil)
+		req.RetryCount = 2
+		handlers.Complete.Run(req)
+
+		logs := logger.Logs()
+		Expect(logs).To(HaveLen(1))
+		Expect(logs[0].LogLevel).To(Equal(lager.ERROR))
+		Expect(logs[0].Data).To(HaveKeyWithValue("error", ContainSubstring("AlreadyExistsException")))
+		Expect(logs[0].Data).To(HaveKeyWithValue("request-id", "4a1b2c3d-0000-1111-2222-333344445555"))
+		Expect(logs[0].Data).To(HaveKeyWithValue("retries", BeNumerically("==", 2)))
+	})
+
+	It("leaves out the stack name of calls not made on a stack", func() {
+		req.ClientInfo.ServiceName = "monitoring"
+		req.Operation.Name = "DescribeAlarms"
+		req.Params = &awscw.DescribeAlarmsInput{}
+		handlers.Complete.Run(req)
+
+		Expect(logger.Logs()[0].Data).NotTo(HaveKey("stack-name"))
+	})
+})
@@ -0,0 +1,20 @@
+package sqs
+
+import (
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awssqs "github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/henrytk/aws-service-broker/aws/logging"
+	"github.com/henrytk/aws-service-broker/metrics"
+)
+
+func NewSQSClient(region string, logger lager.Logger) (*awssqs.SQS, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+	metrics.InstrumentAWSHandlers(&sess.Handlers)
+	logging.LogRequests(&sess.Handlers, logger)
+	return awssqs.New(sess), nil
+}
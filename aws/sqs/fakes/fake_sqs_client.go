@@ -0,0 +1,98 @@
+package fakes
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// FakeSQSAPI fakes the SQS calls the broker makes. Any other call panics on
+// the nil embedded interface.
+//
+// Messages are received in the order they were sent, ten at a time. Once
+// they run out, receiving blocks until the context is done, like a long
+// poll of an empty queue.
+type FakeSQSAPI struct {
+	sqsiface.SQSAPI
+
+	mutex      sync.RWMutex
+	messages   []*sqs.Message
+	receiveErr error
+	received   []*sqs.ReceiveMessageInput
+	deleted    []*sqs.DeleteMessageInput
+}
+
+// Send queues messages with the given bodies.
+func (fake *FakeSQSAPI) Send(bodies ...string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for _, body := range bodies {
+		fake.messages = append(fake.messages, &sqs.Message{
+			Body:          aws.String(body),
+			ReceiptHandle: aws.String("receipt-handle-" + body),
+		})
+	}
+}
+
+// ReceiveMessageReturnsError makes every receive fail with the error.
+func (fake *FakeSQSAPI) ReceiveMessageReturnsError(err error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.receiveErr = err
+}
+
+func (fake *FakeSQSAPI) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	fake.mutex.Lock()
+	fake.received = append(fake.received, input)
+	err := fake.receiveErr
+	n := len(fake.messages)
+	if n > 10 {
+		n = 10
+	}
+	messages := fake.messages[:n]
+	fake.messages = fake.messages[n:]
+	fake.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+}
+
+func (fake *FakeSQSAPI) ReceiveMessageCallCount() int {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+	return len(fake.received)
+}
+
+func (fake *FakeSQSAPI) ReceiveMessageArgsForCall(i int) *sqs.ReceiveMessageInput {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+	return fake.received[i]
+}
+
+func (fake *FakeSQSAPI) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.deleted = append(fake.deleted, input)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// Deleted returns the receipt handles of the deleted messages.
+func (fake *FakeSQSAPI) Deleted() []string {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+	var receiptHandles []string
+	for _, input := range fake.deleted {
+		receiptHandles = append(receiptHandles, aws.StringValue(input.ReceiptHandle))
+	}
+	return receiptHandles
+}
+
+var _ sqsiface.SQSAPI = new(FakeSQSAPI)
@@ -0,0 +1,20 @@
+package ssm
+
+import (
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsssm "github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/henrytk/aws-service-broker/aws/logging"
+	"github.com/henrytk/aws-service-broker/metrics"
+)
+
+func NewSSMClient(region string, logger lager.Logger) (*awsssm.SSM, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+	metrics.InstrumentAWSHandlers(&sess.Handlers)
+	logging.LogRequests(&sess.Handlers, logger)
+	return awsssm.New(sess), nil
+}
@@ -0,0 +1,67 @@
+package fakes
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// FakeSSMAPI fakes the SSM parameter calls the broker makes, keeping the
+// parameters in memory. Any other call panics on the nil embedded
+// interface.
+type FakeSSMAPI struct {
+	ssmiface.SSMAPI
+
+	mutex      sync.RWMutex
+	parameters map[string]*ssm.PutParameterInput
+	putErr     error
+}
+
+// PutParameterReturnsError makes every put fail with the error.
+func (fake *FakeSSMAPI) PutParameterReturnsError(err error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.putErr = err
+}
+
+func (fake *FakeSSMAPI) PutParameterWithContext(ctx aws.Context, input *ssm.PutParameterInput, opts ...request.Option) (*ssm.PutParameterOutput, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if fake.putErr != nil {
+		return nil, fake.putErr
+	}
+	name := aws.StringValue(input.Name)
+	if _, ok := fake.parameters[name]; ok && !aws.BoolValue(input.Overwrite) {
+		return nil, awserr.New(ssm.ErrCodeParameterAlreadyExists, "parameter "+name+" already exists", nil)
+	}
+	if fake.parameters == nil {
+		fake.parameters = map[string]*ssm.PutParameterInput{}
+	}
+	fake.parameters[name] = input
+	return &ssm.PutParameterOutput{Version: aws.Int64(1)}, nil
+}
+
+func (fake *FakeSSMAPI) DeleteParameterWithContext(ctx aws.Context, input *ssm.DeleteParameterInput, opts ...request.Option) (*ssm.DeleteParameterOutput, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	name := aws.StringValue(input.Name)
+	if _, ok := fake.parameters[name]; !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter "+name+" not found", nil)
+	}
+	delete(fake.parameters, name)
+	return &ssm.DeleteParameterOutput{}, nil
+}
+
+// Parameter returns the last put of the parameter with the name, or nil if
+// there is none.
+func (fake *FakeSSMAPI) Parameter(name string) *ssm.PutParameterInput {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+	return fake.parameters[name]
+}
+
+var _ ssmiface.SSMAPI = new(FakeSSMAPI)
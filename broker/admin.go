@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"net/http"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+	"github.com/henrytk/aws-service-broker/provider"
+)
+
+const adminPath = "/admin/"
+
+type instancesResponse struct {
+	Instances []provider.AdminInstance `json:"instances"`
+}
+
+type retryResponse struct {
+	Operation string `json:"operation"`
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// adminHandler serves the admin API:
+//
+//	GET  /admin/instances               lists instances
+//	GET  /admin/instances/<id>          describes an instance's stack
+//	POST /admin/instances/<id>/retry    retries its failed operation
+//	POST /admin/instances/<id>/refresh  refreshes its cached status
+func adminHandler(awsProvider *provider.AWSProvider, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(strings.TrimPrefix(r.URL.Path, adminPath), "/")
+		if path[0] != "instances" || len(path) > 3 {
+			respond(w, http.StatusNotFound, errorResponse{Description: "not found"})
+			return
+		}
+
+		method := http.MethodGet
+		if len(path) == 3 {
+			method = http.MethodPost
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			respond(w, http.StatusMethodNotAllowed, errorResponse{Description: "method not allowed"})
+			return
+		}
+
+		if len(path) == 1 {
+			instances, err := awsProvider.Instances(r.Context())
+			if err != nil {
+				logger.Error("list-instances", err)
+				respond(w, http.StatusInternalServerError, errorResponse{Description: err.Error()})
+				return
+			}
+			respond(w, http.StatusOK, instancesResponse{Instances: instances})
+			return
+		}
+
+		instanceID := path[1]
+		if instanceID == "" {
+			respond(w, http.StatusNotFound, errorResponse{Description: "instance not found"})
+			return
+		}
+		data := lager.Data{"instance-id": instanceID}
+
+		var (
+			response interface{}
+			err      error
+		)
+		action := "describe-instance"
+		if len(path) == 3 {
+			action = path[2]
+		}
+		switch action {
+		case "describe-instance":
+			response, err = awsProvider.Instance(r.Context(), instanceID)
+		case "retry":
+			var operation string
+			operation, err = awsProvider.RetryOperation(r.Context(), instanceID)
+			response = retryResponse{Operation: operation}
+			if err == nil {
+				logger.Info("retry-operation", lager.Data{"instance-id": instanceID, "operation": operation})
+			}
+		case "refresh":
+			var status statusResponse
+			status.Status, status.Reason, err = awsProvider.RefreshStatus(r.Context(), instanceID)
+			response = status
+		default:
+			respond(w, http.StatusNotFound, errorResponse{Description: "not found"})
+			return
+		}
+
+		switch err {
+		case nil:
+			respond(w, http.StatusOK, response)
+		case mongodb.ErrStackNotFound:
+			respond(w, http.StatusNotFound, errorResponse{Description: "instance not found"})
+		case mongodb.ErrNothingToRetry:
+			respond(w, http.StatusConflict, errorResponse{Description: err.Error()})
+		default:
+			logger.Error(action, err, data)
+			respond(w, http.StatusInternalServerError, errorResponse{Description: err.Error()})
+		}
+	}
+}
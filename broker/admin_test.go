@@ -0,0 +1,156 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/aws/aws-sdk-go/aws"
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/fakes"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+	"github.com/henrytk/aws-service-broker/provider"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("adminHandler", func() {
+	var (
+		fakeCloudFormationAPI *fakes.FakeCloudFormationAPI
+		handler               http.HandlerFunc
+	)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, path, nil).WithContext(context.Background())
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	BeforeEach(func() {
+		fakeCloudFormationAPI = &fakes.FakeCloudFormationAPI{}
+		config, err := provider.DecodeConfig([]byte(`{
+			"secret": "half-centaur",
+			"aws_config": {"region": "eu-west-1"},
+			"catalog": {
+				"services": [{
+					"id": "uuid-1",
+					"name": "mongodb",
+					"bastion_security_group_id": "irrelevant",
+					"key_pair_name": "key_pair_name",
+					"vpc_id": "irrelevant",
+					"node_subnet_ids": ["irrelevant"],
+					"plans": [{"id": "uuid-2", "name": "basic"}]
+				}]
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		handler = adminHandler(&provider.AWSProvider{
+			Config:         config,
+			MongoDBService: &mongodb.Service{Client: fakeCloudFormationAPI},
+			Logger:         lagertest.NewTestLogger("provider"),
+		}, lagertest.NewTestLogger("admin"))
+	})
+
+	It("lists instances with their service, plan, status and region", func() {
+		fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+			Stacks: []*awscf.Stack{{
+				StackName:    aws.String("mongodbabc"),
+				StackId:      aws.String("stack-abc"),
+				StackStatus:  aws.String(awscf.StackStatusCreateComplete),
+				CreationTime: aws.Time(time.Now().Add(-time.Hour)),
+				Tags: []*awscf.Tag{
+					{Key: aws.String(mongodb.InstanceIDTag), Value: aws.String("a-b-c")},
+					{Key: aws.String(mongodb.PlanIDTag), Value: aws.String("uuid-2")},
+				},
+			}},
+		}, nil)
+
+		response := serve("GET", "/admin/instances")
+		Expect(response.Code).To(Equal(http.StatusOK))
+		var instances instancesResponse
+		Expect(json.Unmarshal(response.Body.Bytes(), &instances)).To(Succeed())
+		Expect(instances.Instances).To(HaveLen(1))
+		instance := instances.Instances[0]
+		Expect(instance.InstanceID).To(Equal("a-b-c"))
+		Expect(instance.Service).To(Equal("mongodb"))
+		Expect(instance.Plan).To(Equal("basic"))
+		Expect(instance.StackName).To(Equal("mongodbabc"))
+		Expect(instance.Status).To(Equal(awscf.StackStatusCreateComplete))
+		Expect(instance.Region).To(Equal("eu-west-1"))
+		Expect(instance.Age).To(HavePrefix("1h0m"))
+	})
+
+	It("describes an instance", func() {
+		fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+			Stacks: []*awscf.Stack{{
+				StackName:   aws.String("mongodbabc"),
+				StackStatus: aws.String(awscf.StackStatusCreateComplete),
+				Outputs:     []*awscf.Output{{OutputKey: aws.String("PrimaryReplicaNodeIp"), OutputValue: aws.String("10.0.0.1")}},
+			}},
+		}, nil)
+		fakeCloudFormationAPI.DescribeStackEventsWithContextReturns(&awscf.DescribeStackEventsOutput{
+			StackEvents: []*awscf.StackEvent{{
+				LogicalResourceId: aws.String("mongodbabc"),
+				ResourceStatus:    aws.String(awscf.ResourceStatusCreateComplete),
+			}},
+		}, nil)
+
+		response := serve("GET", "/admin/instances/a-b-c")
+		Expect(response.Code).To(Equal(http.StatusOK))
+		var details provider.AdminInstanceDetails
+		Expect(json.Unmarshal(response.Body.Bytes(), &details)).To(Succeed())
+		Expect(details.Outputs).To(HaveKeyWithValue("PrimaryReplicaNodeIp", "10.0.0.1"))
+		Expect(details.Events).To(HaveLen(1))
+		Expect(details.Events[0].Status).To(Equal(awscf.ResourceStatusCreateComplete))
+	})
+
+	It("responds 404 for instances that don't exist", func() {
+		fakeCloudFormationAPI.DescribeStacksWithContextReturns(nil, errors.New("Stack with id mongodbabc does not exist"))
+		Expect(serve("GET", "/admin/instances/a-b-c").Code).To(Equal(http.StatusNotFound))
+		Expect(serve("POST", "/admin/instances/a-b-c/refresh").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("retries failed operations", func() {
+		fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+			Stacks: []*awscf.Stack{{StackStatus: aws.String(awscf.StackStatusDeleteFailed)}},
+		}, nil)
+
+		response := serve("POST", "/admin/instances/a-b-c/retry")
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Body.String()).To(MatchJSON(`{"operation": "delete"}`))
+		Expect(fakeCloudFormationAPI.DeleteStackWithContextCallCount()).To(Equal(1))
+	})
+
+	It("responds 409 when there is no failed operation to retry", func() {
+		fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+			Stacks: []*awscf.Stack{{StackStatus: aws.String(awscf.StackStatusCreateComplete)}},
+		}, nil)
+		Expect(serve("POST", "/admin/instances/a-b-c/retry").Code).To(Equal(http.StatusConflict))
+	})
+
+	It("refreshes an instance's status", func() {
+		fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+			Stacks: []*awscf.Stack{{
+				StackStatus:       aws.String(awscf.StackStatusUpdateRollbackComplete),
+				StackStatusReason: aws.String("instance type not supported"),
+			}},
+		}, nil)
+
+		response := serve("POST", "/admin/instances/a-b-c/refresh")
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Body.String()).To(MatchJSON(`{"status": "UPDATE_ROLLBACK_COMPLETE", "reason": "instance type not supported"}`))
+	})
+
+	It("only allows POST to actions and GET elsewhere", func() {
+		Expect(serve("POST", "/admin/instances").Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(serve("GET", "/admin/instances/a-b-c/retry").Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(serve("GET", "/admin/stacks").Code).To(Equal(http.StatusNotFound))
+		Expect(serve("POST", "/admin/instances/a-b-c/explode").Code).To(Equal(http.StatusNotFound))
+	})
+})
@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+	"github.com/henrytk/aws-service-broker/provider"
+)
+
+const alarmsPath = "/alarms/"
+
+type alarmsResponse struct {
+	Alarms []mongodb.Alarm `json:"alarms"`
+}
+
+type errorResponse struct {
+	Description string `json:"description"`
+}
+
+// alarmsHandler serves the state of an instance's CloudWatch alarms at
+// /alarms/<instance_id>.
+func alarmsHandler(awsProvider *provider.AWSProvider, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			respond(w, http.StatusMethodNotAllowed, errorResponse{Description: "method not allowed"})
+			return
+		}
+		instanceID := strings.TrimPrefix(r.URL.Path, alarmsPath)
+		if instanceID == "" || strings.Contains(instanceID, "/") {
+			respond(w, http.StatusNotFound, errorResponse{Description: "instance not found"})
+			return
+		}
+
+		alarms, err := awsProvider.Alarms(r.Context(), instanceID)
+		if err != nil {
+			logger.Error("describe-alarms", err, lager.Data{"instance-id": instanceID})
+			respond(w, http.StatusInternalServerError, errorResponse{Description: err.Error()})
+			return
+		}
+		if alarms == nil {
+			alarms = []mongodb.Alarm{}
+		}
+		respond(w, http.StatusOK, alarmsResponse{Alarms: alarms})
+	}
+}
+
+func respond(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,137 @@
+package broker
+
+import (
+	"context"
+
+	"github.com/henrytk/aws-service-broker/audit"
+	usbProvider "github.com/henrytk/universal-service-broker/provider"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// auditedProvider records every operation handed to a provider in the
+// audit log, along with the originating identity of the request.
+type auditedProvider struct {
+	usbProvider.ServiceProvider
+	names    func(serviceID, planID string) (serviceName, planName string)
+	log      *audit.Logger
+	finished *finishedOperations
+}
+
+func (p auditedProvider) Provision(ctx context.Context, provisionData usbProvider.ProvisionData) (
+	dashboardURL string, operationData string, err error,
+) {
+	dashboardURL, operationData, err = p.ServiceProvider.Provision(ctx, provisionData)
+	entry := newEntry(ctx, "provision", provisionData.InstanceID, operationData, err)
+	entry.Service = provisionData.Service.Name
+	entry.Plan = provisionData.Plan.Name
+	entry.OrganizationGUID = provisionData.Details.OrganizationGUID
+	entry.SpaceGUID = provisionData.Details.SpaceGUID
+	entry.Parameters = audit.RedactParameters(provisionData.Details.RawParameters)
+	p.log.Log(entry)
+	p.start(provisionData.InstanceID, operationData, err)
+	return dashboardURL, operationData, err
+}
+
+func (p auditedProvider) Deprovision(ctx context.Context, deprovisionData usbProvider.DeprovisionData) (
+	operationData string, err error,
+) {
+	operationData, err = p.ServiceProvider.Deprovision(ctx, deprovisionData)
+	entry := newEntry(ctx, "deprovision", deprovisionData.InstanceID, operationData, err)
+	entry.Service = deprovisionData.Service.Name
+	entry.Plan = deprovisionData.Plan.Name
+	p.log.Log(entry)
+	p.start(deprovisionData.InstanceID, operationData, err)
+	return operationData, err
+}
+
+func (p auditedProvider) Bind(ctx context.Context, bindData usbProvider.BindData) (
+	binding brokerapi.Binding, err error,
+) {
+	binding, err = p.ServiceProvider.Bind(ctx, bindData)
+	entry := newEntry(ctx, "bind", bindData.InstanceID, "", err)
+	entry.BindingID = bindData.BindingID
+	entry.Service, entry.Plan = p.names(bindData.Details.ServiceID, bindData.Details.PlanID)
+	entry.OrganizationGUID, entry.SpaceGUID = audit.OrganizationAndSpace(bindData.Details.RawContext)
+	entry.Parameters = audit.RedactParameters(bindData.Details.RawParameters)
+	p.log.Log(entry)
+	return binding, err
+}
+
+func (p auditedProvider) Unbind(ctx context.Context, unbindData usbProvider.UnbindData) (err error) {
+	err = p.ServiceProvider.Unbind(ctx, unbindData)
+	entry := newEntry(ctx, "unbind", unbindData.InstanceID, "", err)
+	entry.BindingID = unbindData.BindingID
+	entry.Service, entry.Plan = p.names(unbindData.Details.ServiceID, unbindData.Details.PlanID)
+	p.log.Log(entry)
+	return err
+}
+
+func (p auditedProvider) Update(ctx context.Context, updateData usbProvider.UpdateData) (
+	operationData string, err error,
+) {
+	operationData, err = p.ServiceProvider.Update(ctx, updateData)
+	entry := newEntry(ctx, "update", updateData.InstanceID, operationData, err)
+	entry.Service = updateData.Service.Name
+	entry.Plan = updateData.Plan.Name
+	entry.OrganizationGUID = updateData.Details.PreviousValues.OrgID
+	entry.SpaceGUID = updateData.Details.PreviousValues.SpaceID
+	entry.Parameters = audit.RedactParameters(updateData.Details.RawParameters)
+	p.log.Log(entry)
+	p.start(updateData.InstanceID, operationData, err)
+	return operationData, err
+}
+
+// LastOperation records asynchronous operations as they succeed or fail.
+// Polls of operations still in progress, and of operations already
+// recorded as finished, are not recorded.
+func (p auditedProvider) LastOperation(ctx context.Context, lastOperationData usbProvider.LastOperationData) (
+	state brokerapi.LastOperationState, description string, err error,
+) {
+	state, description, err = p.ServiceProvider.LastOperation(ctx, lastOperationData)
+	if err != nil || (state != brokerapi.Succeeded && state != brokerapi.Failed) {
+		return state, description, err
+	}
+	if !p.finished.finish(lastOperationData.InstanceID, lastOperationData.OperationData) {
+		return state, description, err
+	}
+	operation := decodeOperationData(lastOperationData.OperationData)
+	entry := newEntry(ctx, operation.Type, lastOperationData.InstanceID, lastOperationData.OperationData, nil)
+	entry.Service = operation.Service
+	entry.Outcome = string(state)
+	if state == brokerapi.Failed {
+		entry.Error = description
+	}
+	p.log.Log(entry)
+	return state, description, err
+}
+
+// start forgets the last finished operation of an instance when another
+// continues asynchronously on it.
+func (p auditedProvider) start(instanceID, operationData string, err error) {
+	if err == nil && operationData != "" {
+		p.finished.start(instanceID)
+	}
+}
+
+// newEntry starts an audit entry for an operation that returned the given
+// operation data and error. Operations returning operation data continue
+// asynchronously, so they have only been accepted.
+func newEntry(ctx context.Context, operation, instanceID, operationData string, err error) audit.Entry {
+	entry := audit.Entry{
+		Operation:  operation,
+		InstanceID: instanceID,
+		StackID:    decodeOperationData(operationData).StackId,
+		Outcome:    audit.OutcomeSucceeded,
+	}
+	if identity, ok := audit.IdentityFromContext(ctx); ok {
+		entry.Identity = &identity
+	}
+	switch {
+	case err != nil:
+		entry.Outcome = audit.OutcomeError
+		entry.Error = err.Error()
+	case operationData != "":
+		entry.Outcome = audit.OutcomeAccepted
+	}
+	return entry
+}
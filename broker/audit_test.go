@@ -0,0 +1,178 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/henrytk/aws-service-broker/audit"
+	usbProvider "github.com/henrytk/universal-service-broker/provider"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+)
+
+// stubProvider returns the same operation data, state and error for every
+// operation.
+type stubProvider struct {
+	operationData string
+	state         brokerapi.LastOperationState
+	description   string
+	err           error
+}
+
+func (s stubProvider) Provision(context.Context, usbProvider.ProvisionData) (string, string, error) {
+	return "", s.operationData, s.err
+}
+
+func (s stubProvider) Deprovision(context.Context, usbProvider.DeprovisionData) (string, error) {
+	return s.operationData, s.err
+}
+
+func (s stubProvider) Bind(context.Context, usbProvider.BindData) (brokerapi.Binding, error) {
+	return brokerapi.Binding{Credentials: map[string]string{"password": "secret"}}, s.err
+}
+
+func (s stubProvider) Unbind(context.Context, usbProvider.UnbindData) error {
+	return s.err
+}
+
+func (s stubProvider) Update(context.Context, usbProvider.UpdateData) (string, error) {
+	return s.operationData, s.err
+}
+
+func (s stubProvider) LastOperation(context.Context, usbProvider.LastOperationData) (brokerapi.LastOperationState, string, error) {
+	return s.state, s.description, s.err
+}
+
+var _ = Describe("auditedProvider", func() {
+	var (
+		sink *bytes.Buffer
+		ctx  context.Context
+	)
+
+	newProvider := func(stub stubProvider) auditedProvider {
+		return auditedProvider{
+			ServiceProvider: stub,
+			names: func(serviceID, planID string) (string, string) {
+				return "mongodb", "basic"
+			},
+			log:      audit.NewLogger(sink),
+			finished: &finishedOperations{},
+		}
+	}
+
+	entries := func() []audit.Entry {
+		var entries []audit.Entry
+		decoder := json.NewDecoder(sink)
+		for decoder.More() {
+			var entry audit.Entry
+			Expect(decoder.Decode(&entry)).To(Succeed())
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	BeforeEach(func() {
+		sink = &bytes.Buffer{}
+		ctx = audit.WithIdentity(context.Background(), audit.Identity{Platform: "cloudfoundry", User: "user-id"})
+	})
+
+	It("records an accepted provision with who asked for it, where and with what", func() {
+		auditedProvider := newProvider(stubProvider{operationData: `{"type":"provision","service":"mongodb","stack_id":"stack-id"}`})
+		_, _, err := auditedProvider.Provision(ctx, usbProvider.ProvisionData{
+			InstanceID: "instance-id",
+			Details: brokerapi.ProvisionDetails{
+				OrganizationGUID: "org-guid",
+				SpaceGUID:        "space-guid",
+				RawParameters:    json.RawMessage(`{"admin_password": "hunter2"}`),
+			},
+			Service: brokerapi.Service{Name: "mongodb"},
+			Plan:    brokerapi.ServicePlan{Name: "basic"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(entries()).To(ConsistOf(MatchAllFields(Fields{
+			"Time":             Not(BeZero()),
+			"Operation":        Equal("provision"),
+			"InstanceID":       Equal("instance-id"),
+			"BindingID":        BeEmpty(),
+			"Service":          Equal("mongodb"),
+			"Plan":             Equal("basic"),
+			"Identity":         Equal(&audit.Identity{Platform: "cloudfoundry", User: "user-id"}),
+			"OrganizationGUID": Equal("org-guid"),
+			"SpaceGUID":        Equal("space-guid"),
+			"Parameters":       Equal(map[string]interface{}{"admin_password": audit.Redacted}),
+			"StackID":          Equal("stack-id"),
+			"Outcome":          Equal(audit.OutcomeAccepted),
+			"Error":            BeEmpty(),
+		})))
+	})
+
+	It("records failed operations with their error", func() {
+		auditedProvider := newProvider(stubProvider{err: errors.New("could not find plan ID: uuid")})
+		err := auditedProvider.Unbind(ctx, usbProvider.UnbindData{InstanceID: "instance-id", BindingID: "binding-id"})
+		Expect(err).To(HaveOccurred())
+
+		recorded := entries()
+		Expect(recorded).To(HaveLen(1))
+		Expect(recorded[0].Operation).To(Equal("unbind"))
+		Expect(recorded[0].BindingID).To(Equal("binding-id"))
+		Expect(recorded[0].Plan).To(Equal("basic"))
+		Expect(recorded[0].Outcome).To(Equal(audit.OutcomeError))
+		Expect(recorded[0].Error).To(Equal("could not find plan ID: uuid"))
+	})
+
+	It("records bindings without their credentials", func() {
+		auditedProvider := newProvider(stubProvider{})
+		_, err := auditedProvider.Bind(ctx, usbProvider.BindData{InstanceID: "instance-id", BindingID: "binding-id"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sink.String()).NotTo(ContainSubstring("secret"))
+		Expect(entries()[0].Outcome).To(Equal(audit.OutcomeSucceeded))
+	})
+
+	It("records asynchronous operations when they finish", func() {
+		lastOperationData := usbProvider.LastOperationData{
+			InstanceID:    "instance-id",
+			OperationData: `{"type":"update","service":"mongodb","stack_id":"stack-id"}`,
+		}
+		_, _, err := newProvider(stubProvider{state: brokerapi.InProgress}).LastOperation(ctx, lastOperationData)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sink.Len()).To(BeZero())
+
+		_, _, err = newProvider(stubProvider{state: brokerapi.Failed, description: "rolled back"}).LastOperation(ctx, lastOperationData)
+		Expect(err).NotTo(HaveOccurred())
+		recorded := entries()
+		Expect(recorded).To(HaveLen(1))
+		Expect(recorded[0].Operation).To(Equal("update"))
+		Expect(recorded[0].StackID).To(Equal("stack-id"))
+		Expect(recorded[0].Outcome).To(Equal(audit.OutcomeFailed))
+		Expect(recorded[0].Error).To(Equal("rolled back"))
+	})
+
+	It("records a finished operation once however many times it is polled", func() {
+		auditedProvider := newProvider(stubProvider{state: brokerapi.Succeeded, operationData: `{"type":"update","stack_id":"stack-id"}`})
+		lastOperationData := usbProvider.LastOperationData{
+			InstanceID:    "instance-id",
+			OperationData: `{"type":"update","stack_id":"stack-id"}`,
+		}
+		for i := 0; i < 3; i++ {
+			_, _, err := auditedProvider.LastOperation(ctx, lastOperationData)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(entries()).To(HaveLen(1))
+
+		By("recording the operation again when it is repeated")
+		_, err := auditedProvider.Update(ctx, usbProvider.UpdateData{InstanceID: "instance-id"})
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = auditedProvider.LastOperation(ctx, lastOperationData)
+		Expect(err).NotTo(HaveOccurred())
+		recorded := entries()
+		Expect(recorded).To(HaveLen(2))
+		Expect(recorded[0].Outcome).To(Equal(audit.OutcomeAccepted))
+		Expect(recorded[1].Outcome).To(Equal(audit.OutcomeSucceeded))
+	})
+})
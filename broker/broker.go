@@ -1,18 +1,170 @@
 package broker
 
 import (
+	"context"
 	"net/http"
-	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"code.cloudfoundry.org/lager"
+	"github.com/henrytk/aws-service-broker/audit"
+	"github.com/henrytk/aws-service-broker/health"
+	"github.com/henrytk/aws-service-broker/metrics"
 	"github.com/henrytk/aws-service-broker/provider"
+	"github.com/henrytk/aws-service-broker/webhooks"
 	usb "github.com/henrytk/universal-service-broker/broker"
+	usbProvider "github.com/henrytk/universal-service-broker/provider"
+	"github.com/pivotal-cf/brokerapi/auth"
 )
 
-func NewAWSServiceBroker(config usb.Config, awsProvider *provider.AWSProvider) http.Handler {
-	logger := lager.NewLogger("aws-service-broker")
-	logger.RegisterSink(lager.NewWriterSink(os.Stdout, config.API.LagerLogLevel))
+// healthcheckPath is also served by the service broker API, which always
+// reports the broker healthy. It needs no credentials.
+const healthcheckPath = "/healthcheck"
 
-	serviceBroker := usb.New(config, awsProvider, logger)
-	return usb.NewAPI(serviceBroker, logger, config)
+const (
+	livezPath  = "/livez"
+	readyzPath = "/readyz"
+	// Readiness checks that take longer than readinessTimeout fail, and
+	// their report answers probes for readinessCacheFor.
+	readinessTimeout  = 10 * time.Second
+	readinessCacheFor = 5 * time.Second
+)
+
+// ProbePaths are the paths health probes call, which need no credentials.
+var ProbePaths = []string{healthcheckPath, livezPath, readyzPath}
+
+// AWSServiceBroker serves the service broker API along with the broker's
+// own endpoints. Its catalog can be reloaded while it serves.
+type AWSServiceBroker struct {
+	http.Handler
+	awsProvider     *provider.AWSProvider
+	serviceProvider usbProvider.ServiceProvider
+	sender          *webhooks.Sender
+	logger          lager.Logger
+
+	// reloadMu serializes reloads, which replace config and api.
+	reloadMu sync.Mutex
+	config   usb.Config
+	api      atomic.Value
+}
+
+// apiState is the service broker API and the provider config it serves
+// with. They are swapped together, so that each request is served with
+// one catalog.
+type apiState struct {
+	handler http.Handler
+	config  *provider.Config
+}
+
+func NewAWSServiceBroker(config usb.Config, awsProvider *provider.AWSProvider, logger lager.Logger) (*AWSServiceBroker, error) {
+	auditLog, err := audit.Open(awsProvider.Config.AuditLog)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics.SetInstanceCounter(awsProvider.InstanceCounts)
+	// The sender is kept when the config is reloaded, so that it can be
+	// closed on shutdown, and it sends nothing without endpoints.
+	sender := webhooks.NewSender(awsProvider.Config.Webhooks, logger.Session("webhooks"))
+	var serviceProvider usbProvider.ServiceProvider = notifyingProvider{
+		ServiceProvider: awsProvider,
+		sender:          sender,
+		finished:        &finishedOperations{},
+	}
+	serviceProvider = instrumentedProvider{
+		ServiceProvider: auditedProvider{
+			ServiceProvider: serviceProvider,
+			names:           awsProvider.Names,
+			log:             auditLog,
+			finished:        &finishedOperations{},
+		},
+		names: awsProvider.Names,
+	}
+	b := &AWSServiceBroker{
+		awsProvider:     awsProvider,
+		serviceProvider: serviceProvider,
+		sender:          sender,
+		logger:          logger,
+		config:          config,
+	}
+	b.api.Store(apiState{handler: b.newAPI(config), config: awsProvider.CurrentConfig()})
+	brokerCredentials := newCredentials(config.API.BasicAuthUsername, config.API.BasicAuthPassword, awsProvider.Config.Credentials)
+
+	api := http.HandlerFunc(b.serveAPI)
+	mux := http.NewServeMux()
+	mux.Handle("/", brokerCredentials.wrap(audit.IdentityHandler(api)))
+	mux.Handle(alarmsPath, brokerCredentials.wrapFunc(alarmsHandler(awsProvider, logger.Session("alarms"))))
+	mux.Handle(serviceDiscoveryPath, brokerCredentials.wrapFunc(serviceDiscoveryHandler(awsProvider, logger.Session("service-discovery"))))
+	mux.Handle(metricsPath, metrics.Handler())
+	mux.HandleFunc(livezPath, health.Live)
+	mux.Handle(readyzPath, health.NewReadiness(awsProvider.ReadinessChecks(), readinessTimeout, readinessCacheFor))
+	if awsProvider.Preflight != nil {
+		mux.Handle(healthcheckPath, awsProvider.Preflight)
+	} else {
+		mux.Handle(healthcheckPath, api)
+	}
+	if admin := awsProvider.Config.Admin; admin.Username != "" {
+		adminAuthWrapper := auth.NewWrapper(admin.Username, admin.Password)
+		mux.Handle(adminPath, adminAuthWrapper.WrapFunc(adminHandler(awsProvider, logger.Session("admin"))))
+	}
+	b.Handler = mux
+	return b, nil
+}
+
+func (b *AWSServiceBroker) newAPI(config usb.Config) http.Handler {
+	return usb.NewAPI(usb.New(config, b.serviceProvider, b.logger), b.logger, config)
+}
+
+func (b *AWSServiceBroker) serveAPI(w http.ResponseWriter, r *http.Request) {
+	state := b.api.Load().(apiState)
+	r = r.WithContext(provider.WithConfig(r.Context(), state.config))
+	if r.Method == http.MethodGet && r.URL.Path == catalogPath {
+		serveCatalog(w, r, state.handler, state.config)
+		return
+	}
+	state.handler.ServeHTTP(w, r)
+}
+
+// Reload switches the broker to the catalog and webhooks of a reloaded
+// config, unless the provider can't switch to it. Requests in flight
+// finish with the catalog they started with, and webhook deliveries in
+// progress with their endpoints. Only the catalog and webhooks are
+// reloaded: the returned diff lists the other settings that changed,
+// which need a restart.
+func (b *AWSServiceBroker) Reload(ctx context.Context, config usb.Config, providerConfig *provider.Config) (provider.ConfigDiff, error) {
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+	if err := b.awsProvider.CheckReload(ctx, providerConfig); err != nil {
+		return provider.ConfigDiff{}, err
+	}
+
+	diff := provider.DiffConfig(b.awsProvider.CurrentConfig(), providerConfig)
+	for _, setting := range []struct {
+		name     string
+		old, new string
+	}{
+		{"basic_auth_username", b.config.API.BasicAuthUsername, config.API.BasicAuthUsername},
+		{"basic_auth_password", b.config.API.BasicAuthPassword, config.API.BasicAuthPassword},
+		{"port", b.config.API.Port, config.API.Port},
+		{"log_level", b.config.API.LogLevel, config.API.LogLevel},
+	} {
+		if setting.old != setting.new {
+			diff.NotReloaded = append(diff.NotReloaded, setting.name)
+		}
+	}
+
+	reloaded := b.config
+	reloaded.Catalog = config.Catalog
+	b.api.Store(apiState{handler: b.newAPI(reloaded), config: providerConfig})
+	b.awsProvider.SwapConfig(providerConfig)
+	b.sender.SetEndpoints(providerConfig.Webhooks)
+	b.config = reloaded
+	return diff, nil
+}
+
+// Close waits, until ctx is done, for the webhook deliveries in progress.
+// It is called once the broker has stopped serving.
+func (b *AWSServiceBroker) Close(ctx context.Context) error {
+	return b.sender.Close(ctx)
 }
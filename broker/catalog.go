@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/henrytk/aws-service-broker/provider"
+)
+
+const catalogPath = "/v2/catalog"
+
+// planUpdatesMetadata is added to the metadata of each plan in the
+// catalog, so that clients can show the plans an instance may be updated
+// to and what may change.
+type planUpdatesMetadata struct {
+	To      []string `json:"to"`
+	Mutable []string `json:"mutable"`
+}
+
+// bufferedResponse holds a response so that it can be rewritten.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *bufferedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *bufferedResponse) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *bufferedResponse) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+// serveCatalog serves the API's catalog with the update rules of each
+// plan in its metadata, under "updates". The catalog is served unchanged
+// if it can't be rewritten.
+func serveCatalog(w http.ResponseWriter, r *http.Request, api http.Handler, config *provider.Config) {
+	response := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+	api.ServeHTTP(response, r)
+	body := response.body.Bytes()
+	if response.status == http.StatusOK {
+		if rewritten, err := addPlanUpdates(body, config); err == nil {
+			body = rewritten
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(response.status)
+	w.Write(body)
+}
+
+// addPlanUpdates adds the update rules to the plans of a catalog
+// response. Its other fields are decoded generically, so that they are
+// kept as they are.
+func addPlanUpdates(body []byte, config *provider.Config) ([]byte, error) {
+	var catalog struct {
+		Services []map[string]interface{} `json:"services"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&catalog); err != nil {
+		return nil, err
+	}
+	for _, service := range catalog.Services {
+		serviceID, _ := service["id"].(string)
+		configService, ok := findService(config, serviceID)
+		if !ok {
+			continue
+		}
+		plans, _ := service["plans"].([]interface{})
+		for _, p := range plans {
+			plan, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			planID, _ := plan["id"].(string)
+			configPlan, ok := findPlan(configService, planID)
+			if !ok {
+				continue
+			}
+			metadata, ok := plan["metadata"].(map[string]interface{})
+			if !ok {
+				metadata = map[string]interface{}{}
+				plan["metadata"] = metadata
+			}
+			updates := planUpdatesMetadata{
+				To:      []string{},
+				Mutable: configService.MutableFields(configPlan),
+			}
+			for _, target := range configService.UpdateTargets(configPlan) {
+				updates.To = append(updates.To, target.Name)
+			}
+			metadata["updates"] = updates
+		}
+	}
+	return json.Marshal(catalog)
+}
+
+func findService(config *provider.Config, id string) (provider.Service, bool) {
+	for _, service := range config.Catalog.Services {
+		if service.ID == id {
+			return service, true
+		}
+	}
+	return provider.Service{}, false
+}
+
+func findPlan(service provider.Service, id string) (provider.Plan, bool) {
+	for _, plan := range service.Plans {
+		if plan.ID == id {
+			return plan, true
+		}
+	}
+	return provider.Plan{}, false
+}
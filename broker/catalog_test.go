@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/fakes"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+	"github.com/henrytk/aws-service-broker/provider"
+	usb "github.com/henrytk/universal-service-broker/broker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Catalog", func() {
+	var awsServiceBroker *AWSServiceBroker
+
+	BeforeEach(func() {
+		config, err := usb.NewConfig(strings.NewReader(`{
+			"basic_auth_username": "username",
+			"basic_auth_password": "password",
+			"secret": "half-centaur",
+			"aws_config": {"region": "eu-west-1"},
+			"catalog": {
+				"services": [{
+					"id": "uuid-1",
+					"name": "mongodb",
+					"description": "MongoDB",
+					"plan_updateable": true,
+					"bastion_security_group_id": "irrelevant",
+					"key_pair_name": "key_pair_name",
+					"vpc_id": "irrelevant",
+					"node_subnet_ids": ["irrelevant"],
+					"plans": [
+						{
+							"id": "uuid-2",
+							"name": "small",
+							"description": "Small",
+							"metadata": {"displayName": "Small", "costs": [{"amount": {"usd": 0.5}, "unit": "HOURLY"}]},
+							"node_instance_type": "m3.large",
+							"updates": {"to": ["large"], "mutable": ["node_instance_type", "volume_size"]}
+						},
+						{
+							"id": "uuid-3",
+							"name": "large",
+							"description": "Large",
+							"node_instance_type": "m4.large",
+							"updates": {"to": []}
+						},
+						{
+							"id": "uuid-4",
+							"name": "sharded",
+							"description": "Sharded",
+							"shard_count": "2"
+						}
+					]
+				}]
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		providerConfig, err := provider.DecodeConfig(config.Provider)
+		Expect(err).NotTo(HaveOccurred())
+		awsServiceBroker, err = NewAWSServiceBroker(config, &provider.AWSProvider{
+			Config:         providerConfig,
+			MongoDBService: &mongodb.Service{Client: &fakes.FakeCloudFormationAPI{}},
+			Logger:         lagertest.NewTestLogger("provider"),
+		}, lagertest.NewTestLogger("broker"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("adds the update rules of each plan to its metadata", func() {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/v2/catalog", nil)
+		request.SetBasicAuth("username", "password")
+		request.Header.Set("X-Broker-API-Version", "2.13")
+		awsServiceBroker.ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		var catalog struct {
+			Services []struct {
+				Plans []struct {
+					Name     string                 `json:"name"`
+					Metadata map[string]interface{} `json:"metadata"`
+				} `json:"plans"`
+			} `json:"services"`
+		}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &catalog)).To(Succeed())
+		plans := catalog.Services[0].Plans
+		Expect(plans).To(HaveLen(3))
+
+		Expect(plans[0].Metadata).To(Equal(map[string]interface{}{
+			"displayName": "Small",
+			"costs": []interface{}{map[string]interface{}{
+				"amount": map[string]interface{}{"usd": 0.5},
+				"unit":   "HOURLY",
+			}},
+			"updates": map[string]interface{}{
+				"to":      []interface{}{"large"},
+				"mutable": []interface{}{"node_instance_type", "volume_size"},
+			},
+		}))
+		Expect(plans[1].Metadata["updates"]).To(Equal(map[string]interface{}{
+			"to":      []interface{}{},
+			"mutable": []interface{}{"node_instance_type"},
+		}))
+		// Plans without a declaration may only change the default mutable
+		// fields, which rules out the sharded plan.
+		Expect(plans[2].Metadata["updates"]).To(Equal(map[string]interface{}{
+			"to":      []interface{}{},
+			"mutable": []interface{}{"node_instance_type"},
+		}))
+	})
+})
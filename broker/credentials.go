@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"sync"
+
+	"github.com/henrytk/aws-service-broker/provider"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// notAuthorized is the response of the service broker API to requests
+// without valid credentials.
+const notAuthorized = "Not Authorized"
+
+// credentials authenticate requests to the service broker API. Without
+// hashed credentials, requests need the basic auth username and password
+// of the config. With them, requests need one of the hashed credentials,
+// and are passed on with the basic auth username and password, which the
+// service broker API still checks.
+type credentials struct {
+	hashed   []provider.Credential
+	username string
+	password string
+
+	// verified are the digests of the usernames and passwords that
+	// matched a hash, so that bcrypt isn't run on every poll.
+	mu       sync.RWMutex
+	verified map[[sha256.Size]byte]bool
+}
+
+func newCredentials(username, password string, hashed []provider.Credential) *credentials {
+	return &credentials{
+		hashed:   hashed,
+		username: username,
+		password: password,
+		verified: map[[sha256.Size]byte]bool{},
+	}
+}
+
+func (c *credentials) authenticate(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	if len(c.hashed) == 0 {
+		return subtle.ConstantTimeCompare([]byte(username), []byte(c.username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(c.password)) == 1
+	}
+
+	digest := sha256.Sum256([]byte(username + ":" + password))
+	c.mu.RLock()
+	verified := c.verified[digest]
+	c.mu.RUnlock()
+	if verified {
+		return true
+	}
+	for _, credential := range c.hashed {
+		if credential.Username != username {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(credential.PasswordHash), []byte(password)) == nil {
+			c.mu.Lock()
+			c.verified[digest] = true
+			c.mu.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+func (c *credentials) wrap(next http.Handler) http.Handler {
+	return c.wrapFunc(next.ServeHTTP)
+}
+
+func (c *credentials) wrapFunc(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !c.authenticate(r) {
+			http.Error(w, notAuthorized, http.StatusUnauthorized)
+			return
+		}
+		if len(c.hashed) > 0 {
+			// The request is copied, along with its headers, rather than
+			// changed in place.
+			authenticated := *r
+			authenticated.Header = make(http.Header, len(r.Header))
+			for key, values := range r.Header {
+				authenticated.Header[key] = values
+			}
+			authenticated.SetBasicAuth(c.username, c.password)
+			r = &authenticated
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/henrytk/aws-service-broker/provider"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ = Describe("Credentials", func() {
+	var (
+		passedUsername string
+		passedPassword string
+		next           http.HandlerFunc
+	)
+
+	BeforeEach(func() {
+		passedUsername, passedPassword = "", ""
+		next = func(w http.ResponseWriter, r *http.Request) {
+			passedUsername, passedPassword, _ = r.BasicAuth()
+		}
+	})
+
+	call := func(handler http.Handler, username, password string) int {
+		request := httptest.NewRequest("GET", "/v2/catalog", nil)
+		request.SetBasicAuth(username, password)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	hash := func(password string) string {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		Expect(err).NotTo(HaveOccurred())
+		return string(hashed)
+	}
+
+	It("accepts the basic auth username and password without hashed credentials", func() {
+		handler := newCredentials("broker", "secret", nil).wrap(next)
+		Expect(call(handler, "broker", "secret")).To(Equal(http.StatusOK))
+		Expect(call(handler, "broker", "wrong")).To(Equal(http.StatusUnauthorized))
+	})
+
+	Describe("with hashed credentials", func() {
+		var handler http.Handler
+
+		BeforeEach(func() {
+			handler = newCredentials("broker", "secret", []provider.Credential{
+				{Username: "platform", PasswordHash: hash("old-password")},
+				{Username: "platform", PasswordHash: hash("new-password")},
+			}).wrap(next)
+		})
+
+		It("accepts each of them, passing requests on with the basic auth credentials", func() {
+			Expect(call(handler, "platform", "old-password")).To(Equal(http.StatusOK))
+			Expect(passedUsername).To(Equal("broker"))
+			Expect(passedPassword).To(Equal("secret"))
+			Expect(call(handler, "platform", "new-password")).To(Equal(http.StatusOK))
+			Expect(call(handler, "platform", "new-password")).To(Equal(http.StatusOK))
+		})
+
+		It("rejects other passwords and the basic auth credentials", func() {
+			Expect(call(handler, "platform", "wrong")).To(Equal(http.StatusUnauthorized))
+			Expect(call(handler, "broker", "secret")).To(Equal(http.StatusUnauthorized))
+			Expect(passedUsername).To(BeEmpty())
+		})
+	})
+})
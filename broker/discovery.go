@@ -0,0 +1,30 @@
+package broker
+
+import (
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/henrytk/aws-service-broker/provider"
+)
+
+const serviceDiscoveryPath = "/service-discovery"
+
+// serviceDiscoveryHandler serves the nodes running mongodb_exporter in the
+// format of Prometheus HTTP service discovery.
+func serviceDiscoveryHandler(awsProvider *provider.AWSProvider, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			respond(w, http.StatusMethodNotAllowed, errorResponse{Description: "method not allowed"})
+			return
+		}
+
+		targetGroups, err := awsProvider.ServiceDiscovery(r.Context())
+		if err != nil {
+			logger.Error("discover-exporters", err)
+			respond(w, http.StatusInternalServerError, errorResponse{Description: err.Error()})
+			return
+		}
+		respond(w, http.StatusOK, targetGroups)
+	}
+}
@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/henrytk/aws-service-broker/metrics"
+	"github.com/henrytk/aws-service-broker/provider"
+	usbProvider "github.com/henrytk/universal-service-broker/provider"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const metricsPath = "/metrics"
+
+// instrumentedProvider records metrics for every Open Service Broker API
+// operation handed to a provider. Names looks up the names of the service
+// and plan of operations that only carry their IDs.
+type instrumentedProvider struct {
+	usbProvider.ServiceProvider
+	names func(serviceID, planID string) (serviceName, planName string)
+}
+
+func (p instrumentedProvider) Provision(ctx context.Context, provisionData usbProvider.ProvisionData) (
+	dashboardURL string, operationData string, err error,
+) {
+	defer observe("provision", provisionData.Service.Name, provisionData.Plan.Name, time.Now(), &err)
+	dashboardURL, operationData, err = p.ServiceProvider.Provision(ctx, provisionData)
+	if err == nil {
+		startAsyncOperation(provisionData.InstanceID, operationData)
+	}
+	return dashboardURL, operationData, err
+}
+
+func (p instrumentedProvider) Deprovision(ctx context.Context, deprovisionData usbProvider.DeprovisionData) (
+	operationData string, err error,
+) {
+	defer observe("deprovision", deprovisionData.Service.Name, deprovisionData.Plan.Name, time.Now(), &err)
+	operationData, err = p.ServiceProvider.Deprovision(ctx, deprovisionData)
+	if err == nil {
+		startAsyncOperation(deprovisionData.InstanceID, operationData)
+	}
+	return operationData, err
+}
+
+func (p instrumentedProvider) Bind(ctx context.Context, bindData usbProvider.BindData) (
+	binding brokerapi.Binding, err error,
+) {
+	serviceName, planName := p.names(bindData.Details.ServiceID, bindData.Details.PlanID)
+	defer observe("bind", serviceName, planName, time.Now(), &err)
+	return p.ServiceProvider.Bind(ctx, bindData)
+}
+
+func (p instrumentedProvider) Unbind(ctx context.Context, unbindData usbProvider.UnbindData) (err error) {
+	serviceName, planName := p.names(unbindData.Details.ServiceID, unbindData.Details.PlanID)
+	defer observe("unbind", serviceName, planName, time.Now(), &err)
+	return p.ServiceProvider.Unbind(ctx, unbindData)
+}
+
+func (p instrumentedProvider) Update(ctx context.Context, updateData usbProvider.UpdateData) (
+	operationData string, err error,
+) {
+	defer observe("update", updateData.Service.Name, updateData.Plan.Name, time.Now(), &err)
+	operationData, err = p.ServiceProvider.Update(ctx, updateData)
+	if err == nil {
+		startAsyncOperation(updateData.InstanceID, operationData)
+	}
+	return operationData, err
+}
+
+// LastOperation records the state it reports as the outcome, and counts
+// an asynchronous operation as finished once it succeeds or fails.
+func (p instrumentedProvider) LastOperation(ctx context.Context, lastOperationData usbProvider.LastOperationData) (
+	state brokerapi.LastOperationState, description string, err error,
+) {
+	start := time.Now()
+	operation := decodeOperationData(lastOperationData.OperationData)
+	state, description, err = p.ServiceProvider.LastOperation(ctx, lastOperationData)
+
+	outcome := string(state)
+	if err != nil {
+		outcome = metrics.OutcomeError
+	}
+	metrics.ObserveOperation("last_operation", operation.Service, operation.Plan, outcome, start)
+	if err == nil && (state == brokerapi.Succeeded || state == brokerapi.Failed) {
+		metrics.FinishAsyncOperation(operation.Type, operation.Service, lastOperationData.InstanceID, string(state))
+	}
+	return state, description, err
+}
+
+// observe records an operation when it returns, with an outcome that
+// depends on the error it returns.
+func observe(operation, serviceName, planName string, start time.Time, err *error) {
+	outcome := metrics.OutcomeSuccess
+	if *err != nil {
+		outcome = metrics.OutcomeError
+	}
+	metrics.ObserveOperation(operation, serviceName, planName, outcome, start)
+}
+
+func startAsyncOperation(instanceID, operationData string) {
+	operation := decodeOperationData(operationData)
+	if operation.Type == "" {
+		return
+	}
+	metrics.StartAsyncOperation(operation.Type, instanceID)
+}
+
+// decodeOperationData returns empty operation data when it can't be
+// decoded, so that metrics never fail an operation.
+func decodeOperationData(operationData string) provider.OperationData {
+	var operation provider.OperationData
+	if operationData == "" {
+		return operation
+	}
+	json.Unmarshal([]byte(operationData), &operation)
+	return operation
+}
@@ -0,0 +1,36 @@
+package broker
+
+import "sync"
+
+// finishedOperations remembers the last asynchronous operation of each
+// instance found to have finished, so that an operation is reported once
+// however many times it is polled after it finishes. The zero value is
+// ready to use.
+type finishedOperations struct {
+	sync.Mutex
+	operations map[string]string
+}
+
+// start forgets the finished operation of an instance when another
+// operation starts on it, so that repeating the operation, which returns
+// the same operation data, is reported again.
+func (f *finishedOperations) start(instanceID string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.operations, instanceID)
+}
+
+// finish records that the operation with the given operation data has
+// finished, and reports whether it hadn't been recorded already.
+func (f *finishedOperations) finish(instanceID, operationData string) bool {
+	f.Lock()
+	defer f.Unlock()
+	if finished, ok := f.operations[instanceID]; ok && finished == operationData {
+		return false
+	}
+	if f.operations == nil {
+		f.operations = map[string]string{}
+	}
+	f.operations[instanceID] = operationData
+	return true
+}
@@ -0,0 +1,186 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/aws/aws-sdk-go/aws"
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/fakes"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+	"github.com/henrytk/aws-service-broker/provider"
+	"github.com/henrytk/aws-service-broker/webhooks"
+	usb "github.com/henrytk/universal-service-broker/broker"
+	usbProvider "github.com/henrytk/universal-service-broker/provider"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reload", func() {
+	var (
+		fakeCloudFormationAPI *fakes.FakeCloudFormationAPI
+		awsServiceBroker      *AWSServiceBroker
+	)
+
+	configWithPlans := func(plans string) (usb.Config, *provider.Config) {
+		rawConfig := `{
+			"basic_auth_username": "username",
+			"basic_auth_password": "password",
+			"secret": "half-centaur",
+			"aws_config": {"region": "eu-west-1"},
+			"catalog": {
+				"services": [{
+					"id": "uuid-1",
+					"name": "mongodb",
+					"description": "MongoDB",
+					"bastion_security_group_id": "irrelevant",
+					"key_pair_name": "key_pair_name",
+					"vpc_id": "irrelevant",
+					"node_subnet_ids": ["irrelevant"],
+					"plans": [` + plans + `]
+				}]
+			}
+		}`
+		config, err := usb.NewConfig(strings.NewReader(rawConfig))
+		Expect(err).NotTo(HaveOccurred())
+		providerConfig, err := provider.DecodeConfig(config.Provider)
+		Expect(err).NotTo(HaveOccurred())
+		return config, providerConfig
+	}
+
+	planNames := func() []string {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/v2/catalog", nil)
+		request.SetBasicAuth("username", "password")
+		request.Header.Set("X-Broker-API-Version", "2.13")
+		awsServiceBroker.ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		var catalog brokerapi.CatalogResponse
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &catalog)).To(Succeed())
+		var names []string
+		for _, plan := range catalog.Services[0].Plans {
+			names = append(names, plan.Name)
+		}
+		return names
+	}
+
+	BeforeEach(func() {
+		fakeCloudFormationAPI = &fakes.FakeCloudFormationAPI{}
+		config, providerConfig := configWithPlans(`{"id": "uuid-2", "name": "basic", "description": "Basic"}`)
+		var err error
+		awsServiceBroker, err = NewAWSServiceBroker(config, &provider.AWSProvider{
+			Config:         providerConfig,
+			MongoDBService: &mongodb.Service{Client: fakeCloudFormationAPI},
+			Logger:         lagertest.NewTestLogger("provider"),
+		}, lagertest.NewTestLogger("broker"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("serves the reloaded catalog", func() {
+		Expect(planNames()).To(Equal([]string{"basic"}))
+		config, providerConfig := configWithPlans(`
+			{"id": "uuid-2", "name": "basic", "description": "Basic", "volume_size": "50"},
+			{"id": "uuid-3", "name": "large", "description": "Large"}
+		`)
+		diff, err := awsServiceBroker.Reload(context.Background(), config, providerConfig)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff).To(Equal(provider.ConfigDiff{
+			AddedPlans:   []string{"mongodb/large"},
+			ChangedPlans: []string{"mongodb/basic"},
+		}))
+		Expect(planNames()).To(Equal([]string{"basic", "large"}))
+		Expect(awsServiceBroker.awsProvider.CurrentConfig()).To(Equal(providerConfig))
+	})
+
+	It("refuses to drop a plan instances still use", func() {
+		fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+			Stacks: []*awscf.Stack{{
+				StackName: aws.String("mongodbabc"),
+				Tags: []*awscf.Tag{
+					{Key: aws.String(mongodb.InstanceIDTag), Value: aws.String("a-b-c")},
+					{Key: aws.String(mongodb.PlanIDTag), Value: aws.String("uuid-2")},
+				},
+			}},
+		}, nil)
+		config, providerConfig := configWithPlans(`{"id": "uuid-3", "name": "large", "description": "Large"}`)
+		_, err := awsServiceBroker.Reload(context.Background(), config, providerConfig)
+		Expect(err).To(MatchError("plans in use are gone: plan uuid-2 is used by instances a-b-c"))
+		Expect(planNames()).To(Equal([]string{"basic"}))
+	})
+
+	It("refuses to change the volume encryption of a plan instances use", func() {
+		fakeCloudFormationAPI.DescribeStacksWithContextReturns(&awscf.DescribeStacksOutput{
+			Stacks: []*awscf.Stack{{
+				StackName: aws.String("mongodbabc"),
+				Tags: []*awscf.Tag{
+					{Key: aws.String(mongodb.InstanceIDTag), Value: aws.String("a-b-c")},
+					{Key: aws.String(mongodb.PlanIDTag), Value: aws.String("uuid-2")},
+				},
+			}},
+		}, nil)
+		config, providerConfig := configWithPlans(`{"id": "uuid-2", "name": "basic", "description": "Basic"}`)
+		providerConfig.Catalog.Services[0].Encrypted = true
+		_, err := awsServiceBroker.Reload(context.Background(), config, providerConfig)
+		Expect(err).To(MatchError("volume encryption changed for plans in use: plan uuid-2 is used by instances a-b-c"))
+
+		providerConfig.Catalog.Services[0].Encrypted = false
+		providerConfig.Catalog.Services[0].KMSKeyId = "kms-key"
+		_, err = awsServiceBroker.Reload(context.Background(), config, providerConfig)
+		Expect(err).To(MatchError("volume encryption changed for plans in use: plan uuid-2 is used by instances a-b-c"))
+	})
+
+	It("refuses a changed secret", func() {
+		config, providerConfig := configWithPlans(`{"id": "uuid-2", "name": "basic", "description": "Basic"}`)
+		providerConfig.Secret = "another-secret"
+		_, err := awsServiceBroker.Reload(context.Background(), config, providerConfig)
+		Expect(err).To(MatchError("the secret changed, so the passwords of existing instances would no longer match"))
+	})
+
+	It("lists changed settings that need a restart", func() {
+		config, providerConfig := configWithPlans(`{"id": "uuid-2", "name": "basic", "description": "Basic"}`)
+		config.API.Port = "8443"
+		providerConfig.AuditLog = "stdout"
+		diff, err := awsServiceBroker.Reload(context.Background(), config, providerConfig)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.NotReloaded).To(Equal([]string{"audit_log", "port"}))
+	})
+
+	It("sends webhook events to the reloaded endpoints", func() {
+		var (
+			mu     sync.Mutex
+			events []webhooks.Event
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var event webhooks.Event
+			Expect(json.NewDecoder(r.Body).Decode(&event)).To(Succeed())
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event)
+		}))
+		defer server.Close()
+
+		config, providerConfig := configWithPlans(`{"id": "uuid-2", "name": "basic", "description": "Basic"}`)
+		providerConfig.Webhooks = []webhooks.Endpoint{{URL: server.URL, Secret: "hunter2"}}
+		diff, err := awsServiceBroker.Reload(context.Background(), config, providerConfig)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.NotReloaded).To(BeEmpty())
+
+		_, _, err = awsServiceBroker.serviceProvider.Provision(context.Background(), usbProvider.ProvisionData{
+			InstanceID: "instance-id",
+			Service:    brokerapi.Service{ID: "unknown"},
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(awsServiceBroker.Close(context.Background())).To(Succeed())
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Type).To(Equal(webhooks.ProvisionFailed))
+	})
+})
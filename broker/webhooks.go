@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"context"
+
+	"github.com/henrytk/aws-service-broker/webhooks"
+	usbProvider "github.com/henrytk/universal-service-broker/provider"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// notifyingProvider sends webhook events when operations fail straight
+// away or, for asynchronous operations, when LastOperation first finds
+// they have finished.
+type notifyingProvider struct {
+	usbProvider.ServiceProvider
+	sender   *webhooks.Sender
+	finished *finishedOperations
+}
+
+func (p notifyingProvider) Provision(ctx context.Context, provisionData usbProvider.ProvisionData) (
+	dashboardURL string, operationData string, err error,
+) {
+	dashboardURL, operationData, err = p.ServiceProvider.Provision(ctx, provisionData)
+	p.notify("provision", provisionData.InstanceID, provisionData.Service.Name, provisionData.Plan.Name, operationData, err)
+	return dashboardURL, operationData, err
+}
+
+func (p notifyingProvider) Deprovision(ctx context.Context, deprovisionData usbProvider.DeprovisionData) (
+	operationData string, err error,
+) {
+	operationData, err = p.ServiceProvider.Deprovision(ctx, deprovisionData)
+	p.notify("deprovision", deprovisionData.InstanceID, deprovisionData.Service.Name, deprovisionData.Plan.Name, operationData, err)
+	return operationData, err
+}
+
+func (p notifyingProvider) Update(ctx context.Context, updateData usbProvider.UpdateData) (
+	operationData string, err error,
+) {
+	operationData, err = p.ServiceProvider.Update(ctx, updateData)
+	p.notify("update", updateData.InstanceID, updateData.Service.Name, updateData.Plan.Name, operationData, err)
+	return operationData, err
+}
+
+func (p notifyingProvider) LastOperation(ctx context.Context, lastOperationData usbProvider.LastOperationData) (
+	state brokerapi.LastOperationState, description string, err error,
+) {
+	state, description, err = p.ServiceProvider.LastOperation(ctx, lastOperationData)
+	if err != nil || (state != brokerapi.Succeeded && state != brokerapi.Failed) {
+		return state, description, err
+	}
+	if !p.finished.finish(lastOperationData.InstanceID, lastOperationData.OperationData) {
+		return state, description, err
+	}
+	operation := decodeOperationData(lastOperationData.OperationData)
+	event := webhooks.NewEvent(operation.Type+"."+string(state), lastOperationData.InstanceID, operation.StackId)
+	event.Service = operation.Service
+	event.Plan = operation.Plan
+	event.Description = description
+	p.sender.Send(event)
+	return state, description, err
+}
+
+// notify sends an event for an operation that failed or finished straight
+// away. Operations that returned operation data continue asynchronously.
+func (p notifyingProvider) notify(operation, instanceID, serviceName, planName, operationData string, err error) {
+	if err == nil && operationData != "" {
+		p.finished.start(instanceID)
+		return
+	}
+	state := brokerapi.Succeeded
+	if err != nil {
+		state = brokerapi.Failed
+	}
+	event := webhooks.NewEvent(operation+"."+string(state), instanceID, "")
+	event.Service = serviceName
+	event.Plan = planName
+	if err != nil {
+		event.Description = err.Error()
+	}
+	p.sender.Send(event)
+}
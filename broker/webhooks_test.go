@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/henrytk/aws-service-broker/webhooks"
+	usbProvider "github.com/henrytk/universal-service-broker/provider"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("notifyingProvider", func() {
+	var (
+		mu     sync.Mutex
+		events []webhooks.Event
+		server *httptest.Server
+		sender *webhooks.Sender
+	)
+
+	received := func() []webhooks.Event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhooks.Event(nil), events...)
+	}
+
+	BeforeEach(func() {
+		events = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var event webhooks.Event
+			Expect(json.NewDecoder(r.Body).Decode(&event)).To(Succeed())
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event)
+		}))
+		sender = webhooks.NewSender([]webhooks.Endpoint{{URL: server.URL, Secret: "hunter2"}}, lagertest.NewTestLogger("webhooks"))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("sends a failed event when provisioning fails straight away", func() {
+		provider := notifyingProvider{ServiceProvider: stubProvider{err: errors.New("boom")}, sender: sender, finished: &finishedOperations{}}
+		_, _, err := provider.Provision(context.Background(), usbProvider.ProvisionData{
+			InstanceID: "instance-id",
+			Service:    brokerapi.Service{Name: "mongodb"},
+			Plan:       brokerapi.ServicePlan{Name: "basic"},
+		})
+		Expect(err).To(MatchError("boom"))
+
+		Eventually(received).Should(HaveLen(1))
+		event := received()[0]
+		Expect(event.Type).To(Equal(webhooks.ProvisionFailed))
+		Expect(event.InstanceID).To(Equal("instance-id"))
+		Expect(event.Service).To(Equal("mongodb"))
+		Expect(event.Plan).To(Equal("basic"))
+		Expect(event.Description).To(Equal("boom"))
+	})
+
+	It("sends nothing when an operation continues asynchronously", func() {
+		provider := notifyingProvider{ServiceProvider: stubProvider{operationData: `{"type":"update"}`}, sender: sender, finished: &finishedOperations{}}
+		_, err := provider.Update(context.Background(), usbProvider.UpdateData{InstanceID: "instance-id"})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = notifyingProvider{
+			ServiceProvider: stubProvider{state: brokerapi.InProgress},
+			sender:          sender,
+			finished:        &finishedOperations{},
+		}.LastOperation(context.Background(), usbProvider.LastOperationData{
+			InstanceID:    "instance-id",
+			OperationData: `{"type":"update"}`,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Consistently(received, "100ms").Should(BeEmpty())
+	})
+
+	It("sends an event when LastOperation finds an operation finished", func() {
+		provider := notifyingProvider{
+			ServiceProvider: stubProvider{state: brokerapi.Succeeded, description: "done"},
+			sender:          sender,
+			finished:        &finishedOperations{},
+		}
+		_, _, err := provider.LastOperation(context.Background(), usbProvider.LastOperationData{
+			InstanceID:    "instance-id",
+			OperationData: `{"type":"deprovision","service":"mongodb","stack_id":"stack-id"}`,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(received).Should(HaveLen(1))
+		event := received()[0]
+		Expect(event.Type).To(Equal(webhooks.DeprovisionSucceeded))
+		Expect(event.Service).To(Equal("mongodb"))
+		Expect(event.StackID).To(Equal("stack-id"))
+		Expect(event.Description).To(Equal("done"))
+	})
+
+	It("sends the plan of the finished operation", func() {
+		provider := notifyingProvider{
+			ServiceProvider: stubProvider{state: brokerapi.Failed, description: "rolled back"},
+			sender:          sender,
+			finished:        &finishedOperations{},
+		}
+		_, _, err := provider.LastOperation(context.Background(), usbProvider.LastOperationData{
+			InstanceID:    "instance-id",
+			OperationData: `{"type":"update","service":"mongodb","plan":"enhanced","stack_id":"stack-id"}`,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(received).Should(HaveLen(1))
+		event := received()[0]
+		Expect(event.Type).To(Equal(webhooks.UpdateFailed))
+		Expect(event.Plan).To(Equal("enhanced"))
+	})
+
+	It("sends one event however many times a finished operation is polled", func() {
+		provider := notifyingProvider{
+			ServiceProvider: stubProvider{state: brokerapi.Succeeded, operationData: `{"type":"update","stack_id":"stack-id"}`},
+			sender:          sender,
+			finished:        &finishedOperations{},
+		}
+		lastOperationData := usbProvider.LastOperationData{
+			InstanceID:    "instance-id",
+			OperationData: `{"type":"update","stack_id":"stack-id"}`,
+		}
+		for i := 0; i < 3; i++ {
+			_, _, err := provider.LastOperation(context.Background(), lastOperationData)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Eventually(received).Should(HaveLen(1))
+		Consistently(received, "100ms").Should(HaveLen(1))
+
+		By("sending another event when the operation is repeated")
+		_, err := provider.Update(context.Background(), usbProvider.UpdateData{InstanceID: "instance-id"})
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = provider.LastOperation(context.Background(), lastOperationData)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(received).Should(HaveLen(2))
+	})
+})
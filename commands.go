@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+	"github.com/henrytk/aws-service-broker/aws/sts"
+	"github.com/henrytk/aws-service-broker/provider"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// command is an operator subcommand of the broker binary.
+type command struct {
+	summary string
+	run     func(flags *flag.FlagSet, args []string) error
+}
+
+var commands = map[string]command{
+	"validate-config":   {"check the config file, and with -preflight the account, without starting the broker", validateConfig},
+	"render-stack":      {"print the CreateStack request provisioning an instance would make", renderStack},
+	"list-instances":    {"list the instances in the configured account", listInstances},
+	"describe-instance": {"print an instance's stack parameters, outputs and recent events", describeInstance},
+	"delete-orphans":    {"delete the stacks of instances the platform no longer knows of", deleteOrphans},
+	"hash-password":     {"print the bcrypt hash of a password read from stdin, for the credentials config", hashPassword},
+	"plan-updates":      {"list the plans instances of each plan may be updated to, and the fields that may change", planUpdates},
+}
+
+var commandOrder = []string{"validate-config", "render-stack", "list-instances", "describe-instance", "delete-orphans", "hash-password", "plan-updates"}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s -config <file>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s <command> -config <file> [flags]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Without a command the broker starts serving. Commands:")
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %-18s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of a command.\n", os.Args[0])
+}
+
+// runCommand runs a subcommand, returning the process's exit code.
+func runCommand(name string, args []string) int {
+	if name == "help" {
+		usage()
+		return 0
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		usage()
+		return 2
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	if err := cmd.run(flags, args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+func hashPassword(flags *flag.FlagSet, args []string) error {
+	cost := flags.Int("cost", bcrypt.DefaultCost, "bcrypt cost of the hash")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return fmt.Errorf("no password given on stdin")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), *cost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(hash))
+	return nil
+}
+
+func validateConfig(flags *flag.FlagSet, args []string) error {
+	configPath := flags.String("config", "", "Location of the config file")
+	runPreflight := flags.Bool("preflight", false, "Also run the preflight checks against the configured account")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	awsProvider, err := loadProvider(*configPath)
+	if err != nil {
+		return err
+	}
+	errs := awsProvider.CheckPlans()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d plans can't be provisioned", len(errs))
+	}
+	fmt.Println("Config is valid")
+
+	if *runPreflight {
+		monitor, err := awsProvider.NewPreflightMonitor(awsProvider.Logger)
+		if err != nil {
+			return err
+		}
+		report := monitor.Check(context.Background())
+		for _, result := range report.Checks {
+			if result.OK {
+				fmt.Printf("ok    %s\n", result.Name)
+			} else {
+				fmt.Printf("FAIL  %s: %s\n", result.Name, result.Error)
+			}
+		}
+		if !report.OK {
+			return fmt.Errorf("preflight checks failed")
+		}
+	}
+	return nil
+}
+
+func planUpdates(flags *flag.FlagSet, args []string) error {
+	configPath := flags.String("config", "", "Location of the config file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *configPath == "" {
+		return fmt.Errorf("-config is required")
+	}
+	config, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	providerConfig, err := provider.DecodeConfig(config.Provider)
+	if err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SERVICE\tPLAN\tUPDATABLE TO\tMUTABLE FIELDS")
+	for _, service := range providerConfig.Catalog.Services {
+		for _, plan := range service.Plans {
+			var targets []string
+			for _, target := range service.UpdateTargets(plan) {
+				targets = append(targets, target.Name)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", service.Name, plan.Name,
+				orNone(strings.Join(targets, ", ")), orNone(strings.Join(service.MutableFields(plan), ", ")))
+		}
+	}
+	return table.Flush()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func renderStack(flags *flag.FlagSet, args []string) error {
+	configPath := flags.String("config", "", "Location of the config file")
+	serviceName := flags.String("service", "mongodb", "Name of the service")
+	planName := flags.String("plan", "", "Name of the plan")
+	instanceID := flags.String("instance-id", "", "ID of the instance")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *planName == "" || *instanceID == "" {
+		return fmt.Errorf("-plan and -instance-id are required")
+	}
+	awsProvider, err := loadProvider(*configPath)
+	if err != nil {
+		return err
+	}
+	createStackInput, err := awsProvider.RenderStack(*serviceName, *planName, *instanceID)
+	if err != nil {
+		return err
+	}
+	return printJSON(os.Stdout, createStackInput)
+}
+
+func listInstances(flags *flag.FlagSet, args []string) error {
+	configPath := flags.String("config", "", "Location of the config file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	awsProvider, err := loadProvider(*configPath)
+	if err != nil {
+		return err
+	}
+	instances, err := awsProvider.Instances(context.Background())
+	if err != nil {
+		return err
+	}
+	printInstances(os.Stdout, instances)
+	return nil
+}
+
+func describeInstance(flags *flag.FlagSet, args []string) error {
+	configPath := flags.String("config", "", "Location of the config file")
+	instanceID := flags.String("instance-id", "", "ID of the instance")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *instanceID == "" {
+		return fmt.Errorf("-instance-id is required")
+	}
+	awsProvider, err := loadProvider(*configPath)
+	if err != nil {
+		return err
+	}
+	instance, err := awsProvider.Instance(context.Background(), *instanceID)
+	if err == mongodb.ErrStackNotFound {
+		return fmt.Errorf("instance %s not found", *instanceID)
+	} else if err != nil {
+		return err
+	}
+	return printJSON(os.Stdout, instance)
+}
+
+func deleteOrphans(flags *flag.FlagSet, args []string) error {
+	configPath := flags.String("config", "", "Location of the config file")
+	knownInstances := flags.String("known-instances", "", "File listing the IDs of the instances the platform knows of, one per line, or - for stdin")
+	dryRun := flags.Bool("dry-run", false, "List the orphans without deleting them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *knownInstances == "" {
+		return fmt.Errorf("-known-instances is required")
+	}
+	knownInstanceIDs, err := readInstanceIDs(*knownInstances)
+	if err != nil {
+		return err
+	}
+	awsProvider, err := loadProvider(*configPath)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	orphans, err := awsProvider.Orphans(ctx, knownInstanceIDs)
+	if err != nil {
+		return err
+	}
+	printInstances(os.Stdout, orphans)
+	if *dryRun || len(orphans) == 0 {
+		return nil
+	}
+
+	failed := 0
+	for _, orphan := range orphans {
+		if err := awsProvider.DeleteInstance(ctx, orphan.InstanceID); err != nil {
+			fmt.Fprintf(os.Stderr, "Error deleting %s: %s\n", orphan.StackName, err)
+			failed++
+			continue
+		}
+		fmt.Printf("Deleting %s\n", orphan.StackName)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d orphans could not be deleted", failed, len(orphans))
+	}
+	return nil
+}
+
+// loadProvider decodes the config file and returns a provider for the
+// configured account. Unlike the broker's, it doesn't watch stacks.
+func loadProvider(configPath string) (*provider.AWSProvider, error) {
+	if configPath == "" {
+		return nil, fmt.Errorf("-config is required")
+	}
+	config, err := readConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	providerConfig, err := provider.DecodeConfig(config.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only errors are logged, so that they don't mix with the output.
+	logger := lager.NewLogger("aws-service-broker")
+	logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.ERROR))
+	mongoDBService, err := mongodb.NewService(providerConfig.AWSConfig.Region, logger.Session("aws"))
+	if err != nil {
+		return nil, err
+	}
+	stsClient, err := sts.NewSTSClient(providerConfig.AWSConfig.Region, logger.Session("aws"))
+	if err != nil {
+		return nil, err
+	}
+	return &provider.AWSProvider{
+		Config:         providerConfig,
+		MongoDBService: mongoDBService,
+		Logger:         logger.Session("provider"),
+		STS:            stsClient,
+	}, nil
+}
+
+func readInstanceIDs(path string) ([]string, error) {
+	var source io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		source = file
+	}
+	var instanceIDs []string
+	scanner := bufio.NewScanner(source)
+	for scanner.Scan() {
+		if instanceID := strings.TrimSpace(scanner.Text()); instanceID != "" {
+			instanceIDs = append(instanceIDs, instanceID)
+		}
+	}
+	return instanceIDs, scanner.Err()
+}
+
+func printInstances(w io.Writer, instances []provider.AdminInstance) {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "INSTANCE\tSERVICE\tPLAN\tSTACK\tSTATUS\tREGION\tAGE")
+	for _, instance := range instances {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			instance.InstanceID, instance.Service, instance.Plan, instance.StackName,
+			instance.Status, instance.Region, instance.Age)
+	}
+	table.Flush()
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,146 @@
+// Package health serves the broker's liveness and readiness, for load
+// balancers and orchestrators to decide whether to restart the broker or
+// send it requests.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/henrytk/aws-service-broker/preflight"
+)
+
+// Live always reports the broker alive. Answering at all is the check, so
+// it never calls anything that could be slow.
+func Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+// Check is one condition of the broker being ready.
+type Check struct {
+	Name string
+	Run  func(context.Context) error
+}
+
+// Readiness runs the checks when asked whether the broker is ready. The
+// report is kept for a while so that frequent probes, from several load
+// balancers, don't each call AWS.
+type Readiness struct {
+	checks   []Check
+	timeout  time.Duration
+	cacheFor time.Duration
+
+	mu     sync.Mutex
+	report *preflight.Report
+}
+
+// NewReadiness returns the readiness of the checks. Each check fails if it
+// takes longer than the timeout, and reports are reused for cacheFor.
+func NewReadiness(checks []Check, timeout, cacheFor time.Duration) *Readiness {
+	return &Readiness{checks: checks, timeout: timeout, cacheFor: cacheFor}
+}
+
+// Check returns a report of the checks, running them all at once unless
+// the last report is recent enough.
+func (r *Readiness) Check(ctx context.Context) preflight.Report {
+	// Holding the lock while the checks run means probes arriving
+	// meanwhile wait for, and share, their report.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.report != nil && time.Since(r.report.CheckedAt) < r.cacheFor {
+		return *r.report
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	results := make([]preflight.Result, len(r.checks))
+	var wg sync.WaitGroup
+	for i, check := range r.checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = preflight.Result{Name: check.Name, OK: true}
+			if err := check.Run(ctx); err != nil {
+				results[i] = preflight.Result{Name: check.Name, Error: err.Error()}
+			}
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := preflight.NewReport(results)
+	r.report = &report
+	return report
+}
+
+// ServeHTTP serves a report of the checks, with a 503 status if any of
+// them failed.
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report := r.Check(req.Context())
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// Worker records the runs of a background worker. It is healthy while it
+// has run successfully within its allowed silence, so that one failed run
+// doesn't take the broker out of service. A nil Worker records nothing.
+type Worker struct {
+	maxSilence time.Duration
+
+	mu        sync.Mutex
+	started   time.Time
+	succeeded time.Time
+	lastErr   error
+}
+
+// NewWorker returns a worker that has to succeed at least once every
+// maxSilence, counting from now.
+func NewWorker(maxSilence time.Duration) *Worker {
+	return &Worker{maxSilence: maxSilence, started: time.Now()}
+}
+
+// Ran records a run of the worker, which failed if err isn't nil.
+func (w *Worker) Ran(err error) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		w.lastErr = err
+		return
+	}
+	w.succeeded = time.Now()
+	w.lastErr = nil
+}
+
+// Check returns an error if the worker hasn't succeeded recently enough.
+func (w *Worker) Check(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	since := w.succeeded
+	if since.IsZero() {
+		since = w.started
+	}
+	if time.Since(since) <= w.maxSilence {
+		return nil
+	}
+	message := "no successful run since " + since.UTC().Format(time.RFC3339)
+	if w.succeeded.IsZero() {
+		message = "no successful run since starting at " + since.UTC().Format(time.RFC3339)
+	}
+	if w.lastErr != nil {
+		message += ", last error: " + w.lastErr.Error()
+	}
+	return errors.New(message)
+}
@@ -0,0 +1,120 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/henrytk/aws-service-broker/health"
+	"github.com/henrytk/aws-service-broker/preflight"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	It("is always live", func() {
+		recorder := httptest.NewRecorder()
+		Live(recorder, httptest.NewRequest("GET", "/livez", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(MatchJSON(`{"ok": true}`))
+	})
+
+	Describe("Readiness", func() {
+		var (
+			runs     int
+			failure  error
+			checks   []Check
+			cacheFor time.Duration
+		)
+
+		BeforeEach(func() {
+			runs = 0
+			failure = nil
+			cacheFor = 0
+			checks = []Check{
+				{Name: "aws credentials", Run: func(ctx context.Context) error { return nil }},
+				{Name: "cloudformation", Run: func(ctx context.Context) error {
+					runs++
+					return failure
+				}},
+			}
+		})
+
+		serve := func(readiness *Readiness) (int, preflight.Report) {
+			recorder := httptest.NewRecorder()
+			readiness.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+			var report preflight.Report
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &report)).To(Succeed())
+			return recorder.Code, report
+		}
+
+		It("is ready when every check passes", func() {
+			status, report := serve(NewReadiness(checks, time.Second, cacheFor))
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(report.OK).To(BeTrue())
+			Expect(report.Checks).To(Equal([]preflight.Result{
+				{Name: "aws credentials", OK: true},
+				{Name: "cloudformation", OK: true},
+			}))
+		})
+
+		It("reports each failed check", func() {
+			failure = errors.New("CloudFormation is unavailable")
+			status, report := serve(NewReadiness(checks, time.Second, cacheFor))
+			Expect(status).To(Equal(http.StatusServiceUnavailable))
+			Expect(report.OK).To(BeFalse())
+			Expect(report.Checks[1]).To(Equal(preflight.Result{Name: "cloudformation", Error: "CloudFormation is unavailable"}))
+		})
+
+		It("fails checks that take longer than the timeout", func() {
+			checks[1].Run = func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			report := NewReadiness(checks, time.Millisecond, cacheFor).Check(context.Background())
+			Expect(report.Checks[1]).To(Equal(preflight.Result{Name: "cloudformation", Error: context.DeadlineExceeded.Error()}))
+		})
+
+		It("reuses recent reports", func() {
+			readiness := NewReadiness(checks, time.Second, time.Minute)
+			readiness.Check(context.Background())
+			failure = errors.New("CloudFormation is unavailable")
+			Expect(readiness.Check(context.Background()).OK).To(BeTrue())
+			Expect(runs).To(Equal(1))
+		})
+	})
+
+	Describe("Worker", func() {
+		It("is healthy until it has been silent for too long", func() {
+			worker := NewWorker(20 * time.Millisecond)
+			Expect(worker.Check(context.Background())).To(Succeed())
+			Eventually(func() error {
+				return worker.Check(context.Background())
+			}).Should(MatchError(HavePrefix("no successful run since starting at ")))
+		})
+
+		It("stays healthy through failed runs after a recent success", func() {
+			worker := NewWorker(time.Minute)
+			worker.Ran(nil)
+			worker.Ran(errors.New("throttled"))
+			Expect(worker.Check(context.Background())).To(Succeed())
+		})
+
+		It("reports the last error once it has been silent for too long", func() {
+			worker := NewWorker(20 * time.Millisecond)
+			worker.Ran(nil)
+			worker.Ran(errors.New("throttled"))
+			Eventually(func() error {
+				return worker.Check(context.Background())
+			}).Should(MatchError(HaveSuffix(", last error: throttled")))
+		})
+
+		It("ignores runs when it is nil", func() {
+			var worker *Worker
+			worker.Ran(errors.New("throttled"))
+		})
+	})
+})
@@ -1,6 +1,7 @@
 package mongodb_test
 
 import (
+	"code.cloudfoundry.org/lager/lagertest"
 	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
 	"github.com/henrytk/aws-service-broker/integration_tests/helpers"
 	. "github.com/onsi/ginkgo"
@@ -19,9 +20,7 @@ var (
 	id                     string
 	ok                     bool
 	keyPairName            string
-	primaryNodeSubnetId    string
-	secondary0NodeSubnetId string
-	secondary1NodeSubnetId string
+	nodeSubnetIds          []string
 	mongoDBAdminPassword   string
 	vpcId                  string
 	bastionSecurityGroupId string
@@ -32,14 +31,16 @@ func TestMongodb(t *testing.T) {
 		instanceID = uuid.NewV4().String()
 		vpc = helpers.SetupVpc(region, instanceID)
 		vpcId = *vpc.VpcId
-		primaryNodeSubnetId = *vpc.Subnets[3].SubnetId
-		secondary0NodeSubnetId = *vpc.Subnets[4].SubnetId
-		secondary1NodeSubnetId = *vpc.Subnets[5].SubnetId
+		nodeSubnetIds = []string{
+			*vpc.Subnets[3].SubnetId,
+			*vpc.Subnets[4].SubnetId,
+			*vpc.Subnets[5].SubnetId,
+		}
 		bastionSecurityGroupId = *vpc.SecurityGroups[0].GroupId
 		mongoDBAdminPassword = "volunteer-pilot"
 		keyPairName = vpc.KeyPairName
 
-		mongoDBService, err = mongodb.NewService(region)
+		mongoDBService, err = mongodb.NewService(region, lagertest.NewTestLogger("mongodb"))
 		Expect(err).NotTo(HaveOccurred())
 	})
 
@@ -18,12 +18,11 @@ var _ = Describe("Mongodb", func() {
 	It("Manages the lifecycle of a CloudFormation stack", func() {
 		By("Creating a stack")
 		_, err := mongoDBService.CreateStack(
+			context.Background(),
 			instanceID,
 			mongodb.InputParameters{
 				KeyPairName:            keyPairName,
-				PrimaryNodeSubnetId:    primaryNodeSubnetId,
-				Secondary0NodeSubnetId: secondary0NodeSubnetId,
-				Secondary1NodeSubnetId: secondary1NodeSubnetId,
+				NodeSubnetIds:          nodeSubnetIds,
 				MongoDBAdminPassword:   mongoDBAdminPassword,
 				VpcId:                  vpcId,
 				BastionSecurityGroupId: bastionSecurityGroupId,
@@ -34,7 +33,7 @@ var _ = Describe("Mongodb", func() {
 		By("Polling for creation completion")
 		Eventually(
 			func() bool {
-				completed, err := mongoDBService.CreateStackCompleted(instanceID)
+				completed, err := mongoDBService.CreateStackCompleted(context.Background(), instanceID)
 				Expect(err).NotTo(HaveOccurred())
 				return completed
 			},
@@ -52,7 +51,7 @@ var _ = Describe("Mongodb", func() {
 
 		Eventually(
 			func() bool {
-				completed, err := mongoDBService.UpdateStackCompleted(instanceID)
+				completed, err := mongoDBService.UpdateStackCompleted(context.Background(), instanceID)
 				Expect(err).NotTo(HaveOccurred())
 				return completed
 			},
@@ -61,13 +60,13 @@ var _ = Describe("Mongodb", func() {
 		).Should(BeTrue())
 
 		By("Deleting the stack")
-		err = mongoDBService.DeleteStack(instanceID)
+		err = mongoDBService.DeleteStack(context.Background(), instanceID)
 		Expect(err).NotTo(HaveOccurred())
 
 		By("Polling for deletion completion")
 		Eventually(
 			func() bool {
-				completed, err := mongoDBService.DeleteStackCompleted(instanceID)
+				completed, err := mongoDBService.DeleteStackCompleted(context.Background(), instanceID)
 				Expect(err).NotTo(HaveOccurred())
 				return completed
 			},
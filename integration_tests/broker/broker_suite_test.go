@@ -15,9 +15,7 @@ var (
 	vpc                    *helpers.Vpc
 	id                     string
 	keyPairName            string
-	primaryNodeSubnetId    string
-	secondary0NodeSubnetId string
-	secondary1NodeSubnetId string
+	nodeSubnetIds          string
 	vpcId                  string
 	bastionSecurityGroupId string
 )
@@ -27,9 +25,7 @@ func TestBroker(t *testing.T) {
 		testID = uuid.NewV4().String()
 		vpc = helpers.SetupVpc(region, testID)
 		vpcId = *vpc.VpcId
-		primaryNodeSubnetId = *vpc.Subnets[3].SubnetId
-		secondary0NodeSubnetId = *vpc.Subnets[4].SubnetId
-		secondary1NodeSubnetId = *vpc.Subnets[5].SubnetId
+		nodeSubnetIds = `"` + *vpc.Subnets[3].SubnetId + `", "` + *vpc.Subnets[4].SubnetId + `", "` + *vpc.Subnets[5].SubnetId + `"`
 		bastionSecurityGroupId = *vpc.SecurityGroups[0].GroupId
 		keyPairName = vpc.KeyPairName
 	})
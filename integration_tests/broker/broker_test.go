@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"time"
 
+	"code.cloudfoundry.org/lager/lagertest"
+
 	"github.com/henrytk/aws-service-broker/broker"
 	"github.com/henrytk/aws-service-broker/provider"
 	"github.com/pivotal-cf/brokerapi"
@@ -62,9 +64,7 @@ var _ = Describe("Broker", func() {
 						"bastion_security_group_id": "` + bastionSecurityGroupId + `",
 						"key_pair_name": "` + keyPairName + `",
 						"vpc_id": "` + vpcId + `",
-						"primary_node_subnet_id": "` + primaryNodeSubnetId + `",
-						"secondary_0_node_subnet_id": "` + secondary0NodeSubnetId + `",
-						"secondary_1_node_subnet_id": "` + secondary1NodeSubnetId + `",
+						"node_subnet_ids": [` + nodeSubnetIds + `],
 						"plans": [{
 							"id": "` + plan1ID + `",
 							"name": "basic",
@@ -100,10 +100,12 @@ var _ = Describe("Broker", func() {
 		config, err = usb.NewConfig(configFile)
 		Expect(err).NotTo(HaveOccurred())
 
-		awsProvider, err = provider.NewAWSProvider(config.Provider)
+		logger := lagertest.NewTestLogger("aws-service-broker")
+		awsProvider, err = provider.NewAWSProvider(config.Provider, logger.Session("provider"))
 		Expect(err).NotTo(HaveOccurred())
 
-		awsServiceBroker = broker.NewAWSServiceBroker(config, awsProvider)
+		awsServiceBroker, err = broker.NewAWSServiceBroker(config, awsProvider, logger)
+		Expect(err).NotTo(HaveOccurred())
 
 		brokerTester = broker_tester.New(brokerapi.BrokerCredentials{
 			Username: config.API.BasicAuthUsername,
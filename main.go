@@ -1,46 +1,173 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/henrytk/aws-service-broker/broker"
 	"github.com/henrytk/aws-service-broker/provider"
+	"github.com/henrytk/aws-service-broker/server"
 	usb "github.com/henrytk/universal-service-broker/broker"
 )
 
+// certificateReloadInterval is how often the TLS certificate files are
+// checked for changes.
+const certificateReloadInterval = 10 * time.Second
+
 var configFilePath string
 
 func main() {
-	flag.StringVar(&configFilePath, "config", "", "Location of the config file")
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	flag.StringVar(&configFilePath, "config", "", "Location of the config file, read as YAML if it ends in .yml or .yaml")
+	flag.Usage = usage
 	flag.Parse()
 
-	file, err := os.Open(configFilePath)
+	config, err := readConfig(configFilePath)
 	if err != nil {
-		log.Fatalf("Error opening config file %s: %s\n", configFilePath, err)
+		log.Fatalf("Error %v\n", err)
 	}
-	defer file.Close()
 
-	config, err := usb.NewConfig(file)
+	logger := lager.NewLogger("aws-service-broker")
+	logger.RegisterSink(lager.NewWriterSink(os.Stdout, config.API.LagerLogLevel))
+
+	awsProvider, err := provider.NewAWSProvider(config.Provider, logger.Session("provider"))
 	if err != nil {
-		log.Fatalf("Error validating config file: %v\n", err)
+		log.Fatalf("Error creating AWS Provider: %v\n", err)
 	}
 
-	awsProvider, err := provider.NewAWSProvider(config.Provider)
+	awsServiceBroker, err := broker.NewAWSServiceBroker(config, awsProvider, logger)
 	if err != nil {
-		log.Fatalf("Error creating AWS Provider: %v\n", err)
+		log.Fatalf("Error creating AWS Service Broker: %v\n", err)
 	}
 
-	awsServiceBroker := broker.NewAWSServiceBroker(config, awsProvider)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		received := <-signals
+		logger.Info("stopping", lager.Data{"signal": received.String()})
+		cancel()
+	}()
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reloads:
+				reload(ctx, awsServiceBroker, logger.Session("reload"))
+			}
+		}
+	}()
+
+	serverConfig := awsProvider.Config
+	options := server.Options{
+		ReadTimeout:     serverConfig.Timeouts.ReadTimeout(),
+		WriteTimeout:    serverConfig.Timeouts.WriteTimeout(),
+		IdleTimeout:     serverConfig.Timeouts.IdleTimeout(),
+		ShutdownTimeout: serverConfig.Timeouts.ShutdownTimeout(),
+	}
+	if serverConfig.TLS.Enabled() {
+		options.Certificates, err = server.LoadCertificates(serverConfig.TLS.CertFile, serverConfig.TLS.KeyFile)
+		if err != nil {
+			log.Fatalf("Error loading TLS certificate: %v\n", err)
+		}
+		go options.Certificates.Watch(ctx, certificateReloadInterval, logger.Session("tls"))
+	}
+	var handler http.Handler = awsServiceBroker
+	if clientCertificates := serverConfig.ClientCertificates; clientCertificates.Required() {
+		options.ClientCAs, err = server.LoadCertPool(clientCertificates.CAFile)
+		if err != nil {
+			log.Fatalf("Error loading client certificate CA: %v\n", err)
+		}
+		handler = server.RequireClientCertificate(handler, clientCertificates.AllowedSubjects, broker.ProbePaths...)
+	}
 
 	listener, err := net.Listen("tcp", ":"+config.API.Port)
 	if err != nil {
 		log.Fatalf("Error listening to port %s: %s", config.API.Port, err)
 	}
 	fmt.Println("AWS Service Broker started on port " + config.API.Port + "...")
-	http.Serve(listener, awsServiceBroker)
+	err = server.Run(ctx, listener, handler, options, logger.Session("server"))
+	awsProvider.Stop()
+	// Webhook deliveries get as long as requests had to finish.
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), options.ShutdownTimeout)
+	if closeErr := awsServiceBroker.Close(drainCtx); closeErr != nil {
+		logger.Error("webhook-deliveries-abandoned", closeErr)
+	}
+	cancelDrain()
+	if err != nil {
+		log.Fatalf("Error serving: %v\n", err)
+	}
+	logger.Info("stopped")
+}
+
+// reload rereads the config file, validates it and switches the broker to
+// its catalog, logging what changed. The broker carries on with its
+// current catalog if any of that fails.
+func reload(ctx context.Context, awsServiceBroker *broker.AWSServiceBroker, logger lager.Logger) {
+	config, err := readConfig(configFilePath)
+	if err != nil {
+		logger.Error("reload-failed", err)
+		return
+	}
+	providerConfig, err := provider.DecodeConfig(config.Provider)
+	if err != nil {
+		logger.Error("reload-failed", err)
+		return
+	}
+	// Reloading lists the instances, to check their plans are kept.
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	diff, err := awsServiceBroker.Reload(ctx, config, providerConfig)
+	if err != nil {
+		logger.Error("reload-refused", err)
+		return
+	}
+	logger.Info("reloaded", lager.Data{"changes": diff})
+	if len(diff.NotReloaded) > 0 {
+		logger.Info("restart-needed", lager.Data{"settings": diff.NotReloaded})
+	}
+}
+
+// readConfig reads the config file, resolving the secrets it refers to
+// and expanding its plans. Files ending in .yml or .yaml are read as YAML.
+func readConfig(path string) (usb.Config, error) {
+	rawConfig, err := ioutil.ReadFile(path)
+	if err != nil {
+		return usb.Config{}, fmt.Errorf("opening config file %s: %s", path, err)
+	}
+	if extension := filepath.Ext(path); extension == ".yml" || extension == ".yaml" {
+		rawConfig, err = provider.ConvertYAML(rawConfig)
+		if err != nil {
+			return usb.Config{}, fmt.Errorf("parsing YAML config file: %s", err)
+		}
+	}
+	rawConfig, err = provider.PrepareConfig(context.Background(), rawConfig)
+	if err != nil {
+		return usb.Config{}, fmt.Errorf("preparing config file: %s", err)
+	}
+	config, err := usb.NewConfig(bytes.NewReader(rawConfig))
+	if err != nil {
+		return usb.Config{}, fmt.Errorf("validating config file: %s", err)
+	}
+	return config, nil
 }
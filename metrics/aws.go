@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// InstrumentAWSHandlers counts the calls, errors and throttles of every
+// request made through the handlers, typically those of a session that
+// AWS clients are created from.
+func InstrumentAWSHandlers(handlers *request.Handlers) {
+	handlers.Retry.PushFrontNamed(request.NamedHandler{
+		Name: "metrics.CountThrottles",
+		Fn:   countThrottle,
+	})
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "metrics.CountCalls",
+		Fn:   countCall,
+	})
+}
+
+func countThrottle(r *request.Request) {
+	if request.IsErrorThrottle(r.Error) {
+		AWSAPIThrottles.WithLabelValues(r.ClientInfo.ServiceName, operationName(r)).Inc()
+	}
+}
+
+func countCall(r *request.Request) {
+	AWSAPICalls.WithLabelValues(r.ClientInfo.ServiceName, operationName(r)).Inc()
+	if r.Error == nil {
+		return
+	}
+	code := "Unknown"
+	if awsErr, ok := r.Error.(awserr.Error); ok {
+		code = awsErr.Code()
+	}
+	AWSAPIErrors.WithLabelValues(r.ClientInfo.ServiceName, operationName(r), code).Inc()
+}
+
+func operationName(r *request.Request) string {
+	if r.Operation == nil {
+		return ""
+	}
+	return r.Operation.Name
+}
@@ -0,0 +1,217 @@
+// Package metrics holds the broker's Prometheus metrics and serves them
+// at /metrics.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "aws_service_broker"
+
+// instanceCountsCacheFor is how long instance counts are reused for.
+// Scrapes need no credentials, so they mustn't list every stack in the
+// account each time.
+const instanceCountsCacheFor = time.Minute
+
+// instanceCountsTimeout bounds how long a scrape waits for the instances
+// to be counted.
+const instanceCountsTimeout = 30 * time.Second
+
+// Outcomes of broker operations that complete synchronously.
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+)
+
+var (
+	// Registry holds every broker metric, along with the Go runtime and
+	// process metrics.
+	Registry = prometheus.NewRegistry()
+
+	OSBOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "osb",
+		Name:      "operations_total",
+		Help:      "Open Service Broker API operations by service, plan and outcome.",
+	}, []string{"operation", "service", "plan", "outcome"})
+
+	OSBOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "osb",
+		Name:      "operation_duration_seconds",
+		Help:      "Time taken to answer Open Service Broker API operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "service", "plan", "outcome"})
+
+	AsyncOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "osb",
+		Name:      "async_operations_total",
+		Help:      "Asynchronous operations that finished, by type, service and outcome.",
+	}, []string{"type", "service", "outcome"})
+
+	AsyncOperationsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "osb",
+		Name:      "async_operations_in_flight",
+		Help:      "Asynchronous operations started by this broker that have not finished, by type.",
+	}, []string{"type"})
+
+	AWSAPICalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "aws",
+		Name:      "api_calls_total",
+		Help:      "AWS API calls by service and operation. Retries made by the SDK count as one call, and those made by the broker's CloudFormation client as one call each.",
+	}, []string{"service", "operation"})
+
+	AWSAPIErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "aws",
+		Name:      "api_errors_total",
+		Help:      "AWS API calls that failed after any retries, by service, operation and error code.",
+	}, []string{"service", "operation", "code"})
+
+	AWSAPIThrottles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "aws",
+		Name:      "api_throttles_total",
+		Help:      "AWS API attempts that were throttled, by service and operation.",
+	}, []string{"service", "operation"})
+
+	instances = &instancesCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "instances"),
+			"Service instances by the status of their stack.",
+			[]string{"stack_status"}, nil,
+		),
+	}
+
+	inFlight = asyncOperations{}
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(0, ""),
+		OSBOperations,
+		OSBOperationDuration,
+		AsyncOperations,
+		AsyncOperationsInFlight,
+		AWSAPICalls,
+		AWSAPIErrors,
+		AWSAPIThrottles,
+		instances,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format. A
+// failure to count the instances only leaves out the instance counts.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
+
+// ObserveOperation counts an Open Service Broker API operation and records
+// how long it took since start.
+func ObserveOperation(operation, service, plan, outcome string, start time.Time) {
+	OSBOperations.WithLabelValues(operation, service, plan, outcome).Inc()
+	OSBOperationDuration.WithLabelValues(operation, service, plan, outcome).Observe(time.Since(start).Seconds())
+}
+
+// asyncOperations are the instances with an asynchronous operation in
+// flight, by operation type. An instance is only counted once however many
+// times the platform retries the operation.
+type asyncOperations struct {
+	sync.Mutex
+	instances map[string]map[string]bool
+}
+
+// StartAsyncOperation records an asynchronous operation this broker
+// started on an instance.
+func StartAsyncOperation(operationType, instanceID string) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	if inFlight.instances == nil {
+		inFlight.instances = map[string]map[string]bool{}
+	}
+	if inFlight.instances[operationType] == nil {
+		inFlight.instances[operationType] = map[string]bool{}
+	}
+	inFlight.instances[operationType][instanceID] = true
+	AsyncOperationsInFlight.WithLabelValues(operationType).Set(float64(len(inFlight.instances[operationType])))
+}
+
+// FinishAsyncOperation counts an asynchronous operation that finished with
+// the given outcome and stops counting it as in flight.
+func FinishAsyncOperation(operationType, service, instanceID, outcome string) {
+	AsyncOperations.WithLabelValues(operationType, service, outcome).Inc()
+
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	if !inFlight.instances[operationType][instanceID] {
+		return
+	}
+	delete(inFlight.instances[operationType], instanceID)
+	AsyncOperationsInFlight.WithLabelValues(operationType).Set(float64(len(inFlight.instances[operationType])))
+}
+
+// InstanceCounter counts service instances by the status of their stack.
+type InstanceCounter func(ctx context.Context) (map[string]int, error)
+
+// SetInstanceCounter sets how instances are counted when the metrics are
+// scraped. Until it is set no instance counts are reported.
+func SetInstanceCounter(counter InstanceCounter) {
+	instances.Lock()
+	defer instances.Unlock()
+	instances.counter = counter
+	instances.counted = time.Time{}
+}
+
+// instancesCollector counts the instances when they are scraped, reusing
+// the last counts, or the error counting them, until they are
+// instanceCountsCacheFor old. Concurrent scrapes wait for one count.
+type instancesCollector struct {
+	sync.Mutex
+	desc    *prometheus.Desc
+	counter InstanceCounter
+	counts  map[string]int
+	err     error
+	counted time.Time
+}
+
+func (c *instancesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *instancesCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := c.count()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for status, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), status)
+	}
+}
+
+func (c *instancesCollector) count() (map[string]int, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.counter == nil {
+		return nil, nil
+	}
+	if c.counted.IsZero() || time.Since(c.counted) > instanceCountsCacheFor {
+		ctx, cancel := context.WithTimeout(context.Background(), instanceCountsTimeout)
+		c.counts, c.err = c.counter(ctx)
+		cancel()
+		c.counted = time.Now()
+	}
+	return c.counts, c.err
+}
@@ -0,0 +1,200 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	dto "github.com/prometheus/client_model/go"
+
+	. "github.com/henrytk/aws-service-broker/metrics"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// gather returns the metrics of the given family, keyed by their label
+// values in the order the labels were declared.
+func gather(name string) map[string]*dto.Metric {
+	families, err := Registry.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	metrics := map[string]*dto.Metric{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.Metric {
+			key := ""
+			for i, label := range metric.Label {
+				if i > 0 {
+					key += ","
+				}
+				key += label.GetName() + "=" + label.GetValue()
+			}
+			metrics[key] = metric
+		}
+	}
+	return metrics
+}
+
+var _ = Describe("Metrics", func() {
+	BeforeEach(func() {
+		OSBOperations.Reset()
+		OSBOperationDuration.Reset()
+		AsyncOperations.Reset()
+		AWSAPICalls.Reset()
+		AWSAPIErrors.Reset()
+		AWSAPIThrottles.Reset()
+		SetInstanceCounter(nil)
+	})
+
+	It("serves the metrics", func() {
+		ObserveOperation("provision", "mongodb", "small", OutcomeSuccess, time.Now())
+
+		recorder := httptest.NewRecorder()
+		Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(recorder.Code).To(Equal(200))
+		Expect(recorder.Body.String()).To(ContainSubstring(
+			`aws_service_broker_osb_operations_total{operation="provision",outcome="success",plan="small",service="mongodb"} 1`,
+		))
+		Expect(recorder.Body.String()).To(ContainSubstring("go_goroutines"))
+	})
+
+	Describe("ObserveOperation", func() {
+		It("counts operations and records their duration by service, plan and outcome", func() {
+			ObserveOperation("provision", "mongodb", "small", OutcomeError, time.Now().Add(-2*time.Second))
+			ObserveOperation("provision", "mongodb", "small", OutcomeError, time.Now())
+
+			key := "operation=provision,outcome=error,plan=small,service=mongodb"
+			Expect(gather("aws_service_broker_osb_operations_total")[key].Counter.GetValue()).To(Equal(2.0))
+			histogram := gather("aws_service_broker_osb_operation_duration_seconds")[key].Histogram
+			Expect(histogram.GetSampleCount()).To(Equal(uint64(2)))
+			Expect(histogram.GetSampleSum()).To(BeNumerically(">=", 2))
+		})
+	})
+
+	Describe("async operations", func() {
+		It("counts an instance as in flight once until its operation finishes", func() {
+			StartAsyncOperation("provision", "instance-1")
+			StartAsyncOperation("provision", "instance-1")
+			StartAsyncOperation("provision", "instance-2")
+			Expect(gather("aws_service_broker_osb_async_operations_in_flight")["type=provision"].Gauge.GetValue()).To(Equal(2.0))
+
+			FinishAsyncOperation("provision", "mongodb", "instance-1", "failed")
+			Expect(gather("aws_service_broker_osb_async_operations_in_flight")["type=provision"].Gauge.GetValue()).To(Equal(1.0))
+			Expect(gather("aws_service_broker_osb_async_operations_total")["outcome=failed,service=mongodb,type=provision"].Counter.GetValue()).To(Equal(1.0))
+
+			FinishAsyncOperation("provision", "mongodb", "instance-2", "succeeded")
+			Expect(gather("aws_service_broker_osb_async_operations_in_flight")["type=provision"].Gauge.GetValue()).To(Equal(0.0))
+		})
+
+		It("counts operations finishing that this broker did not start", func() {
+			FinishAsyncOperation("update", "mongodb", "instance-3", "succeeded")
+			Expect(gather("aws_service_broker_osb_async_operations_total")["outcome=succeeded,service=mongodb,type=update"].Counter.GetValue()).To(Equal(1.0))
+			Expect(gather("aws_service_broker_osb_async_operations_in_flight")).NotTo(HaveKey("type=update"))
+		})
+	})
+
+	Describe("InstrumentAWSHandlers", func() {
+		var (
+			handlers request.Handlers
+			req      *request.Request
+		)
+
+		BeforeEach(func() {
+			handlers = request.Handlers{}
+			InstrumentAWSHandlers(&handlers)
+			req = &request.Request{
+				ClientInfo: metadata.ClientInfo{ServiceName: "cloudformation"},
+				Operation:  &request.Operation{Name: "DescribeStacks"},
+			}
+		})
+
+		It("counts successful calls", func() {
+			handlers.Complete.Run(req)
+
+			Expect(gather("aws_service_broker_aws_api_calls_total")["operation=DescribeStacks,service=cloudformation"].Counter.GetValue()).To(Equal(1.0))
+			Expect(gather("aws_service_broker_aws_api_errors_total")).To(BeEmpty())
+		})
+
+		It("counts throttled attempts and failed calls by error code", func() {
+			req.Error = awserr.New("Throttling", "Rate exceeded", nil)
+			handlers.Retry.Run(req)
+			handlers.Retry.Run(req)
+			handlers.Complete.Run(req)
+
+			Expect(gather("aws_service_broker_aws_api_throttles_total")["operation=DescribeStacks,service=cloudformation"].Counter.GetValue()).To(Equal(2.0))
+			Expect(gather("aws_service_broker_aws_api_calls_total")["operation=DescribeStacks,service=cloudformation"].Counter.GetValue()).To(Equal(1.0))
+			Expect(gather("aws_service_broker_aws_api_errors_total")["code=Throttling,operation=DescribeStacks,service=cloudformation"].Counter.GetValue()).To(Equal(1.0))
+		})
+
+		It("does not count other errors as throttles", func() {
+			req.Error = errors.New("connection reset")
+			handlers.Retry.Run(req)
+			handlers.Complete.Run(req)
+
+			Expect(gather("aws_service_broker_aws_api_throttles_total")).To(BeEmpty())
+			Expect(gather("aws_service_broker_aws_api_errors_total")["code=Unknown,operation=DescribeStacks,service=cloudformation"].Counter.GetValue()).To(Equal(1.0))
+		})
+	})
+
+	Describe("instances", func() {
+		It("reports no instances until a counter is set", func() {
+			Expect(gather("aws_service_broker_instances")).To(BeEmpty())
+		})
+
+		It("counts the instances when they are scraped", func() {
+			SetInstanceCounter(func(ctx context.Context) (map[string]int, error) {
+				return map[string]int{"CREATE_COMPLETE": 3, "UPDATE_IN_PROGRESS": 1}, nil
+			})
+
+			instances := gather("aws_service_broker_instances")
+			Expect(instances["stack_status=CREATE_COMPLETE"].Gauge.GetValue()).To(Equal(3.0))
+			Expect(instances["stack_status=UPDATE_IN_PROGRESS"].Gauge.GetValue()).To(Equal(1.0))
+		})
+
+		It("bounds how long the instances are counted for", func() {
+			var deadline time.Time
+			var hasDeadline bool
+			SetInstanceCounter(func(ctx context.Context) (map[string]int, error) {
+				deadline, hasDeadline = ctx.Deadline()
+				return map[string]int{}, nil
+			})
+
+			gather("aws_service_broker_instances")
+			Expect(hasDeadline).To(BeTrue())
+			Expect(deadline).To(BeTemporally(">", time.Now()))
+		})
+
+		It("reuses recent counts, so that scrapes don't list the stacks each time", func() {
+			counted := 0
+			SetInstanceCounter(func(ctx context.Context) (map[string]int, error) {
+				counted++
+				return map[string]int{"CREATE_COMPLETE": counted}, nil
+			})
+
+			Expect(gather("aws_service_broker_instances")["stack_status=CREATE_COMPLETE"].Gauge.GetValue()).To(Equal(1.0))
+			Expect(gather("aws_service_broker_instances")["stack_status=CREATE_COMPLETE"].Gauge.GetValue()).To(Equal(1.0))
+			Expect(counted).To(Equal(1))
+		})
+
+		It("serves the other metrics when the instances can't be counted", func() {
+			SetInstanceCounter(func(ctx context.Context) (map[string]int, error) {
+				return nil, errors.New("access denied")
+			})
+			ObserveOperation("bind", "mongodb", "small", OutcomeSuccess, time.Now())
+
+			_, err := Registry.Gather()
+			Expect(err).To(MatchError(ContainSubstring("access denied")))
+
+			recorder := httptest.NewRecorder()
+			Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			Expect(recorder.Code).To(Equal(200))
+			Expect(recorder.Body.String()).To(ContainSubstring("aws_service_broker_osb_operations_total"))
+			Expect(recorder.Body.String()).NotTo(ContainSubstring("aws_service_broker_instances"))
+		})
+	})
+})
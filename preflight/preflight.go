@@ -0,0 +1,280 @@
+// Package preflight checks that the AWS resources the broker creates stacks
+// in exist and fit together, so that mistakes in the config are found
+// before they roll back a stack.
+package preflight
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	awssts "github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// Result is the outcome of one check.
+type Result struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func result(name string, err error) Result {
+	if err != nil {
+		return Result{Name: name, Error: err.Error()}
+	}
+	return Result{Name: name, OK: true}
+}
+
+// Report is the outcome of every check. It is OK if they all passed.
+type Report struct {
+	OK        bool      `json:"ok"`
+	CheckedAt time.Time `json:"checked_at"`
+	Checks    []Result  `json:"checks"`
+}
+
+// NewReport collects results into a report.
+func NewReport(results []Result) Report {
+	report := Report{OK: true, CheckedAt: time.Now().UTC(), Checks: results}
+	for _, result := range results {
+		if !result.OK {
+			report.OK = false
+		}
+	}
+	return report
+}
+
+// Failures returns the checks that failed, one per line.
+func (r Report) Failures() string {
+	var failures []string
+	for _, result := range r.Checks {
+		if !result.OK {
+			failures = append(failures, result.Name+": "+result.Error)
+		}
+	}
+	return strings.Join(failures, "\n")
+}
+
+// Resources are the existing resources a service's stacks are created in.
+type Resources struct {
+	VpcId            string
+	SubnetIds        []string
+	SecurityGroupIds []string
+	KeyPairName      string
+}
+
+// Checker makes the checks against an AWS account.
+type Checker struct {
+	EC2            ec2iface.EC2API
+	STS            stsiface.STSAPI
+	CloudFormation cloudformationiface.CloudFormationAPI
+}
+
+// CheckIdentity checks that the broker has AWS credentials.
+func (c *Checker) CheckIdentity(ctx context.Context) Result {
+	_, err := c.STS.GetCallerIdentityWithContext(ctx, &awssts.GetCallerIdentityInput{})
+	return result("aws credentials", err)
+}
+
+// CheckResources checks that a service's VPC, subnets, security groups
+// and key pair exist, that the subnets are in the VPC and that they are in
+// different availability zones. Security groups can be in other, peered
+// VPCs. Results are named after the service.
+func (c *Checker) CheckResources(ctx context.Context, service string, resources Resources) []Result {
+	prefix := service + ": "
+	results := []Result{
+		result(prefix+"vpc "+resources.VpcId, c.checkVpc(ctx, resources.VpcId)),
+		result(prefix+"subnets", c.checkSubnets(ctx, resources.VpcId, resources.SubnetIds)),
+	}
+	for _, groupId := range resources.SecurityGroupIds {
+		results = append(results, result(prefix+"security group "+groupId, c.checkSecurityGroup(ctx, groupId)))
+	}
+	results = append(results, result(prefix+"key pair "+resources.KeyPairName, c.checkKeyPair(ctx, resources.KeyPairName)))
+	return results
+}
+
+// CheckTemplate asks CloudFormation to validate a stack template. The
+// result has the given name.
+func (c *Checker) CheckTemplate(ctx context.Context, name, body string) Result {
+	_, err := c.CloudFormation.ValidateTemplateWithContext(ctx, &awscf.ValidateTemplateInput{
+		TemplateBody: aws.String(body),
+	})
+	return result(name, err)
+}
+
+func (c *Checker) checkVpc(ctx context.Context, vpcId string) error {
+	output, err := c.EC2.DescribeVpcsWithContext(ctx, &awsec2.DescribeVpcsInput{
+		VpcIds: aws.StringSlice([]string{vpcId}),
+	})
+	if err != nil {
+		return err
+	}
+	if len(output.Vpcs) != 1 {
+		return errors.New("VPC not found")
+	}
+	return nil
+}
+
+func (c *Checker) checkSubnets(ctx context.Context, vpcId string, subnetIds []string) error {
+	// Subnets can be listed more than once to place several members in
+	// them, but are only described once.
+	var unique []string
+	seen := map[string]bool{}
+	for _, subnetId := range subnetIds {
+		if !seen[subnetId] {
+			seen[subnetId] = true
+			unique = append(unique, subnetId)
+		}
+	}
+	output, err := c.EC2.DescribeSubnetsWithContext(ctx, &awsec2.DescribeSubnetsInput{
+		SubnetIds: aws.StringSlice(unique),
+	})
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	zones := map[string][]string{}
+	found := map[string]bool{}
+	for _, subnet := range output.Subnets {
+		subnetId := aws.StringValue(subnet.SubnetId)
+		found[subnetId] = true
+		if aws.StringValue(subnet.VpcId) != vpcId {
+			problems = append(problems, "subnet "+subnetId+" is in "+aws.StringValue(subnet.VpcId)+", not "+vpcId)
+		}
+		zone := aws.StringValue(subnet.AvailabilityZone)
+		zones[zone] = append(zones[zone], subnetId)
+	}
+	for _, subnetId := range unique {
+		if !found[subnetId] {
+			problems = append(problems, "subnet "+subnetId+" not found")
+		}
+	}
+	var shared []string
+	for zone, subnets := range zones {
+		if len(subnets) > 1 {
+			shared = append(shared, "subnets "+strings.Join(subnets, ", ")+" are all in "+zone)
+		}
+	}
+	sort.Strings(shared)
+	problems = append(problems, shared...)
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (c *Checker) checkSecurityGroup(ctx context.Context, groupId string) error {
+	output, err := c.EC2.DescribeSecurityGroupsWithContext(ctx, &awsec2.DescribeSecurityGroupsInput{
+		GroupIds: aws.StringSlice([]string{groupId}),
+	})
+	if err != nil {
+		return err
+	}
+	if len(output.SecurityGroups) != 1 {
+		return errors.New("security group not found")
+	}
+	return nil
+}
+
+func (c *Checker) checkKeyPair(ctx context.Context, keyPairName string) error {
+	output, err := c.EC2.DescribeKeyPairsWithContext(ctx, &awsec2.DescribeKeyPairsInput{
+		KeyNames: aws.StringSlice([]string{keyPairName}),
+	})
+	if err != nil {
+		return err
+	}
+	if len(output.KeyPairs) != 1 {
+		return errors.New("key pair not found")
+	}
+	return nil
+}
+
+// Monitor reruns the checks periodically and serves the latest report.
+type Monitor struct {
+	run func(context.Context) Report
+
+	mu     sync.RWMutex
+	report *Report
+}
+
+// NewMonitor returns a monitor of the given checks, which haven't run yet.
+func NewMonitor(run func(context.Context) Report) *Monitor {
+	return &Monitor{run: run}
+}
+
+// Check runs the checks now, keeping the report.
+func (m *Monitor) Check(ctx context.Context) Report {
+	report := m.run(ctx)
+	m.mu.Lock()
+	m.report = &report
+	m.mu.Unlock()
+	return report
+}
+
+// Report returns the latest report, if the checks have run.
+func (m *Monitor) Report() (Report, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.report == nil {
+		return Report{}, false
+	}
+	return *m.report, true
+}
+
+// Watch reruns the checks every interval until the context is done, logging
+// when they start or stop failing. The checks run straight away if they
+// haven't run yet.
+func (m *Monitor) Watch(ctx context.Context, interval time.Duration, logger lager.Logger) {
+	if _, checked := m.Report(); !checked {
+		m.recheck(ctx, logger)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.recheck(ctx, logger)
+		}
+	}
+}
+
+func (m *Monitor) recheck(ctx context.Context, logger lager.Logger) {
+	previous, checked := m.Report()
+	report := m.Check(ctx)
+	if !report.OK && (!checked || previous.OK || previous.Failures() != report.Failures()) {
+		logger.Error("preflight-failed", errors.New(report.Failures()))
+	} else if report.OK && checked && !previous.OK {
+		logger.Info("preflight-passed")
+	}
+}
+
+// ServeHTTP serves the latest report, with a 503 status if it failed or
+// the checks haven't run yet.
+func (m *Monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report, ok := m.Report()
+	status := http.StatusOK
+	if !ok || !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if !ok {
+		json.NewEncoder(w).Encode(Report{Checks: []Result{}})
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,193 @@
+package preflight_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	awssts "github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+
+	. "github.com/henrytk/aws-service-broker/preflight"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type stubEC2 struct {
+	ec2iface.EC2API
+	vpcs           []*awsec2.Vpc
+	subnets        []*awsec2.Subnet
+	securityGroups []*awsec2.SecurityGroup
+	keyPairs       []*awsec2.KeyPairInfo
+	subnetInputs   []*awsec2.DescribeSubnetsInput
+}
+
+func (s *stubEC2) DescribeVpcsWithContext(ctx aws.Context, input *awsec2.DescribeVpcsInput, opts ...request.Option) (*awsec2.DescribeVpcsOutput, error) {
+	return &awsec2.DescribeVpcsOutput{Vpcs: s.vpcs}, nil
+}
+
+func (s *stubEC2) DescribeSubnetsWithContext(ctx aws.Context, input *awsec2.DescribeSubnetsInput, opts ...request.Option) (*awsec2.DescribeSubnetsOutput, error) {
+	s.subnetInputs = append(s.subnetInputs, input)
+	return &awsec2.DescribeSubnetsOutput{Subnets: s.subnets}, nil
+}
+
+func (s *stubEC2) DescribeSecurityGroupsWithContext(ctx aws.Context, input *awsec2.DescribeSecurityGroupsInput, opts ...request.Option) (*awsec2.DescribeSecurityGroupsOutput, error) {
+	return &awsec2.DescribeSecurityGroupsOutput{SecurityGroups: s.securityGroups}, nil
+}
+
+func (s *stubEC2) DescribeKeyPairsWithContext(ctx aws.Context, input *awsec2.DescribeKeyPairsInput, opts ...request.Option) (*awsec2.DescribeKeyPairsOutput, error) {
+	return &awsec2.DescribeKeyPairsOutput{KeyPairs: s.keyPairs}, nil
+}
+
+type stubSTS struct {
+	stsiface.STSAPI
+	err error
+}
+
+func (s *stubSTS) GetCallerIdentityWithContext(ctx aws.Context, input *awssts.GetCallerIdentityInput, opts ...request.Option) (*awssts.GetCallerIdentityOutput, error) {
+	return &awssts.GetCallerIdentityOutput{}, s.err
+}
+
+type stubCloudFormation struct {
+	cloudformationiface.CloudFormationAPI
+	err error
+}
+
+func (s *stubCloudFormation) ValidateTemplateWithContext(ctx aws.Context, input *awscf.ValidateTemplateInput, opts ...request.Option) (*awscf.ValidateTemplateOutput, error) {
+	return &awscf.ValidateTemplateOutput{}, s.err
+}
+
+func subnet(id, vpcId, zone string) *awsec2.Subnet {
+	return &awsec2.Subnet{SubnetId: aws.String(id), VpcId: aws.String(vpcId), AvailabilityZone: aws.String(zone)}
+}
+
+var _ = Describe("Preflight", func() {
+	var (
+		ec2Client *stubEC2
+		checker   *Checker
+		resources Resources
+	)
+
+	BeforeEach(func() {
+		ec2Client = &stubEC2{
+			vpcs: []*awsec2.Vpc{{VpcId: aws.String("vpc-1")}},
+			subnets: []*awsec2.Subnet{
+				subnet("subnet-a", "vpc-1", "eu-west-1a"),
+				subnet("subnet-b", "vpc-1", "eu-west-1b"),
+			},
+			securityGroups: []*awsec2.SecurityGroup{{GroupId: aws.String("sg-1")}},
+			keyPairs:       []*awsec2.KeyPairInfo{{KeyName: aws.String("key")}},
+		}
+		checker = &Checker{EC2: ec2Client, STS: &stubSTS{}, CloudFormation: &stubCloudFormation{}}
+		resources = Resources{
+			VpcId:            "vpc-1",
+			SubnetIds:        []string{"subnet-a", "subnet-b", "subnet-a"},
+			SecurityGroupIds: []string{"sg-1"},
+			KeyPairName:      "key",
+		}
+	})
+
+	It("passes when the resources exist and fit together", func() {
+		results := checker.CheckResources(context.Background(), "mongodb", resources)
+		Expect(results).To(Equal([]Result{
+			{Name: "mongodb: vpc vpc-1", OK: true},
+			{Name: "mongodb: subnets", OK: true},
+			{Name: "mongodb: security group sg-1", OK: true},
+			{Name: "mongodb: key pair key", OK: true},
+		}))
+		Expect(NewReport(results).OK).To(BeTrue())
+	})
+
+	It("describes each subnet once", func() {
+		checker.CheckResources(context.Background(), "mongodb", resources)
+		Expect(ec2Client.subnetInputs).To(HaveLen(1))
+		Expect(aws.StringValueSlice(ec2Client.subnetInputs[0].SubnetIds)).To(Equal([]string{"subnet-a", "subnet-b"}))
+	})
+
+	It("reports subnets that are missing, in another VPC or share a zone", func() {
+		ec2Client.subnets = []*awsec2.Subnet{
+			subnet("subnet-a", "vpc-2", "eu-west-1a"),
+			subnet("subnet-c", "vpc-1", "eu-west-1a"),
+		}
+		resources.SubnetIds = []string{"subnet-a", "subnet-b", "subnet-c"}
+
+		results := checker.CheckResources(context.Background(), "mongodb", resources)
+		Expect(results[1]).To(Equal(Result{
+			Name:  "mongodb: subnets",
+			Error: "subnet subnet-a is in vpc-2, not vpc-1; subnet subnet-b not found; subnets subnet-a, subnet-c are all in eu-west-1a",
+		}))
+	})
+
+	It("reports a missing VPC, security group and key pair", func() {
+		ec2Client.vpcs = nil
+		ec2Client.securityGroups = nil
+		ec2Client.keyPairs = nil
+
+		report := NewReport(checker.CheckResources(context.Background(), "mongodb", resources))
+		Expect(report.OK).To(BeFalse())
+		Expect(report.Failures()).To(Equal(
+			"mongodb: vpc vpc-1: VPC not found\n" +
+				"mongodb: security group sg-1: security group not found\n" +
+				"mongodb: key pair key: key pair not found",
+		))
+	})
+
+	It("reports missing credentials and invalid templates", func() {
+		checker.STS = &stubSTS{err: errors.New("no credentials")}
+		checker.CloudFormation = &stubCloudFormation{err: errors.New("template is invalid")}
+
+		Expect(checker.CheckIdentity(context.Background())).To(Equal(Result{Name: "aws credentials", Error: "no credentials"}))
+		Expect(checker.CheckTemplate(context.Background(), "mongodb: template", "{}")).To(Equal(Result{Name: "mongodb: template", Error: "template is invalid"}))
+	})
+
+	Describe("Monitor", func() {
+		var (
+			report  Report
+			monitor *Monitor
+		)
+
+		BeforeEach(func() {
+			report = NewReport([]Result{{Name: "aws credentials", OK: true}})
+			monitor = NewMonitor(func(ctx context.Context) Report {
+				return report
+			})
+		})
+
+		serve := func() (int, Report) {
+			recorder := httptest.NewRecorder()
+			monitor.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthcheck", nil))
+			var served Report
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &served)).To(Succeed())
+			return recorder.Code, served
+		}
+
+		It("is unavailable until the checks have run", func() {
+			_, checked := monitor.Report()
+			Expect(checked).To(BeFalse())
+			status, served := serve()
+			Expect(status).To(Equal(http.StatusServiceUnavailable))
+			Expect(served.OK).To(BeFalse())
+		})
+
+		It("serves the latest report", func() {
+			monitor.Check(context.Background())
+			status, served := serve()
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(served.Checks).To(Equal(report.Checks))
+
+			report = NewReport([]Result{{Name: "aws credentials", Error: "no credentials"}})
+			monitor.Check(context.Background())
+			status, served = serve()
+			Expect(status).To(Equal(http.StatusServiceUnavailable))
+			Expect(served.Checks).To(Equal(report.Checks))
+		})
+	})
+})
@@ -0,0 +1,206 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+)
+
+// recentStackEvents is how many of an instance's stack events are shown.
+const recentStackEvents = 25
+
+// AdminInstance is an instance as the admin API shows it. Instances
+// provisioned before their stacks were tagged have no plan.
+type AdminInstance struct {
+	InstanceID   string     `json:"instance_id"`
+	Service      string     `json:"service"`
+	Plan         string     `json:"plan"`
+	StackName    string     `json:"stack_name"`
+	StackID      string     `json:"stack_id"`
+	Status       string     `json:"status"`
+	StatusReason string     `json:"status_reason,omitempty"`
+	Region       string     `json:"region"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+	Age          string     `json:"age"`
+}
+
+// AdminInstanceDetails is an instance with its stack's parameters, outputs
+// and recent events.
+type AdminInstanceDetails struct {
+	AdminInstance
+	Parameters map[string]string `json:"parameters"`
+	Outputs    map[string]string `json:"outputs"`
+	Events     []AdminStackEvent `json:"events"`
+}
+
+type AdminStackEvent struct {
+	Time              time.Time `json:"time"`
+	LogicalResourceID string    `json:"logical_resource_id"`
+	ResourceType      string    `json:"resource_type"`
+	Status            string    `json:"status"`
+	StatusReason      string    `json:"status_reason,omitempty"`
+}
+
+// Instances lists every instance in the account.
+func (ap *AWSProvider) Instances(ctx context.Context) ([]AdminInstance, error) {
+	stacks, err := ap.MongoDBService.ListInstanceStacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instances := []AdminInstance{}
+	for _, stack := range stacks {
+		instances = append(instances, ap.adminInstance(stack))
+	}
+	return instances, nil
+}
+
+// Instance describes an instance. It returns mongodb.ErrStackNotFound for
+// instances that don't exist.
+func (ap *AWSProvider) Instance(ctx context.Context, instanceID string) (AdminInstanceDetails, error) {
+	stack, err := ap.MongoDBService.DescribeInstanceStack(ctx, instanceID, recentStackEvents)
+	if err != nil {
+		return AdminInstanceDetails{}, err
+	}
+	details := AdminInstanceDetails{
+		AdminInstance: ap.adminInstance(stack.InstanceStack),
+		Parameters:    stack.Parameters,
+		Outputs:       stack.Outputs,
+		Events:        []AdminStackEvent{},
+	}
+	for _, event := range stack.Events {
+		details.Events = append(details.Events, AdminStackEvent{
+			Time:              event.Timestamp,
+			LogicalResourceID: event.LogicalResourceId,
+			ResourceType:      event.ResourceType,
+			Status:            event.ResourceStatus,
+			StatusReason:      event.ResourceStatusReason,
+		})
+	}
+	return details, nil
+}
+
+// RetryOperation retries the failed operation of an instance, returning the
+// operation it started. See mongodb.Service.RetryStackOperation.
+func (ap *AWSProvider) RetryOperation(ctx context.Context, instanceID string) (string, error) {
+	return ap.MongoDBService.RetryStackOperation(ctx, instanceID)
+}
+
+// RefreshStatus asks CloudFormation for the status of an instance, so that
+// polls stop being answered with a cached status.
+func (ap *AWSProvider) RefreshStatus(ctx context.Context, instanceID string) (status, reason string, err error) {
+	return ap.MongoDBService.RefreshStackState(ctx, instanceID)
+}
+
+func (ap *AWSProvider) adminInstance(stack mongodb.InstanceStack) AdminInstance {
+	instance := AdminInstance{
+		InstanceID:   stack.ID,
+		Service:      "mongodb",
+		StackName:    stack.StackName,
+		StackID:      stack.StackId,
+		Status:       stack.Status,
+		StatusReason: stack.StatusReason,
+		Region:       ap.CurrentConfig().AWSConfig.Region,
+		CreatedAt:    stack.CreationTime,
+		UpdatedAt:    stack.LastUpdatedTime,
+		Age:          time.Since(stack.CreationTime).Round(time.Second).String(),
+	}
+	if plan, err := ap.findPlanByIdInService("mongodb", stack.Tags[mongodb.PlanIDTag]); err == nil {
+		instance.Plan = plan.Name
+	}
+	return instance
+}
+
+// RenderStack builds the request provisioning an instance of a plan would
+// make to create its stack, with the values of secret parameters masked.
+// The instance has no organization or space.
+func (ap *AWSProvider) RenderStack(serviceName, planName, instanceID string) (*awscf.CreateStackInput, error) {
+	config := ap.CurrentConfig()
+	ctx := WithConfig(context.Background(), config)
+	for _, service := range config.Catalog.Services {
+		if service.Name != serviceName {
+			continue
+		}
+		for _, plan := range service.Plans {
+			if plan.Name == planName {
+				return ap.renderStack(ctx, service, plan, instanceID)
+			}
+		}
+		return nil, errors.New("could not find plan " + planName + " of service " + serviceName)
+	}
+	return nil, errors.New("could not find service " + serviceName)
+}
+
+func (ap *AWSProvider) renderStack(ctx context.Context, service Service, plan Plan, instanceID string) (*awscf.CreateStackInput, error) {
+	switch service.Name {
+	case "mongodb":
+		inputParameters, err := ap.mongoDBProvisionParameters(ctx, service, plan, instanceID, "", "")
+		if err != nil {
+			return nil, err
+		}
+		createStackInput, err := ap.MongoDBService.BuildCreateStack(instanceID, inputParameters)
+		if err != nil {
+			return nil, err
+		}
+		createStackInput.Parameters = mongodb.MaskSecretParameters(createStackInput.Parameters)
+		return createStackInput, nil
+	default:
+		return nil, errors.New("no provider for service name " + service.Name)
+	}
+}
+
+// CheckPlans builds the stack of every plan in the catalog, returning an
+// error for each plan that could not be provisioned.
+func (ap *AWSProvider) CheckPlans() []error {
+	var errs []error
+	config := ap.CurrentConfig()
+	ctx := WithConfig(context.Background(), config)
+	for _, service := range config.Catalog.Services {
+		for _, plan := range service.Plans {
+			if _, err := ap.renderStack(ctx, service, plan, "00000000-0000-0000-0000-000000000000"); err != nil {
+				errs = append(errs, errors.New("plan "+plan.Name+" of service "+service.Name+": "+err.Error()))
+			}
+		}
+	}
+	return errs
+}
+
+// Orphans lists the instances whose stacks remain although the platform no
+// longer knows of them. Stacks created before they were tagged with their
+// instance can't be told apart from orphans, so they are never listed, and
+// nor are stacks in the middle of an operation.
+func (ap *AWSProvider) Orphans(ctx context.Context, knownInstanceIDs []string) ([]AdminInstance, error) {
+	if len(knownInstanceIDs) == 0 {
+		return nil, errors.New("no known instances: every instance would be an orphan")
+	}
+	known := map[string]bool{}
+	for _, instanceID := range knownInstanceIDs {
+		known[instanceID] = true
+	}
+
+	stacks, err := ap.MongoDBService.ListInstanceStacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	orphans := []AdminInstance{}
+	for _, stack := range stacks {
+		if stack.Tags[mongodb.InstanceIDTag] == "" || known[stack.ID] {
+			continue
+		}
+		if strings.HasSuffix(stack.Status, "_IN_PROGRESS") {
+			continue
+		}
+		orphans = append(orphans, ap.adminInstance(stack))
+	}
+	return orphans, nil
+}
+
+// DeleteInstance starts deleting the stack of an instance, as deprovisioning
+// it would.
+func (ap *AWSProvider) DeleteInstance(ctx context.Context, instanceID string) error {
+	return ap.MongoDBService.DeleteStack(ctx, instanceID)
+}
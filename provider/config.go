@@ -1,17 +1,184 @@
 package provider
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/templates"
+	"github.com/henrytk/aws-service-broker/webhooks"
 	"github.com/pivotal-cf/brokerapi"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Config struct {
-	Secret    string    `json:"secret"`
-	AWSConfig AWSConfig `json:"aws_config"`
-	Catalog   Catalog   `json:"catalog"`
+	Secret            string    `json:"secret"`
+	AWSConfig         AWSConfig `json:"aws_config"`
+	Catalog           Catalog   `json:"catalog"`
+	RequireEncryption bool      `json:"require_encryption"`
+	// AuditLog is where the audit log is written: a file path, "stdout"
+	// or a syslog server. See audit.Open.
+	AuditLog string `json:"audit_log"`
+	// StackStatusRefreshInterval is how often the statuses of stacks being
+	// polled about are refreshed, as a duration such as "10s". Zero turns
+	// the stack status cache off.
+	StackStatusRefreshInterval string      `json:"stack_status_refresh_interval"`
+	StackEvents                StackEvents `json:"stack_events"`
+	// Webhooks are the endpoints sent events when operations finish.
+	Webhooks []webhooks.Endpoint `json:"webhooks"`
+	// Admin are the credentials of the admin API, which is not served
+	// without them.
+	Admin AdminCredentials `json:"admin"`
+	// Preflight checks that the AWS resources the catalog refers to exist.
+	Preflight Preflight `json:"preflight"`
+	// TLS serves the API over HTTPS when it has a certificate and key.
+	TLS TLS `json:"tls"`
+	// Timeouts bound how long the API's connections and requests take,
+	// and how long the broker waits for requests when it shuts down.
+	Timeouts Timeouts `json:"timeouts"`
+	// Credentials are accepted by the service broker API instead of its
+	// basic auth username and password, which are then only used within
+	// the broker. Several can be accepted at once, so that they can be
+	// rotated without downtime.
+	Credentials []Credential `json:"credentials"`
+	// ClientCertificates require the platform to present a certificate
+	// when calling the API over HTTPS.
+	ClientCertificates ClientCertificates `json:"client_certificates"`
+}
+
+// Credential is a username and the bcrypt hash of its password.
+type Credential struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+}
+
+// ClientCertificates are required when they have a CA. Certificates must
+// be issued by the CA, and have one of the allowed subjects as their
+// common name or one of their DNS names.
+type ClientCertificates struct {
+	CAFile          string   `json:"ca_file"`
+	AllowedSubjects []string `json:"allowed_subjects"`
+}
+
+// Required reports whether requests need a client certificate.
+func (c ClientCertificates) Required() bool {
+	return c.CAFile != ""
+}
+
+// TLS are the paths of the PEM encoded certificate, including any
+// intermediates, and private key the API is served with. The files are
+// reloaded when they change.
+type TLS struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// Enabled reports whether the API is served over HTTPS.
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// Timeouts of the API server, as durations such as "30s". Those not set
+// have a default.
+type Timeouts struct {
+	// Read bounds reading a request, including its body.
+	Read string `json:"read"`
+	// Write bounds handling a request and writing its response.
+	// Provisioning calls CloudFormation, retrying when it is throttled.
+	Write string `json:"write"`
+	// Idle bounds how long a kept-alive connection waits for a request.
+	Idle string `json:"idle"`
+	// Shutdown bounds how long the broker waits for requests in flight to
+	// finish when it is stopped.
+	Shutdown string `json:"shutdown"`
+}
+
+const (
+	DefaultReadTimeout     = 30 * time.Second
+	DefaultWriteTimeout    = 2 * time.Minute
+	DefaultIdleTimeout     = 2 * time.Minute
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+func (t Timeouts) ReadTimeout() time.Duration {
+	return durationOr(t.Read, DefaultReadTimeout)
+}
+
+func (t Timeouts) WriteTimeout() time.Duration {
+	return durationOr(t.Write, DefaultWriteTimeout)
+}
+
+func (t Timeouts) IdleTimeout() time.Duration {
+	return durationOr(t.Idle, DefaultIdleTimeout)
+}
+
+func (t Timeouts) ShutdownTimeout() time.Duration {
+	return durationOr(t.Shutdown, DefaultShutdownTimeout)
+}
+
+func durationOr(value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+	duration, _ := time.ParseDuration(value)
+	return duration
+}
+
+// Preflight configures the preflight checks. They are off unless they run
+// on startup or have an interval.
+type Preflight struct {
+	// OnStartup runs the checks before the broker starts, which refuses
+	// to start if any of them fail.
+	OnStartup bool `json:"on_startup"`
+	// Interval is how often the checks are rerun, as a duration such as
+	// "5m", to report their results at /healthcheck.
+	Interval string `json:"interval"`
+}
+
+// Enabled reports whether the preflight checks run at all.
+func (p Preflight) Enabled() bool {
+	return p.OnStartup || p.RecheckInterval() > 0
+}
+
+// RecheckInterval returns how often the checks are rerun, or zero if they
+// aren't.
+func (p Preflight) RecheckInterval() time.Duration {
+	interval, _ := time.ParseDuration(p.Interval)
+	return interval
+}
+
+// AdminCredentials authenticate operators of the broker, separately from the
+// platform calling the service broker API.
+type AdminCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// StackEvents configures the broker to follow stack events instead of only
+// polling stack statuses. Stacks notify the SNS topic, which the SQS queue
+// must be subscribed to.
+type StackEvents struct {
+	TopicArn string `json:"topic_arn"`
+	QueueURL string `json:"queue_url"`
+}
+
+// DefaultStackStatusRefreshInterval is used when the config doesn't set a
+// stack status refresh interval.
+const DefaultStackStatusRefreshInterval = 10 * time.Second
+
+// StackStatusInterval returns how often stack statuses are refreshed.
+func (c Config) StackStatusInterval() time.Duration {
+	if c.StackStatusRefreshInterval == "" {
+		return DefaultStackStatusRefreshInterval
+	}
+	interval, _ := time.ParseDuration(c.StackStatusRefreshInterval)
+	return interval
 }
 
 type AWSConfig struct {
@@ -31,28 +198,115 @@ type Service struct {
 type Plan struct {
 	brokerapi.ServicePlan
 	MongoDBPlanParameters
+	Updates *PlanUpdates `json:"updates"`
 }
 
 type MongoDBServiceParameters struct {
-	BastionSecurityGroupId string `json:"bastion_security_group_id"`
-	KeyPairName            string `json:"key_pair_name"`
-	VpcId                  string `json:"vpc_id"`
-	PrimaryNodeSubnetId    string `json:"primary_node_subnet_id"`
-	Secondary0NodeSubnetId string `json:"secondary_0_node_subnet_id"`
-	Secondary1NodeSubnetId string `json:"secondary_1_node_subnet_id"`
+	BastionSecurityGroupId  string   `json:"bastion_security_group_id"`
+	KeyPairName             string   `json:"key_pair_name"`
+	VpcId                   string   `json:"vpc_id"`
+	NodeSubnetIds           []string `json:"node_subnet_ids"`
+	PrimaryNodeSubnetId     string   `json:"primary_node_subnet_id"`
+	Secondary0NodeSubnetId  string   `json:"secondary_0_node_subnet_id"`
+	Secondary1NodeSubnetId  string   `json:"secondary_1_node_subnet_id"`
+	Encrypted               bool     `json:"encrypted"`
+	KMSKeyId                string   `json:"kms_key_id"`
+	AlarmTopicArn           string   `json:"alarm_topic_arn"`
+	Exporter                bool     `json:"mongodb_exporter"`
+	ExporterSecurityGroupId string   `json:"exporter_security_group_id"`
+}
+
+// Subnets returns the subnets replica set members are spread across. The
+// node_subnet_ids list takes precedence over the three fixed subnet fields,
+// which are still accepted for existing configurations.
+func (p MongoDBServiceParameters) Subnets() []string {
+	if len(p.NodeSubnetIds) > 0 {
+		return p.NodeSubnetIds
+	}
+	return []string{p.PrimaryNodeSubnetId, p.Secondary0NodeSubnetId, p.Secondary1NodeSubnetId}
 }
 
 type MongoDBPlanParameters struct {
-	MongoDBVersion         string `json:"mongodb_version"`
-	MongoDBAdminUsername   string `json:"mongodb_admin_username"`
-	ClusterReplicaSetCount string `json:"cluster_replica_set_count"`
-	ReplicaShardIndex      string `json:"replica_shard_index"`
-	VolumeSize             string `json:"volume_size"`
-	VolumeType             string `json:"volume_type"`
-	Iops                   string `json:"iops"`
-	NodeInstanceType       string `json:"node_instance_type"`
+	MongoDBVersion         string          `json:"mongodb_version"`
+	MongoDBAdminUsername   string          `json:"mongodb_admin_username"`
+	ClusterReplicaSetCount string          `json:"cluster_replica_set_count"`
+	ArbiterCount           string          `json:"arbiter_count"`
+	ReplicaShardIndex      string          `json:"replica_shard_index"`
+	VolumeSize             string          `json:"volume_size"`
+	VolumeType             string          `json:"volume_type"`
+	Iops                   string          `json:"iops"`
+	NodeInstanceType       string          `json:"node_instance_type"`
+	ShardCount             string          `json:"shard_count"`
+	MongosCount            string          `json:"mongos_count"`
+	TLS                    bool            `json:"tls"`
+	Encrypted              *bool           `json:"encrypted"`
+	KMSKeyId               string          `json:"kms_key_id"`
+	AlarmTopicArn          string          `json:"alarm_topic_arn"`
+	AlarmThresholds        AlarmThresholds `json:"alarm_thresholds"`
+	Exporter               *bool           `json:"mongodb_exporter"`
+}
+
+// AlarmThresholds are the thresholds of a plan's CloudWatch alarms. Those
+// left empty take the stack template's defaults.
+type AlarmThresholds struct {
+	CPUUtilization       string `json:"cpu_utilization"`
+	BurstBalance         string `json:"burst_balance"`
+	DiskSpaceUtilization string `json:"disk_space_utilization"`
+	ReplicationLag       string `json:"replication_lag"`
 }
 
+// AlarmTopic returns the ARN of the SNS topic a plan's alarms notify,
+// which is the service's unless the plan sets its own. Plans without a
+// topic have no alarms.
+func (s Service) AlarmTopic(plan Plan) string {
+	if plan.AlarmTopicArn != "" {
+		return plan.AlarmTopicArn
+	}
+	return s.AlarmTopicArn
+}
+
+// ExporterSecurityGroup returns the security group allowed to scrape the
+// mongodb_exporter on a plan's nodes. Plans run the exporter if the
+// service does, unless they say otherwise. Plans without the exporter
+// have no security group.
+func (s Service) ExporterSecurityGroup(plan Plan) string {
+	exporter := s.Exporter
+	if plan.Exporter != nil {
+		exporter = *plan.Exporter
+	}
+	if !exporter {
+		return ""
+	}
+	return s.ExporterSecurityGroupId
+}
+
+// VolumeEncryption works out whether a plan's volumes are encrypted and
+// with which KMS key. Plans take the service's settings unless they set
+// their own. An empty key means the account's default EBS key.
+func (s Service) VolumeEncryption(plan Plan) (encrypted bool, kmsKeyId string) {
+	encrypted = s.Encrypted
+	if plan.Encrypted != nil {
+		encrypted = *plan.Encrypted
+	}
+	kmsKeyId = s.KMSKeyId
+	if plan.KMSKeyId != "" {
+		kmsKeyId = plan.KMSKeyId
+	}
+	return encrypted, kmsKeyId
+}
+
+// PrepareConfig resolves the secret references of a raw config and
+// expands its plans, for usb.NewConfig and DecodeConfig. It runs once per
+// config read: a resolved secret may itself look like a reference.
+func PrepareConfig(ctx context.Context, b []byte) ([]byte, error) {
+	b, err := ResolveConfig(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	return ExpandPlans(b)
+}
+
+// DecodeConfig decodes and validates a config prepared by PrepareConfig.
 func DecodeConfig(b []byte) (*Config, error) {
 	var config *Config
 	err := json.Unmarshal(b, &config)
@@ -71,6 +325,70 @@ func DecodeConfig(b []byte) (*Config, error) {
 	if len(config.Catalog.Services) == 0 {
 		return config, errors.New("Config error: at least one service must be configured")
 	}
+	if config.StackStatusRefreshInterval != "" {
+		interval, err := time.ParseDuration(config.StackStatusRefreshInterval)
+		if err != nil || interval < 0 {
+			return config, errors.New("Config error: stack status refresh interval must be a duration such as 10s")
+		}
+	}
+	if config.Preflight.Interval != "" {
+		interval, err := time.ParseDuration(config.Preflight.Interval)
+		if err != nil || interval < 0 {
+			return config, errors.New("Config error: preflight interval must be a duration such as 5m")
+		}
+	}
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		return config, errors.New("Config error: TLS needs both a certificate file and a key file")
+	}
+	if config.ClientCertificates.Required() {
+		if !config.TLS.Enabled() {
+			return config, errors.New("Config error: client certificates need the API to be served over TLS")
+		}
+		if len(config.ClientCertificates.AllowedSubjects) == 0 {
+			return config, errors.New("Config error: client certificates need at least one allowed subject")
+		}
+	} else if len(config.ClientCertificates.AllowedSubjects) > 0 {
+		return config, errors.New("Config error: client certificate subjects need a CA file")
+	}
+	for _, credential := range config.Credentials {
+		if credential.Username == "" {
+			return config, errors.New("Config error: credentials need a username")
+		}
+		if _, err := bcrypt.Cost([]byte(credential.PasswordHash)); err != nil {
+			return config, errors.New("Config error: password hash of " + credential.Username + " is not a bcrypt hash")
+		}
+	}
+	for _, timeout := range []struct{ name, value string }{
+		{"read", config.Timeouts.Read},
+		{"write", config.Timeouts.Write},
+		{"idle", config.Timeouts.Idle},
+		{"shutdown", config.Timeouts.Shutdown},
+	} {
+		if timeout.value == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(timeout.value); err != nil || duration <= 0 {
+			return config, errors.New("Config error: " + timeout.name + " timeout must be a positive duration such as 30s")
+		}
+	}
+	if config.Admin != (AdminCredentials{}) && (config.Admin.Username == "" || config.Admin.Password == "") {
+		return config, errors.New("Config error: admin API needs both a username and a password")
+	}
+	for _, endpoint := range config.Webhooks {
+		if err := validateWebhook(endpoint); err != nil {
+			return config, err
+		}
+	}
+	if config.StackEvents != (StackEvents{}) {
+		if config.StackEvents.TopicArn == "" || config.StackEvents.QueueURL == "" {
+			return config, errors.New("Config error: stack events need both a topic ARN and a queue URL")
+		}
+		// Events are recorded in the stack status cache, and polling
+		// still catches up with any that are lost.
+		if config.StackStatusInterval() == 0 {
+			return config, errors.New("Config error: stack events need the stack status cache, which a zero refresh interval turns off")
+		}
+	}
 
 	for _, service := range config.Catalog.Services {
 		switch service.Name {
@@ -84,14 +402,25 @@ func DecodeConfig(b []byte) (*Config, error) {
 			if service.VpcId == "" {
 				return config, errors.New("Config error: must provide VPC ID")
 			}
-			if service.PrimaryNodeSubnetId == "" {
-				return config, errors.New("Config error: must provide primary node subnet ID")
+			if err := validateMongoDBSubnets(service.MongoDBServiceParameters); err != nil {
+				return config, err
 			}
-			if service.Secondary0NodeSubnetId == "" {
-				return config, errors.New("Config error: must provide secondary 0 node subnet ID")
+			for _, plan := range service.Plans {
+				if err := validateMongoDBPlan(plan); err != nil {
+					return config, err
+				}
+				if err := validateVolumeEncryption(service, plan, config.RequireEncryption); err != nil {
+					return config, err
+				}
+				if err := validateAlarms(service, plan); err != nil {
+					return config, err
+				}
+				if err := validateExporter(service, plan); err != nil {
+					return config, err
+				}
 			}
-			if service.Secondary1NodeSubnetId == "" {
-				return config, errors.New("Config error: must provide secondary 1 node subnet ID")
+			if err := validatePlanUpdates(service); err != nil {
+				return config, err
 			}
 		default:
 			return config, errors.New("Config error: service name " + service.Name + " not recognised")
@@ -101,10 +430,176 @@ func DecodeConfig(b []byte) (*Config, error) {
 			return config, errors.New("Config error: at least one plan must be configured for service " + service.Name)
 		}
 	}
+	if err := validatePlanParameters(config.Catalog); err != nil {
+		return config, err
+	}
 
 	return config, nil
 }
 
+// validatePlanParameters checks the stack parameters of every plan against
+// the constraints of the stack template, listing every violation so that
+// they can all be fixed at once.
+func validatePlanParameters(catalog Catalog) error {
+	var violations []string
+	for _, service := range catalog.Services {
+		for _, plan := range service.Plans {
+			for _, err := range mongodb.ValidateParameters(mongoDBPlanParameters(service, plan)) {
+				violations = append(violations, "plan "+plan.Name+": "+err.Error())
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return errors.New("Config error: plans break the constraints of the stack template:\n  " + strings.Join(violations, "\n  "))
+	}
+	return nil
+}
+
+func validateMongoDBSubnets(service MongoDBServiceParameters) error {
+	if len(service.NodeSubnetIds) > 0 {
+		for _, subnetId := range service.NodeSubnetIds {
+			if subnetId == "" {
+				return errors.New("Config error: node subnet IDs must not be empty")
+			}
+		}
+		return nil
+	}
+	if service.PrimaryNodeSubnetId == "" {
+		return errors.New("Config error: must provide primary node subnet ID")
+	}
+	if service.Secondary0NodeSubnetId == "" {
+		return errors.New("Config error: must provide secondary 0 node subnet ID")
+	}
+	if service.Secondary1NodeSubnetId == "" {
+		return errors.New("Config error: must provide secondary 1 node subnet ID")
+	}
+	return nil
+}
+
+func validateMongoDBPlan(plan Plan) error {
+	if err := validateMongoDBReplicaSet(plan); err != nil {
+		return err
+	}
+	if plan.ShardCount == "" {
+		if plan.MongosCount != "" {
+			return errors.New("Config error: plan " + plan.Name + " sets a mongos count but is not sharded")
+		}
+		return nil
+	}
+	if !positiveNumber(plan.ShardCount) {
+		return errors.New("Config error: shard count for plan " + plan.Name + " must be a positive number")
+	}
+	if plan.MongosCount != "" && !positiveNumber(plan.MongosCount) {
+		return errors.New("Config error: mongos count for plan " + plan.Name + " must be a positive number")
+	}
+	return nil
+}
+
+// validateMongoDBReplicaSet checks the size of the plan's replica sets.
+// Arbiters vote in elections, so data bearing members and arbiters together
+// must make an odd number of voters for a majority to always be possible.
+func validateMongoDBReplicaSet(plan Plan) error {
+	members := 1
+	if plan.ClusterReplicaSetCount != "" {
+		n, err := strconv.Atoi(plan.ClusterReplicaSetCount)
+		if err != nil || n < 1 || n > templates.MaxReplicaSetMembers {
+			return errors.New("Config error: cluster replica set count for plan " + plan.Name + " must be between 1 and " + strconv.Itoa(templates.MaxReplicaSetMembers))
+		}
+		members = n
+	}
+	arbiters := 0
+	switch plan.ArbiterCount {
+	case "", "0":
+	case "1":
+		arbiters = 1
+	default:
+		return errors.New("Config error: arbiter count for plan " + plan.Name + " must be 0 or 1")
+	}
+	if arbiters > 0 && members < 2 {
+		return errors.New("Config error: plan " + plan.Name + " needs at least two data bearing members to use an arbiter")
+	}
+	if (members+arbiters)%2 == 0 {
+		return errors.New("Config error: plan " + plan.Name + " must have an odd number of voting replica set members")
+	}
+	return nil
+}
+
+func validateVolumeEncryption(service Service, plan Plan, requireEncryption bool) error {
+	encrypted, kmsKeyId := service.VolumeEncryption(plan)
+	if kmsKeyId != "" && !encrypted {
+		return errors.New("Config error: plan " + plan.Name + " sets a KMS key but does not encrypt its volumes")
+	}
+	if requireEncryption && !encrypted {
+		return errors.New("Config error: plan " + plan.Name + " must encrypt its volumes because encryption is required")
+	}
+	return nil
+}
+
+func validateAlarms(service Service, plan Plan) error {
+	thresholds := plan.AlarmThresholds
+	if service.AlarmTopic(plan) == "" {
+		if thresholds != (AlarmThresholds{}) {
+			return errors.New("Config error: plan " + plan.Name + " sets alarm thresholds but has no alarm topic")
+		}
+		return nil
+	}
+	for _, threshold := range []struct {
+		name, value string
+		percentage  bool
+	}{
+		{"CPU utilization", thresholds.CPUUtilization, true},
+		{"burst balance", thresholds.BurstBalance, true},
+		{"disk space utilization", thresholds.DiskSpaceUtilization, true},
+		{"replication lag", thresholds.ReplicationLag, false},
+	} {
+		if threshold.value == "" {
+			continue
+		}
+		if !positiveNumber(threshold.value) {
+			return errors.New("Config error: " + threshold.name + " alarm threshold for plan " + plan.Name + " must be a positive number")
+		}
+		if n, _ := strconv.Atoi(threshold.value); threshold.percentage && n > 100 {
+			return errors.New("Config error: " + threshold.name + " alarm threshold for plan " + plan.Name + " must be a percentage")
+		}
+	}
+	return nil
+}
+
+func validateExporter(service Service, plan Plan) error {
+	if service.ExporterSecurityGroupId != "" {
+		return nil
+	}
+	if service.Exporter || (plan.Exporter != nil && *plan.Exporter) {
+		return errors.New("Config error: plan " + plan.Name + " runs mongodb_exporter but the service has no exporter security group ID")
+	}
+	return nil
+}
+
+func validateWebhook(endpoint webhooks.Endpoint) error {
+	u, err := url.Parse(endpoint.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("Config error: webhook URL " + endpoint.URL + " must be an http or https URL")
+	}
+	if endpoint.Secret == "" {
+		return errors.New("Config error: webhook " + endpoint.URL + " must have a secret to sign events with")
+	}
+	for _, eventType := range endpoint.Events {
+		switch eventType {
+		case webhooks.ProvisionSucceeded, webhooks.ProvisionFailed,
+			webhooks.UpdateSucceeded, webhooks.UpdateFailed,
+			webhooks.DeprovisionSucceeded, webhooks.DeprovisionFailed:
+		default:
+			return errors.New("Config error: webhook " + endpoint.URL + " subscribes to unknown event " + eventType)
+		}
+	}
+	return nil
+}
+
+func positiveNumber(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n > 0
+}
+
 func findServiceById(id string, catalog *Catalog) (Service, error) {
 	for _, service := range catalog.Services {
 		if service.ID == id {
@@ -114,6 +609,17 @@ func findServiceById(id string, catalog *Catalog) (Service, error) {
 	return Service{}, errors.New("could not find service with id " + id)
 }
 
+// findServiceByName returns the named service, or an empty service with
+// no plans if the catalog doesn't have it.
+func findServiceByName(name string, catalog *Catalog) Service {
+	for _, service := range catalog.Services {
+		if service.Name == name {
+			return service
+		}
+	}
+	return Service{}
+}
+
 func findPlanById(id string, service Service) (Plan, error) {
 	for _, plan := range service.Plans {
 		if plan.ID == id {
@@ -1,15 +1,27 @@
 package provider_test
 
 import (
+	"context"
 	"encoding/json"
+	"os"
+	"time"
 
 	. "github.com/henrytk/aws-service-broker/provider"
+	"github.com/henrytk/aws-service-broker/webhooks"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("Config", func() {
+	prepareAndDecode := func(raw []byte) (*Config, error) {
+		prepared, err := PrepareConfig(context.Background(), raw)
+		if err != nil {
+			return nil, err
+		}
+		return DecodeConfig(prepared)
+	}
+
 	var (
 		rawConfig json.RawMessage
 	)
@@ -139,6 +151,199 @@ var _ = Describe("Config", func() {
 		})
 	})
 
+	Describe("Sharded plans", func() {
+		decodeWithPlan := func(plan string) (*Config, error) {
+			return DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"primary_node_subnet_id": "irrelevant",
+								"secondary_0_node_subnet_id": "irrelevant",
+								"secondary_1_node_subnet_id": "irrelevant",
+								"plans": [` + plan + `]
+							}
+						]
+					}
+				}
+			`))
+		}
+
+		It("decodes the shard and mongos counts", func() {
+			config, err := decodeWithPlan(`{"id": "1", "name": "sharded", "shard_count": "2", "mongos_count": "3"}`)
+			Expect(err).NotTo(HaveOccurred())
+			plan := config.Catalog.Services[0].Plans[0]
+			Expect(plan.ShardCount).To(Equal("2"))
+			Expect(plan.MongosCount).To(Equal("3"))
+		})
+
+		It("returns an error if the shard count is not a positive number", func() {
+			_, err := decodeWithPlan(`{"id": "1", "name": "sharded", "shard_count": "0"}`)
+			Expect(err).To(MatchError("Config error: shard count for plan sharded must be a positive number"))
+		})
+
+		It("returns an error if the mongos count is not a positive number", func() {
+			_, err := decodeWithPlan(`{"id": "1", "name": "sharded", "shard_count": "2", "mongos_count": "none"}`)
+			Expect(err).To(MatchError("Config error: mongos count for plan sharded must be a positive number"))
+		})
+
+		It("returns an error if a mongos count is given for a replica set", func() {
+			_, err := decodeWithPlan(`{"id": "1", "name": "basic", "mongos_count": "2"}`)
+			Expect(err).To(MatchError("Config error: plan basic sets a mongos count but is not sharded"))
+		})
+	})
+
+	Describe("Replica set sizes", func() {
+		decodeWithPlan := func(plan string) (*Config, error) {
+			return DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["subnet-a", "subnet-b"],
+								"plans": [` + plan + `]
+							}
+						]
+					}
+				}
+			`))
+		}
+
+		It("accepts up to seven data bearing members", func() {
+			config, err := decodeWithPlan(`{"id": "1", "name": "large", "cluster_replica_set_count": "7"}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Catalog.Services[0].Subnets()).To(Equal([]string{"subnet-a", "subnet-b"}))
+		})
+
+		It("accepts two data bearing members and an arbiter", func() {
+			config, err := decodeWithPlan(`{"id": "1", "name": "arbitered", "cluster_replica_set_count": "2", "arbiter_count": "1"}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Catalog.Services[0].Plans[0].ArbiterCount).To(Equal("1"))
+		})
+
+		It("returns an error if the replica set count is out of range", func() {
+			_, err := decodeWithPlan(`{"id": "1", "name": "huge", "cluster_replica_set_count": "9"}`)
+			Expect(err).To(MatchError("Config error: cluster replica set count for plan huge must be between 1 and 7"))
+		})
+
+		It("returns an error if the arbiter count is not 0 or 1", func() {
+			_, err := decodeWithPlan(`{"id": "1", "name": "arbitered", "cluster_replica_set_count": "3", "arbiter_count": "2"}`)
+			Expect(err).To(MatchError("Config error: arbiter count for plan arbitered must be 0 or 1"))
+		})
+
+		It("returns an error if an arbiter is added to a single member", func() {
+			_, err := decodeWithPlan(`{"id": "1", "name": "arbitered", "cluster_replica_set_count": "1", "arbiter_count": "1"}`)
+			Expect(err).To(MatchError("Config error: plan arbitered needs at least two data bearing members to use an arbiter"))
+		})
+
+		It("returns an error if there is an even number of voting members", func() {
+			_, err := decodeWithPlan(`{"id": "1", "name": "even", "cluster_replica_set_count": "3", "arbiter_count": "1"}`)
+			Expect(err).To(MatchError("Config error: plan even must have an odd number of voting replica set members"))
+		})
+
+		It("returns an error if the subnet list contains an empty subnet", func() {
+			_, err := DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["subnet-a", ""],
+								"plans": [{"id": "1", "name": "basic"}]
+							}
+						]
+					}
+				}
+			`))
+			Expect(err).To(MatchError("Config error: node subnet IDs must not be empty"))
+		})
+	})
+
+	Describe("Volume encryption", func() {
+		decodeWithEncryption := func(requireEncryption, service, plan string) (*Config, error) {
+			return DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"require_encryption": ` + requireEncryption + `,
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"primary_node_subnet_id": "irrelevant",
+								"secondary_0_node_subnet_id": "irrelevant",
+								"secondary_1_node_subnet_id": "irrelevant",
+								` + service + `
+								"plans": [` + plan + `]
+							}
+						]
+					}
+				}
+			`))
+		}
+
+		It("applies the service's encryption settings to its plans", func() {
+			config, err := decodeWithEncryption("false", `"encrypted": true, "kms_key_id": "service-key",`, `{"id": "1", "name": "basic"}`)
+			Expect(err).NotTo(HaveOccurred())
+			service := config.Catalog.Services[0]
+			encrypted, kmsKeyId := service.VolumeEncryption(service.Plans[0])
+			Expect(encrypted).To(BeTrue())
+			Expect(kmsKeyId).To(Equal("service-key"))
+		})
+
+		It("lets plans override the service's encryption settings", func() {
+			config, err := decodeWithEncryption("false", `"encrypted": true, "kms_key_id": "service-key",`, `{"id": "1", "name": "basic", "kms_key_id": "plan-key"}`)
+			Expect(err).NotTo(HaveOccurred())
+			service := config.Catalog.Services[0]
+			encrypted, kmsKeyId := service.VolumeEncryption(service.Plans[0])
+			Expect(encrypted).To(BeTrue())
+			Expect(kmsKeyId).To(Equal("plan-key"))
+		})
+
+		It("lets plans opt out of the service's encryption", func() {
+			config, err := decodeWithEncryption("false", `"encrypted": true,`, `{"id": "1", "name": "plain", "encrypted": false}`)
+			Expect(err).NotTo(HaveOccurred())
+			service := config.Catalog.Services[0]
+			encrypted, _ := service.VolumeEncryption(service.Plans[0])
+			Expect(encrypted).To(BeFalse())
+		})
+
+		It("returns an error if a plan sets a KMS key without encryption", func() {
+			_, err := decodeWithEncryption("false", "", `{"id": "1", "name": "basic", "kms_key_id": "plan-key"}`)
+			Expect(err).To(MatchError("Config error: plan basic sets a KMS key but does not encrypt its volumes"))
+		})
+
+		It("returns an error if encryption is required and a plan is unencrypted", func() {
+			_, err := decodeWithEncryption("true", "", `{"id": "1", "name": "encrypted", "encrypted": true}, {"id": "2", "name": "basic"}`)
+			Expect(err).To(MatchError("Config error: plan basic must encrypt its volumes because encryption is required"))
+		})
+
+		It("accepts unencrypted plans when encryption is not required", func() {
+			_, err := decodeWithEncryption("false", "", `{"id": "1", "name": "basic"}`)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
 	Describe("Mandatory parameters", func() {
 		It("returns an error if secret is empty", func() {
 			rawConfig = json.RawMessage(`
@@ -324,4 +529,701 @@ var _ = Describe("Config", func() {
 			Expect(err).To(MatchError("Config error: must provide secondary 1 node subnet ID"))
 		})
 	})
+
+	Describe("Alarms", func() {
+		decodeWithAlarms := func(service, plan string) (*Config, error) {
+			return DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"primary_node_subnet_id": "irrelevant",
+								"secondary_0_node_subnet_id": "irrelevant",
+								"secondary_1_node_subnet_id": "irrelevant",
+								` + service + `
+								"plans": [` + plan + `]
+							}
+						]
+					}
+				}
+			`))
+		}
+
+		It("decodes the plan's alarm thresholds and takes the service's topic", func() {
+			config, err := decodeWithAlarms(`"alarm_topic_arn": "service-topic",`, `{"id": "1", "name": "basic", "alarm_thresholds": {"cpu_utilization": "90", "burst_balance": "10", "disk_space_utilization": "75", "replication_lag": "120"}}`)
+			Expect(err).NotTo(HaveOccurred())
+			service := config.Catalog.Services[0]
+			plan := service.Plans[0]
+			Expect(service.AlarmTopic(plan)).To(Equal("service-topic"))
+			Expect(plan.AlarmThresholds).To(Equal(AlarmThresholds{
+				CPUUtilization:       "90",
+				BurstBalance:         "10",
+				DiskSpaceUtilization: "75",
+				ReplicationLag:       "120",
+			}))
+		})
+
+		It("lets plans notify their own topic", func() {
+			config, err := decodeWithAlarms(`"alarm_topic_arn": "service-topic",`, `{"id": "1", "name": "basic", "alarm_topic_arn": "plan-topic"}`)
+			Expect(err).NotTo(HaveOccurred())
+			service := config.Catalog.Services[0]
+			Expect(service.AlarmTopic(service.Plans[0])).To(Equal("plan-topic"))
+		})
+
+		It("returns an error if a plan sets thresholds without an alarm topic", func() {
+			_, err := decodeWithAlarms("", `{"id": "1", "name": "basic", "alarm_thresholds": {"cpu_utilization": "90"}}`)
+			Expect(err).To(MatchError("Config error: plan basic sets alarm thresholds but has no alarm topic"))
+		})
+
+		It("returns an error if a threshold is not a positive number", func() {
+			_, err := decodeWithAlarms(`"alarm_topic_arn": "service-topic",`, `{"id": "1", "name": "basic", "alarm_thresholds": {"replication_lag": "soon"}}`)
+			Expect(err).To(MatchError("Config error: replication lag alarm threshold for plan basic must be a positive number"))
+		})
+
+		It("returns an error if a percentage threshold is over 100", func() {
+			_, err := decodeWithAlarms(`"alarm_topic_arn": "service-topic",`, `{"id": "1", "name": "basic", "alarm_thresholds": {"disk_space_utilization": "101"}}`)
+			Expect(err).To(MatchError("Config error: disk space utilization alarm threshold for plan basic must be a percentage"))
+		})
+	})
+
+	Describe("mongodb_exporter", func() {
+		decodeWithExporter := func(service, plan string) (*Config, error) {
+			return DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"primary_node_subnet_id": "irrelevant",
+								"secondary_0_node_subnet_id": "irrelevant",
+								"secondary_1_node_subnet_id": "irrelevant",
+								` + service + `
+								"plans": [` + plan + `]
+							}
+						]
+					}
+				}
+			`))
+		}
+
+		It("runs the exporter on the service's plans, scraped from its security group", func() {
+			config, err := decodeWithExporter(`"mongodb_exporter": true, "exporter_security_group_id": "sg-prometheus",`, `{"id": "1", "name": "basic"}`)
+			Expect(err).NotTo(HaveOccurred())
+			service := config.Catalog.Services[0]
+			Expect(service.ExporterSecurityGroup(service.Plans[0])).To(Equal("sg-prometheus"))
+		})
+
+		It("lets plans opt in and out of the exporter", func() {
+			config, err := decodeWithExporter(`"exporter_security_group_id": "sg-prometheus",`, `{"id": "1", "name": "basic"}, {"id": "2", "name": "monitored", "mongodb_exporter": true}`)
+			Expect(err).NotTo(HaveOccurred())
+			service := config.Catalog.Services[0]
+			Expect(service.ExporterSecurityGroup(service.Plans[0])).To(BeEmpty())
+			Expect(service.ExporterSecurityGroup(service.Plans[1])).To(Equal("sg-prometheus"))
+
+			config, err = decodeWithExporter(`"mongodb_exporter": true, "exporter_security_group_id": "sg-prometheus",`, `{"id": "1", "name": "basic", "mongodb_exporter": false}`)
+			Expect(err).NotTo(HaveOccurred())
+			service = config.Catalog.Services[0]
+			Expect(service.ExporterSecurityGroup(service.Plans[0])).To(BeEmpty())
+		})
+
+		It("returns an error if a plan runs the exporter without a security group", func() {
+			_, err := decodeWithExporter("", `{"id": "1", "name": "basic", "mongodb_exporter": true}`)
+			Expect(err).To(MatchError("Config error: plan basic runs mongodb_exporter but the service has no exporter security group ID"))
+		})
+	})
+
+	Describe("Stack status refresh interval", func() {
+		decodeWithInterval := func(interval string) (*Config, error) {
+			return DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					` + interval + `
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"plans": [{"id": "1", "name": "basic"}]
+							}
+						]
+					}
+				}
+			`))
+		}
+
+		It("defaults to refreshing every ten seconds", func() {
+			config, err := decodeWithInterval("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.StackStatusInterval()).To(Equal(10 * time.Second))
+		})
+
+		It("decodes the interval", func() {
+			config, err := decodeWithInterval(`"stack_status_refresh_interval": "1m30s",`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.StackStatusInterval()).To(Equal(90 * time.Second))
+		})
+
+		It("can turn the cache off", func() {
+			config, err := decodeWithInterval(`"stack_status_refresh_interval": "0s",`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.StackStatusInterval()).To(BeZero())
+		})
+
+		It("returns an error if the interval is not a duration", func() {
+			_, err := decodeWithInterval(`"stack_status_refresh_interval": "10",`)
+			Expect(err).To(MatchError("Config error: stack status refresh interval must be a duration such as 10s"))
+		})
+
+		It("decodes stack events", func() {
+			config, err := decodeWithInterval(`"stack_events": {"topic_arn": "arn:aws:sns:eu-west-1:123456789012:stack-events", "queue_url": "https://sqs.eu-west-1.amazonaws.com/123456789012/stack-events"},`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.StackEvents).To(Equal(StackEvents{
+				TopicArn: "arn:aws:sns:eu-west-1:123456789012:stack-events",
+				QueueURL: "https://sqs.eu-west-1.amazonaws.com/123456789012/stack-events",
+			}))
+		})
+
+		It("returns an error if stack events have no queue", func() {
+			_, err := decodeWithInterval(`"stack_events": {"topic_arn": "arn:aws:sns:eu-west-1:123456789012:stack-events"},`)
+			Expect(err).To(MatchError("Config error: stack events need both a topic ARN and a queue URL"))
+		})
+
+		It("returns an error if stack events are used without the cache", func() {
+			_, err := decodeWithInterval(`"stack_status_refresh_interval": "0s", "stack_events": {"topic_arn": "arn", "queue_url": "url"},`)
+			Expect(err).To(MatchError("Config error: stack events need the stack status cache, which a zero refresh interval turns off"))
+		})
+	})
+
+	Describe("Webhooks", func() {
+		decodeWithWebhooks := func(webhooks string) (*Config, error) {
+			return DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"webhooks": ` + webhooks + `,
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"plans": [{"id": "1", "name": "basic"}]
+							}
+						]
+					}
+				}
+			`))
+		}
+
+		It("decodes webhook endpoints", func() {
+			config, err := decodeWithWebhooks(`[{"url": "https://example.com/hooks", "secret": "hunter2", "events": ["provision.failed"]}]`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Webhooks).To(Equal([]webhooks.Endpoint{{
+				URL:    "https://example.com/hooks",
+				Secret: "hunter2",
+				Events: []string{webhooks.ProvisionFailed},
+			}}))
+		})
+
+		It("returns an error if a webhook URL is not an http URL", func() {
+			_, err := decodeWithWebhooks(`[{"url": "example.com/hooks", "secret": "hunter2"}]`)
+			Expect(err).To(MatchError("Config error: webhook URL example.com/hooks must be an http or https URL"))
+		})
+
+		It("returns an error if a webhook has no secret", func() {
+			_, err := decodeWithWebhooks(`[{"url": "https://example.com/hooks"}]`)
+			Expect(err).To(MatchError("Config error: webhook https://example.com/hooks must have a secret to sign events with"))
+		})
+
+		It("returns an error if a webhook subscribes to an unknown event", func() {
+			_, err := decodeWithWebhooks(`[{"url": "https://example.com/hooks", "secret": "hunter2", "events": ["bind.succeeded"]}]`)
+			Expect(err).To(MatchError("Config error: webhook https://example.com/hooks subscribes to unknown event bind.succeeded"))
+		})
+	})
+
+	Describe("Admin API", func() {
+		It("returns an error if admin credentials have no password", func() {
+			_, err := DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"admin": {"username": "operator"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"plans": [{"id": "1", "name": "basic"}]
+							}
+						]
+					}
+				}
+			`))
+			Expect(err).To(MatchError("Config error: admin API needs both a username and a password"))
+		})
+	})
+
+	Describe("Preflight", func() {
+		It("returns an error if the recheck interval isn't a duration", func() {
+			_, err := DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"preflight": {"on_startup": true, "interval": "often"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"plans": [{"id": "1", "name": "basic"}]
+							}
+						]
+					}
+				}
+			`))
+			Expect(err).To(MatchError("Config error: preflight interval must be a duration such as 5m"))
+		})
+
+		It("is only enabled when it runs on startup or has an interval", func() {
+			Expect(Preflight{}.Enabled()).To(BeFalse())
+			Expect(Preflight{OnStartup: true}.Enabled()).To(BeTrue())
+			Expect(Preflight{Interval: "5m"}.Enabled()).To(BeTrue())
+			Expect(Preflight{Interval: "5m"}.RecheckInterval()).To(Equal(5 * time.Minute))
+		})
+	})
+
+	Describe("Server", func() {
+		It("returns an error if TLS has a certificate but no key", func() {
+			_, err := DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"tls": {"cert_file": "/etc/broker/cert.pem"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"plans": [{"id": "1", "name": "basic"}]
+							}
+						]
+					}
+				}
+			`))
+			Expect(err).To(MatchError("Config error: TLS needs both a certificate file and a key file"))
+		})
+
+		It("returns an error if a timeout isn't a positive duration", func() {
+			_, err := DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"timeouts": {"read": "10s", "shutdown": "0s"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"plans": [{"id": "1", "name": "basic"}]
+							}
+						]
+					}
+				}
+			`))
+			Expect(err).To(MatchError("Config error: shutdown timeout must be a positive duration such as 30s"))
+		})
+
+		It("returns an error if client certificates are required without TLS", func() {
+			_, err := DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"client_certificates": {"ca_file": "/etc/broker/ca.pem", "allowed_subjects": ["cloud-controller"]},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"plans": [{"id": "1", "name": "basic"}]
+							}
+						]
+					}
+				}
+			`))
+			Expect(err).To(MatchError("Config error: client certificates need the API to be served over TLS"))
+		})
+
+		It("returns an error if credentials have a password rather than its hash", func() {
+			_, err := DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"credentials": [{"username": "platform", "password_hash": "plaintext"}],
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"plans": [{"id": "1", "name": "basic"}]
+							}
+						]
+					}
+				}
+			`))
+			Expect(err).To(MatchError("Config error: password hash of platform is not a bcrypt hash"))
+		})
+
+		It("accepts bcrypt hashed credentials", func() {
+			_, err := DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"credentials": [{"username": "platform", "password_hash": "$2a$04$S0ORV3OxuZMNNPho3./FY.74cPEitez6eRt9kzVV/SCkWtSoB/Vui"}],
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"plans": [{"id": "1", "name": "basic"}]
+							}
+						]
+					}
+				}
+			`))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("defaults the timeouts that aren't set", func() {
+			timeouts := Timeouts{Write: "5m"}
+			Expect(timeouts.ReadTimeout()).To(Equal(DefaultReadTimeout))
+			Expect(timeouts.WriteTimeout()).To(Equal(5 * time.Minute))
+			Expect(timeouts.IdleTimeout()).To(Equal(DefaultIdleTimeout))
+			Expect(timeouts.ShutdownTimeout()).To(Equal(DefaultShutdownTimeout))
+		})
+	})
+
+	Describe("Secret references", func() {
+		BeforeEach(func() {
+			os.Setenv("CONFIG_TEST_SECRET", "half-centaur")
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("CONFIG_TEST_SECRET")
+		})
+
+		config := func(secret string) json.RawMessage {
+			return json.RawMessage(`
+				{
+					"secret": "` + secret + `",
+					"aws_config": {"region": "eu-west-1"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"plans": [{"id": "1", "name": "basic"}]
+							}
+						]
+					}
+				}
+			`)
+		}
+
+		It("resolves them before validating", func() {
+			config, err := prepareAndDecode(config("${env:CONFIG_TEST_SECRET}"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Secret).To(Equal("half-centaur"))
+		})
+
+		It("returns an error naming the field that failed to resolve", func() {
+			_, err := prepareAndDecode(config("${env:CONFIG_TEST_UNSET}"))
+			Expect(err).To(MatchError("Config error: could not resolve secret: ${env:CONFIG_TEST_UNSET}: environment variable is not set"))
+		})
+
+		It("resolves them once, keeping secrets that look like references", func() {
+			os.Setenv("CONFIG_TEST_SECRET", "half-${env:CONFIG_TEST_UNSET}-centaur")
+			config, err := prepareAndDecode(config("${env:CONFIG_TEST_SECRET}"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Secret).To(Equal("half-${env:CONFIG_TEST_UNSET}-centaur"))
+		})
+	})
+
+	Describe("Plan expansion", func() {
+		config := func(plans string) json.RawMessage {
+			return json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"alarm_topic_arn": "service-topic",
+								"plans": [` + plans + `]
+							}
+						]
+					}
+				}
+			`)
+		}
+
+		It("lets plans extend other plans", func() {
+			config, err := prepareAndDecode(config(`
+				{"id": "1", "name": "small", "description": "Small", "node_instance_type": "m4.large", "cluster_replica_set_count": "3",
+				 "alarm_thresholds": {"cpu_utilization": "75", "replication_lag": "30"}, "metadata": {"displayName": "Small", "bullets": ["Small"]}},
+				{"id": "2", "name": "large", "extends": "small", "node_instance_type": "m4.xlarge", "alarm_thresholds": {"cpu_utilization": "90"}},
+				{"id": "3", "name": "larger", "extends": "2", "volume_size": "800"}
+			`))
+			Expect(err).NotTo(HaveOccurred())
+			plans := config.Catalog.Services[0].Plans
+			Expect(plans[1].ID).To(Equal("2"))
+			Expect(plans[1].Name).To(Equal("large"))
+			Expect(plans[1].NodeInstanceType).To(Equal("m4.xlarge"))
+			Expect(plans[1].ClusterReplicaSetCount).To(Equal("3"))
+			Expect(plans[1].AlarmThresholds).To(Equal(AlarmThresholds{CPUUtilization: "90", ReplicationLag: "30"}))
+			Expect(plans[1].Description).To(Equal("3 replicas. Disk: 400GiB gp2. Instance: m4.xlarge"))
+			Expect(plans[1].Metadata.DisplayName).To(BeEmpty())
+			Expect(plans[2].NodeInstanceType).To(Equal("m4.xlarge"))
+			Expect(plans[2].VolumeSize).To(Equal("800"))
+		})
+
+		It("returns an error if a plan extends an unknown plan", func() {
+			_, err := prepareAndDecode(config(`{"id": "1", "name": "small", "extends": "tiny"}`))
+			Expect(err).To(MatchError("Config error: plan small extends unknown plan tiny"))
+		})
+
+		It("returns an error if plans extend each other in a cycle", func() {
+			_, err := prepareAndDecode(config(`
+				{"id": "1", "name": "small", "extends": "large"},
+				{"id": "2", "name": "large", "extends": "small"}
+			`))
+			Expect(err).To(MatchError("Config error: plans extend each other in a cycle: small, large, small"))
+		})
+
+		It("converts values with units", func() {
+			config, err := prepareAndDecode(config(`
+				{"id": "1", "name": "small", "volume_size": "1TiB", "volume_type": "io1", "iops": 1000, "cluster_replica_set_count": 3,
+				 "alarm_thresholds": {"cpu_utilization": "75%", "disk_space_utilization": 90, "replication_lag": "2m"}},
+				{"id": "2", "name": "large", "volume_size": "400GiB"}
+			`))
+			Expect(err).NotTo(HaveOccurred())
+			plans := config.Catalog.Services[0].Plans
+			Expect(plans[0].VolumeSize).To(Equal("1024"))
+			Expect(plans[0].Iops).To(Equal("1000"))
+			Expect(plans[0].ClusterReplicaSetCount).To(Equal("3"))
+			Expect(plans[0].AlarmThresholds).To(Equal(AlarmThresholds{
+				CPUUtilization:       "75",
+				DiskSpaceUtilization: "90",
+				ReplicationLag:       "120",
+			}))
+			Expect(plans[1].VolumeSize).To(Equal("400"))
+			Expect(plans[0].Description).To(Equal("3 replicas. Disk: 1TiB io1 with 1000 IOPS. Instance: m4.large"))
+		})
+
+		It("returns an error for a volume size without a known unit", func() {
+			_, err := prepareAndDecode(config(`{"id": "1", "name": "small", "volume_size": "400GB"}`))
+			Expect(err).To(MatchError("Config error: plan small: volume_size must be a size in GiB or TiB, such as 400GiB"))
+		})
+
+		It("returns an error for counts that aren't whole numbers", func() {
+			_, err := prepareAndDecode(config(`{"id": "1", "name": "small", "shard_count": 1.5}`))
+			Expect(err).To(MatchError("Config error: plan small: shard_count must be a whole number"))
+		})
+
+		It("returns an error for an unquoted MongoDB version", func() {
+			_, err := prepareAndDecode(config(`{"id": "1", "name": "small", "mongodb_version": 3.4}`))
+			Expect(err).To(MatchError(`Config error: plan small: mongodb_version must be quoted, such as "3.4", so that it keeps its trailing zeros`))
+		})
+
+		It("generates the descriptions and bullets plans don't have", func() {
+			config, err := prepareAndDecode(config(`
+				{"id": "1", "name": "small"},
+				{"id": "2", "name": "sharded", "shard_count": "2", "cluster_replica_set_count": "3", "tls": true, "encrypted": true},
+				{"id": "3", "name": "arbitered", "cluster_replica_set_count": "2", "arbiter_count": "1", "volume_type": "io1", "iops": "1000"},
+				{"id": "4", "name": "described", "description": "Described", "metadata": {"bullets": ["Described"]}}
+			`))
+			Expect(err).NotTo(HaveOccurred())
+			plans := config.Catalog.Services[0].Plans
+			Expect(plans[0].Description).To(Equal("No replicas. Disk: 400GiB gp2. Instance: m4.large"))
+			Expect(plans[0].Metadata.Bullets).To(Equal([]string{
+				"MongoDB 3.4",
+				"No replicas",
+				"400GiB gp2 volumes",
+				"m4.large instances",
+				"CloudWatch alarms",
+			}))
+			Expect(plans[1].Description).To(Equal("2 shards of 3 replicas, 2 mongos routers requiring TLS with encrypted volumes. Disk: 400GiB gp2. Instance: m4.large"))
+			Expect(plans[2].Description).To(Equal("2 replicas and an arbiter. Disk: 400GiB io1 with 1000 IOPS. Instance: m4.large"))
+			Expect(plans[3].Description).To(Equal("Described"))
+			Expect(plans[3].Metadata.Bullets).To(Equal([]string{"Described"}))
+		})
+
+		It("leaves expanded configs as they are", func() {
+			expanded, err := ExpandPlans(config(`{"id": "1", "name": "small"}, {"id": "2", "name": "large", "extends": "small", "volume_size": "1TiB"}`))
+			Expect(err).NotTo(HaveOccurred())
+			expandedAgain, err := ExpandPlans(expanded)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(expandedAgain).To(MatchJSON(expanded))
+		})
+	})
+
+	Describe("YAML", func() {
+		It("converts YAML configs to JSON", func() {
+			converted, err := ConvertYAML([]byte(`
+secret: ${env:SECRET}
+aws_config:
+  region: eu-west-1
+catalog:
+  services:
+  - name: mongodb
+    plans:
+    - id: "1"
+      name: small
+      volume_size: 400GiB
+      iops: 1000
+      tls: true
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(converted).To(MatchJSON(`{
+				"secret": "${env:SECRET}",
+				"aws_config": {"region": "eu-west-1"},
+				"catalog": {
+					"services": [{
+						"name": "mongodb",
+						"plans": [{"id": "1", "name": "small", "volume_size": "400GiB", "iops": 1000, "tls": true}]
+					}]
+				}
+			}`))
+		})
+
+		It("returns an error for keys that aren't strings", func() {
+			_, err := ConvertYAML([]byte("1: one\n"))
+			Expect(err).To(MatchError("key 1 is not a string"))
+		})
+	})
+
+	Describe("Plan updates", func() {
+		config := func(updates string) json.RawMessage {
+			return json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"plans": [
+									{"id": "1", "name": "small", "updates": ` + updates + `},
+									{"id": "2", "name": "large"}
+								]
+							}
+						]
+					}
+				}
+			`)
+		}
+
+		It("accepts plans declared by ID or name", func() {
+			config, err := DecodeConfig(config(`{"to": ["2", "large"], "mutable": ["node_instance_type", "volume_size"]}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Catalog.Services[0].Plans[0].Updates).To(Equal(&PlanUpdates{
+				To:      []string{"2", "large"},
+				Mutable: []string{"node_instance_type", "volume_size"},
+			}))
+		})
+
+		It("returns an error if a plan can be updated to an unknown plan", func() {
+			_, err := DecodeConfig(config(`{"to": ["huge"]}`))
+			Expect(err).To(MatchError("Config error: plan small can be updated to unknown plan huge"))
+		})
+
+		It("returns an error if a plan declares an unknown mutable field", func() {
+			_, err := DecodeConfig(config(`{"mutable": ["colour"]}`))
+			Expect(err).To(MatchError(HavePrefix("Config error: plan small declares unknown mutable field colour, expected one of mongodb_admin_username, ")))
+		})
+
+		It("returns an error if a plan declares volume encryption mutable", func() {
+			_, err := DecodeConfig(config(`{"mutable": ["kms_key_id"]}`))
+			Expect(err).To(MatchError("Config error: plan small declares kms_key_id mutable, but it can't be updated"))
+		})
+	})
+
+	Describe("Plan parameters", func() {
+		It("lists every plan parameter the stack template doesn't allow", func() {
+			_, err := DecodeConfig(json.RawMessage(`
+				{
+					"secret": "half-centaur",
+					"aws_config": {"region": "eu-west-1"},
+					"catalog": {
+						"services": [
+							{
+								"name": "mongodb",
+								"bastion_security_group_id": "irrelevant",
+								"key_pair_name": "key_pair_name",
+								"vpc_id": "irrelevant",
+								"node_subnet_ids": ["irrelevant"],
+								"plans": [
+									{"id": "1", "name": "basic", "volume_type": "gp3"},
+									{"id": "2", "name": "old", "mongodb_version": "2.6", "mongodb_admin_username": "1admin"}
+								]
+							}
+						]
+					}
+				}
+			`))
+			Expect(err).To(MatchError("Config error: plans break the constraints of the stack template:\n" +
+				"  plan basic: parameter VolumeType value gp3 must be one of gp2, io1\n" +
+				"  plan old: parameter MongoDBAdminUsername value 1admin must match the pattern [a-zA-Z][a-zA-Z0-9]*\n" +
+				"  plan old: parameter MongoDBVersion value 2.6 must be one of 3.4, 3.2"))
+		})
+	})
 })
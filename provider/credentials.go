@@ -0,0 +1,77 @@
+package provider
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+)
+
+const mongoDBPort = "27017"
+
+type MongoDBCredentials struct {
+	Hosts         []string `json:"hosts"`
+	Port          string   `json:"port"`
+	Username      string   `json:"username"`
+	Password      string   `json:"password"`
+	ReplicaSet    string   `json:"replica_set,omitempty"`
+	URI           string   `json:"uri"`
+	CACertificate string   `json:"ca_certificate,omitempty"`
+}
+
+// buildMongoDBCredentials works out the hosts to connect to from the cluster.
+// Sharded clusters are reached through their mongos nodes, replica sets
+// through their data bearing members. Clients of TLS plans are given the
+// certificate of the instance's certificate authority to verify the nodes.
+func buildMongoDBCredentials(cluster mongodb.Cluster, plan Plan, password string) (MongoDBCredentials, error) {
+	credentials := MongoDBCredentials{
+		Port:     mongoDBPort,
+		Username: plan.MongoDBAdminUsername,
+		Password: password,
+	}
+	if credentials.Username == "" {
+		credentials.Username = "admin"
+	}
+
+	for _, member := range cluster.DataMembers() {
+		credentials.Hosts = append(credentials.Hosts, member.Ip)
+	}
+	if !cluster.Sharded {
+		credentials.ReplicaSet = "s0"
+		if plan.ReplicaShardIndex != "" {
+			credentials.ReplicaSet = "s" + plan.ReplicaShardIndex
+		}
+	}
+	if len(credentials.Hosts) == 0 {
+		return MongoDBCredentials{}, errors.New("could not find any MongoDB hosts in the stack outputs")
+	}
+	if plan.TLS {
+		if cluster.CACertificate == "" {
+			return MongoDBCredentials{}, errors.New("could not find the MongoDB CA certificate in the stack outputs")
+		}
+		credentials.CACertificate = cluster.CACertificate
+	}
+
+	var hostPorts []string
+	for _, host := range credentials.Hosts {
+		hostPorts = append(hostPorts, host+":"+credentials.Port)
+	}
+	uri := url.URL{
+		Scheme: "mongodb",
+		User:   url.UserPassword(credentials.Username, credentials.Password),
+		Host:   strings.Join(hostPorts, ","),
+		Path:   "/admin",
+	}
+	query := url.Values{}
+	if credentials.ReplicaSet != "" {
+		query.Set("replicaSet", credentials.ReplicaSet)
+	}
+	if plan.TLS {
+		query.Set("tls", "true")
+	}
+	uri.RawQuery = query.Encode()
+	credentials.URI = uri.String()
+
+	return credentials, nil
+}
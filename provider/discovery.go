@@ -0,0 +1,63 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+)
+
+// TargetGroup is a group of Prometheus scrape targets sharing their labels,
+// in the format of Prometheus HTTP service discovery.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// ServiceDiscovery lists a scrape target for every node of every instance
+// running mongodb_exporter, labelled with the instance, its plan and the
+// organization and space it was provisioned in. Instances provisioned
+// before their stacks were tagged have no plan, organization or space.
+func (ap *AWSProvider) ServiceDiscovery(ctx context.Context) ([]TargetGroup, error) {
+	instances, err := ap.MongoDBService.DiscoverExporters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	targetGroups := []TargetGroup{}
+	for _, instance := range instances {
+		planName := ""
+		if plan, err := ap.findPlanByIdInService("mongodb", instance.Tags[mongodb.PlanIDTag]); err == nil {
+			planName = plan.Name
+		}
+		for _, member := range instance.Cluster.Members {
+			targetGroups = append(targetGroups, TargetGroup{
+				Targets: []string{net.JoinHostPort(member.Ip, instance.ExporterPort)},
+				Labels: map[string]string{
+					"service":           "mongodb",
+					"instance_guid":     instance.ID,
+					"plan":              planName,
+					"organization_guid": instance.Tags[mongodb.OrganizationGUIDTag],
+					"space_guid":        instance.Tags[mongodb.SpaceGUIDTag],
+					"node":              member.Name,
+					"role":              member.Role,
+				},
+			})
+		}
+	}
+	return targetGroups, nil
+}
+
+// findPlanByIdInService looks up a plan of the service with the given name.
+func (ap *AWSProvider) findPlanByIdInService(serviceName, planID string) (Plan, error) {
+	for _, service := range ap.CurrentConfig().Catalog.Services {
+		if service.Name != serviceName {
+			continue
+		}
+		if plan, err := findPlanById(planID, service); err == nil {
+			return plan, nil
+		}
+	}
+	return Plan{}, errors.New("could not find plan with id " + planID)
+}
@@ -0,0 +1,61 @@
+package provider
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscf "github.com/aws/aws-sdk-go/service/cloudformation"
+	awssts "github.com/aws/aws-sdk-go/service/sts"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation"
+	"github.com/henrytk/aws-service-broker/health"
+)
+
+// ReadinessChecks are the conditions of the broker being able to serve
+// requests: its AWS credentials work, CloudFormation, where the broker
+// keeps the state of its instances, answers, and its background workers
+// and preflight checks are passing.
+func (ap *AWSProvider) ReadinessChecks() []health.Check {
+	checks := []health.Check{
+		{Name: "aws credentials", Run: ap.checkCredentials},
+		{Name: "cloudformation", Run: ap.checkCloudFormation},
+	}
+	if ap.stackStatusesWorker != nil {
+		checks = append(checks, health.Check{Name: "stack statuses worker", Run: ap.stackStatusesWorker.Check})
+	}
+	if ap.stackEventsWorker != nil {
+		checks = append(checks, health.Check{Name: "stack events worker", Run: ap.stackEventsWorker.Check})
+	}
+	if ap.Preflight != nil {
+		checks = append(checks, health.Check{Name: "preflight", Run: ap.checkPreflight})
+	}
+	return checks
+}
+
+func (ap *AWSProvider) checkCredentials(ctx context.Context) error {
+	_, err := ap.STS.GetCallerIdentityWithContext(ctx, &awssts.GetCallerIdentityInput{})
+	return err
+}
+
+func (ap *AWSProvider) checkCloudFormation(ctx context.Context) error {
+	// An open circuit already tells that CloudFormation isn't answering,
+	// without waiting for the cooldown.
+	if client, ok := ap.MongoDBService.Client.(*cloudformation.Client); ok && client.CircuitOpen() {
+		return cloudformation.ErrCircuitOpen
+	}
+	_, err := ap.MongoDBService.Client.ListStacksWithContext(ctx, &awscf.ListStacksInput{
+		StackStatusFilter: aws.StringSlice([]string{awscf.StackStatusCreateInProgress}),
+	})
+	return err
+}
+
+func (ap *AWSProvider) checkPreflight(ctx context.Context) error {
+	report, checked := ap.Preflight.Report()
+	if !checked {
+		return errors.New("preflight checks haven't run yet")
+	}
+	if !report.OK {
+		return errors.New(report.Failures())
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+)
+
+// ExpandPlans resolves the plans of a raw config into the form the broker
+// reads them in:
+//
+//   - plans that extend another plan of their service take the fields they
+//     don't set from it, except its ID, name and description
+//   - values with units, such as a volume_size of 400GiB, and numbers are
+//     converted to the strings the stack parameters take
+//   - plans without a description or metadata bullets have them generated
+//     from their parameters
+//
+// Expanding a config that is already expanded leaves it as it is.
+func ExpandPlans(raw []byte) ([]byte, error) {
+	var config map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	catalog, _ := config["catalog"].(map[string]interface{})
+	services, _ := catalog["services"].([]interface{})
+	for _, s := range services {
+		service, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		plans, err := expandPlans(service)
+		if err != nil {
+			return nil, err
+		}
+		service["plans"] = plans
+	}
+	return json.Marshal(config)
+}
+
+func expandPlans(service map[string]interface{}) ([]interface{}, error) {
+	rawPlans, _ := service["plans"].([]interface{})
+	var plans []map[string]interface{}
+	for _, p := range rawPlans {
+		plan, ok := p.(map[string]interface{})
+		if !ok {
+			return rawPlans, nil
+		}
+		plans = append(plans, plan)
+	}
+	if err := extendPlans(plans); err != nil {
+		return nil, err
+	}
+
+	expanded := make([]interface{}, len(plans))
+	for i, plan := range plans {
+		if err := convertUnits(plan); err != nil {
+			return nil, err
+		}
+		if err := describePlan(service, plan); err != nil {
+			return nil, err
+		}
+		expanded[i] = plan
+	}
+	return expanded, nil
+}
+
+// notInherited are the plan fields plans don't take from the plan they
+// extend, and inheritedMetadataExceptions those of its metadata.
+var (
+	notInherited                = []string{"id", "name", "description", "extends"}
+	inheritedMetadataExceptions = []string{"displayName", "bullets"}
+)
+
+// extendPlans merges the plans the plans extend into them, in place.
+func extendPlans(plans []map[string]interface{}) error {
+	extended := make([]bool, len(plans))
+	var extend func(i int, chain []string) error
+	extend = func(i int, chain []string) error {
+		plan := plans[i]
+		extends, ok := plan["extends"]
+		if extended[i] || !ok {
+			return nil
+		}
+		baseName, _ := extends.(string)
+		j := findRawPlan(plans, baseName)
+		if j < 0 {
+			return errors.New("Config error: plan " + rawPlanName(plan) + " extends unknown plan " + baseName)
+		}
+		chain = append(chain, rawPlanName(plan))
+		if contains(chain, rawPlanName(plans[j])) {
+			return errors.New("Config error: plans extend each other in a cycle: " + strings.Join(append(chain, rawPlanName(plans[j])), ", "))
+		}
+		if err := extend(j, chain); err != nil {
+			return err
+		}
+		plans[i] = mergePlan(plans[j], plan)
+		extended[i] = true
+		return nil
+	}
+	for i := range plans {
+		if err := extend(i, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mergePlan(base, plan map[string]interface{}) map[string]interface{} {
+	inherited := map[string]interface{}{}
+	for key, value := range base {
+		if contains(notInherited, key) {
+			continue
+		}
+		if metadata, ok := value.(map[string]interface{}); ok && key == "metadata" {
+			value = without(metadata, inheritedMetadataExceptions)
+		}
+		inherited[key] = value
+	}
+	merged := mergeObjects(inherited, plan)
+	delete(merged, "extends")
+	return merged
+}
+
+// mergeObjects returns the fields of base overridden by those of
+// override. Objects set in both are merged in turn.
+func mergeObjects(base, override map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		baseObject, baseOK := merged[key].(map[string]interface{})
+		object, ok := value.(map[string]interface{})
+		if baseOK && ok {
+			value = mergeObjects(baseObject, object)
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+func without(object map[string]interface{}, keys []string) map[string]interface{} {
+	copied := map[string]interface{}{}
+	for key, value := range object {
+		if !contains(keys, key) {
+			copied[key] = value
+		}
+	}
+	return copied
+}
+
+// findRawPlan finds a plan by its ID or name, returning -1 if there is none.
+func findRawPlan(plans []map[string]interface{}, idOrName string) int {
+	for i, plan := range plans {
+		if plan["id"] == idOrName || plan["name"] == idOrName {
+			return i
+		}
+	}
+	return -1
+}
+
+func rawPlanName(plan map[string]interface{}) string {
+	name, _ := plan["name"].(string)
+	return name
+}
+
+// unitConversions convert the values of plan fields, and of their alarm
+// thresholds, to the strings of the stack parameters they set. Values they
+// don't recognise are left for validation to report, except for volume
+// sizes, which nothing else checks.
+var (
+	unitConversions = map[string]func(value interface{}) (string, error){
+		"mongodb_version":           version,
+		"cluster_replica_set_count": count,
+		"arbiter_count":             count,
+		"replica_shard_index":       count,
+		"volume_size":               gibibytes,
+		"iops":                      count,
+		"shard_count":               count,
+		"mongos_count":              count,
+	}
+	alarmThresholdConversions = map[string]func(value interface{}) (string, error){
+		"cpu_utilization":        percent,
+		"burst_balance":          percent,
+		"disk_space_utilization": percent,
+		"replication_lag":        seconds,
+	}
+)
+
+func convertUnits(plan map[string]interface{}) error {
+	if err := convertFields(plan, unitConversions, rawPlanName(plan), ""); err != nil {
+		return err
+	}
+	if thresholds, ok := plan["alarm_thresholds"].(map[string]interface{}); ok {
+		return convertFields(thresholds, alarmThresholdConversions, rawPlanName(plan), "alarm_thresholds.")
+	}
+	return nil
+}
+
+func convertFields(object map[string]interface{}, conversions map[string]func(interface{}) (string, error), planName, prefix string) error {
+	for field, convert := range conversions {
+		value, ok := object[field]
+		if !ok || value == nil {
+			continue
+		}
+		converted, err := convert(value)
+		if err != nil {
+			return errors.New("Config error: plan " + planName + ": " + prefix + field + " " + err.Error())
+		}
+		object[field] = converted
+	}
+	return nil
+}
+
+func version(value interface{}) (string, error) {
+	if _, ok := value.(json.Number); ok {
+		return "", errors.New("must be quoted, such as \"3.4\", so that it keeps its trailing zeros")
+	}
+	return plainString(value)
+}
+
+func count(value interface{}) (string, error) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return plainString(value)
+	}
+	n, err := strconv.Atoi(number.String())
+	if err != nil || n < 0 {
+		return "", errors.New("must be a whole number")
+	}
+	return strconv.Itoa(n), nil
+}
+
+var sizePattern = regexp.MustCompile(`^([0-9]+)\s*(GiB|TiB)?$`)
+
+func gibibytes(value interface{}) (string, error) {
+	size, err := unitValue(value)
+	if err != nil || size == "" {
+		return size, err
+	}
+	match := sizePattern.FindStringSubmatch(size)
+	if match == nil {
+		return "", errors.New("must be a size in GiB or TiB, such as 400GiB")
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return "", errors.New("must be a size in GiB or TiB, such as 400GiB")
+	}
+	if match[2] == "TiB" {
+		n *= 1024
+	}
+	return strconv.Itoa(n), nil
+}
+
+func percent(value interface{}) (string, error) {
+	s, err := unitValue(value)
+	if err != nil {
+		return "", err
+	}
+	number := strings.TrimSpace(strings.TrimSuffix(s, "%"))
+	if _, err := strconv.ParseFloat(number, 64); err == nil {
+		return number, nil
+	}
+	return s, nil
+}
+
+func seconds(value interface{}) (string, error) {
+	s, err := unitValue(value)
+	if err != nil {
+		return "", err
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return s, nil
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return s, nil
+	}
+	if duration%time.Second != 0 {
+		return "", errors.New("must be a whole number of seconds")
+	}
+	return strconv.Itoa(int(duration / time.Second)), nil
+}
+
+// plainString passes on strings, which plan fields without a unit must be.
+func plainString(value interface{}) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", errors.New("must be a string")
+	}
+	return s, nil
+}
+
+// unitValue returns a number, or a string that may end with a unit.
+func unitValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.String(), nil
+	case string:
+		return strings.TrimSpace(v), nil
+	}
+	return "", errors.New("must be a number or a string")
+}
+
+// describePlan generates the description and metadata bullets of a plan
+// that doesn't have them, from the parameters its stacks are created
+// with. Plans whose parameters don't build a template are left for
+// validation to report.
+func describePlan(rawService, rawPlan map[string]interface{}) error {
+	if rawService["name"] != "mongodb" {
+		return nil
+	}
+	description, _ := rawPlan["description"].(string)
+	metadata, ok := rawPlan["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = map[string]interface{}{}
+	}
+	_, hasBullets := metadata["bullets"]
+	if description != "" && hasBullets {
+		return nil
+	}
+
+	var service Service
+	if err := remarshal(without(rawService, []string{"plans"}), &service); err != nil {
+		return err
+	}
+	var plan Plan
+	if err := remarshal(rawPlan, &plan); err != nil {
+		return err
+	}
+	parameters, err := mongodb.WithDefaults(mongoDBPlanParameters(service, plan))
+	if err != nil {
+		return nil
+	}
+
+	topology := planTopology(parameters)
+	disk := sizeLabel(parameters.VolumeSize) + " " + parameters.VolumeType
+	if parameters.VolumeType == "io1" {
+		disk += " with " + parameters.Iops + " IOPS"
+	}
+	if description == "" {
+		rawPlan["description"] = topology + ". Disk: " + disk + ". Instance: " + parameters.NodeInstanceType
+	}
+	if !hasBullets {
+		bullets := []string{
+			"MongoDB " + parameters.MongoDBVersion,
+			topology,
+			disk + " volumes",
+			parameters.NodeInstanceType + " instances",
+		}
+		if parameters.Alarms() {
+			bullets = append(bullets, "CloudWatch alarms")
+		}
+		if parameters.Exporter() {
+			bullets = append(bullets, "Prometheus metrics from mongodb_exporter")
+		}
+		metadata["bullets"] = bullets
+		rawPlan["metadata"] = metadata
+	}
+	return nil
+}
+
+// planTopology describes the members of a plan's replica sets or sharded
+// cluster, and how they are secured.
+func planTopology(p mongodb.InputParameters) string {
+	var topology string
+	if p.Sharded() {
+		topology = p.ShardCount + " shards of " + plural(p.ClusterReplicaSetCount, "replica") + ", " + p.MongosCount + " mongos routers"
+	} else if p.ClusterReplicaSetCount == "1" {
+		topology = "No replicas"
+	} else {
+		topology = plural(p.ClusterReplicaSetCount, "replica")
+	}
+	if p.ArbiterCount == "1" {
+		topology += " and an arbiter"
+	}
+	if p.TLS {
+		topology += " requiring TLS"
+	}
+	if p.EncryptedVolumes() {
+		topology += " with encrypted volumes"
+	}
+	return topology
+}
+
+// sizeLabel writes a size in GiB in TiB when it is a whole number of them.
+func sizeLabel(gibibytes string) string {
+	if n, err := strconv.Atoi(gibibytes); err == nil && n > 0 && n%1024 == 0 {
+		return strconv.Itoa(n/1024) + "TiB"
+	}
+	return gibibytes + "GiB"
+}
+
+func plural(n, noun string) string {
+	if n == "1" {
+		return n + " " + noun
+	}
+	return n + " " + noun + "s"
+}
+
+func remarshal(from, to interface{}) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, to)
+}
@@ -0,0 +1,59 @@
+package provider
+
+import (
+	"context"
+	"strings"
+
+	"github.com/henrytk/aws-service-broker/preflight"
+)
+
+// preflightChecks returns the preflight checks of the catalog: the broker's
+// credentials, the resources of every service and the templates of every
+// plan. Plans sharing a template have it validated once.
+func (ap *AWSProvider) preflightChecks(checker *preflight.Checker) func(context.Context) preflight.Report {
+	return func(ctx context.Context) preflight.Report {
+		results := []preflight.Result{checker.CheckIdentity(ctx)}
+		for _, service := range ap.config(ctx).Catalog.Services {
+			securityGroupIds := []string{service.BastionSecurityGroupId}
+			for _, plan := range service.Plans {
+				if groupId := service.ExporterSecurityGroup(plan); groupId != "" && !contains(securityGroupIds, groupId) {
+					securityGroupIds = append(securityGroupIds, groupId)
+				}
+			}
+			results = append(results, checker.CheckResources(ctx, service.Name, preflight.Resources{
+				VpcId:            service.VpcId,
+				SubnetIds:        service.Subnets(),
+				SecurityGroupIds: securityGroupIds,
+				KeyPairName:      service.KeyPairName,
+			})...)
+
+			var templateBodies []string
+			plansByTemplate := map[string][]string{}
+			for _, plan := range service.Plans {
+				templateBody, err := ap.MongoDBService.BuildTemplateBody(mongoDBPlanParameters(service, plan))
+				if err != nil {
+					results = append(results, preflight.Result{Name: service.Name + ": template of plan " + plan.Name, Error: err.Error()})
+					continue
+				}
+				if _, ok := plansByTemplate[templateBody]; !ok {
+					templateBodies = append(templateBodies, templateBody)
+				}
+				plansByTemplate[templateBody] = append(plansByTemplate[templateBody], plan.Name)
+			}
+			for _, templateBody := range templateBodies {
+				name := service.Name + ": template of plans " + strings.Join(plansByTemplate[templateBody], ", ")
+				results = append(results, checker.CheckTemplate(ctx, name, templateBody))
+			}
+		}
+		return preflight.NewReport(results)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,38 +1,165 @@
 package provider
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
+	"time"
 
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/henrytk/aws-service-broker/aws/cloudformation"
 	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+	"github.com/henrytk/aws-service-broker/aws/ec2"
+	"github.com/henrytk/aws-service-broker/aws/sqs"
+	"github.com/henrytk/aws-service-broker/aws/sts"
+	"github.com/henrytk/aws-service-broker/health"
+	"github.com/henrytk/aws-service-broker/preflight"
 	usbProvider "github.com/henrytk/universal-service-broker/provider"
 	"github.com/pivotal-cf/brokerapi"
 )
 
 type AWSProvider struct {
+	// Config is the config the provider started with, or was last
+	// reloaded with. Read it with CurrentConfig while the broker serves.
 	Config         *Config
 	MongoDBService *mongodb.Service
+	Logger         lager.Logger
+	// Preflight reports the results of the preflight checks, if they
+	// are enabled.
+	Preflight *preflight.Monitor
+	STS       stsiface.STSAPI
+
+	// configMu guards Config, which is swapped when the config is
+	// reloaded. See CurrentConfig.
+	configMu sync.RWMutex
+
+	stackStatusesWorker *health.Worker
+	stackEventsWorker   *health.Worker
+
+	// stopWorkers stops the background workers, which workers waits for.
+	stopWorkers context.CancelFunc
+	workers     sync.WaitGroup
 }
 
-func NewAWSProvider(rawConfig []byte) (*AWSProvider, error) {
+// stackEventsSilence is how long the stack events consumer can go without
+// receiving from its queue. Receives wait for messages for up to 20 seconds.
+const stackEventsSilence = 2 * time.Minute
+
+func NewAWSProvider(rawConfig []byte, logger lager.Logger) (*AWSProvider, error) {
 	config, err := DecodeConfig(rawConfig)
 	if err != nil {
 		return &AWSProvider{}, err
 	}
-	mongoDBService, err := mongodb.NewService(config.AWSConfig.Region)
+	mongoDBService, err := mongodb.NewService(config.AWSConfig.Region, logger.Session("aws"))
+	if err != nil {
+		return &AWSProvider{}, err
+	}
+	stsClient, err := sts.NewSTSClient(config.AWSConfig.Region, logger.Session("aws"))
 	if err != nil {
 		return &AWSProvider{}, err
 	}
-	return &AWSProvider{
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	awsProvider := &AWSProvider{
 		Config:         config,
 		MongoDBService: mongoDBService,
-	}, nil
+		Logger:         logger,
+		STS:            stsClient,
+		stopWorkers:    stopWorkers,
+	}
+	if interval := config.StackStatusInterval(); interval > 0 {
+		// Statuses are allowed to miss a refresh before polls stop
+		// being answered from the cache.
+		mongoDBService.StackStatuses = mongodb.NewStackStatuses(2*interval + interval/2)
+		awsProvider.stackStatusesWorker = health.NewWorker(3 * interval)
+		awsProvider.startWorker(func() {
+			mongoDBService.WatchStackStatuses(workersCtx, interval, awsProvider.stackStatusesWorker, logger.Session("stack-statuses"))
+		})
+	}
+	if config.StackEvents.QueueURL != "" {
+		queue, err := sqs.NewSQSClient(config.AWSConfig.Region, logger.Session("aws"))
+		if err != nil {
+			awsProvider.Stop()
+			return &AWSProvider{}, err
+		}
+		mongoDBService.NotificationARNs = []string{config.StackEvents.TopicArn}
+		awsProvider.stackEventsWorker = health.NewWorker(stackEventsSilence)
+		awsProvider.startWorker(func() {
+			mongoDBService.ConsumeStackEvents(workersCtx, queue, config.StackEvents.QueueURL, awsProvider.stackEventsWorker, logger.Session("stack-events"))
+		})
+	}
+	if config.Preflight.Enabled() {
+		if err := awsProvider.startPreflight(workersCtx, logger.Session("preflight")); err != nil {
+			awsProvider.Stop()
+			return &AWSProvider{}, err
+		}
+	}
+	return awsProvider, nil
+}
+
+func (ap *AWSProvider) startWorker(run func()) {
+	ap.workers.Add(1)
+	go func() {
+		defer ap.workers.Done()
+		run()
+	}()
+}
+
+// Stop stops the provider's background workers, returning once they have
+// stopped. Stack operations they were following are picked up again by
+// polling or by the next broker to run.
+func (ap *AWSProvider) Stop() {
+	if ap.stopWorkers != nil {
+		ap.stopWorkers()
+	}
+	ap.workers.Wait()
+}
+
+// NewPreflightMonitor returns a monitor of the preflight checks of the
+// catalog against the configured account.
+func (ap *AWSProvider) NewPreflightMonitor(logger lager.Logger) (*preflight.Monitor, error) {
+	ec2Client, err := ec2.NewEC2Client(ap.Config.AWSConfig.Region, logger.Session("aws"))
+	if err != nil {
+		return nil, err
+	}
+	return preflight.NewMonitor(ap.preflightChecks(&preflight.Checker{
+		EC2:            ec2Client,
+		STS:            ap.STS,
+		CloudFormation: ap.MongoDBService.Client,
+	})), nil
+}
+
+// startPreflight runs the preflight checks on startup and reruns them in the
+// background, as configured.
+func (ap *AWSProvider) startPreflight(ctx context.Context, logger lager.Logger) error {
+	monitor, err := ap.NewPreflightMonitor(logger)
+	if err != nil {
+		return err
+	}
+	ap.Preflight = monitor
+	if ap.Config.Preflight.OnStartup {
+		checkCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		report := ap.Preflight.Check(checkCtx)
+		cancel()
+		if !report.OK {
+			return errors.New("Preflight checks failed:\n" + report.Failures())
+		}
+	}
+	if interval := ap.Config.Preflight.RecheckInterval(); interval > 0 {
+		ap.startWorker(func() {
+			ap.Preflight.Watch(ctx, interval, logger)
+		})
+	}
+	return nil
 }
 
 type OperationData struct {
 	Type       string `json:"type"`
 	Service    string `json:"service"`
+	Plan       string `json:"plan,omitempty"`
 	StackId    string `json:"stack_id,omitempty"`
 	InstanceID string `json:"instance_id,omitempty"`
 }
@@ -40,7 +167,7 @@ type OperationData struct {
 func (ap *AWSProvider) Provision(ctx context.Context, provisionData usbProvider.ProvisionData) (
 	dashboardURL string, operationData string, err error,
 ) {
-	service, err := findServiceById(provisionData.Service.ID, &ap.Config.Catalog)
+	service, err := findServiceById(provisionData.Service.ID, &ap.config(ctx).Catalog)
 	if err != nil {
 		return "", "", errors.New("could not find service ID: " + provisionData.Service.ID)
 	}
@@ -52,34 +179,22 @@ func (ap *AWSProvider) Provision(ctx context.Context, provisionData usbProvider.
 
 	switch service.Name {
 	case "mongodb":
-		createStackOutput, err := ap.MongoDBService.CreateStack(
-			provisionData.InstanceID,
-			mongodb.InputParameters{
-				BastionSecurityGroupId: service.BastionSecurityGroupId,
-				KeyPairName:            service.KeyPairName,
-				VpcId:                  service.VpcId,
-				PrimaryNodeSubnetId:    service.PrimaryNodeSubnetId,
-				Secondary0NodeSubnetId: service.Secondary0NodeSubnetId,
-				Secondary1NodeSubnetId: service.Secondary1NodeSubnetId,
-				MongoDBVersion:         plan.MongoDBVersion,
-				MongoDBAdminUsername:   plan.MongoDBAdminUsername,
-				MongoDBAdminPassword: ap.MongoDBService.GenerateAdminPassword(
-					ap.Config.Secret + provisionData.InstanceID,
-				),
-				ClusterReplicaSetCount: plan.ClusterReplicaSetCount,
-				ReplicaShardIndex:      plan.ReplicaShardIndex,
-				VolumeSize:             plan.VolumeSize,
-				VolumeType:             plan.VolumeType,
-				Iops:                   plan.Iops,
-				NodeInstanceType:       plan.NodeInstanceType,
-			},
+		inputParameters, err := ap.mongoDBProvisionParameters(
+			ctx, service, plan, provisionData.InstanceID,
+			provisionData.Details.OrganizationGUID, provisionData.Details.SpaceGUID,
 		)
 		if err != nil {
 			return "", "", err
 		}
+		createStackOutput, err := ap.MongoDBService.CreateStack(ctx, provisionData.InstanceID, inputParameters)
+		if err != nil {
+			ap.Logger.Error("create-stack", err, lager.Data{"instance-id": provisionData.InstanceID, "plan": plan.Name})
+			return "", "", err
+		}
 		operationDataJSON, err := json.Marshal(OperationData{
 			Type:    "provision",
 			Service: service.Name,
+			Plan:    plan.Name,
 			StackId: *createStackOutput.StackId,
 		})
 		if err != nil {
@@ -91,23 +206,91 @@ func (ap *AWSProvider) Provision(ctx context.Context, provisionData usbProvider.
 	}
 }
 
+// mongoDBProvisionParameters returns the stack parameters of a new MongoDB
+// instance of the plan, with secrets derived from the context's config.
+func (ap *AWSProvider) mongoDBProvisionParameters(ctx context.Context, service Service, plan Plan, instanceID, organizationGUID, spaceGUID string) (
+	mongodb.InputParameters, error,
+) {
+	secret := ap.config(ctx).Secret
+	inputParameters := mongoDBPlanParameters(service, plan)
+	inputParameters.MongoDBAdminPassword = ap.MongoDBService.GenerateAdminPassword(
+		secret + instanceID,
+	)
+	inputParameters.MongoDBClusterKey = ap.MongoDBService.GenerateClusterKey(
+		secret + "cluster-key" + instanceID,
+	)
+	inputParameters.Tags = map[string]string{
+		mongodb.InstanceIDTag:       instanceID,
+		mongodb.PlanIDTag:           plan.ID,
+		mongodb.OrganizationGUIDTag: organizationGUID,
+		mongodb.SpaceGUIDTag:        spaceGUID,
+	}
+	if plan.TLS {
+		certificateAuthority, err := ap.MongoDBService.GenerateCertificateAuthority(instanceID)
+		if err != nil {
+			return mongodb.InputParameters{}, err
+		}
+		inputParameters.MongoDBCACertificate = certificateAuthority.Certificate
+		inputParameters.MongoDBCAKey = certificateAuthority.PrivateKey
+		inputParameters.MongoDBCertificateExpiry = ap.MongoDBService.GenerateCertificateExpiry()
+	}
+	return inputParameters, nil
+}
+
+// mongoDBPlanParameters returns the stack parameters the service and plan
+// set for every instance of the plan.
+func mongoDBPlanParameters(service Service, plan Plan) mongodb.InputParameters {
+	inputParameters := mongodb.InputParameters{
+		BastionSecurityGroupId: service.BastionSecurityGroupId,
+		KeyPairName:            service.KeyPairName,
+		VpcId:                  service.VpcId,
+		NodeSubnetIds:          service.Subnets(),
+		MongoDBVersion:         plan.MongoDBVersion,
+		MongoDBAdminUsername:   plan.MongoDBAdminUsername,
+		ClusterReplicaSetCount: plan.ClusterReplicaSetCount,
+		ArbiterCount:           plan.ArbiterCount,
+		ReplicaShardIndex:      plan.ReplicaShardIndex,
+		VolumeSize:             plan.VolumeSize,
+		VolumeType:             plan.VolumeType,
+		Iops:                   plan.Iops,
+		NodeInstanceType:       plan.NodeInstanceType,
+		ShardCount:             plan.ShardCount,
+		MongosCount:            plan.MongosCount,
+		TLS:                    plan.TLS,
+	}
+	if encrypted, kmsKeyId := service.VolumeEncryption(plan); encrypted {
+		inputParameters.VolumeEncrypted = "true"
+		inputParameters.VolumeKmsKeyId = kmsKeyId
+	}
+	setMongoDBAlarmParameters(&inputParameters, service, plan)
+	inputParameters.MongoDBExporterSecurityGroupId = service.ExporterSecurityGroup(plan)
+	return inputParameters
+}
+
 func (ap *AWSProvider) Deprovision(ctx context.Context, deprovisionData usbProvider.DeprovisionData) (
 	operationData string, err error,
 ) {
-	service, err := findServiceById(deprovisionData.Service.ID, &ap.Config.Catalog)
+	service, err := findServiceById(deprovisionData.Service.ID, &ap.config(ctx).Catalog)
 	if err != nil {
 		return "", errors.New("could not find service ID: " + deprovisionData.Service.ID)
 	}
 
+	var planName string
+	if plan, err := findPlanById(deprovisionData.Plan.ID, service); err == nil {
+		planName = plan.Name
+	}
+
 	switch service.Name {
 	case "mongodb":
-		err := ap.MongoDBService.DeleteStack(deprovisionData.InstanceID)
+		err := ap.MongoDBService.DeleteStack(ctx, deprovisionData.InstanceID)
 		if err != nil {
+			ap.Logger.Error("delete-stack", err, lager.Data{"instance-id": deprovisionData.InstanceID})
 			return "", err
 		}
 		operationDataJSON, err := json.Marshal(OperationData{
 			Type:       "deprovision",
 			Service:    service.Name,
+			Plan:       planName,
 			InstanceID: deprovisionData.InstanceID,
 		})
 		if err != nil {
@@ -119,22 +302,63 @@ func (ap *AWSProvider) Deprovision(ctx context.Context, deprovisionData usbProvi
 	}
 }
 
-func (ap *AWSProvider) Bind(context.Context, usbProvider.BindData) (
+func (ap *AWSProvider) Bind(ctx context.Context, bindData usbProvider.BindData) (
 	binding brokerapi.Binding, err error,
 ) {
-	return brokerapi.Binding{}, errors.New("Error: not implemented")
+	service, err := findServiceById(bindData.Details.ServiceID, &ap.config(ctx).Catalog)
+	if err != nil {
+		return brokerapi.Binding{}, errors.New("could not find service ID: " + bindData.Details.ServiceID)
+	}
+
+	plan, err := findPlanById(bindData.Details.PlanID, service)
+	if err != nil {
+		return brokerapi.Binding{}, errors.New("could not find plan ID: " + bindData.Details.PlanID)
+	}
+
+	switch service.Name {
+	case "mongodb":
+		cluster, err := ap.MongoDBService.DescribeCluster(ctx, bindData.InstanceID)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+		credentials, err := buildMongoDBCredentials(
+			cluster,
+			plan,
+			ap.MongoDBService.GenerateAdminPassword(ap.config(ctx).Secret+bindData.InstanceID),
+		)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+		return brokerapi.Binding{Credentials: credentials}, nil
+	default:
+		return brokerapi.Binding{}, errors.New("no provider for service name " + service.Name)
+	}
 }
 
+// Bindings hand out the cluster's admin credentials, so there is nothing to
+// revoke when unbinding.
 func (ap *AWSProvider) Unbind(context.Context, usbProvider.UnbindData) (err error) {
-	return errors.New("Error: not implemented")
+	return nil
+}
+
+// UpdateParameters are the parameters accepted by an update.
+type UpdateParameters struct {
+	// ReissueCertificates makes the nodes of a TLS instance reissue their
+	// certificates even when they are not close to expiring.
+	ReissueCertificates bool `json:"reissue_certificates"`
 }
 
 func (ap *AWSProvider) Update(ctx context.Context, updateData usbProvider.UpdateData) (operationData string, err error) {
+	var updateParameters UpdateParameters
 	if len(updateData.Details.RawParameters) > 0 {
-		return "", errors.New("update parameters are not supported")
+		decoder := json.NewDecoder(bytes.NewReader(updateData.Details.RawParameters))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&updateParameters); err != nil {
+			return "", errors.New("update parameters are not supported, except for reissue_certificates")
+		}
 	}
 
-	service, err := findServiceById(updateData.Service.ID, &ap.Config.Catalog)
+	service, err := findServiceById(updateData.Service.ID, &ap.config(ctx).Catalog)
 	if err != nil {
 		return "", errors.New("could not find service ID: " + updateData.Service.ID)
 	}
@@ -149,20 +373,40 @@ func (ap *AWSProvider) Update(ctx context.Context, updateData usbProvider.Update
 		return "", errors.New("could not find plan ID: " + updateData.Details.PreviousValues.PlanID)
 	}
 
-	if err := validPlanUpdate(currentPlan, newPlan); err != nil {
+	if err := service.CheckPlanUpdate(currentPlan, newPlan); err != nil {
 		return "", err
 	}
+	if updateParameters.ReissueCertificates && !newPlan.TLS {
+		return "", errors.New("certificates can only be reissued for plans using TLS")
+	}
 
 	switch service.Name {
 	case "mongodb":
-		updateParameters := buildMongoDBUpdateParameters(currentPlan, newPlan)
-		updateStackOutput, err := ap.MongoDBService.UpdateStack(ctx, updateData.InstanceID, updateParameters)
+		inputParameters := buildMongoDBUpdateParameters(service, currentPlan, newPlan)
+		if newPlan.ID != currentPlan.ID {
+			inputParameters.Tags = map[string]string{mongodb.PlanIDTag: newPlan.ID}
+		}
+		if newPlan.TLS {
+			reissue := updateParameters.ReissueCertificates
+			if !reissue {
+				reissue, err = ap.mongoDBCertificatesExpiring(ctx, updateData.InstanceID)
+				if err != nil {
+					return "", err
+				}
+			}
+			if reissue {
+				inputParameters.MongoDBCertificateExpiry = ap.MongoDBService.GenerateCertificateExpiry()
+			}
+		}
+		updateStackOutput, err := ap.MongoDBService.UpdateStack(ctx, updateData.InstanceID, inputParameters)
 		if err != nil {
+			ap.Logger.Error("update-stack", err, lager.Data{"instance-id": updateData.InstanceID, "plan": newPlan.Name})
 			return "", err
 		}
 		operationDataJSON, err := json.Marshal(OperationData{
 			Type:    "update",
 			Service: service.Name,
+			Plan:    newPlan.Name,
 			StackId: *updateStackOutput.StackId,
 		})
 		if err != nil {
@@ -174,6 +418,9 @@ func (ap *AWSProvider) Update(ctx context.Context, updateData usbProvider.Update
 	}
 }
 
+// LastOperation reports the state of an instance's stack. Polls that are
+// throttled or fail transiently report the operation as in progress, so
+// that the platform asks again rather than failing it.
 func (ap *AWSProvider) LastOperation(ctx context.Context, lastOperationData usbProvider.LastOperationData) (
 	state brokerapi.LastOperationState, description string, err error,
 ) {
@@ -187,35 +434,44 @@ func (ap *AWSProvider) LastOperation(ctx context.Context, lastOperationData usbP
 	case "mongodb":
 		switch operationData.Type {
 		case "provision":
-			completed, err := ap.MongoDBService.CreateStackCompleted(lastOperationData.InstanceID)
+			completed, err := ap.MongoDBService.CreateStackCompleted(ctx, lastOperationData.InstanceID)
 			if completed {
 				if err == nil {
 					return brokerapi.Succeeded, "provision succeeded", nil
 				} else {
+					ap.logOperationFailed(operationData, lastOperationData.InstanceID, err)
 					return brokerapi.Failed, err.Error(), nil
 				}
 			}
-			return brokerapi.InProgress, "provision in progress", nil
+			if cloudformation.IsTransient(err) {
+				return brokerapi.InProgress, "provision in progress", nil
+			}
+			return brokerapi.InProgress, ap.mongoDBProgress(ctx, "provision in progress", lastOperationData.InstanceID), nil
 		case "deprovision":
-			completed, err := ap.MongoDBService.DeleteStackCompleted(lastOperationData.InstanceID)
+			completed, err := ap.MongoDBService.DeleteStackCompleted(ctx, lastOperationData.InstanceID)
 			if completed {
 				if err == nil {
 					return brokerapi.Succeeded, "deprovision succeeded", nil
 				} else {
+					ap.logOperationFailed(operationData, lastOperationData.InstanceID, err)
 					return brokerapi.Failed, err.Error(), nil
 				}
 			}
 			return brokerapi.InProgress, "deprovision in progress", nil
 		case "update":
-			completed, err := ap.MongoDBService.UpdateStackCompleted(lastOperationData.InstanceID)
+			completed, err := ap.MongoDBService.UpdateStackCompleted(ctx, lastOperationData.InstanceID)
 			if completed {
 				if err == nil {
 					return brokerapi.Succeeded, "update succeeded", nil
 				} else {
+					ap.logOperationFailed(operationData, lastOperationData.InstanceID, err)
 					return brokerapi.Failed, err.Error(), nil
 				}
 			}
-			return brokerapi.InProgress, "update in progress", nil
+			if cloudformation.IsTransient(err) {
+				return brokerapi.InProgress, "update in progress", nil
+			}
+			return brokerapi.InProgress, ap.mongoDBProgress(ctx, "update in progress", lastOperationData.InstanceID), nil
 		default:
 			return "", "", errors.New("unknown operation type '" + operationData.Type + "'")
 		}
@@ -224,33 +480,82 @@ func (ap *AWSProvider) LastOperation(ctx context.Context, lastOperationData usbP
 	}
 }
 
-func validPlanUpdate(currentPlan, newPlan Plan) error {
-	if currentPlan.MongoDBAdminUsername != newPlan.MongoDBAdminUsername {
-		return errors.New("updating MongoDB admin username is not supported")
-	}
-	if currentPlan.MongoDBVersion != newPlan.MongoDBVersion {
-		return errors.New("updating MongoDB version is not supported")
-	}
-	if currentPlan.ClusterReplicaSetCount != newPlan.ClusterReplicaSetCount {
-		return errors.New("updating cluster replica set count is not supported")
+// logOperationFailed logs an asynchronous operation whose stack failed, so
+// the failure can be found in the broker's logs as well as on the platform.
+func (ap *AWSProvider) logOperationFailed(operationData OperationData, instanceID string, err error) {
+	ap.Logger.Error(operationData.Type+"-failed", err, lager.Data{
+		"instance-id": instanceID,
+		"stack-id":    operationData.StackId,
+	})
+}
+
+// Alarms returns the state of an instance's CloudWatch alarms. Instances
+// of plans without an alarm topic have none.
+func (ap *AWSProvider) Alarms(ctx context.Context, instanceID string) ([]mongodb.Alarm, error) {
+	return ap.MongoDBService.DescribeAlarms(ctx, instanceID)
+}
+
+// InstanceCounts counts the service instances in the account by the status
+// of their stack.
+func (ap *AWSProvider) InstanceCounts(ctx context.Context) (map[string]int, error) {
+	return ap.MongoDBService.CountStacksByStatus(ctx)
+}
+
+// Names returns the names of the service and plan with the given IDs. The
+// name of a service or plan that is not in the catalog is empty.
+func (ap *AWSProvider) Names(serviceID, planID string) (serviceName, planName string) {
+	service, err := findServiceById(serviceID, &ap.CurrentConfig().Catalog)
+	if err != nil {
+		return "", ""
 	}
-	if currentPlan.ReplicaShardIndex != newPlan.ReplicaShardIndex {
-		return errors.New("updating replica shard index is not supported")
+	plan, err := findPlanById(planID, service)
+	if err != nil {
+		return service.Name, ""
 	}
-	if currentPlan.VolumeSize != newPlan.VolumeSize {
-		return errors.New("updating volume size is not supported")
+	return service.Name, plan.Name
+}
+
+// mongoDBProgress adds the number of finished nested node stacks to an in
+// progress description. Progress is best effort: if it can't be retrieved
+// the description is returned unchanged.
+func (ap *AWSProvider) mongoDBProgress(ctx context.Context, description, instanceID string) string {
+	completed, total, err := ap.MongoDBService.NestedStackProgress(ctx, instanceID)
+	if err != nil || total == 0 {
+		return description
 	}
-	if currentPlan.VolumeType != newPlan.VolumeType {
-		return errors.New("updating volume type is not supported")
+	return fmt.Sprintf("%s: %d of %d nodes ready", description, completed, total)
+}
+
+// mongoDBCertificatesExpiring reports whether the node certificates of an
+// instance are within the renewal window of their expiry.
+func (ap *AWSProvider) mongoDBCertificatesExpiring(ctx context.Context, instanceID string) (bool, error) {
+	cluster, err := ap.MongoDBService.DescribeCluster(ctx, instanceID)
+	if err != nil {
+		return false, err
 	}
-	if currentPlan.Iops != newPlan.Iops {
-		return errors.New("updating IOPS is not supported")
+	expiry, err := mongodb.ParseCertificateExpiry(cluster.CertificateExpiry)
+	if err != nil {
+		return false, err
 	}
-	return nil
+	return time.Now().Add(mongodb.CertificateRenewalWindow).After(expiry), nil
 }
 
-func buildMongoDBUpdateParameters(currentPlan, newPlan Plan) mongodb.InputParameters {
-	updateParameters := mongodb.InputParameters{}
+// buildMongoDBUpdateParameters only sets the plan parameters that changed.
+// The subnets and arbiter count are always set because stacks created before
+// they were template parameters have no previous value to fall back on.
+func buildMongoDBUpdateParameters(service Service, currentPlan, newPlan Plan) mongodb.InputParameters {
+	updateParameters := mongodb.InputParameters{
+		NodeSubnetIds: service.Subnets(),
+		ArbiterCount:  newPlan.ArbiterCount,
+		ShardCount:    newPlan.ShardCount,
+		MongosCount:   newPlan.MongosCount,
+		TLS:           newPlan.TLS,
+	}
+	if updateParameters.ArbiterCount == "" {
+		updateParameters.ArbiterCount = "0"
+	}
+	setMongoDBAlarmParameters(&updateParameters, service, newPlan)
+	updateParameters.MongoDBExporterSecurityGroupId = service.ExporterSecurityGroup(newPlan)
 	if currentPlan.MongoDBVersion != newPlan.MongoDBVersion {
 		updateParameters.MongoDBVersion = newPlan.MongoDBVersion
 	}
@@ -277,3 +582,17 @@ func buildMongoDBUpdateParameters(currentPlan, newPlan Plan) mongodb.InputParame
 	}
 	return updateParameters
 }
+
+// setMongoDBAlarmParameters passes on the plan's alarm topic and
+// thresholds. Updates pass them every time, so that an instance's alarms
+// always follow its current plan.
+func setMongoDBAlarmParameters(inputParameters *mongodb.InputParameters, service Service, plan Plan) {
+	inputParameters.AlarmTopicArn = service.AlarmTopic(plan)
+	if inputParameters.AlarmTopicArn == "" {
+		return
+	}
+	inputParameters.CPUUtilizationAlarmThreshold = plan.AlarmThresholds.CPUUtilization
+	inputParameters.BurstBalanceAlarmThreshold = plan.AlarmThresholds.BurstBalance
+	inputParameters.DiskSpaceUtilizationAlarmThreshold = plan.AlarmThresholds.DiskSpaceUtilization
+	inputParameters.ReplicationLagAlarmThreshold = plan.AlarmThresholds.ReplicationLag
+}
@@ -0,0 +1,209 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/henrytk/aws-service-broker/aws/cloudformation/mongodb"
+)
+
+type configKey struct{}
+
+// WithConfig returns a context in which the provider uses the config, so
+// that a request is served with one config throughout, even if the config
+// is reloaded meanwhile.
+func WithConfig(ctx context.Context, config *Config) context.Context {
+	return context.WithValue(ctx, configKey{}, config)
+}
+
+// config returns the config of the context, or else the current config.
+func (ap *AWSProvider) config(ctx context.Context) *Config {
+	if config, ok := ctx.Value(configKey{}).(*Config); ok {
+		return config
+	}
+	return ap.CurrentConfig()
+}
+
+// CurrentConfig returns the config the provider is using.
+func (ap *AWSProvider) CurrentConfig() *Config {
+	ap.configMu.RLock()
+	defer ap.configMu.RUnlock()
+	return ap.Config
+}
+
+// SwapConfig has the provider use a reloaded config from now on. Check the
+// config with CheckReload first.
+func (ap *AWSProvider) SwapConfig(config *Config) {
+	ap.configMu.Lock()
+	defer ap.configMu.Unlock()
+	ap.Config = config
+}
+
+// CheckReload returns an error if the provider can't switch to a reloaded
+// config: the secret its instances' passwords are derived from changed, a
+// plan that instances still use is gone, or the volume encryption of such
+// a plan changed. Stacks created before they were tagged with their plan
+// aren't checked.
+func (ap *AWSProvider) CheckReload(ctx context.Context, config *Config) error {
+	current := ap.CurrentConfig()
+	if config.Secret != current.Secret {
+		return errors.New("the secret changed, so the passwords of existing instances would no longer match")
+	}
+	instances, err := ap.MongoDBService.ListInstanceStacks(ctx)
+	if err != nil {
+		return err
+	}
+	currentService := findServiceByName("mongodb", &current.Catalog)
+	service := findServiceByName("mongodb", &config.Catalog)
+	missing := map[string][]string{}
+	encryption := map[string][]string{}
+	for _, instance := range instances {
+		planID := instance.Tags[mongodb.PlanIDTag]
+		if planID == "" {
+			continue
+		}
+		plan, err := findPlanById(planID, service)
+		if err != nil {
+			missing[planID] = append(missing[planID], instance.ID)
+			continue
+		}
+		if currentPlan, err := findPlanById(planID, currentService); err == nil {
+			currentEncrypted, currentKMSKeyId := currentService.VolumeEncryption(currentPlan)
+			encrypted, kmsKeyId := service.VolumeEncryption(plan)
+			if encrypted != currentEncrypted || kmsKeyId != currentKMSKeyId {
+				encryption[planID] = append(encryption[planID], instance.ID)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("plans in use are gone: " + plansInUse(missing))
+	}
+	if len(encryption) > 0 {
+		return errors.New("volume encryption changed for plans in use: " + plansInUse(encryption))
+	}
+	return nil
+}
+
+// plansInUse describes plans and the instances using them.
+func plansInUse(instanceIDs map[string][]string) string {
+	var plans []string
+	for planID, ids := range instanceIDs {
+		plans = append(plans, "plan "+planID+" is used by instances "+strings.Join(ids, ", "))
+	}
+	sort.Strings(plans)
+	return strings.Join(plans, "; ")
+}
+
+// ConfigDiff is what changed between two configs. Services are named, and
+// plans are named service/plan.
+type ConfigDiff struct {
+	AddedServices   []string `json:"added_services,omitempty"`
+	RemovedServices []string `json:"removed_services,omitempty"`
+	ChangedServices []string `json:"changed_services,omitempty"`
+	AddedPlans      []string `json:"added_plans,omitempty"`
+	RemovedPlans    []string `json:"removed_plans,omitempty"`
+	ChangedPlans    []string `json:"changed_plans,omitempty"`
+	// NotReloaded are the settings outside the catalog and webhooks that
+	// changed, which only take effect when the broker is restarted.
+	NotReloaded []string `json:"not_reloaded,omitempty"`
+}
+
+// DiffConfig compares a config with the one it is reloaded as.
+func DiffConfig(old, new *Config) ConfigDiff {
+	var diff ConfigDiff
+	oldServices := servicesById(old.Catalog)
+	newServices := servicesById(new.Catalog)
+	for id, newService := range newServices {
+		oldService, ok := oldServices[id]
+		if !ok {
+			diff.AddedServices = append(diff.AddedServices, newService.Name)
+			for _, plan := range newService.Plans {
+				diff.AddedPlans = append(diff.AddedPlans, newService.Name+"/"+plan.Name)
+			}
+			continue
+		}
+		if !equalJSON(withoutPlans(oldService), withoutPlans(newService)) {
+			diff.ChangedServices = append(diff.ChangedServices, newService.Name)
+		}
+		oldPlans := plansById(oldService)
+		newPlans := plansById(newService)
+		for planID, newPlan := range newPlans {
+			oldPlan, ok := oldPlans[planID]
+			if !ok {
+				diff.AddedPlans = append(diff.AddedPlans, newService.Name+"/"+newPlan.Name)
+			} else if !equalJSON(oldPlan, newPlan) {
+				diff.ChangedPlans = append(diff.ChangedPlans, newService.Name+"/"+newPlan.Name)
+			}
+		}
+		for planID, oldPlan := range oldPlans {
+			if _, ok := newPlans[planID]; !ok {
+				diff.RemovedPlans = append(diff.RemovedPlans, oldService.Name+"/"+oldPlan.Name)
+			}
+		}
+	}
+	for id, oldService := range oldServices {
+		if _, ok := newServices[id]; !ok {
+			diff.RemovedServices = append(diff.RemovedServices, oldService.Name)
+			for _, plan := range oldService.Plans {
+				diff.RemovedPlans = append(diff.RemovedPlans, oldService.Name+"/"+plan.Name)
+			}
+		}
+	}
+
+	oldValue := reflect.ValueOf(*old)
+	newValue := reflect.ValueOf(*new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := strings.Split(oldValue.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "catalog" || name == "webhooks" {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			diff.NotReloaded = append(diff.NotReloaded, name)
+		}
+	}
+
+	for _, names := range [][]string{
+		diff.AddedServices, diff.RemovedServices, diff.ChangedServices,
+		diff.AddedPlans, diff.RemovedPlans, diff.ChangedPlans,
+	} {
+		sort.Strings(names)
+	}
+	return diff
+}
+
+// Empty reports whether nothing changed.
+func (d ConfigDiff) Empty() bool {
+	return reflect.DeepEqual(d, ConfigDiff{})
+}
+
+func servicesById(catalog Catalog) map[string]Service {
+	services := map[string]Service{}
+	for _, service := range catalog.Services {
+		services[service.ID] = service
+	}
+	return services
+}
+
+func plansById(service Service) map[string]Plan {
+	plans := map[string]Plan{}
+	for _, plan := range service.Plans {
+		plans[plan.ID] = plan
+	}
+	return plans
+}
+
+func withoutPlans(service Service) Service {
+	service.Plans = nil
+	service.Service.Plans = nil
+	return service
+}
+
+func equalJSON(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && string(aJSON) == string(bJSON)
+}
@@ -0,0 +1,52 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/henrytk/aws-service-broker/aws/ssm"
+	"github.com/henrytk/aws-service-broker/secrets"
+)
+
+// ResolveConfig replaces the secret references in a config with the
+// secrets they name. See package secrets. The AWS region of the config can
+// only refer to environment variables, as it is needed to look up the
+// others.
+func ResolveConfig(ctx context.Context, rawConfig []byte) ([]byte, error) {
+	if !secrets.HasReferences(rawConfig) {
+		return rawConfig, nil
+	}
+
+	var regionConfig struct {
+		AWSConfig AWSConfig `json:"aws_config"`
+	}
+	if err := json.Unmarshal(rawConfig, &regionConfig); err != nil {
+		return nil, err
+	}
+	rawRegion, err := json.Marshal(regionConfig.AWSConfig)
+	if err != nil {
+		return nil, err
+	}
+	rawRegion, err = secrets.Resolve(ctx, rawRegion, secrets.Resolvers{"env": secrets.Env})
+	if err != nil {
+		return nil, err
+	}
+	var awsConfig AWSConfig
+	if err := json.Unmarshal(rawRegion, &awsConfig); err != nil {
+		return nil, err
+	}
+
+	// Secrets are looked up before the broker's logger exists, and
+	// aren't logged.
+	ssmClient, err := ssm.NewSSMClient(awsConfig.Region, lager.NewLogger("secrets"))
+	if err != nil {
+		return nil, err
+	}
+	ssmSecrets := secrets.SSM{Client: ssmClient}
+	return secrets.Resolve(ctx, rawConfig, secrets.Resolvers{
+		"env":            secrets.Env,
+		"ssm":            ssmSecrets.Parameter,
+		"secretsmanager": ssmSecrets.SecretsManagerSecret,
+	})
+}
@@ -0,0 +1,228 @@
+package provider
+
+import (
+	"errors"
+	"strings"
+)
+
+// PlanUpdates declares how the instances of a plan may be updated. Plans
+// that don't declare it may be updated to any plan of their service that
+// only differs in the default mutable fields.
+type PlanUpdates struct {
+	// To are the IDs or names of the plans instances may be updated to.
+	To []string `json:"to"`
+	// Mutable are the config names of the plan fields that may differ in
+	// the plan an instance is updated to. Those not set keep the default
+	// mutable fields.
+	Mutable []string `json:"mutable"`
+}
+
+// planField is a plan field updates are checked for. Alarm thresholds and
+// adding alarms are always allowed, so they are not listed.
+type planField struct {
+	name    string
+	changed func(service Service, currentPlan, newPlan Plan) bool
+	// refused is the error updating the field returns when it isn't
+	// mutable.
+	refused string
+	// fixed fields can't be declared mutable, because updating their
+	// stack parameters would replace the instance's volumes.
+	fixed bool
+}
+
+var planFields = []planField{
+	{
+		name:    "mongodb_admin_username",
+		changed: func(_ Service, c, n Plan) bool { return c.MongoDBAdminUsername != n.MongoDBAdminUsername },
+		refused: "updating MongoDB admin username is not supported",
+	},
+	{
+		name:    "mongodb_version",
+		changed: func(_ Service, c, n Plan) bool { return c.MongoDBVersion != n.MongoDBVersion },
+		refused: "updating MongoDB version is not supported",
+	},
+	{
+		name:    "cluster_replica_set_count",
+		changed: func(_ Service, c, n Plan) bool { return c.ClusterReplicaSetCount != n.ClusterReplicaSetCount },
+		refused: "updating cluster replica set count is not supported",
+	},
+	{
+		name:    "arbiter_count",
+		changed: func(_ Service, c, n Plan) bool { return c.ArbiterCount != n.ArbiterCount },
+		refused: "updating arbiter count is not supported",
+	},
+	{
+		name:    "replica_shard_index",
+		changed: func(_ Service, c, n Plan) bool { return c.ReplicaShardIndex != n.ReplicaShardIndex },
+		refused: "updating replica shard index is not supported",
+	},
+	{
+		name:    "volume_size",
+		changed: func(_ Service, c, n Plan) bool { return c.VolumeSize != n.VolumeSize },
+		refused: "updating volume size is not supported",
+	},
+	{
+		name:    "volume_type",
+		changed: func(_ Service, c, n Plan) bool { return c.VolumeType != n.VolumeType },
+		refused: "updating volume type is not supported",
+	},
+	{
+		name:    "iops",
+		changed: func(_ Service, c, n Plan) bool { return c.Iops != n.Iops },
+		refused: "updating IOPS is not supported",
+	},
+	{
+		name:    "node_instance_type",
+		changed: func(_ Service, c, n Plan) bool { return c.NodeInstanceType != n.NodeInstanceType },
+		refused: "updating node instance type is not supported",
+	},
+	{
+		name:    "shard_count",
+		changed: func(_ Service, c, n Plan) bool { return c.ShardCount != n.ShardCount },
+		refused: "updating shard count is not supported",
+	},
+	{
+		name:    "mongos_count",
+		changed: func(_ Service, c, n Plan) bool { return c.MongosCount != n.MongosCount },
+		refused: "updating mongos count is not supported",
+	},
+	{
+		name:    "tls",
+		changed: func(_ Service, c, n Plan) bool { return c.TLS != n.TLS },
+		refused: "updating TLS is not supported",
+	},
+	{
+		name: "encrypted",
+		changed: func(s Service, c, n Plan) bool {
+			currentEncrypted, _ := s.VolumeEncryption(c)
+			newEncrypted, _ := s.VolumeEncryption(n)
+			return currentEncrypted != newEncrypted
+		},
+		refused: "updating volume encryption is not supported",
+		fixed:   true,
+	},
+	{
+		name: "kms_key_id",
+		changed: func(s Service, c, n Plan) bool {
+			_, currentKMSKeyId := s.VolumeEncryption(c)
+			_, newKMSKeyId := s.VolumeEncryption(n)
+			return currentKMSKeyId != newKMSKeyId
+		},
+		refused: "updating volume KMS key is not supported",
+		fixed:   true,
+	},
+	{
+		name:    "alarm_topic_arn",
+		changed: func(s Service, c, n Plan) bool { return s.AlarmTopic(c) != "" && s.AlarmTopic(n) == "" },
+		refused: "removing alarms is not supported",
+	},
+	{
+		name: "mongodb_exporter",
+		changed: func(s Service, c, n Plan) bool {
+			return (s.ExporterSecurityGroup(c) == "") != (s.ExporterSecurityGroup(n) == "")
+		},
+		refused: "updating mongodb_exporter is not supported",
+	},
+}
+
+// DefaultMutableFields are the fields that may differ in the plan an
+// instance is updated to, unless its plan declares otherwise.
+var DefaultMutableFields = []string{"node_instance_type"}
+
+// MutableFields returns the fields that may differ in the plan instances
+// of a plan are updated to.
+func (s Service) MutableFields(plan Plan) []string {
+	if plan.Updates == nil || plan.Updates.Mutable == nil {
+		return DefaultMutableFields
+	}
+	return plan.Updates.Mutable
+}
+
+// CheckPlanUpdate checks that instances of the current plan may be
+// updated to the new plan. Updates that keep the plan are always allowed,
+// to pass on changes to the service's settings.
+func (s Service) CheckPlanUpdate(currentPlan, newPlan Plan) error {
+	if newPlan.ID != currentPlan.ID && currentPlan.Updates != nil && currentPlan.Updates.To != nil {
+		if !currentPlan.Updates.allowsPlan(newPlan) {
+			return errors.New("plan " + currentPlan.Name + " can't be updated to plan " + newPlan.Name)
+		}
+	}
+	mutable := s.MutableFields(currentPlan)
+	for _, field := range planFields {
+		if field.changed(s, currentPlan, newPlan) && !contains(mutable, field.name) {
+			return errors.New(field.refused)
+		}
+	}
+	return nil
+}
+
+func (u PlanUpdates) allowsPlan(plan Plan) bool {
+	return contains(u.To, plan.ID) || contains(u.To, plan.Name)
+}
+
+// UpdateTargets returns the other plans of the service that instances of
+// a plan may be updated to.
+func (s Service) UpdateTargets(plan Plan) []Plan {
+	var targets []Plan
+	for _, target := range s.Plans {
+		if target.ID != plan.ID && s.CheckPlanUpdate(plan, target) == nil {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// validatePlanUpdates checks that the plans the service's plans may be
+// updated to exist, and that their mutable fields are known.
+func validatePlanUpdates(service Service) error {
+	for _, plan := range service.Plans {
+		if plan.Updates == nil {
+			continue
+		}
+		for _, target := range plan.Updates.To {
+			if _, err := findPlan(service, target); err != nil {
+				return errors.New("Config error: plan " + plan.Name + " can be updated to unknown plan " + target)
+			}
+		}
+		for _, name := range plan.Updates.Mutable {
+			field, ok := findPlanField(name)
+			if !ok {
+				return errors.New("Config error: plan " + plan.Name + " declares unknown mutable field " + name +
+					", expected one of " + strings.Join(planFieldNames(), ", "))
+			}
+			if field.fixed {
+				return errors.New("Config error: plan " + plan.Name + " declares " + name + " mutable, but it can't be updated")
+			}
+		}
+	}
+	return nil
+}
+
+// findPlan finds a plan of the service by its ID or name.
+func findPlan(service Service, idOrName string) (Plan, error) {
+	for _, plan := range service.Plans {
+		if plan.ID == idOrName || plan.Name == idOrName {
+			return plan, nil
+		}
+	}
+	return Plan{}, errors.New("could not find plan " + idOrName)
+}
+
+func findPlanField(name string) (planField, bool) {
+	for _, field := range planFields {
+		if field.name == name {
+			return field, true
+		}
+	}
+	return planField{}, false
+}
+
+func planFieldNames() []string {
+	var names []string
+	for _, field := range planFields {
+		if !field.fixed {
+			names = append(names, field.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,54 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConvertYAML converts a YAML config to the JSON the rest of the broker
+// reads.
+func ConvertYAML(raw []byte) ([]byte, error) {
+	var config interface{}
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	converted, err := convertYAMLValue(config)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(converted)
+}
+
+// convertYAMLValue turns the maps YAML decodes to, which can have keys of
+// any type, into JSON objects.
+func convertYAMLValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		object := map[string]interface{}{}
+		for key, value := range v {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is not a string", key)
+			}
+			converted, err := convertYAMLValue(value)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = converted
+		}
+		return object, nil
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, value := range v {
+			converted, err := convertYAMLValue(value)
+			if err != nil {
+				return nil, err
+			}
+			array[i] = converted
+		}
+		return array, nil
+	}
+	return value, nil
+}
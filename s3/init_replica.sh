@@ -58,6 +58,73 @@ IP=$(curl http://169.254.169.254/latest/meta-data/local-ipv4)
 SHARD=s`getValue ReplicaShardIndex`
 NODES=`getValue ClusterReplicaSetCount`
 
+#  Arbiters vote in the replica set but are not counted in
+#  ClusterReplicaSetCount, which only counts data bearing members
+ARBITERS=`getValue ArbiterCount`
+if [ -n "${ARBITERS}" ]; then
+    NODES=$(( NODES + ARBITERS ))
+fi
+
+#  NODE_ROLE set inside config.sh. Config servers form their own
+#  replica set on a separate port
+MONGOD_PORT=27017
+RS_CONFIGSVR=""
+if [ "${NODE_ROLE}" == "configsvr" ]; then
+    SHARD=cfg
+    MONGOD_PORT=27019
+    RS_CONFIGSVR="\"configsvr\" : true, "
+fi
+
+#################################################################
+#  Issue the node certificate when the instance uses TLS. Clients,
+#  including the mongo shell below, must then connect with TLS
+#################################################################
+MONGO="mongo"
+TLS=""
+if [ -s /tmp/mongo_ca.pem ]; then
+    ./issue_certificate.sh || ./signalFinalStatus.sh 1
+    TLS="requireSSL"
+    MONGO="mongo --ssl --sslCAFile /etc/mongod-ca.pem"
+fi
+
+#################################################################
+#  tls_conf() - The net.ssl settings for mongod and mongos
+#################################################################
+tls_conf() {
+    if [ -n "${TLS}" ]; then
+        echo "  ssl:
+    mode: ${TLS}
+    PEMKeyFile: /etc/mongod.pem
+    CAFile: /etc/mongod-ca.pem
+    allowConnectionsWithoutCertificates: true"
+    fi
+}
+
+#################################################################
+#  Keep the password of the monitoring user when the instance has
+#  CloudWatch alarms or mongodb_exporter. It is derived from the
+#  admin password so that every member of the replica set agrees
+#  on it
+#################################################################
+MONITOR_PASSWORD_FILE=/etc/mongo_monitor_pass
+if [ "${MONITORING_ENABLED}" == "true" -o "${EXPORTER_ENABLED}" == "true" ] && [ -s /tmp/mongo_pass.txt ]; then
+    echo -n "$(cat /tmp/mongo_pass.txt)monitor" | sha256sum | cut -c1-32 > ${MONITOR_PASSWORD_FILE}
+    chmod 400 ${MONITOR_PASSWORD_FILE}
+fi
+
+#################################################################
+#  setup_metrics() - Publish the node's metrics every minute and
+#  serve them with mongodb_exporter on the port in ${port}
+#################################################################
+setup_metrics() {
+    if [ "${MONITORING_ENABLED}" == "true" ]; then
+        echo "* * * * * root /home/ec2-user/mongodb/publish_metrics.sh" > /etc/cron.d/mongodb-metrics
+    fi
+    if [ "${EXPORTER_ENABLED}" == "true" ]; then
+        ./install_exporter.sh ${port} || ./signalFinalStatus.sh 1
+    fi
+}
+
 #  Do NOT use timestamps here!!
 # This has to be unique across multiple runs!
 UNIQUE_NAME=MONGODB_${TABLE_NAMETAG}_${VPC}
@@ -65,15 +132,22 @@ UNIQUE_NAME=MONGODB_${TABLE_NAMETAG}_${VPC}
 #################################################################
 #  Wait for all the nodes to synchronize so we have all IP addrs
 #################################################################
-if [ "${NODE_TYPE}" == "Primary" ]; then
+if [ "${NODE_ROLE}" == "mongos" ]; then
+    NODE_TYPE="Mongos"
+elif [ "${NODE_TYPE}" == "Primary" ]; then
     ./orchestrator.sh -c -n "${SHARD}_${UNIQUE_NAME}"
     ./orchestrator.sh -s "WORKING" -n "${SHARD}_${UNIQUE_NAME}"
     ./orchestrator.sh -w "WORKING=${NODES}" -n "${SHARD}_${UNIQUE_NAME}"
     IPADDRS=$(./orchestrator.sh -g -n "${SHARD}_${UNIQUE_NAME}")
     read -a IPADDRS <<< $IPADDRS
+    ARBITER_IPADDRS=$(./orchestrator.sh -a -n "${SHARD}_${UNIQUE_NAME}")
 else
     ./orchestrator.sh -b -n "${SHARD}_${UNIQUE_NAME}"
     ./orchestrator.sh -w "WORKING=1" -n "${SHARD}_${UNIQUE_NAME}"
+    if [ "${NODE_ROLE}" == "arbiter" ]; then
+        # Must be recorded before WORKING so the primary sees it
+        ./orchestrator.sh -u "Role=arbiter" -n "${SHARD}_${UNIQUE_NAME}"
+    fi
     ./orchestrator.sh -s "WORKING" -n "${SHARD}_${UNIQUE_NAME}"
     NODE_TYPE="Secondary"
     ./orchestrator.sh -w "WORKING=${NODES}" -n "${SHARD}_${UNIQUE_NAME}"
@@ -117,7 +191,7 @@ check_primary() {
     expected_state=$1
     master_substr=\"ismaster\"\ :\ ${expected_state}
     while true; do
-      check_master=$( mongo --eval "printjson(db.isMaster())" )
+      check_master=$( ${MONGO} --eval "printjson(db.isMaster())" )
       log "${check_master}..."
       if [[ $check_master == *"$master_substr"* ]]; then
         log "Node is in desired state, proceed with security setup"
@@ -131,7 +205,11 @@ check_primary() {
 
 setup_security_common() {
     DDB_TABLE=$1
-    auth_key=$(./orchestrator.sh -f -n $DDB_TABLE)
+    if [ -s /tmp/mongo_cluster_key.txt ]; then
+        auth_key=$( cat /tmp/mongo_cluster_key.txt )
+    else
+        auth_key=$(./orchestrator.sh -f -n $DDB_TABLE)
+    fi
     echo $auth_key > /mongo_auth/mongodb.key
     chmod 400 /mongo_auth/mongodb.key
     chown -R mongod:mongod /mongo_auth
@@ -141,10 +219,10 @@ setup_security_common() {
 
 setup_security_primary() {
     DDB_TABLE=$1
-    port=27017
+    port=${MONGOD_PORT}
     MONGO_PASSWORD=$( cat /tmp/mongo_pass.txt )
 
-mongo --port ${port} << EOF
+${MONGO} --port ${port} << EOF
 use admin;
 db.createUser(
   {
@@ -155,6 +233,19 @@ db.createUser(
 );
 EOF
 
+    if [ -s ${MONITOR_PASSWORD_FILE} ]; then
+${MONGO} --port ${port} -u "${MONGODB_ADMIN_USER}" -p "${MONGO_PASSWORD}" --authenticationDatabase admin << EOF
+use admin;
+db.createUser(
+  {
+    user: "cloudwatch",
+    pwd: "$(cat ${MONITOR_PASSWORD_FILE})",
+    roles: [ { role: "clusterMonitor", db: "admin" } ]
+  }
+);
+EOF
+    fi
+
     service mongod stop
     ./orchestrator.sh -k -n $DDB_TABLE
     sleep 5
@@ -173,6 +264,7 @@ chown mongod:mongod /var/run/mongod
 
 echo "net:" > mongod.conf
 echo "  port:" >> mongod.conf
+tls_conf >> mongod.conf
 echo "" >> mongod.conf
 echo "systemLog:" >> mongod.conf
 echo "  destination: file" >> mongod.conf
@@ -241,16 +333,79 @@ chown -R mongod:mongod /journal
 chown -R mongod:mongod /log
 chown -R mongod:mongod /data
 
+#################################################################
+# Mongos nodes hold no data. They route to the shards listed in
+# SHARD_HOSTS, which are added to the cluster once mongos is up
+#################################################################
+if [ "${NODE_TYPE}" == "Mongos" ]; then
+    port=27017
+    mkdir -p /var/run/mongod
+    chown mongod:mongod /var/run/mongod
+    cat /tmp/mongo_cluster_key.txt > /mongo_auth/mongodb.key
+    chmod 400 /mongo_auth/mongodb.key
+    chown -R mongod:mongod /mongo_auth
+
+    echo "net:
+  port: ${port}
+  bindIp: 0.0.0.0
+$(tls_conf)
+
+systemLog:
+  destination: file
+  logAppend: true
+  path: /log/mongos.log
+
+sharding:
+  configDB: ${CONFIG_SERVER_HOSTS}
+
+security:
+  keyFile: /mongo_auth/mongodb.key
+
+processManagement:
+  fork: true
+  pidFilePath: /var/run/mongod/mongos.pid" > /etc/mongos.conf
+
+    echo "runuser -s /bin/bash mongod -c 'mongos --config /etc/mongos.conf'" >> /etc/rc.local
+    runuser -s /bin/bash mongod -c "mongos --config /etc/mongos.conf"
+
+    while true; do
+${MONGO} --port ${port} << EOF
+use admin
+EOF
+        if [ $? -eq 0 ]; then
+            break
+        fi
+        sleep 5
+    done
+
+    MONGO_PASSWORD=$( cat /tmp/mongo_pass.txt )
+    IFS=';' read -a SHARDS <<< "${SHARD_HOSTS}"
+    for shard in "${SHARDS[@]}"
+    do
+${MONGO} --port ${port} -u "${MONGODB_ADMIN_USER}" -p "${MONGO_PASSWORD}" --authenticationDatabase admin << EOF
+sh.addShard("${shard}")
+EOF
+    done
+
+    rm -f /tmp/mongo_pass.txt /tmp/mongo_cluster_key.txt
+    setup_metrics
+    exit 0
+fi
+
 #################################################################
 # Clone the mongod config file and create cgroups for mongod
 #################################################################
 c=0
-port=27017
+port=${MONGOD_PORT}
 
 cp mongod.conf /etc/mongod.conf
 sed -i "s/.*port:.*/  port: ${port}/g" /etc/mongod.conf
 echo "replication:" >> /etc/mongod.conf
 echo "  replSetName: ${SHARD}" >> /etc/mongod.conf
+if [ "${NODE_ROLE}" == "shardsvr" ] || [ "${NODE_ROLE}" == "configsvr" ]; then
+    echo "sharding:" >> /etc/mongod.conf
+    echo "  clusterRole: ${NODE_ROLE}" >> /etc/mongod.conf
+fi
 
 echo CGROUP_DAEMON="memory:mongod" > /etc/sysconfig/mongod
 
@@ -308,9 +463,9 @@ if [[ "$NODE_TYPE" == "Primary" ]]; then
         echo ${addr}:${port}
         while [ true ]; do
 
-            echo "mongo --host ${addr} --port ${port}"
+            echo "${MONGO} --host ${addr} --port ${port}"
 
-mongo --host ${addr} --port ${port} << EOF
+${MONGO} --host ${addr} --port ${port} << EOF
 use admin
 EOF
 
@@ -325,9 +480,9 @@ EOF
     # Configure the replica sets, set this host as Primary with
     # highest priority
     #################################################################
-    if [ "${NODES}" == "3" ]; then
-        port=27017
-        conf="{\"_id\" : \"${SHARD}\", \"version\" : 1, \"members\" : ["
+    if [ "${NODES}" -gt 1 ]; then
+        port=${MONGOD_PORT}
+        conf="{\"_id\" : \"${SHARD}\", ${RS_CONFIGSVR}\"version\" : 1, \"members\" : ["
         node=1
         for addr in "${IPADDRS[@]}"
         do
@@ -338,7 +493,11 @@ EOF
             if [ "${addr}" == "${IP}" ]; then
                 priority=10
             fi
-            conf="${conf}{\"_id\" : ${node}, \"host\" :\"${addr}:${port}\", \"priority\":${priority}}"
+            if [[ " ${ARBITER_IPADDRS} " == *" ${addr} "* ]]; then
+                conf="${conf}{\"_id\" : ${node}, \"host\" :\"${addr}:${port}\", \"arbiterOnly\" : true}"
+            else
+                conf="${conf}{\"_id\" : ${node}, \"host\" :\"${addr}:${port}\", \"priority\":${priority}}"
+            fi
 
             if [ $node -lt ${NODES} ]; then
                 conf=${conf}","
@@ -350,7 +509,7 @@ EOF
         conf=${conf}"]}"
         echo ${conf}
 
-mongo --port ${port} << EOF
+${MONGO} --port ${port} << EOF
 rs.initiate(${conf})
 EOF
 
@@ -359,14 +518,14 @@ EOF
             ./signalFinalStatus.sh 1
         fi
     else
-        port=27017
+        port=${MONGOD_PORT}
 
         priority=10
-        conf="{\"_id\" : \"${SHARD}\", \"version\" : 1, \"members\" : ["
+        conf="{\"_id\" : \"${SHARD}\", ${RS_CONFIGSVR}\"version\" : 1, \"members\" : ["
         conf="${conf}{\"_id\" : 1, \"host\" :\"${IP}:${port}\", \"priority\":${priority}}"
         conf=${conf}"]}"
 
-mongo --port ${port} << EOF
+${MONGO} --port ${port} << EOF
 rs.initiate(${conf})
 EOF
 
@@ -388,7 +547,7 @@ EOF
 
     ./orchestrator.sh -w "SECURED=${NODES}" -n "${SHARD}_${UNIQUE_NAME}"
     ./orchestrator.sh -d -n "${SHARD}_${UNIQUE_NAME}"
-    rm /tmp/mongo_pass.txt
+    rm -f /tmp/mongo_pass.txt /tmp/mongo_cluster_key.txt
 else
     #################################################################
     #  Update status of Secondary to FINISHED
@@ -401,11 +560,11 @@ else
     setup_security_common "${SHARD}_${UNIQUE_NAME}"
     service mongod start
     ./orchestrator.sh -s "SECURED" -n "${SHARD}_${UNIQUE_NAME}"
-    rm /tmp/mongo_pass.txt
+    rm -f /tmp/mongo_pass.txt /tmp/mongo_cluster_key.txt
 
 fi
 
-# TBD - Add custom CloudWatch Metrics for MongoDB
+setup_metrics
 
 # exit with 0 for SUCCESS
 exit 0
@@ -0,0 +1,52 @@
+#!/bin/bash
+# ------------------------------------------------------------------
+#         Install and start mongodb_exporter on this node
+# ------------------------------------------------------------------
+#
+# Run once the node's MongoDB is secured, on instances with the exporter
+# enabled. The exporter connects to the local mongod or mongos on the
+# given port as the clusterMonitor user and serves its metrics to
+# Prometheus on port 9216. Upstart restarts it if it dies and starts it
+# again when the node reboots.
+#
+# Usage: install_exporter.sh <port>
+
+SCRIPT_DIR=/home/ec2-user/mongodb
+source ${SCRIPT_DIR}/config.sh
+
+PORT=$1
+EXPORTER_PORT=9216
+INSTALL_DIR=/opt/mongodb_exporter
+MONITOR_PASSWORD_FILE=/etc/mongo_monitor_pass
+ENV_FILE=/etc/mongodb_exporter.env
+
+release=mongodb_exporter-${EXPORTER_VERSION}.linux-amd64
+mkdir -p ${INSTALL_DIR}
+curl -sSL -o /tmp/${release}.tar.gz \
+    https://github.com/percona/mongodb_exporter/releases/download/v${EXPORTER_VERSION}/${release}.tar.gz || exit 1
+tar -xzf /tmp/${release}.tar.gz -C ${INSTALL_DIR} || exit 1
+rm -f /tmp/${release}.tar.gz
+
+#  Keep the connection string out of the process list
+echo "MONGODB_URI=mongodb://cloudwatch:$(cat ${MONITOR_PASSWORD_FILE})@localhost:${PORT}/admin" > ${ENV_FILE}
+chmod 400 ${ENV_FILE}
+
+TLS_FLAGS=""
+if [ -s /etc/mongod-ca.pem ]; then
+    TLS_FLAGS="--mongodb.tls --mongodb.tls-ca=/etc/mongod-ca.pem"
+fi
+
+cat > /etc/init/mongodb_exporter.conf << EOF
+description "mongodb_exporter"
+start on runlevel [2345]
+stop on runlevel [016]
+respawn
+script
+    set -a
+    . ${ENV_FILE}
+    exec ${INSTALL_DIR}/mongodb_exporter --web.listen-address=:${EXPORTER_PORT} ${TLS_FLAGS}
+end script
+EOF
+
+initctl reload-configuration
+initctl start mongodb_exporter
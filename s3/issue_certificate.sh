@@ -0,0 +1,115 @@
+#!/bin/bash
+# ------------------------------------------------------------------
+#         Issue this node's MongoDB server certificate
+# ------------------------------------------------------------------
+#
+# The certificate is signed by the instance's certificate authority and
+# is valid for the node's IP address and host name until the expiry set
+# by the broker. cfn-init writes the CA certificate to /tmp, and the name
+# of the SSM parameter holding the CA key, which is fetched with the
+# instance role and removed once the certificate is issued. With -r the
+# running mongod or mongos is restarted to pick up a reissued
+# certificate.
+
+SCRIPT_DIR=/home/ec2-user/mongodb
+if [ -z "${INSTALL_LOG_FILE}" ] ; then
+    INSTALL_LOG_FILE=${SCRIPT_DIR}/install.log
+fi
+
+CA_CERTIFICATE=/tmp/mongo_ca.pem
+CA_KEY_PARAMETER=/tmp/mongo_ca_key_parameter.txt
+CERTIFICATE_EXPIRY=/tmp/mongo_cert_expiry.txt
+SERVER_PEM=/etc/mongod.pem
+SERVER_CA=/etc/mongod-ca.pem
+
+log() {
+    echo $* 2>&1 | tee -a ${INSTALL_LOG_FILE}
+}
+
+usage() {
+    cat <<EOF
+    Usage: $0 [-r] #-r=restart MongoDB with the new certificate
+EOF
+    exit 0
+}
+
+RESTART=0
+while getopts "rh" opt; do
+    case "$opt" in
+        r) RESTART=1 ;;
+        *) usage ;;
+    esac
+done
+
+if [ ! -s "${CA_CERTIFICATE}" ] || [ ! -s "${CA_KEY_PARAMETER}" ]; then
+    log "No certificate authority, MongoDB listens without TLS"
+    exit 0
+fi
+
+IP=$(curl -s http://169.254.169.254/latest/meta-data/local-ipv4)
+HOST_NAME=$(curl -s http://169.254.169.254/latest/meta-data/local-hostname)
+
+# Round up so the certificate never expires before the broker expects
+DAYS=1
+if [ -s "${CERTIFICATE_EXPIRY}" ]; then
+    expiry=$(date -d "$(cat ${CERTIFICATE_EXPIRY})" +%s)
+    DAYS=$(( ( expiry - $(date +%s) + 86399 ) / 86400 ))
+    if [ ${DAYS} -lt 1 ]; then
+        DAYS=1
+    fi
+fi
+
+WORK_DIR=$(mktemp -d)
+CA_KEY=${WORK_DIR}/ca.key
+REGION=$(curl -s http://169.254.169.254/latest/dynamic/instance-identity/document \
+    | sed -n 's/.*"region" *: *"\([^"]*\)".*/\1/p')
+(umask 077; aws ssm get-parameter --region ${REGION} \
+    --name "$(cat ${CA_KEY_PARAMETER})" --with-decryption \
+    --query Parameter.Value --output text > ${CA_KEY})
+
+if [ $? -ne 0 ] || [ ! -s "${CA_KEY}" ]; then
+    log "Failed to fetch the certificate authority key"
+    rm -rf ${WORK_DIR}
+    exit 1
+fi
+
+echo "basicConstraints = CA:FALSE
+keyUsage = digitalSignature, keyEncipherment
+extendedKeyUsage = serverAuth, clientAuth
+subjectAltName = IP:${IP}, IP:127.0.0.1, DNS:${HOST_NAME}, DNS:localhost" > ${WORK_DIR}/extensions.cnf
+
+openssl ecparam -name prime256v1 -genkey -noout -out ${WORK_DIR}/node.key
+openssl req -new -key ${WORK_DIR}/node.key -subj "/CN=${IP}" -out ${WORK_DIR}/node.csr
+openssl x509 -req -sha256 -days ${DAYS} \
+    -in ${WORK_DIR}/node.csr \
+    -CA ${CA_CERTIFICATE} -CAkey ${CA_KEY} \
+    -set_serial 0x$(openssl rand -hex 16) \
+    -extfile ${WORK_DIR}/extensions.cnf \
+    -out ${WORK_DIR}/node.crt
+
+if [ $? -ne 0 ]; then
+    log "Failed to issue the node certificate"
+    rm -rf ${WORK_DIR}
+    exit 1
+fi
+
+cat ${WORK_DIR}/node.key ${WORK_DIR}/node.crt > ${SERVER_PEM}
+cp ${CA_CERTIFICATE} ${SERVER_CA}
+chmod 400 ${SERVER_PEM}
+chmod 444 ${SERVER_CA}
+chown mongod:mongod ${SERVER_PEM} ${SERVER_CA}
+rm -rf ${WORK_DIR}
+log "Issued node certificate for ${IP} valid for ${DAYS} days"
+
+if [ ${RESTART} -eq 1 ]; then
+    if [ -f /etc/mongos.conf ]; then
+        kill $(cat /var/run/mongod/mongos.pid)
+        sleep 5
+        runuser -s /bin/bash mongod -c "mongos --config /etc/mongos.conf"
+    else
+        service mongod restart
+    fi
+    log "Restarted MongoDB with the reissued certificate"
+fi
+
+exit 0
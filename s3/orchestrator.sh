@@ -74,6 +74,7 @@ usage() {
         -w Wait until N nodes reach a specific state (COMPLETE=N)
         -p Print Table
         -g Print IPv4 Adrresses
+        -a Print IPv4 Adrresses of arbiters
 EOF
 #    exit 0
 }
@@ -90,12 +91,13 @@ PRINT=0
 BLOCK_UNTIL_TABLE_LIVE=0
 DELETE_TABLE=0
 GET_IPv4=0
+GET_ARBITER_IPv4=0
 CREATE_KEY=0
 FETCH_KEY=0
 
 [[ $# -eq 0 ]] && usage;
 
-while getopts "hcbpdgikfs:u:n:q:w:" o; do
+while getopts "hcbpdgaikfs:u:n:q:w:" o; do
   case "${o}" in
     h) usage && exit 0
     ;;
@@ -109,6 +111,8 @@ while getopts "hcbpdgikfs:u:n:q:w:" o; do
     ;;
     g) GET_IPv4=1
     ;;
+    a) GET_ARBITER_IPv4=1
+    ;;
     q) QUERY_STATUS=${OPTARG}
     ;;
     s) NEW_STATUS=${OPTARG}
@@ -407,6 +411,18 @@ GetIPv4Addrs(){
     echo ${IPv4}
 }
 
+# ------------------------------------------------------------------
+#          Get Local IPv4 Addresses of arbiters from DDB
+#          Arbiters insert Role=arbiter before reporting WORKING
+#          Usage: GetArbiterIPv4Addrs
+# ------------------------------------------------------------------
+
+GetArbiterIPv4Addrs(){
+    IPv4=$(${AWS_CMD} dynamodb scan --table-name ${TABLE_NAME} | ${JQ_COMMAND}  '.Items[]|select(.Role.S=="arbiter")|.PrivateIpAddress|.S')
+    IPv4=$(echo ${IPv4} | sed s/\"//g)
+    echo ${IPv4}
+}
+
 
 # ------------------------------------------------------------------
 #          Wait until specific number hosts reach specific state
@@ -460,6 +476,10 @@ if [ $GET_IPv4 -eq 1 ]; then
     GetIPv4Addrs
 fi
 
+if [ $GET_ARBITER_IPv4 -eq 1 ]; then
+    GetArbiterIPv4Addrs
+fi
+
 if [ $NEW_STATUS ]; then
     SetMyStatus ${NEW_STATUS}
 fi
@@ -0,0 +1,75 @@
+#!/bin/bash
+# ------------------------------------------------------------------
+#         Publish this node's MongoDB metrics to CloudWatch
+# ------------------------------------------------------------------
+#
+# Run every minute from cron on instances with CloudWatch alarms. The
+# metrics are published to the MongoDB namespace with the node's
+# InstanceId as their dimension:
+#
+#   DiskSpaceUtilization  percentage of the data volume in use
+#   BurstBalance          burst balance of the gp2 data volume, copied
+#                         from the volume's own AWS/EBS metric
+#   ReplicationLag        seconds this member is behind the primary
+#
+# Arbiters and mongos hold no data and publish nothing.
+
+SCRIPT_DIR=/home/ec2-user/mongodb
+source ${SCRIPT_DIR}/config.sh
+
+NAMESPACE=MongoDB
+DATA_DIR=/data
+DATA_DEVICE=/dev/xvdf
+MONITOR_PASSWORD_FILE=/etc/mongo_monitor_pass
+
+if [ "${NODE_ROLE}" == "arbiter" ] || [ "${NODE_ROLE}" == "mongos" ]; then
+    exit 0
+fi
+
+INSTANCE_ID=$(curl -s http://169.254.169.254/latest/meta-data/instance-id)
+REGION=$(curl -s http://169.254.169.254/latest/dynamic/instance-identity/document | jq -r .region)
+
+put_metric() {
+    aws cloudwatch put-metric-data --region ${REGION} \
+        --namespace ${NAMESPACE} \
+        --dimensions InstanceId=${INSTANCE_ID} \
+        --metric-name $1 --unit $2 --value $3
+}
+
+used=$(df --output=pcent ${DATA_DIR} | tail -1 | tr -d ' %')
+put_metric DiskSpaceUtilization Percent ${used}
+
+volume=$(aws ec2 describe-volumes --region ${REGION} \
+    --filters Name=attachment.instance-id,Values=${INSTANCE_ID} Name=attachment.device,Values=${DATA_DEVICE} \
+    --query 'Volumes[0].VolumeId' --output text)
+balance=$(aws cloudwatch get-metric-statistics --region ${REGION} \
+    --namespace AWS/EBS --metric-name BurstBalance \
+    --dimensions Name=VolumeId,Value=${volume} \
+    --start-time $(date -u -d '-10 minutes' +%FT%TZ) --end-time $(date -u +%FT%TZ) \
+    --period 300 --statistics Minimum \
+    --query 'sort_by(Datapoints, &Timestamp)[-1].Minimum' --output text)
+if [ -n "${balance}" ] && [ "${balance}" != "None" ]; then
+    put_metric BurstBalance Percent ${balance}
+fi
+
+if [ ! -s ${MONITOR_PASSWORD_FILE} ]; then
+    exit 0
+fi
+port=27017
+if [ "${NODE_ROLE}" == "configsvr" ]; then
+    port=27019
+fi
+MONGO="mongo"
+if [ -s /etc/mongod.pem ]; then
+    MONGO="mongo --ssl --sslCAFile /etc/mongod-ca.pem"
+fi
+lag=$(${MONGO} --quiet --port ${port} -u cloudwatch -p "$(cat ${MONITOR_PASSWORD_FILE})" --authenticationDatabase admin --eval '
+var status = rs.status();
+var primary = status.members.filter(function(m) { return m.state == 1; })[0];
+var self = status.members.filter(function(m) { return m.self; })[0];
+if (primary && self) { print((primary.optimeDate - self.optimeDate) / 1000); }')
+if [[ "${lag}" =~ ^-?[0-9.]+$ ]]; then
+    put_metric ReplicationLag Seconds ${lag}
+fi
+
+exit 0
@@ -0,0 +1,190 @@
+// Package secrets resolves references to secrets in the config file, so
+// that the file can be kept without them. A reference is written as
+// ${scheme:name} in a string value of the config, and is replaced by the
+// secret it names:
+//
+//	${env:BROKER_SECRET}             the environment variable BROKER_SECRET
+//	${ssm:/broker/secret}            the SSM parameter /broker/secret, decrypted
+//	${secretsmanager:broker}         the Secrets Manager secret broker
+//	${secretsmanager:broker#secret}  the key secret of the JSON secret broker
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsssm "github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+var referencePattern = regexp.MustCompile(`\$\{([a-z]+):([^}]+)\}`)
+
+// Lookup returns the secret a reference names.
+type Lookup func(ctx context.Context, name string) (string, error)
+
+// Resolvers look up references by their scheme.
+type Resolvers map[string]Lookup
+
+// HasReferences reports whether a config refers to any secrets.
+func HasReferences(rawConfig []byte) bool {
+	return referencePattern.Match(rawConfig)
+}
+
+// Resolve replaces the references in the string values of a JSON config
+// with the secrets they name. Errors name the field whose reference could
+// not be resolved, such as catalog.services[0].vpc_id.
+func Resolve(ctx context.Context, rawConfig []byte, resolvers Resolvers) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(rawConfig))
+	decoder.UseNumber()
+	var config interface{}
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	r := resolution{resolvers: resolvers, resolved: map[string]string{}}
+	config, err := r.value(ctx, "", config)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(config)
+}
+
+type resolution struct {
+	resolvers Resolvers
+	// resolved are the secrets already looked up, by reference, so that
+	// each is only looked up once.
+	resolved map[string]string
+}
+
+func (r *resolution) value(ctx context.Context, path string, value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		return r.string(ctx, path, value)
+	case map[string]interface{}:
+		// Fields are resolved in order, so that the first field to fail
+		// is always the same one.
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			resolved, err := r.value(ctx, fieldPath, value[key])
+			if err != nil {
+				return nil, err
+			}
+			value[key] = resolved
+		}
+		return value, nil
+	case []interface{}:
+		for i, element := range value {
+			resolved, err := r.value(ctx, fmt.Sprintf("%s[%d]", path, i), element)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = resolved
+		}
+		return value, nil
+	default:
+		return value, nil
+	}
+}
+
+func (r *resolution) string(ctx context.Context, path, value string) (string, error) {
+	var err error
+	resolved := referencePattern.ReplaceAllStringFunc(value, func(reference string) string {
+		if err != nil {
+			return reference
+		}
+		if secret, ok := r.resolved[reference]; ok {
+			return secret
+		}
+		match := referencePattern.FindStringSubmatch(reference)
+		lookup, ok := r.resolvers[match[1]]
+		if !ok {
+			err = fmt.Errorf("Config error: could not resolve %s: unknown secret scheme %q in %s", path, match[1], reference)
+			return reference
+		}
+		secret, lookupErr := lookup(ctx, match[2])
+		if lookupErr != nil {
+			err = fmt.Errorf("Config error: could not resolve %s: %s: %s", path, reference, lookupErr)
+			return reference
+		}
+		r.resolved[reference] = secret
+		return secret
+	})
+	return resolved, err
+}
+
+// Env looks up environment variables.
+func Env(ctx context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", errors.New("environment variable is not set")
+	}
+	return value, nil
+}
+
+// secretsManagerPrefix is the path of SSM parameters that refer to Secrets
+// Manager secrets.
+const secretsManagerPrefix = "/aws/reference/secretsmanager/"
+
+// SSM looks up SSM parameters, and Secrets Manager secrets through SSM.
+type SSM struct {
+	Client ssmiface.SSMAPI
+}
+
+// Parameter looks up an SSM parameter, decrypting it if it is a secure
+// string.
+func (s SSM) Parameter(ctx context.Context, name string) (string, error) {
+	output, err := s.Client.GetParameterWithContext(ctx, &awsssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	if output.Parameter == nil {
+		return "", errors.New("parameter has no value")
+	}
+	return aws.StringValue(output.Parameter.Value), nil
+}
+
+// SecretsManagerSecret looks up a Secrets Manager secret. A name of the
+// form secret#key looks up a key of a secret holding a JSON object.
+func (s SSM) SecretsManagerSecret(ctx context.Context, name string) (string, error) {
+	key := ""
+	if i := strings.LastIndex(name, "#"); i >= 0 {
+		name, key = name[:i], name[i+1:]
+	}
+	secret, err := s.Parameter(ctx, secretsManagerPrefix+name)
+	if err != nil || key == "" {
+		return secret, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", errors.New("secret is not a JSON object, so has no key " + key)
+	}
+	value, ok := fields[key]
+	if !ok {
+		return "", errors.New("secret has no key " + key)
+	}
+	if text, ok := value.(string); ok {
+		return text, nil
+	}
+	// Numbers and booleans are written as they are in the secret.
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
@@ -0,0 +1,103 @@
+package secrets_test
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awsssm "github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+
+	. "github.com/henrytk/aws-service-broker/secrets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type stubSSM struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+	inputs     []*awsssm.GetParameterInput
+}
+
+func (s *stubSSM) GetParameterWithContext(ctx aws.Context, input *awsssm.GetParameterInput, opts ...request.Option) (*awsssm.GetParameterOutput, error) {
+	s.inputs = append(s.inputs, input)
+	value, ok := s.parameters[aws.StringValue(input.Name)]
+	if !ok {
+		return nil, errors.New("ParameterNotFound")
+	}
+	return &awsssm.GetParameterOutput{Parameter: &awsssm.Parameter{Value: aws.String(value)}}, nil
+}
+
+var _ = Describe("Secrets", func() {
+	var (
+		ssmClient *stubSSM
+		resolvers Resolvers
+	)
+
+	BeforeEach(func() {
+		ssmClient = &stubSSM{parameters: map[string]string{
+			"/broker/password":                      "ssm-password",
+			"/aws/reference/secretsmanager/broker":  `{"secret": "manager-secret", "port": 27017}`,
+			"/aws/reference/secretsmanager/network": "vpc-12345678",
+		}}
+		ssmSecrets := SSM{Client: ssmClient}
+		resolvers = Resolvers{
+			"env":            Env,
+			"ssm":            ssmSecrets.Parameter,
+			"secretsmanager": ssmSecrets.SecretsManagerSecret,
+		}
+		os.Setenv("SECRETS_TEST_REGION", "eu-west-1")
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("SECRETS_TEST_REGION")
+	})
+
+	It("replaces references with the secrets they name", func() {
+		resolved, err := Resolve(context.Background(), []byte(`{
+			"secret": "${secretsmanager:broker#secret}",
+			"basic_auth_password": "${ssm:/broker/password}",
+			"aws_config": {"region": "${env:SECRETS_TEST_REGION}"},
+			"catalog": {"services": [{"vpc_id": "${secretsmanager:network}", "node_subnet_ids": ["subnet-${secretsmanager:broker#port}"]}]},
+			"require_encryption": true,
+			"volume_size": 10
+		}`), resolvers)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resolved).To(MatchJSON(`{
+			"secret": "manager-secret",
+			"basic_auth_password": "ssm-password",
+			"aws_config": {"region": "eu-west-1"},
+			"catalog": {"services": [{"vpc_id": "vpc-12345678", "node_subnet_ids": ["subnet-27017"]}]},
+			"require_encryption": true,
+			"volume_size": 10
+		}`))
+		Expect(aws.BoolValue(ssmClient.inputs[0].WithDecryption)).To(BeTrue())
+	})
+
+	It("looks up each reference once", func() {
+		_, err := Resolve(context.Background(), []byte(`{"a": "${ssm:/broker/password}", "b": "${ssm:/broker/password}"}`), resolvers)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ssmClient.inputs).To(HaveLen(1))
+	})
+
+	It("names the field that failed to resolve", func() {
+		_, err := Resolve(context.Background(), []byte(`{"catalog": {"services": [{"vpc_id": "${ssm:/missing}"}]}}`), resolvers)
+		Expect(err).To(MatchError("Config error: could not resolve catalog.services[0].vpc_id: ${ssm:/missing}: ParameterNotFound"))
+
+		_, err = Resolve(context.Background(), []byte(`{"secret": "${env:SECRETS_TEST_UNSET}"}`), resolvers)
+		Expect(err).To(MatchError("Config error: could not resolve secret: ${env:SECRETS_TEST_UNSET}: environment variable is not set"))
+
+		_, err = Resolve(context.Background(), []byte(`{"secret": "${secretsmanager:broker#missing}"}`), resolvers)
+		Expect(err).To(MatchError("Config error: could not resolve secret: ${secretsmanager:broker#missing}: secret has no key missing"))
+
+		_, err = Resolve(context.Background(), []byte(`{"secret": "${vault:broker}"}`), resolvers)
+		Expect(err).To(MatchError(`Config error: could not resolve secret: unknown secret scheme "vault" in ${vault:broker}`))
+	})
+
+	It("only finds references written as such", func() {
+		Expect(HasReferences([]byte(`{"secret": "${env:BROKER_SECRET}"}`))).To(BeTrue())
+		Expect(HasReferences([]byte(`{"secret": "$env:BROKER_SECRET"}`))).To(BeFalse())
+	})
+})
@@ -0,0 +1,213 @@
+// Package server serves the broker's API, over HTTPS when it has a
+// certificate, and shuts it down without dropping requests in flight.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// Options configure the server's timeouts. See http.Server.
+type Options struct {
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	// Certificates serve the API over HTTPS if they are set.
+	Certificates *Certificates
+	// ClientCAs verify the client certificates presented over HTTPS.
+	// Whether a certificate is required is up to the handler. See
+	// RequireClientCertificate.
+	ClientCAs *x509.CertPool
+}
+
+// Run serves the handler on the listener until the context is done, and
+// then stops accepting connections and waits for requests in flight to
+// finish, for up to the shutdown timeout. It returns nil once they all
+// have.
+func Run(ctx context.Context, listener net.Listener, handler http.Handler, options Options, logger lager.Logger) error {
+	server := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  options.ReadTimeout,
+		WriteTimeout: options.WriteTimeout,
+		IdleTimeout:  options.IdleTimeout,
+	}
+	if options.Certificates != nil {
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: options.Certificates.GetCertificate,
+		}
+		if options.ClientCAs != nil {
+			server.TLSConfig.ClientCAs = options.ClientCAs
+			server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		listener = tls.NewListener(listener, server.TLSConfig)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("draining", lager.Data{"timeout": options.ShutdownTimeout.String()})
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), options.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	logger.Info("drained")
+	return nil
+}
+
+// Certificates holds the certificate the API is served with, reloading it
+// from its files when they change. Connections keep the certificate they
+// were made with.
+type Certificates struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	modTimes    [2]time.Time
+}
+
+// LoadCertificates loads a PEM encoded certificate and private key.
+func LoadCertificates(certFile, keyFile string) (*Certificates, error) {
+	c := &Certificates{certFile: certFile, keyFile: keyFile}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the latest certificate. It is a
+// tls.Config.GetCertificate.
+func (c *Certificates) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.certificate, nil
+}
+
+// Reload loads the certificate again if either of its files changed since
+// it was last loaded, reporting whether it did. The previous certificate is
+// kept if the files can't be loaded, such as while they are being replaced
+// one after the other.
+func (c *Certificates) Reload() (bool, error) {
+	modTimes, err := c.modTimesOfFiles()
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	unchanged := c.certificate != nil && modTimes == c.modTimes
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.certificate = &certificate
+	c.modTimes = modTimes
+	c.mu.Unlock()
+	return true, nil
+}
+
+func (c *Certificates) modTimesOfFiles() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// Watch reloads the certificate whenever its files change, checking every
+// interval until the context is done.
+func (c *Certificates) Watch(ctx context.Context, interval time.Duration, logger lager.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := c.Reload()
+			if err != nil {
+				logger.Error("reload-certificate", err)
+			} else if reloaded {
+				logger.Info("reloaded-certificate")
+			}
+		}
+	}
+}
+
+// LoadCertPool loads the PEM encoded CA certificates in a file.
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+	return pool, nil
+}
+
+// RequireClientCertificate only passes on requests made with a verified
+// client certificate whose common name or one of whose DNS names is an
+// allowed subject. Requests for the exempt paths, such as those of
+// health probes that can't present certificates, are always passed on.
+func RequireClientCertificate(next http.Handler, allowedSubjects []string, exemptPaths ...string) http.Handler {
+	allowed := map[string]bool{}
+	for _, subject := range allowedSubjects {
+		allowed[subject] = true
+	}
+	exempt := map[string]bool{}
+	for _, path := range exemptPaths {
+		exempt[path] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "Client certificate required", http.StatusUnauthorized)
+			return
+		}
+		leaf := r.TLS.VerifiedChains[0][0]
+		if allowed[leaf.Subject.CommonName] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, name := range leaf.DNSNames {
+			if allowed[name] {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.Error(w, "Client certificate not allowed", http.StatusForbidden)
+	})
+}
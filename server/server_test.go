@@ -0,0 +1,196 @@
+package server_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/henrytk/aws-service-broker/server"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// writeCertificate writes a self-signed certificate for the common name,
+// dated so that its files look modified at the given time.
+func writeCertificate(certFile, keyFile, commonName string, modified time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	privateKey, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privateKey}), 0600)).To(Succeed())
+	Expect(os.Chtimes(certFile, modified, modified)).To(Succeed())
+	Expect(os.Chtimes(keyFile, modified, modified)).To(Succeed())
+}
+
+func commonName(certificates *Certificates) string {
+	certificate, err := certificates.GetCertificate(nil)
+	Expect(err).NotTo(HaveOccurred())
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	Expect(err).NotTo(HaveOccurred())
+	return parsed.Subject.CommonName
+}
+
+var _ = Describe("Server", func() {
+	var (
+		dir      string
+		certFile string
+		keyFile  string
+		options  Options
+		listener net.Listener
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "server")
+		Expect(err).NotTo(HaveOccurred())
+		certFile = filepath.Join(dir, "cert.pem")
+		keyFile = filepath.Join(dir, "key.pem")
+		options = Options{
+			ReadTimeout:     time.Second,
+			WriteTimeout:    time.Second,
+			IdleTimeout:     time.Second,
+			ShutdownTimeout: time.Second,
+		}
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("finishes requests in flight when it is stopped", func() {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.WriteHeader(http.StatusCreated)
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- Run(ctx, listener, handler, options, lagertest.NewTestLogger("server"))
+		}()
+
+		statuses := make(chan int, 1)
+		go func() {
+			defer GinkgoRecover()
+			response, err := http.Get("http://" + listener.Addr().String() + "/v2/service_instances/1")
+			Expect(err).NotTo(HaveOccurred())
+			statuses <- response.StatusCode
+		}()
+		Eventually(started).Should(BeClosed())
+		cancel()
+		Consistently(stopped, 50*time.Millisecond).ShouldNot(Receive())
+
+		close(release)
+		Eventually(statuses).Should(Receive(Equal(http.StatusCreated)))
+		Eventually(stopped).Should(Receive(BeNil()))
+	})
+
+	It("serves over HTTPS with the certificate", func() {
+		writeCertificate(certFile, keyFile, "broker", time.Now())
+		var err error
+		options.Certificates, err = LoadCertificates(certFile, keyFile)
+		Expect(err).NotTo(HaveOccurred())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go Run(ctx, listener, http.NotFoundHandler(), options, lagertest.NewTestLogger("server"))
+
+		connection, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		Expect(err).NotTo(HaveOccurred())
+		defer connection.Close()
+		Expect(connection.ConnectionState().PeerCertificates[0].Subject.CommonName).To(Equal("broker"))
+	})
+
+	Describe("RequireClientCertificate", func() {
+		var handler http.Handler
+
+		BeforeEach(func() {
+			handler = RequireClientCertificate(http.NotFoundHandler(), []string{"cloud-controller"}, "/readyz")
+		})
+
+		call := func(path string, certificate *x509.Certificate) int {
+			request := httptest.NewRequest("GET", path, nil)
+			if certificate != nil {
+				request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			return recorder.Code
+		}
+
+		It("passes on requests with an allowed subject", func() {
+			Expect(call("/v2/catalog", &x509.Certificate{Subject: pkix.Name{CommonName: "cloud-controller"}})).To(Equal(http.StatusNotFound))
+			Expect(call("/v2/catalog", &x509.Certificate{DNSNames: []string{"cloud-controller"}})).To(Equal(http.StatusNotFound))
+		})
+
+		It("rejects requests without a certificate or with another subject", func() {
+			Expect(call("/v2/catalog", nil)).To(Equal(http.StatusUnauthorized))
+			Expect(call("/v2/catalog", &x509.Certificate{Subject: pkix.Name{CommonName: "someone-else"}})).To(Equal(http.StatusForbidden))
+		})
+
+		It("passes on requests for the exempt paths", func() {
+			Expect(call("/readyz", nil)).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Certificates", func() {
+		It("fails to load certificates that don't exist", func() {
+			_, err := LoadCertificates(certFile, keyFile)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("reloads the certificate when its files change", func() {
+			writeCertificate(certFile, keyFile, "old", time.Now().Add(-time.Minute))
+			certificates, err := LoadCertificates(certFile, keyFile)
+			Expect(err).NotTo(HaveOccurred())
+
+			reloaded, err := certificates.Reload()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reloaded).To(BeFalse())
+
+			writeCertificate(certFile, keyFile, "new", time.Now())
+			reloaded, err = certificates.Reload()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reloaded).To(BeTrue())
+			Expect(commonName(certificates)).To(Equal("new"))
+		})
+
+		It("keeps the certificate while the new files don't load", func() {
+			writeCertificate(certFile, keyFile, "old", time.Now().Add(-time.Minute))
+			certificates, err := LoadCertificates(certFile, keyFile)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.WriteFile(keyFile, []byte("half written"), 0600)).To(Succeed())
+			_, err = certificates.Reload()
+			Expect(err).To(HaveOccurred())
+			Expect(commonName(certificates)).To(Equal("old"))
+		})
+	})
+})
@@ -0,0 +1,252 @@
+// Package webhooks posts signed JSON events about service instances to
+// configured endpoints.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 signature of a delivery,
+	// as "sha256=" followed by the hex encoded signature.
+	SignatureHeader = "X-Broker-Signature"
+	// TimestampHeader carries the Unix time a delivery was signed at.
+	// The timestamp is signed along with the body so that old deliveries
+	// can't be replayed.
+	TimestampHeader = "X-Broker-Timestamp"
+)
+
+// Event types are an operation and its outcome.
+const (
+	ProvisionSucceeded   = "provision.succeeded"
+	ProvisionFailed      = "provision.failed"
+	UpdateSucceeded      = "update.succeeded"
+	UpdateFailed         = "update.failed"
+	DeprovisionSucceeded = "deprovision.succeeded"
+	DeprovisionFailed    = "deprovision.failed"
+)
+
+// Endpoint is a URL events are posted to, signed with its secret. Endpoints
+// receive every type of event unless they list the types they want.
+type Endpoint struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+func (e Endpoint) wants(eventType string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, t := range e.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is the body posted to endpoints. Deliveries of the same event have
+// the same ID, so that receivers can ignore repeats.
+type Event struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	InstanceID  string    `json:"instance_id"`
+	Service     string    `json:"service,omitempty"`
+	Plan        string    `json:"plan,omitempty"`
+	StackID     string    `json:"stack_id,omitempty"`
+	Description string    `json:"description,omitempty"`
+}
+
+// NewEvent returns an event of the given type about an instance. Its ID is
+// derived from the type, the instance and its stack, because the same
+// operation can be seen to finish by more than one poll.
+func NewEvent(eventType, instanceID, stackID string) Event {
+	id := sha256.Sum256([]byte(eventType + "\n" + instanceID + "\n" + stackID))
+	return Event{
+		ID:         hex.EncodeToString(id[:16]),
+		Type:       eventType,
+		Time:       time.Now().UTC(),
+		InstanceID: instanceID,
+		StackID:    stackID,
+	}
+}
+
+// Sign returns the signature of a body sent at the given Unix time.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a delivery and that it was signed within
+// the given tolerance of now.
+func Verify(secret, signature, timestamp string, body []byte, tolerance time.Duration) bool {
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(t, 0))
+	if age > tolerance || age < -tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(Sign(secret, t, body)))
+}
+
+// Sender delivers events to endpoints in the background. Deliveries that
+// fail with a network error, a 429 or a 5xx are retried with exponential
+// backoff. Senders are made with NewSender, and closed once nothing sends
+// to them any more so that their deliveries finish.
+type Sender struct {
+	Client      *http.Client
+	MaxAttempts int
+	RetryDelay  time.Duration
+	Logger      lager.Logger
+
+	// mu guards endpoints and closed, so that no delivery starts once
+	// Close waits for them.
+	mu         sync.Mutex
+	endpoints  []Endpoint
+	closed     bool
+	deliveries sync.WaitGroup
+	// stop is cancelled to abandon the deliveries in progress.
+	stop   context.Context
+	cancel context.CancelFunc
+}
+
+func NewSender(endpoints []Endpoint, logger lager.Logger) *Sender {
+	stop, cancel := context.WithCancel(context.Background())
+	return &Sender{
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: 6,
+		RetryDelay:  time.Second,
+		Logger:      logger,
+		endpoints:   endpoints,
+		stop:        stop,
+		cancel:      cancel,
+	}
+}
+
+// SetEndpoints changes the endpoints events are sent to. Deliveries in
+// progress carry on to the endpoints they started with.
+func (s *Sender) SetEndpoints(endpoints []Endpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpoints = endpoints
+}
+
+// Send starts delivering an event to every endpoint that wants it. Events
+// sent once the sender is closed are dropped.
+func (s *Sender) Send(event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		s.Logger.Error("marshal-event", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		s.Logger.Info("sender-closed", lager.Data{"event-id": event.ID, "event-type": event.Type})
+		return
+	}
+	for _, endpoint := range s.endpoints {
+		if endpoint.wants(event.Type) {
+			s.deliveries.Add(1)
+			go s.deliver(endpoint, event, body)
+		}
+	}
+}
+
+// Close stops the sender taking events and waits for the deliveries in
+// progress, retries included, until ctx is done. Those still in progress
+// then are abandoned, and ctx's error is returned.
+func (s *Sender) Close(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.deliveries.Wait()
+		close(done)
+	}()
+	defer s.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *Sender) deliver(endpoint Endpoint, event Event, body []byte) {
+	defer s.deliveries.Done()
+	data := lager.Data{"url": endpoint.URL, "event-id": event.ID, "event-type": event.Type}
+	delay := s.RetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(endpoint, body)
+		if err == nil {
+			s.Logger.Info("delivered", data)
+			return
+		}
+		data["attempts"] = attempt
+		if !retry || attempt >= s.MaxAttempts {
+			s.Logger.Error("delivery-failed", err, data)
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-s.stop.Done():
+			s.Logger.Error("delivery-abandoned", err, data)
+			return
+		}
+		delay *= 2
+	}
+}
+
+// post makes one delivery, returning whether a failed delivery should be
+// retried.
+func (s *Sender) post(endpoint Endpoint, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(s.stop)
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(endpoint.Secret, timestamp, body))
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500, &statusError{res.Status}
+}
+
+type statusError struct {
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "endpoint responded " + strings.TrimSpace(e.status)
+}
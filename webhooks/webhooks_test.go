@@ -0,0 +1,157 @@
+package webhooks_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/henrytk/aws-service-broker/webhooks"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type delivery struct {
+	signature, timestamp string
+	body                 []byte
+}
+
+var _ = Describe("Webhooks", func() {
+	var (
+		mu         sync.Mutex
+		deliveries []delivery
+		statuses   []int
+		server     *httptest.Server
+		sender     *Sender
+	)
+
+	received := func() []delivery {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]delivery(nil), deliveries...)
+	}
+
+	BeforeEach(func() {
+		deliveries = nil
+		statuses = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mu.Lock()
+			defer mu.Unlock()
+			deliveries = append(deliveries, delivery{
+				signature: r.Header.Get(SignatureHeader),
+				timestamp: r.Header.Get(TimestampHeader),
+				body:      body,
+			})
+			status := http.StatusNoContent
+			if len(statuses) > 0 {
+				status, statuses = statuses[0], statuses[1:]
+			}
+			w.WriteHeader(status)
+		}))
+		sender = NewSender([]Endpoint{{URL: server.URL, Secret: "hunter2"}}, lagertest.NewTestLogger("webhooks"))
+		sender.RetryDelay = time.Millisecond
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("posts events signed with the endpoint's secret", func() {
+		event := NewEvent(ProvisionSucceeded, "instance-id", "stack-id")
+		sender.Send(event)
+
+		Eventually(received).Should(HaveLen(1))
+		d := received()[0]
+		Expect(Verify("hunter2", d.signature, d.timestamp, d.body, time.Minute)).To(BeTrue())
+		Expect(Verify("wrong", d.signature, d.timestamp, d.body, time.Minute)).To(BeFalse())
+
+		var posted Event
+		Expect(json.Unmarshal(d.body, &posted)).To(Succeed())
+		Expect(posted.ID).To(Equal(event.ID))
+		Expect(posted.Type).To(Equal(ProvisionSucceeded))
+		Expect(posted.InstanceID).To(Equal("instance-id"))
+		Expect(posted.StackID).To(Equal("stack-id"))
+	})
+
+	It("retries deliveries that fail with server errors", func() {
+		statuses = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+		sender.Send(NewEvent(UpdateFailed, "instance-id", ""))
+
+		Eventually(received).Should(HaveLen(3))
+		Consistently(received, 50*time.Millisecond).Should(HaveLen(3))
+	})
+
+	It("does not retry deliveries the endpoint rejects", func() {
+		statuses = []int{http.StatusBadRequest}
+		sender.Send(NewEvent(UpdateFailed, "instance-id", ""))
+
+		Eventually(received).Should(HaveLen(1))
+		Consistently(received, 50*time.Millisecond).Should(HaveLen(1))
+	})
+
+	It("gives up after the maximum number of attempts", func() {
+		statuses = []int{500, 500, 500, 500}
+		sender.MaxAttempts = 3
+		sender.Send(NewEvent(DeprovisionFailed, "instance-id", ""))
+
+		Eventually(received).Should(HaveLen(3))
+		Consistently(received, 50*time.Millisecond).Should(HaveLen(3))
+	})
+
+	It("only posts the events an endpoint subscribes to", func() {
+		sender.SetEndpoints([]Endpoint{{URL: server.URL, Secret: "hunter2", Events: []string{ProvisionFailed}}})
+		sender.Send(NewEvent(ProvisionSucceeded, "instance-id", ""))
+		sender.Send(NewEvent(ProvisionFailed, "instance-id", ""))
+
+		Eventually(received).Should(HaveLen(1))
+		Consistently(received, 50*time.Millisecond).Should(HaveLen(1))
+		Expect(string(received()[0].body)).To(ContainSubstring(ProvisionFailed))
+	})
+
+	Describe("Close", func() {
+		It("waits for the deliveries in progress, retries included", func() {
+			statuses = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+			sender.RetryDelay = 20 * time.Millisecond
+			sender.Send(NewEvent(UpdateFailed, "instance-id", ""))
+
+			Expect(sender.Close(context.Background())).To(Succeed())
+			Expect(received()).To(HaveLen(3))
+		})
+
+		It("abandons the deliveries still in progress once its context is done", func() {
+			statuses = []int{500, 500, 500, 500}
+			sender.RetryDelay = time.Hour
+			sender.Send(NewEvent(UpdateFailed, "instance-id", ""))
+			Eventually(received).Should(HaveLen(1))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			Expect(sender.Close(ctx)).To(MatchError(context.DeadlineExceeded))
+			Expect(received()).To(HaveLen(1))
+		})
+
+		It("drops events sent once it is closed", func() {
+			Expect(sender.Close(context.Background())).To(Succeed())
+			sender.Send(NewEvent(UpdateFailed, "instance-id", ""))
+			Consistently(received, 50*time.Millisecond).Should(BeEmpty())
+		})
+	})
+
+	It("gives repeated events of an operation the same ID", func() {
+		Expect(NewEvent(ProvisionFailed, "a", "s").ID).To(Equal(NewEvent(ProvisionFailed, "a", "s").ID))
+		Expect(NewEvent(ProvisionFailed, "a", "s").ID).NotTo(Equal(NewEvent(ProvisionFailed, "b", "s").ID))
+	})
+
+	It("rejects signatures made too long ago", func() {
+		body := []byte(`{}`)
+		then := time.Now().Add(-time.Hour).Unix()
+		Expect(Verify("hunter2", Sign("hunter2", then, body), strconv.FormatInt(then, 10), body, 5*time.Minute)).To(BeFalse())
+	})
+})